@@ -6,48 +6,53 @@ import (
 	"os"
 
 	"commerce-app/internal/auth"
+	"commerce-app/internal/database"
 	"commerce-app/internal/handlers"
+	"commerce-app/internal/storage"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 )
 
 // Router sets up the REST API routes
-func Router() http.Handler {
+func Router(repos *database.Repositories) http.Handler {
 	r := mux.NewRouter()
 
-	// Initialize handlers
-	customerHandler := handlers.NewCustomerHandler()
-	productHandler := handlers.NewProductHandler()
-	orderHandler := handlers.NewOrderHandler()
-	rootHandler := handlers.NewRootHandler()
-
-	// Initialize auth handler
-	authHandler, err := handlers.NewAuthHandler()
+	// Uploaded product images are kept on the local filesystem or in an S3 bucket
+	imageStorage, err := storage.NewFromEnv()
 	if err != nil {
-		log.Printf("Warning: Failed to initialize OIDC auth handler: %v", err)
-		authHandler = nil
+		log.Fatalf("Failed to initialize image storage: %v", err)
 	}
 
-	// Initialize OIDC middleware
-	var oidcMiddleware *auth.OIDCMiddleware
-	if authHandler != nil {
-		jwtSecret := []byte(getEnv("JWT_SECRET", "secret"))
-		oidcMiddleware = auth.NewOIDCMiddleware(authHandler.GetOIDCProvider(), jwtSecret)
-	}
+	// Initialize handlers
+	customerHandler := handlers.NewCustomerHandler(repos.Customers)
+	productHandler := handlers.NewProductHandler(repos.Products, repos.Categories, database.BulkQueryTimeoutFromEnv())
+	variantHandler := handlers.NewVariantHandler(repos.Variants, repos.Products)
+	priceHandler := handlers.NewPriceHandler(repos.Prices, repos.Products)
+	inventoryHandler := handlers.NewInventoryHandler(repos.Inventory, repos.Products)
+	stockAlertHandler := handlers.NewStockAlertHandler(repos.StockAlerts, repos.Products, repos.Categories)
+	imageHandler := handlers.NewImageHandler(repos.Images, repos.Products, imageStorage, handlers.ImageMaxBytesFromEnv())
+	orderHandler := handlers.NewOrderHandler(repos.Orders, repos.Customers, repos.Products)
+	cartHandler := handlers.NewCartHandler(repos.Carts, repos.Products, repos.Customers, orderHandler)
+	adminHandler := handlers.NewAdminHandler(repos.Customers, repos.Categories, repos.Products)
+	rootHandler := handlers.NewRootHandler()
+	idempotency := handlers.NewIdempotencyMiddleware(repos.Idempotency, handlers.IdempotencyKeyTTLFromEnv())
 
 	// Initialize auth handler
-	authHandler, err = handlers.NewAuthHandler()
+	authHandler, err := handlers.NewAuthHandler()
 	if err != nil {
 		log.Printf("Warning: Failed to initialize OIDC auth handler: %v", err)
 		authHandler = nil
 	}
 
-	// Initialize OIDC middleware
+	// Initialize auth middleware. Without an OIDC provider, protected routes
+	// still accept the JWTs issued by this API.
+	var oidcProvider *auth.OIDCProvider
 	if authHandler != nil {
-		jwtSecret := []byte(getEnv("JWT_SECRET", "secret"))
-		oidcMiddleware = auth.NewOIDCMiddleware(authHandler.GetOIDCProvider(), jwtSecret)
+		oidcProvider = authHandler.GetOIDCProvider()
 	}
+	jwtSecret := []byte(getEnv("JWT_SECRET", "secret"))
+	oidcMiddleware := auth.NewOIDCMiddleware(oidcProvider, jwtSecret)
 
 	// OIDC Authentication routes
 	if authHandler != nil {
@@ -58,40 +63,109 @@ func Router() http.Handler {
 
 	// Protected customer routes (require authentication)
 	protectedCustomer := r.PathPrefix("/api/customers").Subrouter()
-	if oidcMiddleware != nil {
-		protectedCustomer.Use(oidcMiddleware.RequireAuth)
-	}
+	protectedCustomer.Use(oidcMiddleware.RequireAuth)
 
 	protectedCustomer.HandleFunc("", customerHandler.CreateCustomer).Methods("POST")
 	protectedCustomer.HandleFunc("/{id}", customerHandler.GetCustomer).Methods("GET")
+	protectedCustomer.HandleFunc("/{id}", customerHandler.DeleteCustomer).Methods("DELETE")
 	protectedCustomer.HandleFunc("/{customerId}/orders", orderHandler.GetOrdersByCustomer).Methods("GET")
 
+	// Protected admin routes for deleted rows (require authentication)
+	protectedAdmin := r.PathPrefix("/api/admin").Subrouter()
+	protectedAdmin.Use(oidcMiddleware.RequireAuth)
+
+	protectedAdmin.HandleFunc("/deleted/products", adminHandler.GetDeletedProducts).Methods("GET")
+	protectedAdmin.HandleFunc("/deleted/categories", adminHandler.GetDeletedCategories).Methods("GET")
+	protectedAdmin.HandleFunc("/deleted/customers", adminHandler.GetDeletedCustomers).Methods("GET")
+	protectedAdmin.HandleFunc("/products/{id}/restore", adminHandler.RestoreProduct).Methods("POST")
+	protectedAdmin.HandleFunc("/categories/{id}/restore", adminHandler.RestoreCategory).Methods("POST")
+	protectedAdmin.HandleFunc("/customers/{id}/restore", adminHandler.RestoreCustomer).Methods("POST")
+
 	// Protected user info route (require authentication)
 	protectedUserInfo := r.PathPrefix("/api/auth/userinfo").Subrouter()
-	if oidcMiddleware != nil {
-		protectedUserInfo.Use(oidcMiddleware.RequireAuth)
-	}
+	protectedUserInfo.Use(oidcMiddleware.RequireAuth)
 
 	// Initialize root handler
 	r.HandleFunc("/", rootHandler.ServeHTTP)
 
-	// Product routes
-	r.HandleFunc("/api/products", productHandler.CreateProduct).Methods("POST")
+	// Product routes. Price history records the authenticated caller of the
+	// routes that change prices, and price schedules and deletes require one.
+	r.Handle("/api/products", oidcMiddleware.OptionalAuth(http.HandlerFunc(productHandler.CreateProduct))).Methods("POST")
 	r.HandleFunc("/api/products", productHandler.GetAllProducts).Methods("GET")
+	r.HandleFunc("/api/products/search", productHandler.SearchProducts).Methods("GET")
+	r.HandleFunc("/api/products/facets", productHandler.GetProductFacets).Methods("GET")
+	r.Handle("/api/products/import", oidcMiddleware.OptionalAuth(http.HandlerFunc(productHandler.ImportProducts))).Methods("POST")
+	r.HandleFunc("/api/products/export", productHandler.ExportProducts).Methods("GET")
 	r.HandleFunc("/api/products/{id}", productHandler.GetProduct).Methods("GET")
+	r.Handle("/api/products/{id}", oidcMiddleware.OptionalAuth(http.HandlerFunc(productHandler.UpdateProduct))).Methods("PUT")
+	r.Handle("/api/products/{id}", oidcMiddleware.OptionalAuth(http.HandlerFunc(productHandler.PatchProduct))).Methods("PATCH")
+	r.Handle("/api/products/{id}", oidcMiddleware.RequireAuth(http.HandlerFunc(productHandler.DeleteProduct))).Methods("DELETE")
+	r.HandleFunc("/api/products/{id}/variants", variantHandler.GetVariants).Methods("GET")
+	r.Handle("/api/products/{id}/variants", oidcMiddleware.OptionalAuth(http.HandlerFunc(variantHandler.CreateVariant))).Methods("POST")
+	r.HandleFunc("/api/products/{id}/variants/{variantId}", variantHandler.GetVariant).Methods("GET")
+	r.Handle("/api/products/{id}/variants/{variantId}", oidcMiddleware.OptionalAuth(http.HandlerFunc(variantHandler.UpdateVariant))).Methods("PUT")
+	r.HandleFunc("/api/products/{id}/variants/{variantId}", variantHandler.DeleteVariant).Methods("DELETE")
+	r.HandleFunc("/api/products/{id}/prices", priceHandler.GetPriceTimeline).Methods("GET")
+	r.Handle("/api/products/{id}/prices/schedules", oidcMiddleware.RequireAuth(http.HandlerFunc(priceHandler.CreateSchedule))).Methods("POST")
+	r.Handle("/api/products/{id}/prices/schedules/{scheduleId}", oidcMiddleware.RequireAuth(http.HandlerFunc(priceHandler.CancelSchedule))).Methods("DELETE")
+	r.HandleFunc("/api/products/{id}/inventory", inventoryHandler.GetProductInventory).Methods("GET")
+	r.HandleFunc("/api/products/{id}/reorder-threshold", stockAlertHandler.GetProductThreshold).Methods("GET")
+	r.HandleFunc("/api/products/{id}/reorder-threshold", stockAlertHandler.SetProductThreshold).Methods("PUT")
+	r.HandleFunc("/api/products/{id}/images", imageHandler.GetImages).Methods("GET")
+	r.HandleFunc("/api/products/{id}/images", imageHandler.UploadImages).Methods("POST")
+	r.HandleFunc("/api/products/{id}/images/order", imageHandler.ReorderImages).Methods("PUT")
+	r.HandleFunc("/api/products/{id}/images/{imageId}", imageHandler.DeleteImage).Methods("DELETE")
+	r.HandleFunc("/api/images/{key:.+}", imageHandler.ServeFile).Methods("GET")
 	r.HandleFunc("/api/products/category/{categoryId}", productHandler.GetProductsByCategory).Methods("GET")
 	r.HandleFunc("/api/products/category/{categoryId}/average-price", productHandler.GetAveragePriceByCategory).Methods("GET")
 
-	// Category routes
+	// Category routes. Deleting a category hides its whole subtree, so it
+	// requires authentication as restoring it does.
 	r.HandleFunc("/api/categories", productHandler.CreateCategory).Methods("POST")
 	r.HandleFunc("/api/categories", productHandler.GetAllCategories).Methods("GET")
+	r.HandleFunc("/api/categories/tree", productHandler.GetCategoryTree).Methods("GET")
 	r.HandleFunc("/api/categories/{id}", productHandler.GetCategory).Methods("GET")
+	r.HandleFunc("/api/categories/{id}", productHandler.UpdateCategory).Methods("PUT")
+	r.Handle("/api/categories/{id}", oidcMiddleware.RequireAuth(http.HandlerFunc(productHandler.DeleteCategory))).Methods("DELETE")
 	r.HandleFunc("/api/categories/{parentId}/children", productHandler.GetCategoryChildren).Methods("GET")
+	r.HandleFunc("/api/categories/{id}/stats", productHandler.GetCategoryStats).Methods("GET")
+	r.HandleFunc("/api/categories/{id}/attributes", productHandler.GetCategoryAttributes).Methods("GET")
+	r.HandleFunc("/api/categories/{id}/attributes", productHandler.CreateCategoryAttribute).Methods("POST")
+	r.HandleFunc("/api/categories/{id}/attributes/{name}", productHandler.DeleteCategoryAttribute).Methods("DELETE")
+	r.HandleFunc("/api/categories/{id}/reorder-threshold", stockAlertHandler.SetCategoryThreshold).Methods("PUT")
+
+	// Warehouse and inventory routes. Transfers and adjustments require
+	// authentication so that the ledger records who moved the stock.
+	r.HandleFunc("/api/warehouses", inventoryHandler.CreateWarehouse).Methods("POST")
+	r.HandleFunc("/api/warehouses", inventoryHandler.GetWarehouses).Methods("GET")
+	r.HandleFunc("/api/warehouses/{id}", inventoryHandler.GetWarehouse).Methods("GET")
+	r.HandleFunc("/api/warehouses/{id}", inventoryHandler.UpdateWarehouse).Methods("PUT")
+	r.HandleFunc("/api/warehouses/{id}/inventory", inventoryHandler.GetWarehouseInventory).Methods("GET")
+	r.Handle("/api/inventory/transfers", oidcMiddleware.RequireAuth(http.HandlerFunc(inventoryHandler.CreateTransfer))).Methods("POST")
+	r.Handle("/api/inventory/adjustments", oidcMiddleware.RequireAuth(http.HandlerFunc(inventoryHandler.CreateAdjustment))).Methods("POST")
+	r.HandleFunc("/api/inventory/movements", inventoryHandler.GetMovements).Methods("GET")
+	r.HandleFunc("/api/inventory/reconciliation", inventoryHandler.GetReconciliation).Methods("GET")
+	r.HandleFunc("/api/inventory/alerts", stockAlertHandler.GetAlerts).Methods("GET")
 
 	// Order routes
-	r.HandleFunc("/api/orders", orderHandler.CreateOrder).Methods("POST")
+	r.Handle("/api/orders", oidcMiddleware.OptionalAuth(idempotency.Handle(http.HandlerFunc(orderHandler.CreateOrder)))).Methods("POST")
 	r.HandleFunc("/api/orders/{id}", orderHandler.GetOrder).Methods("GET")
-	r.HandleFunc("/api/orders/{id}/status", orderHandler.UpdateOrderStatus).Methods("PUT")
+	r.Handle("/api/orders/{id}/status", oidcMiddleware.RequireAuth(http.HandlerFunc(orderHandler.UpdateOrderStatus))).Methods("PUT")
+	r.HandleFunc("/api/orders/{id}/history", orderHandler.GetOrderHistory).Methods("GET")
+	r.Handle("/api/orders/{id}/items/{itemId}/cancel", oidcMiddleware.RequireAuth(http.HandlerFunc(orderHandler.CancelOrderItem))).Methods("POST")
+
+	// Cart routes. Anonymous carts are reached with their X-Cart-Token and
+	// customer carts only by the authenticated customer.
+	carts := r.PathPrefix("/api/carts").Subrouter()
+	carts.Use(oidcMiddleware.OptionalAuth)
+
+	carts.HandleFunc("", cartHandler.CreateCart).Methods("POST")
+	carts.HandleFunc("/{id}", cartHandler.GetCart).Methods("GET")
+	carts.HandleFunc("/{id}/items", cartHandler.AddCartItem).Methods("POST")
+	carts.HandleFunc("/{id}/items/{itemId}", cartHandler.UpdateCartItem).Methods("PUT")
+	carts.HandleFunc("/{id}/items/{itemId}", cartHandler.RemoveCartItem).Methods("DELETE")
+	carts.Handle("/{id}/merge", oidcMiddleware.RequireAuth(http.HandlerFunc(cartHandler.MergeCart))).Methods("POST")
+	carts.Handle("/{id}/checkout", oidcMiddleware.RequireAuth(idempotency.Handle(http.HandlerFunc(cartHandler.Checkout)))).Methods("POST")
 
 	// Protected routes (require authentication)
 	// protected := r.PathPrefix("/api/protected").Subrouter()
@@ -111,7 +185,7 @@ func Router() http.Handler {
 	// CORS configuration
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders: []string{"*"},
 	})
 
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"commerce-app/internal/database"
+)
+
+const usage = `Usage: migrate <command>
+
+Commands:
+  up                apply all pending migrations
+  down <version>    revert migrations newer than version (0 reverts everything)
+  status            list migrations and whether they are applied`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	// Initialize database
+	if err := database.InitDB(); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer database.CloseDB()
+
+	switch os.Args[1] {
+	case "up":
+		if err := database.MigrateUp(); err != nil {
+			log.Fatalf("Failed to run migrations: %v", err)
+		}
+	case "down":
+		if len(os.Args) < 3 {
+			fmt.Println(usage)
+			os.Exit(2)
+		}
+		target, err := strconv.Atoi(os.Args[2])
+		if err != nil {
+			log.Fatalf("Invalid target version %q: %v", os.Args[2], err)
+		}
+		if err := database.MigrateDown(target); err != nil {
+			log.Fatalf("Failed to revert migrations: %v", err)
+		}
+	case "status":
+		states, err := database.MigrationStatus()
+		if err != nil {
+			log.Fatalf("Failed to read migration status: %v", err)
+		}
+		for _, state := range states {
+			appliedAt := "pending"
+			if state.Applied {
+				appliedAt = "applied " + state.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-45s %s\n", state.Version, state.Description, appliedAt)
+		}
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+}
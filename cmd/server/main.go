@@ -11,22 +11,49 @@ import (
 
 	"commerce-app/api/rest"
 	"commerce-app/internal/database"
+	"commerce-app/internal/notifications"
 )
 
 func main() {
-	// Initialize database
-	if err := database.InitDB(); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
-	}
-	defer database.CloseDB()
+	// Select storage backend
+	var repos *database.Repositories
+	if getEnv("STORAGE_BACKEND", "postgres") == "memory" {
+		log.Println("Using in-memory storage backend")
+		repos = database.NewMemoryRepositories()
+	} else {
+		// Initialize database
+		if err := database.InitDB(); err != nil {
+			log.Fatalf("Failed to initialize database: %v", err)
+		}
+		defer database.CloseDB()
+
+		// Run migrations
+		if err := database.RunMigrations(); err != nil {
+			log.Fatalf("Failed to run migrations: %v", err)
+		}
 
-	// Run migrations
-	if err := database.RunMigrations(); err != nil {
-		log.Fatalf("Failed to run migrations: %v", err)
+		repos = database.NewPostgresRepositories()
 	}
 
+	// Purge soft-deleted rows once their retention period has passed
+	purgeCtx, stopPurger := context.WithCancel(context.Background())
+	retention, interval := database.PurgeSettingsFromEnv()
+	go repos.RunPurger(purgeCtx, retention, interval)
+
+	// Start and end scheduled price changes as they fall due
+	schedulerCtx, stopScheduler := context.WithCancel(context.Background())
+	go repos.RunPriceScheduler(schedulerCtx, database.PriceScheduleIntervalFromEnv())
+
+	// Tell the admin about products that have run low on stock
+	alerterCtx, stopAlerter := context.WithCancel(context.Background())
+	go repos.RunStockAlerter(alerterCtx, database.StockAlertIntervalFromEnv(), notifications.NewLowStockNotifier())
+
+	// Delete idempotency keys and their stored responses once they expire
+	cleanerCtx, stopCleaner := context.WithCancel(context.Background())
+	go repos.RunIdempotencyCleaner(cleanerCtx, database.IdempotencyCleanupIntervalFromEnv())
+
 	// Create router
-	router := rest.Router()
+	router := rest.Router(repos)
 
 	// Get port from environment or use default
 	port := getEnv("PORT", "8181")
@@ -55,6 +82,10 @@ func main() {
 	<-quit
 
 	log.Println("Shutting down server...")
+	stopPurger()
+	stopScheduler()
+	stopAlerter()
+	stopCleaner()
 
 	// Create a deadline for server shutdown
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
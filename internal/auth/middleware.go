@@ -15,7 +15,8 @@ type OIDCMiddleware struct {
 	jwtSecret    []byte
 }
 
-// NewOIDCMiddleware creates a new OIDC middleware instance
+// NewOIDCMiddleware creates a new OIDC middleware instance. A nil provider
+// limits authentication to locally issued JWTs.
 func NewOIDCMiddleware(oidcProvider *OIDCProvider, jwtSecret []byte) *OIDCMiddleware {
 	return &OIDCMiddleware{
 		oidcProvider: oidcProvider,
@@ -45,6 +46,11 @@ func (m *OIDCMiddleware) Authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		if m.oidcProvider == nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
 		// If JWT validation fails, try to validate as OIDC token
 		oidcClaims, err := m.oidcProvider.VerifyIDToken(r.Context(), tokenString)
 		if err != nil {
@@ -87,6 +93,19 @@ func (m *OIDCMiddleware) RequireAuth(next http.Handler) http.Handler {
 	return m.Authenticate(next)
 }
 
+// OptionalAuth authenticates requests that carry an Authorization header and
+// passes the others through without user information
+func (m *OIDCMiddleware) OptionalAuth(next http.Handler) http.Handler {
+	authenticated := m.Authenticate(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		authenticated.ServeHTTP(w, r)
+	})
+}
+
 // RequireRole is a middleware that requires a specific role
 func (m *OIDCMiddleware) RequireRole(role string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"commerce-app/internal/models"
+)
+
+const defaultStockAlertInterval = time.Minute
+
+// StockAlertNotifier tells the administrator about a low-stock alert
+type StockAlertNotifier interface {
+	NotifyLowStock(alert models.StockAlert) error
+}
+
+// NotifyStockAlerts sends every open alert the administrator has not been
+// told about yet and returns how many were sent. An alert that could not be
+// sent is released so that the next run retries it.
+func (r *Repositories) NotifyStockAlerts(ctx context.Context, notifier StockAlertNotifier) (int, error) {
+	alerts, err := r.StockAlerts.ClaimPending(ctx, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, alert := range alerts {
+		if err := notifier.NotifyLowStock(alert); err != nil {
+			log.Printf("Error sending low stock alert for product %s: %v", alert.ProductID, err)
+			if err := r.StockAlerts.ReleaseAlert(ctx, alert.ID); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// RunStockAlerter sends the pending low-stock alerts, then again every
+// interval, until ctx is cancelled
+func (r *Repositories) RunStockAlerter(ctx context.Context, interval time.Duration, notifier StockAlertNotifier) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		sent, err := r.NotifyStockAlerts(ctx, notifier)
+		if err != nil {
+			log.Printf("Error sending low stock alerts: %v", err)
+		} else if sent > 0 {
+			log.Printf("Sent %d low stock alerts", sent)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// StockAlertIntervalFromEnv reads STOCK_ALERT_INTERVAL, how often pending
+// low-stock alerts are sent (a Go duration such as "30s")
+func StockAlertIntervalFromEnv() time.Duration {
+	return durationFromEnv("STOCK_ALERT_INTERVAL", defaultStockAlertInterval)
+}
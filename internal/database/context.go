@@ -0,0 +1,103 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// defaultQueryTimeout bounds every repository call unless DB_QUERY_TIMEOUT or
+// a per-call deadline says otherwise
+const defaultQueryTimeout = 5 * time.Second
+
+// defaultBulkQueryTimeout bounds each repository call of a product import or
+// export unless DB_BULK_QUERY_TIMEOUT says otherwise
+const defaultBulkQueryTimeout = 2 * time.Minute
+
+var (
+	// ErrQueryCanceled is returned when the caller's context was cancelled, e.g. the client disconnected
+	ErrQueryCanceled = errors.New("query canceled")
+	// ErrQueryTimeout is returned when a query ran past its deadline
+	ErrQueryTimeout = errors.New("query timed out")
+)
+
+var queryTimeout = defaultQueryTimeout
+
+type queryTimeoutKey struct{}
+
+type actorKey struct{}
+
+// systemActor is recorded for changes made without a WithActor context, such
+// as those of background jobs
+const systemActor = "system"
+
+// WithQueryTimeout overrides the default deadline for repository calls made with the returned context
+func WithQueryTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, queryTimeoutKey{}, d)
+}
+
+// WithActor attributes the changes recorded by repository calls made with the
+// returned context, such as price history entries, to actor
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// actorFromContext returns the actor set by WithActor, or "system"
+func actorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return systemActor
+}
+
+// loadQueryTimeout reads DB_QUERY_TIMEOUT (a Go duration such as "3s")
+func loadQueryTimeout() time.Duration {
+	value := getEnv("DB_QUERY_TIMEOUT", "")
+	if value == "" {
+		return defaultQueryTimeout
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid DB_QUERY_TIMEOUT %q, using %s: %v", value, defaultQueryTimeout, err)
+		return defaultQueryTimeout
+	}
+	return d
+}
+
+// BulkQueryTimeoutFromEnv reads DB_BULK_QUERY_TIMEOUT, the deadline of each
+// repository call made by bulk operations such as product imports (a Go
+// duration such as "2m")
+func BulkQueryTimeoutFromEnv() time.Duration {
+	return durationFromEnv("DB_BULK_QUERY_TIMEOUT", defaultBulkQueryTimeout)
+}
+
+// withQueryTimeout derives the context a single repository call runs under
+func withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := queryTimeout
+	if d, ok := ctx.Value(queryTimeoutKey{}).(time.Duration); ok {
+		timeout = d
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// wrapQueryError tags errors caused by the context ending so callers can tell a
+// cancelled or timed out query apart from one that failed
+func wrapQueryError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch ctx.Err() {
+	case context.Canceled:
+		return fmt.Errorf("%w: %v", ErrQueryCanceled, err)
+	case context.DeadlineExceeded:
+		return fmt.Errorf("%w: %v", ErrQueryTimeout, err)
+	}
+	return err
+}
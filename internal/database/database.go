@@ -18,6 +18,8 @@ func InitDB() error {
 		log.Println("No .env file found")
 	}
 
+	queryTimeout = loadQueryTimeout()
+
 	host := getEnv("DB_HOST", "localhost")
 	port := getEnv("DB_PORT", "5432")
 	user := getEnv("DB_USER", "postgres")
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrProductInUse is returned when deleting a product that order items still reference
+	ErrProductInUse = errors.New("product is referenced by existing orders")
+	// ErrParentDeleted is returned when restoring a row whose parent category is still deleted
+	ErrParentDeleted = errors.New("parent category is deleted")
+	// ErrVariantInUse is returned when deleting a product variant that order items still reference
+	ErrVariantInUse = errors.New("product variant is referenced by existing orders")
+	// ErrDuplicateSKU is returned when a product variant's SKU is already taken
+	ErrDuplicateSKU = errors.New("SKU is already in use")
+	// ErrCategoryCycle is returned when moving a category under itself or one of its descendants
+	ErrCategoryCycle = errors.New("category cannot be moved under itself or its subcategories")
+	// ErrDuplicateAttribute is returned when an attribute name is already defined
+	// by the category, one of its ancestors or one of its descendants
+	ErrDuplicateAttribute = errors.New("attribute is already defined in the category tree")
+	// ErrTooManyImages is returned when adding an image to a product that has the most it can have
+	ErrTooManyImages = fmt.Errorf("a product can have at most %d images", models.MaxProductImages)
+	// ErrImageOrder is returned when a new image order does not list each of the product's images once
+	ErrImageOrder = errors.New("image order must list each of the product's images exactly once")
+	// ErrProductDeleted is returned when importing over a product that is soft-deleted
+	ErrProductDeleted = errors.New("product is deleted")
+	// ErrVariantCurrency is returned when changing the currency of a product
+	// whose variants have prices of their own
+	ErrVariantCurrency = errors.New("price currency must match the product's variant prices")
+	// ErrScheduleOverlap is returned when a price schedule would hold the
+	// product's price at the same time as another open schedule
+	ErrScheduleOverlap = errors.New("price schedule overlaps another pending or active schedule")
+	// ErrScheduleClosed is returned when cancelling a price schedule that has
+	// already completed, expired or been cancelled
+	ErrScheduleClosed = errors.New("price schedule has already finished")
+	// ErrDuplicateWarehouseCode is returned when a warehouse code is already taken
+	ErrDuplicateWarehouseCode = errors.New("warehouse code is already in use")
+	// ErrDefaultWarehouse is returned when deactivating the default warehouse
+	ErrDefaultWarehouse = errors.New("the default warehouse cannot be deactivated")
+	// ErrWarehouseNotEmpty is returned when deactivating a warehouse that still holds stock
+	ErrWarehouseNotEmpty = errors.New("warehouse still holds stock")
+	// ErrWarehouseInactive is returned when moving stock into or out of an inactive warehouse
+	ErrWarehouseInactive = errors.New("warehouse is inactive")
+)
+
+// foreignKeyError mirrors the error Postgres raises for a missing referenced row
+func foreignKeyError(table, column string) error {
+	return fmt.Errorf("insert or update on table %q violates foreign key constraint on %q", table, column)
+}
+
+// InsufficientStockError reports the product that could not cover an order
+// line. SKU is set when the line was for a variant.
+type InsufficientStockError struct {
+	ProductID   uuid.UUID
+	ProductName string
+	SKU         string
+	Requested   int
+	Available   int
+}
+
+// Item names the product, and the variant's SKU if there is one
+func (e *InsufficientStockError) Item() string {
+	if e.SKU != "" {
+		return fmt.Sprintf("%s (%s)", e.ProductName, e.SKU)
+	}
+	return e.ProductName
+}
+
+func (e *InsufficientStockError) Error() string {
+	return fmt.Sprintf("insufficient stock for product %s: requested %d, available %d",
+		e.Item(), e.Requested, e.Available)
+}
+
+// BatchError reports the item that stopped a batch write. The batch was
+// rolled back, so none of its items were written.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch item %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,37 @@
+package database
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const defaultIdempotencyCleanupInterval = time.Hour
+
+// RunIdempotencyCleaner deletes the expired idempotency keys, then again every
+// interval, until ctx is cancelled
+func (r *Repositories) RunIdempotencyCleaner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := r.Idempotency.DeleteExpired(ctx, time.Now())
+		if err != nil {
+			log.Printf("Error deleting expired idempotency keys: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Deleted %d expired idempotency keys", deleted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// IdempotencyCleanupIntervalFromEnv reads IDEMPOTENCY_CLEANUP_INTERVAL, how
+// often expired idempotency keys are deleted (a Go duration such as "1h")
+func IdempotencyCleanupIntervalFromEnv() time.Duration {
+	return durationFromEnv("IDEMPOTENCY_CLEANUP_INTERVAL", defaultIdempotencyCleanupInterval)
+}
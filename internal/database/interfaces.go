@@ -0,0 +1,253 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// SoftDeleter is implemented by repositories whose rows are soft-deleted.
+// Deleted rows are hidden from every other query until they are restored, and
+// Delete stays available to remove a row outright.
+type SoftDeleter[T any] interface {
+	SoftDelete(ctx context.Context, id uuid.UUID) error
+	Restore(ctx context.Context, id uuid.UUID) error
+	GetDeleted(ctx context.Context) ([]T, error)
+	// Purge permanently deletes the rows soft-deleted before the cutoff and
+	// returns how many it removed
+	Purge(ctx context.Context, before time.Time) (int, error)
+}
+
+// CustomerRepository defines the customer persistence operations
+type CustomerRepository interface {
+	Create(ctx context.Context, customer *models.Customer) error
+	GetByID(ctx context.Context, id uuid.UUID) (*models.Customer, error)
+	GetByEmail(ctx context.Context, email string) (*models.Customer, error)
+	Delete(ctx context.Context, id uuid.UUID) error
+	SoftDeleter[models.Customer]
+}
+
+// CategoryRepository defines the category persistence operations
+type CategoryRepository interface {
+	Create(ctx context.Context, category *models.Category) error
+	GetByID(ctx context.Context, id uuid.UUID) (*models.Category, error)
+	GetAll(ctx context.Context) ([]models.Category, error)
+	GetChildren(ctx context.Context, parentID uuid.UUID) ([]models.Category, error)
+	// GetTree returns the categories nested under their parents, each with the
+	// product count of its subtree. A nil rootID returns every top-level
+	// category; depth limits the levels below the roots, or is negative for
+	// no limit.
+	GetTree(ctx context.Context, rootID *uuid.UUID, depth int) ([]models.Category, error)
+	// Update renames and reparents a category, rewriting the path and level
+	// of every category below it
+	Update(ctx context.Context, category *models.Category) error
+	Delete(ctx context.Context, id uuid.UUID, level int) error
+	// CreateAttribute defines an attribute for the category's products and
+	// those of its subcategories. An attribute name may appear only once on
+	// any path through the category tree.
+	CreateAttribute(ctx context.Context, attribute *models.AttributeDefinition) error
+	// GetAttributeSchema returns the attributes of a category's products,
+	// including those inherited from its ancestors, ordered by name
+	GetAttributeSchema(ctx context.Context, categoryID uuid.UUID) (models.AttributeSchema, error)
+	// DeleteAttribute removes an attribute definition along with the values
+	// of the products it applied to
+	DeleteAttribute(ctx context.Context, categoryID uuid.UUID, name string) error
+	SoftDeleter[models.Category]
+}
+
+// ProductRepository defines the product persistence operations
+type ProductRepository interface {
+	Create(ctx context.Context, product *models.Product) error
+	GetByID(ctx context.Context, id uuid.UUID) (*models.Product, error)
+	Update(ctx context.Context, id uuid.UUID, update models.ProductUpdate) error
+	// Upsert creates or replaces products by ID in one transaction, assigning
+	// an ID to those without one, and returns how many it created. A product
+	// with variants keeps its stock, which is the total of theirs. If any
+	// product cannot be written none are, and the error is a *BatchError.
+	Upsert(ctx context.Context, products []models.Product) (int, error)
+	List(ctx context.Context, filter models.ProductFilter) (*models.ProductPage, error)
+	Search(ctx context.Context, query string, limit int) ([]models.ProductSearchResult, error)
+	GetByCategory(ctx context.Context, categoryID uuid.UUID) ([]models.Product, error)
+	GetAveragePriceByCategory(ctx context.Context, categoryID uuid.UUID) (*models.CategoryPrice, error)
+	// GetCategoryStats summarises the category's products priced in currency,
+	// and those of its subcategories when recursive is set
+	GetCategoryStats(ctx context.Context, categoryID uuid.UUID, currency string, recursive bool) (*models.CategoryStats, error)
+	GetFacets(ctx context.Context, filter models.ProductFilter, bucketEdges []models.Money) (*models.ProductFacets, error)
+	Delete(ctx context.Context, id uuid.UUID) error
+	SoftDeleter[models.Product]
+}
+
+// VariantRepository defines the product variant persistence operations. Every
+// change to a variant's stock also sets its product's stock to the variants' total.
+type VariantRepository interface {
+	Create(ctx context.Context, variant *models.ProductVariant) error
+	GetByID(ctx context.Context, id uuid.UUID) (*models.ProductVariant, error)
+	GetByProduct(ctx context.Context, productID uuid.UUID) ([]models.ProductVariant, error)
+	Update(ctx context.Context, variant *models.ProductVariant) error
+	Delete(ctx context.Context, id uuid.UUID) error
+}
+
+// ProductImageRepository defines the product image persistence operations. A
+// product's images are numbered from 1 in display order, without gaps.
+type ProductImageRepository interface {
+	// Create adds an image after the product's last one
+	Create(ctx context.Context, image *models.ProductImage) error
+	GetByID(ctx context.Context, id uuid.UUID) (*models.ProductImage, error)
+	GetByProduct(ctx context.Context, productID uuid.UUID) ([]models.ProductImage, error)
+	// Reorder numbers a product's images in the order of ids, which must list
+	// each of them once
+	Reorder(ctx context.Context, productID uuid.UUID, ids []uuid.UUID) error
+	// Delete removes an image and moves the images after it up
+	Delete(ctx context.Context, id uuid.UUID) error
+}
+
+// PriceRepository defines the product price history and price schedule
+// operations. Every change to a product's price, through any repository, is
+// recorded in its history with the actor of the context it was made under.
+type PriceRepository interface {
+	// GetHistory returns a product's price changes, oldest first
+	GetHistory(ctx context.Context, productID uuid.UUID) ([]models.PriceChange, error)
+	// CreateSchedule adds a pending price schedule. It must not overlap the
+	// product's other pending or active schedules.
+	CreateSchedule(ctx context.Context, schedule *models.PriceSchedule) error
+	GetSchedule(ctx context.Context, id uuid.UUID) (*models.PriceSchedule, error)
+	// GetSchedules returns a product's schedules ordered by start time
+	GetSchedules(ctx context.Context, productID uuid.UUID) ([]models.PriceSchedule, error)
+	// CancelSchedule cancels a pending schedule, or ends an active one now
+	CancelSchedule(ctx context.Context, id uuid.UUID) error
+	// ApplySchedules ends the active schedules due by now, then starts the
+	// pending ones, and returns how many of each it changed
+	ApplySchedules(ctx context.Context, now time.Time) (started, ended int, err error)
+}
+
+// InventoryRepository defines the warehouse and per-warehouse stock
+// operations. Every change to the stock held at a warehouse, through any
+// repository, is recorded in the inventory ledger as a movement.
+type InventoryRepository interface {
+	CreateWarehouse(ctx context.Context, warehouse *models.Warehouse) error
+	GetWarehouse(ctx context.Context, id uuid.UUID) (*models.Warehouse, error)
+	// GetWarehouses returns every warehouse ordered by priority and code
+	GetWarehouses(ctx context.Context) ([]models.Warehouse, error)
+	// UpdateWarehouse replaces a warehouse's code, name, location, priority
+	// and active flag. Only a warehouse holding no stock can be deactivated.
+	UpdateWarehouse(ctx context.Context, warehouse *models.Warehouse) error
+	// GetLevels returns the inventory levels at filter's warehouse or of its product
+	GetLevels(ctx context.Context, filter models.InventoryFilter) ([]models.InventoryLevel, error)
+	// Transfer moves available stock between two active warehouses
+	Transfer(ctx context.Context, transfer *models.StockTransfer) error
+	// Adjust changes the on-hand stock at an active warehouse by the
+	// adjustment's change, and the stock total of its product or variant
+	// with it. Stock reserved for orders cannot be taken away.
+	Adjust(ctx context.Context, adjustment *models.StockAdjustment) error
+	// GetMovements returns the movements matching filter, newest first
+	GetMovements(ctx context.Context, filter models.InventoryFilter) ([]models.InventoryMovement, error)
+	// Reconcile recomputes the inventory levels and the stock totals of
+	// products and variants from the ledger, of one product or of all
+	Reconcile(ctx context.Context, productID *uuid.UUID) (*models.ReconciliationReport, error)
+}
+
+// StockAlertRepository defines reorder thresholds and the low-stock alerts
+// raised against them. Every stock change, through any repository, opens an
+// alert for a product at or below its threshold that has none open, and
+// resolves the open alert of one back above it.
+type StockAlertRepository interface {
+	// GetThreshold returns a product's own, category and effective thresholds
+	GetThreshold(ctx context.Context, productID uuid.UUID) (*models.ReorderThreshold, error)
+	// SetProductThreshold sets a product's own threshold, or clears it with nil
+	SetProductThreshold(ctx context.Context, productID uuid.UUID, threshold *int) error
+	// SetCategoryThreshold sets the threshold of a category's products
+	// without their own, or clears it with nil
+	SetCategoryThreshold(ctx context.Context, categoryID uuid.UUID, threshold *int) error
+	// GetAlerts returns the alerts newest first, only the open ones if openOnly
+	GetAlerts(ctx context.Context, openOnly bool) ([]models.StockAlert, error)
+	// ClaimPending marks the open alerts the admin has not been told about
+	// as notified at and returns them, oldest first
+	ClaimPending(ctx context.Context, at time.Time) ([]models.StockAlert, error)
+	// ReleaseAlert marks a claimed alert as not notified so it is claimed again
+	ReleaseAlert(ctx context.Context, id uuid.UUID) error
+}
+
+// OrderRepository defines the order persistence operations
+type OrderRepository interface {
+	Create(ctx context.Context, order *models.Order) error
+	UpdateStatus(ctx context.Context, change *models.OrderStatusChange) error
+	GetStatusHistory(ctx context.Context, orderID uuid.UUID) ([]models.OrderStatusChange, error)
+	CancelItem(ctx context.Context, orderID, itemID uuid.UUID, quantity int) error
+	GetByID(ctx context.Context, id uuid.UUID) (*models.Order, error)
+	GetByCustomer(ctx context.Context, customerID uuid.UUID) ([]models.Order, error)
+	Delete(ctx context.Context, id uuid.UUID) error
+}
+
+// CartRepository defines the cart persistence operations
+type CartRepository interface {
+	Create(ctx context.Context, cart *models.Cart) error
+	GetByID(ctx context.Context, id uuid.UUID) (*models.Cart, error)
+	GetByCustomer(ctx context.Context, customerID uuid.UUID) (*models.Cart, error)
+	SetItem(ctx context.Context, cartID, productID uuid.UUID, variantID *uuid.UUID, quantity int) error
+	RemoveItem(ctx context.Context, cartID, itemID uuid.UUID) error
+	Merge(ctx context.Context, fromID, intoID uuid.UUID) error
+	Delete(ctx context.Context, id uuid.UUID) error
+}
+
+// IdempotencyRepository stores the responses of requests made with idempotency keys
+type IdempotencyRepository interface {
+	Reserve(ctx context.Context, record *models.IdempotencyRecord) (*models.IdempotencyRecord, error)
+	Complete(ctx context.Context, key string, statusCode int, contentType string, body []byte) error
+	Release(ctx context.Context, key string) error
+	// DeleteExpired deletes the keys that expired at or before now and returns
+	// how many were deleted
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// Repositories groups the repositories used by the handlers
+type Repositories struct {
+	Customers   CustomerRepository
+	Categories  CategoryRepository
+	Products    ProductRepository
+	Variants    VariantRepository
+	Images      ProductImageRepository
+	Prices      PriceRepository
+	Inventory   InventoryRepository
+	StockAlerts StockAlertRepository
+	Orders      OrderRepository
+	Carts       CartRepository
+	Idempotency IdempotencyRepository
+}
+
+// NewPostgresRepositories returns repositories backed by the global DB connection
+func NewPostgresRepositories() *Repositories {
+	return &Repositories{
+		Customers:   &PostgresCustomerRepository{},
+		Categories:  &PostgresCategoryRepository{},
+		Products:    &PostgresProductRepository{},
+		Variants:    &PostgresVariantRepository{},
+		Images:      &PostgresProductImageRepository{},
+		Prices:      &PostgresPriceRepository{},
+		Inventory:   &PostgresInventoryRepository{},
+		StockAlerts: &PostgresStockAlertRepository{},
+		Orders:      &PostgresOrderRepository{},
+		Carts:       &PostgresCartRepository{},
+		Idempotency: &PostgresIdempotencyRepository{},
+	}
+}
+
+// NewMemoryRepositories returns repositories sharing a single in-memory store
+func NewMemoryRepositories() *Repositories {
+	store := newMemoryStore()
+	return &Repositories{
+		Customers:   &MemoryCustomerRepository{store: store},
+		Categories:  &MemoryCategoryRepository{store: store},
+		Products:    &MemoryProductRepository{store: store},
+		Variants:    &MemoryVariantRepository{store: store},
+		Images:      &MemoryProductImageRepository{store: store},
+		Prices:      &MemoryPriceRepository{store: store},
+		Inventory:   &MemoryInventoryRepository{store: store},
+		StockAlerts: &MemoryStockAlertRepository{store: store},
+		Orders:      &MemoryOrderRepository{store: store},
+		Carts:       &MemoryCartRepository{store: store},
+		Idempotency: &MemoryIdempotencyRepository{store: store},
+	}
+}
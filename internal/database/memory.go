@@ -0,0 +1,3540 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"html"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+var (
+	errDuplicateEmail        = errors.New(`duplicate key value violates unique constraint "customers_email_key"`)
+	errDuplicateCustomerCart = errors.New(`duplicate key value violates unique constraint "idx_carts_customer_id"`)
+)
+
+// checkContext reports a cancelled or expired context the same way the SQL repositories do
+func checkContext(ctx context.Context) error {
+	return wrapQueryError(ctx, ctx.Err())
+}
+
+// memoryStore holds the shared state for the in-memory repositories.
+// Rows are stored without their joined relations; those are filled in on read
+// the same way the SQL queries join them.
+type memoryStore struct {
+	mu         sync.RWMutex
+	customers  map[uuid.UUID]models.Customer
+	categories map[uuid.UUID]models.Category
+	attributes map[uuid.UUID][]models.AttributeDefinition
+	products   map[uuid.UUID]models.Product
+	variants   map[uuid.UUID]models.ProductVariant
+	images     map[uuid.UUID]models.ProductImage
+	orders     map[uuid.UUID]models.Order
+	orderItems map[uuid.UUID][]models.OrderItem
+
+	statusHistory map[uuid.UUID][]models.OrderStatusChange
+	carts         map[uuid.UUID]models.Cart
+	cartItems     map[uuid.UUID][]models.CartItem
+	idempotency   map[string]models.IdempotencyRecord
+
+	priceHistory   map[uuid.UUID][]models.PriceChange
+	priceSchedules map[uuid.UUID]models.PriceSchedule
+
+	warehouses map[uuid.UUID]models.Warehouse
+	inventory  map[inventoryKey]models.InventoryLevel
+	// movements is the inventory ledger, oldest first
+	movements []models.InventoryMovement
+	// allocations holds the allocations of order lines by line ID
+	allocations map[uuid.UUID][]models.OrderAllocation
+
+	productThresholds  map[uuid.UUID]int
+	categoryThresholds map[uuid.UUID]int
+	// stockAlerts holds the low-stock alerts, oldest first
+	stockAlerts []models.StockAlert
+}
+
+// inventoryKey identifies an inventory level. The variant is uuid.Nil for a
+// product's own stock.
+type inventoryKey struct {
+	warehouseID uuid.UUID
+	productID   uuid.UUID
+	variantID   uuid.UUID
+}
+
+// levelKey returns the key of a product's or variant's level at a warehouse
+func levelKey(warehouseID, productID uuid.UUID, variantID *uuid.UUID) inventoryKey {
+	key := inventoryKey{warehouseID: warehouseID, productID: productID}
+	if variantID != nil {
+		key.variantID = *variantID
+	}
+	return key
+}
+
+func newMemoryStore() *memoryStore {
+	store := &memoryStore{
+		customers:  make(map[uuid.UUID]models.Customer),
+		categories: make(map[uuid.UUID]models.Category),
+		attributes: make(map[uuid.UUID][]models.AttributeDefinition),
+		products:   make(map[uuid.UUID]models.Product),
+		variants:   make(map[uuid.UUID]models.ProductVariant),
+		images:     make(map[uuid.UUID]models.ProductImage),
+		orders:     make(map[uuid.UUID]models.Order),
+		orderItems: make(map[uuid.UUID][]models.OrderItem),
+
+		statusHistory: make(map[uuid.UUID][]models.OrderStatusChange),
+		carts:         make(map[uuid.UUID]models.Cart),
+		cartItems:     make(map[uuid.UUID][]models.CartItem),
+		idempotency:   make(map[string]models.IdempotencyRecord),
+
+		priceHistory:   make(map[uuid.UUID][]models.PriceChange),
+		priceSchedules: make(map[uuid.UUID]models.PriceSchedule),
+
+		warehouses:  make(map[uuid.UUID]models.Warehouse),
+		inventory:   make(map[inventoryKey]models.InventoryLevel),
+		allocations: make(map[uuid.UUID][]models.OrderAllocation),
+
+		productThresholds:  make(map[uuid.UUID]int),
+		categoryThresholds: make(map[uuid.UUID]int),
+	}
+
+	// The migrations create the default warehouse along with the table
+	now := time.Now()
+	main := models.Warehouse{
+		ID:        uuid.New(),
+		Code:      "MAIN",
+		Name:      "Main warehouse",
+		IsDefault: true,
+		Active:    true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	store.warehouses[main.ID] = main
+	return store
+}
+
+// deleteCustomer removes a customer and cascades to its orders and cart. Callers must hold the write lock.
+func (s *memoryStore) deleteCustomer(id uuid.UUID) {
+	delete(s.customers, id)
+	for orderID, order := range s.orders {
+		if order.CustomerID == id {
+			s.deleteOrder(orderID)
+		}
+	}
+	for cartID, cart := range s.carts {
+		if cart.CustomerID != nil && *cart.CustomerID == id {
+			s.deleteCart(cartID)
+		}
+	}
+}
+
+// deleteCategory removes a category and cascades to its attribute definitions,
+// subcategories and products. Callers must hold the write lock.
+func (s *memoryStore) deleteCategory(id uuid.UUID) {
+	delete(s.categories, id)
+	delete(s.attributes, id)
+	delete(s.categoryThresholds, id)
+	for childID, child := range s.categories {
+		if child.ParentID != nil && *child.ParentID == id {
+			s.deleteCategory(childID)
+		}
+	}
+	for productID, product := range s.products {
+		if product.CategoryID == id {
+			s.deleteProduct(productID)
+		}
+	}
+}
+
+// deleteProduct removes a product and cascades to its variants, images, price
+// history and schedules, inventory, stock alerts and the order and cart items
+// referencing it. Callers must hold the write lock.
+func (s *memoryStore) deleteProduct(id uuid.UUID) {
+	delete(s.products, id)
+	delete(s.priceHistory, id)
+	delete(s.productThresholds, id)
+	s.stockAlerts = slices.DeleteFunc(s.stockAlerts, func(alert models.StockAlert) bool { return alert.ProductID == id })
+	s.deleteInventory(func(productID uuid.UUID, _ *uuid.UUID) bool { return productID == id })
+	for scheduleID, schedule := range s.priceSchedules {
+		if schedule.ProductID == id {
+			delete(s.priceSchedules, scheduleID)
+		}
+	}
+	for variantID, variant := range s.variants {
+		if variant.ProductID == id {
+			delete(s.variants, variantID)
+		}
+	}
+	for imageID, image := range s.images {
+		if image.ProductID == id {
+			delete(s.images, imageID)
+		}
+	}
+	for orderID, items := range s.orderItems {
+		kept := items[:0]
+		for _, item := range items {
+			if item.ProductID != id {
+				kept = append(kept, item)
+			} else {
+				delete(s.allocations, item.ID)
+			}
+		}
+		s.orderItems[orderID] = kept
+	}
+	s.removeFromCarts(id)
+}
+
+// deleteOrder removes an order and its items, leaving the inventory movements
+// it caused without an order. Callers must hold the write lock.
+func (s *memoryStore) deleteOrder(id uuid.UUID) {
+	for _, item := range s.orderItems[id] {
+		delete(s.allocations, item.ID)
+	}
+	for i, movement := range s.movements {
+		if movement.OrderID != nil && *movement.OrderID == id {
+			s.movements[i].OrderID = nil
+		}
+	}
+	delete(s.orders, id)
+	delete(s.orderItems, id)
+	delete(s.statusHistory, id)
+}
+
+// deleteInventory removes the inventory levels and movements of the products
+// and variants matching match. Callers must hold the write lock.
+func (s *memoryStore) deleteInventory(match func(productID uuid.UUID, variantID *uuid.UUID) bool) {
+	for key, level := range s.inventory {
+		if match(level.ProductID, level.VariantID) {
+			delete(s.inventory, key)
+		}
+	}
+	s.movements = slices.DeleteFunc(s.movements, func(movement models.InventoryMovement) bool {
+		return match(movement.ProductID, movement.VariantID)
+	})
+}
+
+// deleteCart removes a cart and its items. Callers must hold the write lock.
+func (s *memoryStore) deleteCart(id uuid.UUID) {
+	delete(s.carts, id)
+	delete(s.cartItems, id)
+}
+
+// restockOrder returns the uncancelled quantity of every line of an order to
+// product and variant stock. Callers must hold the write lock.
+func (s *memoryStore) restockOrder(id uuid.UUID, actor string) {
+	now := time.Now()
+	for _, item := range s.orderItems[id] {
+		if remaining := item.RemainingQuantity(); remaining > 0 {
+			s.restockItem(item, remaining, actor, now)
+		}
+	}
+}
+
+// restockItem returns quantity units of an order line to its product's stock,
+// and to its variant's if it has one, and releases them at the warehouses
+// holding them. Callers must hold the write lock.
+func (s *memoryStore) restockItem(item models.OrderItem, quantity int, actor string, at time.Time) {
+	s.releaseItem(item, quantity, actor, at)
+	if product, ok := s.products[item.ProductID]; ok {
+		product.Stock += quantity
+		product.UpdatedAt = at
+		s.products[item.ProductID] = product
+		s.syncStockAlert(item.ProductID, at)
+	}
+	if item.VariantID == nil {
+		return
+	}
+	if variant, ok := s.variants[*item.VariantID]; ok {
+		variant.Stock += quantity
+		variant.UpdatedAt = at
+		s.variants[variant.ID] = variant
+	}
+}
+
+// productVariants returns a product's variants ordered by SKU. Callers must hold the read lock.
+func (s *memoryStore) productVariants(productID uuid.UUID) []models.ProductVariant {
+	variants := []models.ProductVariant{}
+	for _, variant := range s.variants {
+		if variant.ProductID == productID {
+			variants = append(variants, variant)
+		}
+	}
+	sort.Slice(variants, func(i, j int) bool {
+		return variants[i].SKU < variants[j].SKU
+	})
+	return variants
+}
+
+// productImages returns a product's images in display order. Callers must hold the read lock.
+func (s *memoryStore) productImages(productID uuid.UUID) []models.ProductImage {
+	images := []models.ProductImage{}
+	for _, image := range s.images {
+		if image.ProductID == productID {
+			images = append(images, image)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Position < images[j].Position
+	})
+	return images
+}
+
+// syncProductStock sets a product's stock to the total of its variants' stock,
+// leaving none once its last variant is deleted, and syncs its low-stock
+// alert. Callers must hold the write lock.
+func (s *memoryStore) syncProductStock(productID uuid.UUID, at time.Time) {
+	product, ok := s.products[productID]
+	if !ok {
+		return
+	}
+	product.Stock = 0
+	for _, variant := range s.variants {
+		if variant.ProductID == productID {
+			product.Stock += variant.Stock
+		}
+	}
+	product.UpdatedAt = at
+	s.products[productID] = product
+	s.syncStockAlert(productID, at)
+}
+
+// reorderThreshold returns a product's own, category and effective reorder
+// thresholds. A category without a threshold inherits the one of its nearest
+// ancestor that has one. Callers must hold the read lock.
+func (s *memoryStore) reorderThreshold(product models.Product) *models.ReorderThreshold {
+	var own, category *int
+	if threshold, ok := s.productThresholds[product.ID]; ok {
+		own = &threshold
+	}
+	for categoryID := &product.CategoryID; categoryID != nil; categoryID = s.categories[*categoryID].ParentID {
+		if threshold, ok := s.categoryThresholds[*categoryID]; ok {
+			category = &threshold
+			break
+		}
+	}
+	return models.NewReorderThreshold(product.ID, own, category, product.Stock)
+}
+
+// syncCategoryStockAlerts syncs the low-stock alerts of the products of a
+// category and all its subcategories. Callers must hold the write lock.
+func (s *memoryStore) syncCategoryStockAlerts(root models.Category, at time.Time) {
+	subtree := s.categorySubtree(root)
+	for id, product := range s.products {
+		if subtree[product.CategoryID] {
+			s.syncStockAlert(id, at)
+		}
+	}
+}
+
+// syncStockAlert opens a low-stock alert for a product at or below its reorder
+// threshold that has none open, or resolves its open alert once it is back
+// above the threshold or no longer has one. Callers must hold the write lock.
+func (s *memoryStore) syncStockAlert(productID uuid.UUID, at time.Time) {
+	product, ok := s.products[productID]
+	if !ok {
+		return
+	}
+	open := slices.IndexFunc(s.stockAlerts, func(alert models.StockAlert) bool {
+		return alert.ProductID == productID && alert.IsOpen()
+	})
+	threshold := s.reorderThreshold(product).Effective
+	low := threshold != nil && product.Stock <= *threshold
+
+	switch {
+	case low && open < 0 && product.DeletedAt == nil:
+		s.stockAlerts = append(s.stockAlerts, models.StockAlert{
+			ID:        uuid.New(),
+			ProductID: productID,
+			Threshold: *threshold,
+			Stock:     product.Stock,
+			CreatedAt: at,
+		})
+	case !low && open >= 0:
+		resolvedAt := at
+		s.stockAlerts[open].ResolvedAt = &resolvedAt
+	}
+}
+
+// defaultWarehouse returns the ID of the warehouse stock is added to. Callers must hold the read lock.
+func (s *memoryStore) defaultWarehouse() uuid.UUID {
+	for id, warehouse := range s.warehouses {
+		if warehouse.IsDefault {
+			return id
+		}
+	}
+	return uuid.Nil
+}
+
+// moveStock applies a movement to its inventory level, creating the level on
+// its first movement, and records it in the inventory ledger, returning the
+// movement's ID. Callers must hold the write lock.
+func (s *memoryStore) moveStock(movement models.InventoryMovement) uuid.UUID {
+	movement.ID = uuid.New()
+	key := levelKey(movement.WarehouseID, movement.ProductID, movement.VariantID)
+	level, ok := s.inventory[key]
+	if !ok {
+		level = models.InventoryLevel{
+			WarehouseID: movement.WarehouseID,
+			ProductID:   movement.ProductID,
+			VariantID:   movement.VariantID,
+		}
+	}
+	level.OnHand += movement.OnHandChange
+	level.Reserved += movement.ReservedChange
+	level.UpdatedAt = movement.CreatedAt
+	s.inventory[key] = level
+	s.movements = append(s.movements, movement)
+	return movement.ID
+}
+
+// takeableStock returns the stock adjustStock can take away from a product, or
+// from one of its variants: what its levels hold beyond their reservations.
+// Callers must hold the read lock.
+func (s *memoryStore) takeableStock(productID uuid.UUID, variantID *uuid.UUID) int {
+	takeable := 0
+	for key, level := range s.inventory {
+		if key == levelKey(key.warehouseID, productID, variantID) && level.OnHand > level.Reserved {
+			takeable += level.OnHand - level.Reserved
+		}
+	}
+	return takeable
+}
+
+// checkStockChange returns the InsufficientStockError the SQL repository's
+// adjustStock would return for a change of change units. Callers check before
+// changing anything and must hold the read lock.
+func (s *memoryStore) checkStockChange(product models.Product, variant *models.ProductVariant, change int) error {
+	var variantID *uuid.UUID
+	if variant != nil {
+		variantID = &variant.ID
+	}
+	takeable := s.takeableStock(product.ID, variantID)
+	if change >= 0 || takeable >= -change {
+		return nil
+	}
+
+	stockErr := &InsufficientStockError{ProductID: product.ID, ProductName: product.Name, Requested: -change, Available: takeable}
+	if variant != nil {
+		stockErr.SKU = variant.SKU
+	}
+	return stockErr
+}
+
+// adjustStock records a change of change units to the stock total of a
+// product, or of one of its variants, as the SQL repository does: stock added
+// goes to the default warehouse and stock taken away comes out of what is
+// available at the default warehouse first and then at the least preferred
+// warehouses. Callers check the change with checkStockChange first and must
+// hold the write lock.
+func (s *memoryStore) adjustStock(productID uuid.UUID, variantID *uuid.UUID, change int, movementType, actor string, at time.Time) {
+	movement := models.InventoryMovement{
+		ProductID: productID,
+		VariantID: variantID,
+		Type:      movementType,
+		CreatedBy: actor,
+		CreatedAt: at,
+	}
+	if change > 0 {
+		movement.WarehouseID = s.defaultWarehouse()
+		movement.OnHandChange = change
+		s.moveStock(movement)
+		return
+	}
+
+	var levels []models.InventoryLevel
+	for key, level := range s.inventory {
+		if key == levelKey(key.warehouseID, productID, variantID) && level.OnHand > level.Reserved {
+			levels = append(levels, level)
+		}
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		a, b := s.warehouses[levels[i].WarehouseID], s.warehouses[levels[j].WarehouseID]
+		if a.IsDefault != b.IsDefault {
+			return a.IsDefault
+		}
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.Code > b.Code
+	})
+
+	remaining := -change
+	for _, level := range levels {
+		if remaining == 0 {
+			break
+		}
+		taken := min(level.OnHand-level.Reserved, remaining)
+		movement.WarehouseID = level.WarehouseID
+		movement.OnHandChange = -taken
+		s.moveStock(movement)
+		remaining -= taken
+	}
+}
+
+// allocateItem picks the active warehouses an order line is reserved at, as
+// the SQL repository does, without reserving anything. taken holds the units
+// earlier lines of the order take from each level and is updated with this
+// line's. It returns nil when the warehouses hold too little available stock.
+// Callers must hold the read lock.
+func (s *memoryStore) allocateItem(item models.OrderItem, shipTo *models.Location, taken map[inventoryKey]int) []models.OrderAllocation {
+	var warehouses []models.Warehouse
+	available := make(map[uuid.UUID]int)
+	for key, level := range s.inventory {
+		if key != levelKey(key.warehouseID, item.ProductID, item.VariantID) {
+			continue
+		}
+		warehouse := s.warehouses[key.warehouseID]
+		if quantity := level.OnHand - level.Reserved - taken[key]; warehouse.Active && quantity > 0 {
+			warehouses = append(warehouses, warehouse)
+			available[warehouse.ID] = quantity
+		}
+	}
+
+	models.RankWarehouses(warehouses, shipTo)
+	levels := make([]models.InventoryLevel, len(warehouses))
+	for i, warehouse := range warehouses {
+		levels[i] = models.InventoryLevel{WarehouseID: warehouse.ID, Available: available[warehouse.ID]}
+	}
+	allocations := models.AllocateStock(levels, item.Quantity)
+	for _, allocation := range allocations {
+		taken[levelKey(allocation.WarehouseID, item.ProductID, item.VariantID)] += allocation.Quantity
+	}
+	return allocations
+}
+
+// itemAllocations returns a copy of an order line's allocations in warehouse
+// ID order. Callers must hold the read lock.
+func (s *memoryStore) itemAllocations(itemID uuid.UUID) []models.OrderAllocation {
+	allocations := slices.Clone(s.allocations[itemID])
+	sort.Slice(allocations, func(i, j int) bool {
+		return allocations[i].WarehouseID.String() < allocations[j].WarehouseID.String()
+	})
+	return allocations
+}
+
+// releaseItem releases quantity units reserved for an order line, shrinking
+// its allocations in warehouse ID order. Units of a line without allocations
+// go back on hand at the default warehouse. Callers must hold the write lock.
+func (s *memoryStore) releaseItem(item models.OrderItem, quantity int, actor string, at time.Time) {
+	movement := models.InventoryMovement{
+		ProductID: item.ProductID,
+		VariantID: item.VariantID,
+		Type:      models.MovementCancellation,
+		OrderID:   &item.OrderID,
+		CreatedBy: actor,
+		CreatedAt: at,
+	}
+
+	var kept []models.OrderAllocation
+	remaining := quantity
+	for _, allocation := range s.itemAllocations(item.ID) {
+		released := min(allocation.Quantity, remaining)
+		if released > 0 {
+			movement.WarehouseID = allocation.WarehouseID
+			movement.ReservedChange = -released
+			s.moveStock(movement)
+			remaining -= released
+		}
+		if allocation.Quantity -= released; allocation.Quantity > 0 {
+			kept = append(kept, allocation)
+		}
+	}
+	if len(kept) > 0 {
+		s.allocations[item.ID] = kept
+	} else {
+		delete(s.allocations, item.ID)
+	}
+
+	if remaining > 0 {
+		movement.WarehouseID = s.defaultWarehouse()
+		movement.OnHandChange = remaining
+		movement.ReservedChange = 0
+		s.moveStock(movement)
+	}
+}
+
+// shipOrder takes the stock reserved for an order out of the warehouses
+// holding it, keeping the allocations as the record of where each line
+// shipped from. Callers must hold the write lock.
+func (s *memoryStore) shipOrder(orderID uuid.UUID, actor string, at time.Time) {
+	for _, item := range s.orderItems[orderID] {
+		for _, allocation := range s.itemAllocations(item.ID) {
+			s.moveStock(models.InventoryMovement{
+				WarehouseID:    allocation.WarehouseID,
+				ProductID:      item.ProductID,
+				VariantID:      item.VariantID,
+				Type:           models.MovementShipment,
+				OnHandChange:   -allocation.Quantity,
+				ReservedChange: -allocation.Quantity,
+				OrderID:        &orderID,
+				CreatedBy:      actor,
+				CreatedAt:      at,
+			})
+		}
+	}
+}
+
+// recordPriceChange adds an entry to a product's price history. Callers must hold the write lock.
+func (s *memoryStore) recordPriceChange(change models.PriceChange) {
+	change.ID = uuid.New()
+	s.priceHistory[change.ProductID] = append(s.priceHistory[change.ProductID], change)
+}
+
+// productSchedules returns a product's price schedules ordered by start time. Callers must hold the read lock.
+func (s *memoryStore) productSchedules(productID uuid.UUID) []models.PriceSchedule {
+	schedules := []models.PriceSchedule{}
+	for _, schedule := range s.priceSchedules {
+		if schedule.ProductID == productID {
+			schedules = append(schedules, schedule)
+		}
+	}
+	sortSchedules(schedules, func(schedule models.PriceSchedule) time.Time { return schedule.StartsAt })
+	return schedules
+}
+
+// sortSchedules orders price schedules by the time key returns, breaking ties on ID
+func sortSchedules(schedules []models.PriceSchedule, key func(models.PriceSchedule) time.Time) {
+	sort.Slice(schedules, func(i, j int) bool {
+		if a, b := key(schedules[i]), key(schedules[j]); !a.Equal(b) {
+			return a.Before(b)
+		}
+		return schedules[i].ID.String() < schedules[j].ID.String()
+	})
+}
+
+// regularPrice returns the price a product had before the active sale that
+// set its current one, or nil when no sale set it. Callers must hold the read lock.
+func (s *memoryStore) regularPrice(product models.Product) *models.Money {
+	for _, schedule := range s.priceSchedules {
+		if schedule.ProductID == product.ID && schedule.Status == models.PriceScheduleActive &&
+			schedule.Price == product.Price && schedule.PreviousPrice != nil {
+			regular := *schedule.PreviousPrice
+			return &regular
+		}
+	}
+	return nil
+}
+
+// categorySubtree returns the IDs of a category and all of its descendants.
+// Callers must hold the read lock.
+func (s *memoryStore) categorySubtree(root models.Category) map[uuid.UUID]bool {
+	subtree := map[uuid.UUID]bool{root.ID: true}
+	for id, category := range s.categories {
+		if strings.HasPrefix(category.Path, root.Path+"/") {
+			subtree[id] = true
+		}
+	}
+	return subtree
+}
+
+// removeFromCarts deletes the cart lines for a product. Callers must hold the write lock.
+func (s *memoryStore) removeFromCarts(productID uuid.UUID) {
+	for cartID, items := range s.cartItems {
+		s.cartItems[cartID] = slices.DeleteFunc(items, func(item models.CartItem) bool {
+			return item.ProductID == productID
+		})
+	}
+}
+
+// recentlyDeletedFirst orders soft-deleted rows from the most recently deleted,
+// breaking ties on ID
+func recentlyDeletedFirst(aDeletedAt, bDeletedAt *time.Time, aID, bID uuid.UUID) bool {
+	if !aDeletedAt.Equal(*bDeletedAt) {
+		return aDeletedAt.After(*bDeletedAt)
+	}
+	return aID.String() < bID.String()
+}
+
+// productsMatching returns the live products selected by a listing filter, ignoring
+// its cursor, sort and limit. The caller must hold the lock.
+func (s *memoryStore) productsMatching(filter models.ProductFilter) []models.Product {
+	var categoryPath string
+	if filter.CategoryID != nil {
+		category, ok := s.categories[*filter.CategoryID]
+		if !ok {
+			return nil
+		}
+		categoryPath = category.Path
+	}
+
+	var products []models.Product
+	for _, product := range s.products {
+		if product.DeletedAt != nil {
+			continue
+		}
+		product = s.listedProduct(product)
+
+		if filter.CategoryID != nil && product.CategoryID != *filter.CategoryID &&
+			!strings.HasPrefix(product.Category.Path, categoryPath+"/") {
+			continue
+		}
+		if filter.MinPrice != nil && (product.Price.Currency != filter.MinPrice.Currency || product.Price.Amount < filter.MinPrice.Amount) {
+			continue
+		}
+		if filter.MaxPrice != nil && (product.Price.Currency != filter.MaxPrice.Currency || product.Price.Amount > filter.MaxPrice.Amount) {
+			continue
+		}
+		if filter.InStock && product.Stock <= 0 {
+			continue
+		}
+		if !slices.ContainsFunc(filter.Attributes, func(attribute models.AttributeFilter) bool {
+			return !attribute.Matches(product.Attributes)
+		}) {
+			products = append(products, product)
+		}
+	}
+	return products
+}
+
+// productWithCategory returns a product joined with its category. Callers must hold the read lock.
+func (s *memoryStore) productWithCategory(product models.Product) models.Product {
+	product.Category = s.categories[product.CategoryID]
+	return product
+}
+
+// listedProduct returns a product joined with its category, its price range
+// across variants and its regular price, as the listing queries return it. Callers must hold the read lock.
+func (s *memoryStore) listedProduct(product models.Product) models.Product {
+	product = s.productWithCategory(product)
+	product.SetPriceRange(s.productVariants(product.ID))
+	product.RegularPrice = s.regularPrice(product)
+	return product
+}
+
+// MemoryCustomerRepository is a thread-safe in-memory CustomerRepository
+type MemoryCustomerRepository struct {
+	store *memoryStore
+}
+
+func (r *MemoryCustomerRepository) Create(ctx context.Context, customer *models.Customer) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for _, existing := range r.store.customers {
+		if existing.Email == customer.Email {
+			return errDuplicateEmail
+		}
+	}
+
+	customer.ID = uuid.New()
+	customer.CreatedAt = time.Now()
+	customer.UpdatedAt = time.Now()
+
+	r.store.customers[customer.ID] = *customer
+	return nil
+}
+
+func (r *MemoryCustomerRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Customer, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	customer, ok := r.store.customers[id]
+	if !ok || customer.DeletedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+	return &customer, nil
+}
+
+func (r *MemoryCustomerRepository) GetByEmail(ctx context.Context, email string) (*models.Customer, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	for _, customer := range r.store.customers {
+		if customer.Email == email && customer.DeletedAt == nil {
+			return &customer, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (r *MemoryCustomerRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	r.store.deleteCustomer(id)
+	return nil
+}
+
+// SoftDelete marks a customer deleted, hiding it from the other queries until it
+// is restored or purged. Its orders are kept.
+func (r *MemoryCustomerRepository) SoftDelete(ctx context.Context, id uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	customer, ok := r.store.customers[id]
+	if !ok || customer.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+	now := time.Now()
+	customer.DeletedAt = &now
+	r.store.customers[id] = customer
+	return nil
+}
+
+// Restore undoes SoftDelete
+func (r *MemoryCustomerRepository) Restore(ctx context.Context, id uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	customer, ok := r.store.customers[id]
+	if !ok || customer.DeletedAt == nil {
+		return sql.ErrNoRows
+	}
+	customer.DeletedAt = nil
+	customer.UpdatedAt = time.Now()
+	r.store.customers[id] = customer
+	return nil
+}
+
+// GetDeleted returns the soft-deleted customers, most recently deleted first
+func (r *MemoryCustomerRepository) GetDeleted(ctx context.Context) ([]models.Customer, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	customers := []models.Customer{}
+	for _, customer := range r.store.customers {
+		if customer.DeletedAt != nil {
+			customers = append(customers, customer)
+		}
+	}
+	sort.Slice(customers, func(i, j int) bool {
+		return recentlyDeletedFirst(customers[i].DeletedAt, customers[j].DeletedAt, customers[i].ID, customers[j].ID)
+	})
+	return customers, nil
+}
+
+// Purge permanently deletes customers soft-deleted before the cutoff. Customers
+// with orders are kept so that the order history survives.
+func (r *MemoryCustomerRepository) Purge(ctx context.Context, before time.Time) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	ordered := make(map[uuid.UUID]bool)
+	for _, order := range r.store.orders {
+		ordered[order.CustomerID] = true
+	}
+
+	purged := 0
+	for id, customer := range r.store.customers {
+		if customer.DeletedAt != nil && customer.DeletedAt.Before(before) && !ordered[id] {
+			r.store.deleteCustomer(id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// MemoryCategoryRepository is a thread-safe in-memory CategoryRepository
+type MemoryCategoryRepository struct {
+	store *memoryStore
+}
+
+func (r *MemoryCategoryRepository) Create(ctx context.Context, category *models.Category) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	category.ID = uuid.New()
+	category.CreatedAt = time.Now()
+	category.UpdatedAt = time.Now()
+
+	// Calculate level and path
+	if category.ParentID != nil {
+		parent, ok := r.store.categories[*category.ParentID]
+		if !ok || parent.DeletedAt != nil {
+			return sql.ErrNoRows
+		}
+		category.Level = parent.Level + 1
+		category.Path = parent.Path + "/" + category.Name
+	} else {
+		category.Level = 0
+		category.Path = "/" + category.Name
+	}
+
+	stored := *category
+	stored.Children = nil
+	r.store.categories[category.ID] = stored
+	return nil
+}
+
+func (r *MemoryCategoryRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Category, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	category, ok := r.store.categories[id]
+	if !ok || category.DeletedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+	return &category, nil
+}
+
+func (r *MemoryCategoryRepository) GetAll(ctx context.Context) ([]models.Category, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	var categories []models.Category
+	for _, category := range r.store.categories {
+		if category.DeletedAt == nil {
+			categories = append(categories, category)
+		}
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		return categories[i].Path < categories[j].Path
+	})
+	return categories, nil
+}
+
+func (r *MemoryCategoryRepository) GetChildren(ctx context.Context, parentID uuid.UUID) ([]models.Category, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	var categories []models.Category
+	for _, category := range r.store.categories {
+		if category.ParentID != nil && *category.ParentID == parentID && category.DeletedAt == nil {
+			categories = append(categories, category)
+		}
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		return categories[i].Name < categories[j].Name
+	})
+	return categories, nil
+}
+
+func (r *MemoryCategoryRepository) GetTree(ctx context.Context, rootID *uuid.UUID, depth int) ([]models.Category, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	var categories []models.Category
+	for _, category := range r.store.categories {
+		if category.DeletedAt == nil {
+			categories = append(categories, category)
+		}
+	}
+
+	rootLevel := 0
+	if rootID != nil {
+		root, ok := r.store.categories[*rootID]
+		if !ok || root.DeletedAt != nil {
+			return nil, sql.ErrNoRows
+		}
+		subtree := r.store.categorySubtree(root)
+		categories = slices.DeleteFunc(categories, func(category models.Category) bool {
+			return !subtree[category.ID]
+		})
+		rootLevel = root.Level
+	}
+	if depth >= 0 {
+		categories = slices.DeleteFunc(categories, func(category models.Category) bool {
+			return category.Level > rootLevel+depth
+		})
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		return categories[i].Path < categories[j].Path
+	})
+
+	for i, category := range categories {
+		count := 0
+		for _, product := range r.store.products {
+			if product.DeletedAt != nil {
+				continue
+			}
+			path := r.store.categories[product.CategoryID].Path
+			if product.CategoryID == category.ID || strings.HasPrefix(path, category.Path+"/") {
+				count++
+			}
+		}
+		categories[i].ProductCount = &count
+	}
+	return models.CategoryTree(categories), nil
+}
+
+// Update renames and reparents a category, rewriting the path and level of its
+// whole subtree, deleted subcategories included
+func (r *MemoryCategoryRepository) Update(ctx context.Context, category *models.Category) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, ok := r.store.categories[category.ID]
+	if !ok || stored.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+
+	category.Level = 0
+	category.Path = "/" + category.Name
+	if category.ParentID != nil {
+		parent, ok := r.store.categories[*category.ParentID]
+		if !ok || parent.DeletedAt != nil {
+			return foreignKeyError("categories", "parent_id")
+		}
+		if strings.HasPrefix(parent.Path+"/", stored.Path+"/") {
+			return ErrCategoryCycle
+		}
+		if r.store.attributesClash(stored, parent) {
+			return ErrDuplicateAttribute
+		}
+		category.Level = parent.Level + 1
+		category.Path = parent.Path + "/" + category.Name
+	}
+	category.CreatedAt = stored.CreatedAt
+	category.UpdatedAt = time.Now()
+
+	for id, descendant := range r.store.categories {
+		if strings.HasPrefix(descendant.Path, stored.Path+"/") {
+			descendant.Path = category.Path + strings.TrimPrefix(descendant.Path, stored.Path)
+			descendant.Level += category.Level - stored.Level
+			descendant.UpdatedAt = category.UpdatedAt
+			r.store.categories[id] = descendant
+		}
+	}
+
+	updated := *category
+	updated.DeletedAt = nil
+	updated.Children = nil
+	r.store.categories[category.ID] = updated
+
+	// Moved products may inherit a different reorder threshold
+	r.store.syncCategoryStockAlerts(updated, category.UpdatedAt)
+	return nil
+}
+
+// attributesClash reports whether moving a category under parent would define
+// an attribute name twice along a path of the tree. Callers must hold the read lock.
+func (s *memoryStore) attributesClash(category, parent models.Category) bool {
+	moved := s.categorySubtree(category)
+	for id, definitions := range s.attributes {
+		owner := s.categories[id]
+		if id != parent.ID && !strings.HasPrefix(parent.Path, owner.Path+"/") {
+			continue
+		}
+		for movedID := range moved {
+			for _, definition := range definitions {
+				if _, ok := models.AttributeSchema(s.attributes[movedID]).Attribute(definition.Name); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (r *MemoryCategoryRepository) Delete(ctx context.Context, id uuid.UUID, level int) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if category, ok := r.store.categories[id]; ok && category.Level == level {
+		r.store.deleteCategory(id)
+	}
+	return nil
+}
+
+// SoftDelete marks a category, its subcategories and their products deleted
+// with one timestamp, so that Restore can bring back exactly what was deleted
+// together. The deleted products are taken out of carts.
+func (r *MemoryCategoryRepository) SoftDelete(ctx context.Context, id uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	category, ok := r.store.categories[id]
+	if !ok || category.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+
+	now := time.Now().Truncate(time.Microsecond)
+	subtree := r.store.categorySubtree(category)
+	for categoryID := range subtree {
+		if category := r.store.categories[categoryID]; category.DeletedAt == nil {
+			category.DeletedAt = &now
+			r.store.categories[categoryID] = category
+		}
+	}
+	for productID, product := range r.store.products {
+		if subtree[product.CategoryID] && product.DeletedAt == nil {
+			product.DeletedAt = &now
+			r.store.products[productID] = product
+			r.store.removeFromCarts(productID)
+		}
+	}
+	return nil
+}
+
+// Restore undoes SoftDelete, restoring the subcategories and products that were
+// deleted along with the category. A category whose parent is deleted cannot
+// be restored on its own.
+func (r *MemoryCategoryRepository) Restore(ctx context.Context, id uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	category, ok := r.store.categories[id]
+	if !ok || category.DeletedAt == nil {
+		return sql.ErrNoRows
+	}
+	if category.ParentID != nil && r.store.categories[*category.ParentID].DeletedAt != nil {
+		return ErrParentDeleted
+	}
+
+	deletedAt := *category.DeletedAt
+	now := time.Now()
+	restored := make(map[uuid.UUID]bool)
+	for categoryID := range r.store.categorySubtree(category) {
+		if category := r.store.categories[categoryID]; category.DeletedAt != nil && category.DeletedAt.Equal(deletedAt) {
+			category.DeletedAt = nil
+			category.UpdatedAt = now
+			r.store.categories[categoryID] = category
+			restored[categoryID] = true
+		}
+	}
+	for productID, product := range r.store.products {
+		if restored[product.CategoryID] && product.DeletedAt != nil && product.DeletedAt.Equal(deletedAt) {
+			product.DeletedAt = nil
+			product.UpdatedAt = now
+			r.store.products[productID] = product
+		}
+	}
+	return nil
+}
+
+// GetDeleted returns the soft-deleted categories, most recently deleted first
+func (r *MemoryCategoryRepository) GetDeleted(ctx context.Context) ([]models.Category, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	categories := []models.Category{}
+	for _, category := range r.store.categories {
+		if category.DeletedAt != nil {
+			categories = append(categories, category)
+		}
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if !categories[i].DeletedAt.Equal(*categories[j].DeletedAt) {
+			return categories[i].DeletedAt.After(*categories[j].DeletedAt)
+		}
+		return categories[i].Path < categories[j].Path
+	})
+	return categories, nil
+}
+
+// Purge permanently deletes categories soft-deleted before the cutoff. A
+// category is only purged once its whole subtree is purgeable and holds no
+// products, so purging never cascades into live rows or order history.
+func (r *MemoryCategoryRepository) Purge(ctx context.Context, before time.Time) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stocked := make(map[uuid.UUID]bool)
+	for _, product := range r.store.products {
+		stocked[product.CategoryID] = true
+	}
+
+	var purgeable []uuid.UUID
+	for id, category := range r.store.categories {
+		ok := true
+		for categoryID := range r.store.categorySubtree(category) {
+			deletedAt := r.store.categories[categoryID].DeletedAt
+			if deletedAt == nil || !deletedAt.Before(before) || stocked[categoryID] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			purgeable = append(purgeable, id)
+		}
+	}
+
+	for _, id := range purgeable {
+		r.store.deleteCategory(id)
+	}
+	return len(purgeable), nil
+}
+
+// CreateAttribute defines an attribute on a category whose name is not yet
+// defined on the category, its ancestors or its descendants
+func (r *MemoryCategoryRepository) CreateAttribute(ctx context.Context, attribute *models.AttributeDefinition) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	category, ok := r.store.categories[attribute.CategoryID]
+	if !ok || category.DeletedAt != nil {
+		return foreignKeyError("category_attributes", "category_id")
+	}
+
+	for categoryID, definitions := range r.store.attributes {
+		other := r.store.categories[categoryID]
+		if categoryID != category.ID && !strings.HasPrefix(category.Path, other.Path+"/") &&
+			!strings.HasPrefix(other.Path, category.Path+"/") {
+			continue
+		}
+		if _, ok := models.AttributeSchema(definitions).Attribute(attribute.Name); ok {
+			return ErrDuplicateAttribute
+		}
+	}
+
+	attribute.CreatedAt = time.Now()
+	attribute.UpdatedAt = time.Now()
+
+	stored := *attribute
+	stored.Values = slices.Clone(attribute.Values)
+	r.store.attributes[category.ID] = append(r.store.attributes[category.ID], stored)
+	return nil
+}
+
+// GetAttributeSchema returns the attributes defined on a category and its
+// ancestors. A missing category has an empty schema.
+func (r *MemoryCategoryRepository) GetAttributeSchema(ctx context.Context, categoryID uuid.UUID) (models.AttributeSchema, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	schema := models.AttributeSchema{}
+	category, ok := r.store.categories[categoryID]
+	if !ok || category.DeletedAt != nil {
+		return schema, nil
+	}
+
+	for id, definitions := range r.store.attributes {
+		ancestor := r.store.categories[id]
+		if ancestor.DeletedAt != nil || (id != categoryID && !strings.HasPrefix(category.Path, ancestor.Path+"/")) {
+			continue
+		}
+		for _, definition := range definitions {
+			definition.Values = slices.Clone(definition.Values)
+			schema = append(schema, definition)
+		}
+	}
+	sort.Slice(schema, func(i, j int) bool {
+		return schema[i].Name < schema[j].Name
+	})
+	return schema, nil
+}
+
+// DeleteAttribute removes an attribute definition and the values stored for
+// it on the products of the category and its subcategories
+func (r *MemoryCategoryRepository) DeleteAttribute(ctx context.Context, categoryID uuid.UUID, name string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	definitions := r.store.attributes[categoryID]
+	kept := slices.DeleteFunc(slices.Clone(definitions), func(definition models.AttributeDefinition) bool {
+		return definition.Name == name
+	})
+	if len(kept) == len(definitions) {
+		return sql.ErrNoRows
+	}
+	r.store.attributes[categoryID] = kept
+
+	subtree := r.store.categorySubtree(r.store.categories[categoryID])
+	for id, product := range r.store.products {
+		if _, ok := product.Attributes[name]; !ok || !subtree[product.CategoryID] {
+			continue
+		}
+		product.Attributes = maps.Clone(product.Attributes)
+		delete(product.Attributes, name)
+		product.UpdatedAt = time.Now()
+		r.store.products[id] = product
+	}
+	return nil
+}
+
+// MemoryProductRepository is a thread-safe in-memory ProductRepository
+type MemoryProductRepository struct {
+	store *memoryStore
+}
+
+func (r *MemoryProductRepository) Create(ctx context.Context, product *models.Product) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if category, ok := r.store.categories[product.CategoryID]; !ok || category.DeletedAt != nil {
+		return foreignKeyError("products", "category_id")
+	}
+
+	product.ID = uuid.New()
+	product.CreatedAt = time.Now()
+	product.UpdatedAt = time.Now()
+	if product.Price.Currency == "" {
+		product.Price.Currency = models.DefaultCurrency
+	}
+
+	stored := *product
+	stored.Category = models.Category{}
+	stored.Attributes = maps.Clone(product.Attributes)
+	r.store.products[product.ID] = stored
+	r.store.recordPriceChange(models.PriceChange{
+		ProductID: product.ID,
+		NewPrice:  product.Price,
+		Source:    models.PriceSourceCreated,
+		ChangedBy: actorFromContext(ctx),
+		ChangedAt: product.CreatedAt,
+	})
+	if product.Stock > 0 {
+		r.store.adjustStock(product.ID, nil, product.Stock, models.MovementInitial, actorFromContext(ctx), product.CreatedAt)
+	}
+	r.store.syncStockAlert(product.ID, product.CreatedAt)
+	return nil
+}
+
+func (r *MemoryProductRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Product, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	product, ok := r.store.products[id]
+	if !ok || product.DeletedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+	product = r.store.productWithCategory(product)
+	product.Variants = r.store.productVariants(id)
+	product.SetPriceRange(product.Variants)
+	product.RegularPrice = r.store.regularPrice(product)
+	return &product, nil
+}
+
+// Update changes the fields set in update
+func (r *MemoryProductRepository) Update(ctx context.Context, id uuid.UUID, update models.ProductUpdate) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, ok := r.store.products[id]
+	if !ok || stored.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+
+	if update.CategoryID != nil {
+		if category, ok := r.store.categories[*update.CategoryID]; !ok || category.DeletedAt != nil {
+			return foreignKeyError("products", "category_id")
+		}
+		stored.CategoryID = *update.CategoryID
+	}
+	if update.Name != nil {
+		stored.Name = *update.Name
+	}
+	if update.Description != nil {
+		stored.Description = *update.Description
+	}
+	oldPrice, oldStock := stored.Price, stored.Stock
+	if update.Price != nil {
+		stored.Price = *update.Price
+	}
+	if update.Stock != nil {
+		if err := r.store.checkStockChange(stored, nil, *update.Stock-oldStock); err != nil {
+			return err
+		}
+		stored.Stock = *update.Stock
+	}
+	if update.ImageURL != nil {
+		stored.ImageURL = *update.ImageURL
+	}
+	if update.Attributes != nil {
+		stored.Attributes = maps.Clone(*update.Attributes)
+	}
+	stored.UpdatedAt = time.Now()
+	r.store.products[id] = stored
+	if stored.Price != oldPrice {
+		r.store.recordPriceChange(models.PriceChange{
+			ProductID: id,
+			OldPrice:  &oldPrice,
+			NewPrice:  stored.Price,
+			Source:    models.PriceSourceUpdated,
+			ChangedBy: actorFromContext(ctx),
+			ChangedAt: stored.UpdatedAt,
+		})
+	}
+	if stored.Stock != oldStock {
+		r.store.adjustStock(id, nil, stored.Stock-oldStock, models.MovementAdjustment, actorFromContext(ctx), stored.UpdatedAt)
+	}
+	r.store.syncStockAlert(id, stored.UpdatedAt)
+	return nil
+}
+
+// Upsert creates or replaces products by ID. Every product is checked before
+// any is written, so a failed batch leaves the store unchanged.
+func (r *MemoryProductRepository) Upsert(ctx context.Context, products []models.Product) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	now := time.Now()
+	written := make([]models.Product, len(products))
+	// pending holds the products written earlier in the batch, which later
+	// entries with the same ID replace again
+	pending := make(map[uuid.UUID]models.Product, len(products))
+	var changes []models.PriceChange
+	// stockChanges holds the movements to record once the batch is checked
+	var stockChanges []models.InventoryMovement
+	// takeable holds the stock each replaced product can still give up once
+	// the earlier entries of the batch have changed it
+	takeable := make(map[uuid.UUID]int)
+	created := 0
+	for i, product := range products {
+		if product.ID == uuid.Nil {
+			product.ID = uuid.New()
+		}
+		if product.Price.Currency == "" {
+			product.Price.Currency = models.DefaultCurrency
+		}
+		if category, ok := r.store.categories[product.CategoryID]; !ok || category.DeletedAt != nil {
+			return 0, &BatchError{Index: i, Err: foreignKeyError("products", "category_id")}
+		}
+
+		stored, exists := pending[product.ID]
+		if !exists {
+			stored, exists = r.store.products[product.ID]
+		}
+		change := models.PriceChange{
+			ProductID: product.ID,
+			NewPrice:  product.Price,
+			Source:    models.PriceSourceImported,
+			ChangedBy: actorFromContext(ctx),
+			ChangedAt: now,
+		}
+		switch {
+		case !exists:
+			product.CreatedAt = now
+			created++
+			changes = append(changes, change)
+			stockChanges = append(stockChanges, models.InventoryMovement{
+				ProductID: product.ID, Type: models.MovementInitial, OnHandChange: product.Stock,
+			})
+		case stored.DeletedAt != nil:
+			return 0, &BatchError{Index: i, Err: ErrProductDeleted}
+		default:
+			product.CreatedAt = stored.CreatedAt
+			variants := r.store.productVariants(product.ID)
+			for _, variant := range variants {
+				if variant.Price != nil && stored.Price.Currency != product.Price.Currency {
+					return 0, &BatchError{Index: i, Err: ErrVariantCurrency}
+				}
+			}
+			if len(variants) > 0 {
+				product.Stock = stored.Stock
+			}
+			if _, ok := takeable[product.ID]; !ok {
+				takeable[product.ID] = r.store.takeableStock(product.ID, nil)
+			}
+			if stockChange := product.Stock - stored.Stock; takeable[product.ID]+stockChange < 0 {
+				return 0, &BatchError{Index: i, Err: &InsufficientStockError{ProductID: product.ID,
+					ProductName: stored.Name, Requested: -stockChange, Available: takeable[product.ID]}}
+			}
+			takeable[product.ID] += product.Stock - stored.Stock
+			stockChanges = append(stockChanges, models.InventoryMovement{
+				ProductID: product.ID, Type: models.MovementAdjustment, OnHandChange: product.Stock - stored.Stock,
+			})
+			if stored.Price != product.Price {
+				oldPrice := stored.Price
+				change.OldPrice = &oldPrice
+				changes = append(changes, change)
+			}
+		}
+		product.UpdatedAt = now
+		product.Category = models.Category{}
+		product.MinPrice, product.MaxPrice, product.Variants = nil, nil, nil
+		product.Attributes = maps.Clone(product.Attributes)
+		written[i] = product
+		pending[product.ID] = product
+	}
+
+	for i, product := range written {
+		r.store.products[product.ID] = product
+		products[i].ID = product.ID
+		products[i].Price.Currency = product.Price.Currency
+		products[i].Stock = product.Stock
+		products[i].CreatedAt = product.CreatedAt
+		products[i].UpdatedAt = product.UpdatedAt
+	}
+	for _, change := range changes {
+		r.store.recordPriceChange(change)
+	}
+	for _, change := range stockChanges {
+		if change.OnHandChange != 0 {
+			r.store.adjustStock(change.ProductID, nil, change.OnHandChange, change.Type, actorFromContext(ctx), now)
+		}
+	}
+	for _, product := range written {
+		r.store.syncStockAlert(product.ID, now)
+	}
+	return created, nil
+}
+
+// List returns one page of products matching filter
+func (r *MemoryProductRepository) List(ctx context.Context, filter models.ProductFilter) (*models.ProductPage, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	products := []models.Product{}
+	for _, product := range r.store.productsMatching(filter) {
+		if filter.Cursor != nil && !filter.Cursor.After(product) {
+			continue
+		}
+		products = append(products, product)
+	}
+	sort.Slice(products, func(i, j int) bool {
+		return models.ProductLess(filter.Sort, products[i], products[j])
+	})
+
+	limit := productPageSize(filter.Limit)
+	if len(products) > limit+1 {
+		products = products[:limit+1]
+	}
+	return newProductPage(filter.Sort, products, limit), nil
+}
+
+// GetFacets counts the products matching filter per category (including
+// descendants), per price bucket and by availability
+func (r *MemoryProductRepository) GetFacets(ctx context.Context, filter models.ProductFilter, bucketEdges []models.Money) (*models.ProductFacets, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	facets := &models.ProductFacets{
+		Categories:   []models.CategoryFacet{},
+		PriceBuckets: models.NewPriceBuckets(bucketEdges),
+	}
+	counts := make(map[uuid.UUID]int)
+	for _, product := range r.store.productsMatching(filter) {
+		facets.Total++
+		if product.Stock > 0 {
+			facets.Availability.InStock++
+		} else {
+			facets.Availability.OutOfStock++
+		}
+
+		if i := models.PriceBucketIndex(bucketEdges, product.Price); i >= 0 {
+			facets.PriceBuckets[i].ProductCount++
+		}
+
+		for _, category := range r.store.categories {
+			if category.DeletedAt != nil {
+				continue
+			}
+			if category.ID == product.CategoryID || strings.HasPrefix(product.Category.Path, category.Path+"/") {
+				counts[category.ID]++
+			}
+		}
+	}
+
+	for id, count := range counts {
+		category := r.store.categories[id]
+		facets.Categories = append(facets.Categories, models.CategoryFacet{
+			CategoryID:   category.ID,
+			CategoryName: category.Name,
+			Path:         category.Path,
+			Level:        category.Level,
+			ProductCount: count,
+		})
+	}
+	sort.Slice(facets.Categories, func(i, j int) bool {
+		return facets.Categories[i].Path < facets.Categories[j].Path
+	})
+	return facets, nil
+}
+
+// Search finds products whose name or description match every term of query,
+// treating each term as a prefix. Unlike Postgres there is no stemming; name
+// matches are still ranked above description matches.
+func (r *MemoryProductRepository) Search(ctx context.Context, query string, limit int) ([]models.ProductSearchResult, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	results := []models.ProductSearchResult{}
+	terms := models.SearchTerms(query)
+	if len(terms) == 0 {
+		return results, nil
+	}
+
+	for _, product := range r.store.products {
+		if product.DeletedAt != nil {
+			continue
+		}
+		nameWords := searchWords(product.Name)
+		descriptionWords := searchWords(product.Description)
+
+		rank := 0.0
+		for _, term := range terms {
+			inName := slices.ContainsFunc(nameWords, func(word string) bool { return strings.HasPrefix(word, term) })
+			inDescription := slices.ContainsFunc(descriptionWords, func(word string) bool { return strings.HasPrefix(word, term) })
+			if !inName && !inDescription {
+				rank = 0
+				break
+			}
+			if inName {
+				rank += 1
+			}
+			if inDescription {
+				rank += 0.4
+			}
+		}
+		if rank == 0 {
+			continue
+		}
+
+		results = append(results, models.ProductSearchResult{
+			Product: r.store.listedProduct(product),
+			Rank:    rank / float64(len(terms)),
+			Highlights: models.SearchHighlights{
+				Name:        highlightTerms(product.Name, terms),
+				Description: highlightTerms(product.Description, terms),
+			},
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return models.ProductLess(models.ProductSortName, results[i].Product, results[j].Product)
+	})
+	if limit = searchLimit(limit); len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func isSearchWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// searchWords returns the lower-cased words of text
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !isSearchWordRune(r) })
+}
+
+// highlightTerms HTML-escapes text and wraps every word of it that starts with
+// one of terms in highlight markers
+func highlightTerms(text string, terms []string) string {
+	var b strings.Builder
+	start := -1
+	flush := func(end int) {
+		word := text[start:end]
+		lower := strings.ToLower(word)
+		if slices.ContainsFunc(terms, func(term string) bool { return strings.HasPrefix(lower, term) }) {
+			b.WriteString(models.HighlightStart + html.EscapeString(word) + models.HighlightStop)
+		} else {
+			b.WriteString(html.EscapeString(word))
+		}
+	}
+
+	for i, r := range text {
+		if isSearchWordRune(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			flush(i)
+			start = -1
+		}
+		b.WriteString(html.EscapeString(string(r)))
+	}
+	if start >= 0 {
+		flush(len(text))
+	}
+	return b.String()
+}
+
+func (r *MemoryProductRepository) GetByCategory(ctx context.Context, categoryID uuid.UUID) ([]models.Product, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	var products []models.Product
+	for _, product := range r.store.products {
+		if product.CategoryID == categoryID && product.DeletedAt == nil {
+			products = append(products, r.store.listedProduct(product))
+		}
+	}
+	sort.Slice(products, func(i, j int) bool {
+		return products[i].Name < products[j].Name
+	})
+	return products, nil
+}
+
+// GetAveragePriceByCategory returns average price for a category
+func (r *MemoryProductRepository) GetAveragePriceByCategory(ctx context.Context, categoryID uuid.UUID) (*models.CategoryPrice, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	category, ok := r.store.categories[categoryID]
+	if !ok || category.DeletedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+
+	categoryPrice := models.CategoryPrice{
+		CategoryID:   category.ID,
+		CategoryName: category.Name,
+		AveragePrice: models.NewMoney(0, models.DefaultCurrency),
+	}
+
+	var sum int64
+	for _, product := range r.store.products {
+		if product.CategoryID == categoryID && product.DeletedAt == nil {
+			sum += product.Price.Amount
+			categoryPrice.AveragePrice.Currency = product.Price.Currency
+			categoryPrice.ProductCount++
+		}
+	}
+	if categoryPrice.ProductCount > 0 {
+		categoryPrice.AveragePrice.Amount = int64(math.Round(float64(sum) / float64(categoryPrice.ProductCount)))
+	}
+	return &categoryPrice, nil
+}
+
+func (r *MemoryProductRepository) GetCategoryStats(ctx context.Context, categoryID uuid.UUID, currency string, recursive bool) (*models.CategoryStats, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	category, ok := r.store.categories[categoryID]
+	if !ok || category.DeletedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+
+	stats := models.CategoryStats{
+		CategoryID:      category.ID,
+		CategoryName:    category.Name,
+		Recursive:       recursive,
+		TotalStockValue: models.NewMoney(0, currency),
+	}
+	stats.Currency = stats.TotalStockValue.Currency
+
+	scope := map[uuid.UUID]bool{category.ID: true}
+	if recursive {
+		scope = r.store.categorySubtree(category)
+	}
+
+	var prices []int64
+	var sum int64
+	for _, product := range r.store.products {
+		if !scope[product.CategoryID] || product.Price.Currency != stats.Currency || product.DeletedAt != nil {
+			continue
+		}
+		prices = append(prices, product.Price.Amount)
+		sum += product.Price.Amount
+
+		variants := r.store.productVariants(product.ID)
+		if len(variants) == 0 {
+			stats.TotalStockValue.Amount += product.Price.Amount * int64(product.Stock)
+		}
+		for _, variant := range variants {
+			stats.TotalStockValue.Amount += variant.UnitPrice(product.Price).Amount * int64(variant.Stock)
+		}
+	}
+
+	stats.ProductCount = len(prices)
+	if len(prices) == 0 {
+		return &stats, nil
+	}
+
+	slices.Sort(prices)
+	average := int64(math.Round(float64(sum) / float64(len(prices))))
+	median := prices[len(prices)/2]
+	if len(prices)%2 == 0 {
+		median = int64(math.Round(float64(prices[len(prices)/2-1]+median) / 2))
+	}
+	stats.SetPrices(&average, &prices[0], &prices[len(prices)-1], &median)
+	return &stats, nil
+}
+
+func (r *MemoryProductRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for _, items := range r.store.orderItems {
+		for _, item := range items {
+			if item.ProductID == id {
+				return ErrProductInUse
+			}
+		}
+	}
+
+	r.store.deleteProduct(id)
+	return nil
+}
+
+// SoftDelete marks a product deleted, hiding it from listings and new orders
+// while existing orders keep referring to it. It is taken out of carts.
+func (r *MemoryProductRepository) SoftDelete(ctx context.Context, id uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	product, ok := r.store.products[id]
+	if !ok || product.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+	now := time.Now()
+	product.DeletedAt = &now
+	r.store.products[id] = product
+	r.store.removeFromCarts(id)
+	return nil
+}
+
+// Restore undoes SoftDelete. A product in a deleted category cannot be restored.
+func (r *MemoryProductRepository) Restore(ctx context.Context, id uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	product, ok := r.store.products[id]
+	if !ok || product.DeletedAt == nil {
+		return sql.ErrNoRows
+	}
+	if r.store.categories[product.CategoryID].DeletedAt != nil {
+		return ErrParentDeleted
+	}
+	product.DeletedAt = nil
+	product.UpdatedAt = time.Now()
+	r.store.products[id] = product
+	return nil
+}
+
+// GetDeleted returns the soft-deleted products, most recently deleted first
+func (r *MemoryProductRepository) GetDeleted(ctx context.Context) ([]models.Product, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	products := []models.Product{}
+	for _, product := range r.store.products {
+		if product.DeletedAt != nil {
+			products = append(products, r.store.productWithCategory(product))
+		}
+	}
+	sort.Slice(products, func(i, j int) bool {
+		return recentlyDeletedFirst(products[i].DeletedAt, products[j].DeletedAt, products[i].ID, products[j].ID)
+	})
+	return products, nil
+}
+
+// Purge permanently deletes products soft-deleted before the cutoff. Products
+// that orders reference are kept so that the order history survives.
+func (r *MemoryProductRepository) Purge(ctx context.Context, before time.Time) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	ordered := make(map[uuid.UUID]bool)
+	for _, items := range r.store.orderItems {
+		for _, item := range items {
+			ordered[item.ProductID] = true
+		}
+	}
+
+	purged := 0
+	for id, product := range r.store.products {
+		if product.DeletedAt != nil && product.DeletedAt.Before(before) && !ordered[id] {
+			r.store.deleteProduct(id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// MemoryVariantRepository is a thread-safe in-memory VariantRepository
+type MemoryVariantRepository struct {
+	store *memoryStore
+}
+
+func (r *MemoryVariantRepository) Create(ctx context.Context, variant *models.ProductVariant) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	product, ok := r.store.products[variant.ProductID]
+	if !ok || product.DeletedAt != nil {
+		return foreignKeyError("product_variants", "product_id")
+	}
+	if r.store.skuTaken(variant.SKU, uuid.Nil) {
+		return ErrDuplicateSKU
+	}
+	writeOff := len(r.store.productVariants(variant.ProductID)) == 0 && product.Stock > 0
+	if writeOff {
+		if err := r.store.checkStockChange(product, nil, -product.Stock); err != nil {
+			return err
+		}
+	}
+
+	variant.ID = uuid.New()
+	variant.CreatedAt = time.Now()
+	variant.UpdatedAt = time.Now()
+
+	// Once a product has variants its stock is theirs, so the stock it held
+	// of its own is written off
+	actor := actorFromContext(ctx)
+	if writeOff {
+		r.store.adjustStock(product.ID, nil, -product.Stock, models.MovementAdjustment, actor, variant.CreatedAt)
+	}
+	r.store.variants[variant.ID] = *variant
+	if variant.Stock > 0 {
+		variantID := variant.ID
+		r.store.adjustStock(product.ID, &variantID, variant.Stock, models.MovementInitial, actor, variant.CreatedAt)
+	}
+	r.store.syncProductStock(variant.ProductID, variant.UpdatedAt)
+	return nil
+}
+
+func (r *MemoryVariantRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.ProductVariant, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	variant, ok := r.store.variants[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &variant, nil
+}
+
+// GetByProduct returns a product's variants ordered by SKU
+func (r *MemoryVariantRepository) GetByProduct(ctx context.Context, productID uuid.UUID) ([]models.ProductVariant, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	return r.store.productVariants(productID), nil
+}
+
+// Update replaces a variant's SKU, options, price, stock and image
+func (r *MemoryVariantRepository) Update(ctx context.Context, variant *models.ProductVariant) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, ok := r.store.variants[variant.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if r.store.skuTaken(variant.SKU, variant.ID) {
+		return ErrDuplicateSKU
+	}
+	if err := r.store.checkStockChange(r.store.products[stored.ProductID], &stored, variant.Stock-stored.Stock); err != nil {
+		return err
+	}
+
+	variant.ProductID = stored.ProductID
+	variant.CreatedAt = stored.CreatedAt
+	variant.UpdatedAt = time.Now()
+
+	r.store.variants[variant.ID] = *variant
+	if change := variant.Stock - stored.Stock; change != 0 {
+		variantID := variant.ID
+		r.store.adjustStock(variant.ProductID, &variantID, change, models.MovementAdjustment,
+			actorFromContext(ctx), variant.UpdatedAt)
+	}
+	r.store.syncProductStock(variant.ProductID, variant.UpdatedAt)
+	return nil
+}
+
+// Delete removes a variant and takes it out of carts. Variants that orders
+// reference are kept so that the order history stays intact.
+func (r *MemoryVariantRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	variant, ok := r.store.variants[id]
+	if !ok {
+		return nil
+	}
+	for _, items := range r.store.orderItems {
+		for _, item := range items {
+			if item.VariantID != nil && *item.VariantID == id {
+				return ErrVariantInUse
+			}
+		}
+	}
+
+	delete(r.store.variants, id)
+	r.store.deleteInventory(func(_ uuid.UUID, variantID *uuid.UUID) bool {
+		return variantID != nil && *variantID == id
+	})
+	for cartID, items := range r.store.cartItems {
+		r.store.cartItems[cartID] = slices.DeleteFunc(items, func(item models.CartItem) bool {
+			return item.VariantID != nil && *item.VariantID == id
+		})
+	}
+	r.store.syncProductStock(variant.ProductID, time.Now())
+	return nil
+}
+
+// skuTaken reports whether a variant other than except uses sku. Callers must hold the read lock.
+func (s *memoryStore) skuTaken(sku string, except uuid.UUID) bool {
+	for id, variant := range s.variants {
+		if variant.SKU == sku && id != except {
+			return true
+		}
+	}
+	return false
+}
+
+// MemoryProductImageRepository is a thread-safe in-memory ProductImageRepository
+type MemoryProductImageRepository struct {
+	store *memoryStore
+}
+
+func (r *MemoryProductImageRepository) Create(ctx context.Context, image *models.ProductImage) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if product, ok := r.store.products[image.ProductID]; !ok || product.DeletedAt != nil {
+		return foreignKeyError("product_images", "product_id")
+	}
+
+	count := len(r.store.productImages(image.ProductID))
+	if count >= models.MaxProductImages {
+		return ErrTooManyImages
+	}
+
+	image.ID = uuid.New()
+	image.Position = count + 1
+	image.CreatedAt = time.Now()
+
+	r.store.images[image.ID] = *image
+	return nil
+}
+
+func (r *MemoryProductImageRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.ProductImage, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	image, ok := r.store.images[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &image, nil
+}
+
+// GetByProduct returns a product's images in display order
+func (r *MemoryProductImageRepository) GetByProduct(ctx context.Context, productID uuid.UUID) ([]models.ProductImage, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	return r.store.productImages(productID), nil
+}
+
+func (r *MemoryProductImageRepository) Reorder(ctx context.Context, productID uuid.UUID, ids []uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if _, ok := r.store.products[productID]; !ok {
+		return sql.ErrNoRows
+	}
+	if !sameImages(r.store.productImages(productID), ids) {
+		return ErrImageOrder
+	}
+
+	for i, id := range ids {
+		image := r.store.images[id]
+		image.Position = i + 1
+		r.store.images[id] = image
+	}
+	return nil
+}
+
+func (r *MemoryProductImageRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	deleted, ok := r.store.images[id]
+	if !ok {
+		return nil
+	}
+	delete(r.store.images, id)
+
+	for imageID, image := range r.store.images {
+		if image.ProductID == deleted.ProductID && image.Position > deleted.Position {
+			image.Position--
+			r.store.images[imageID] = image
+		}
+	}
+	return nil
+}
+
+// MemoryPriceRepository is a thread-safe in-memory PriceRepository
+type MemoryPriceRepository struct {
+	store *memoryStore
+}
+
+func (r *MemoryPriceRepository) GetHistory(ctx context.Context, productID uuid.UUID) ([]models.PriceChange, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	return append([]models.PriceChange{}, r.store.priceHistory[productID]...), nil
+}
+
+func (r *MemoryPriceRepository) CreateSchedule(ctx context.Context, schedule *models.PriceSchedule) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if product, ok := r.store.products[schedule.ProductID]; !ok || product.DeletedAt != nil {
+		return foreignKeyError("price_schedules", "product_id")
+	}
+	for _, other := range r.store.productSchedules(schedule.ProductID) {
+		if other.IsOpen() && other.Overlaps(*schedule) {
+			return ErrScheduleOverlap
+		}
+	}
+
+	schedule.ID = uuid.New()
+	schedule.Status = models.PriceSchedulePending
+	schedule.CreatedBy = actorFromContext(ctx)
+	schedule.CreatedAt = time.Now()
+	schedule.UpdatedAt = schedule.CreatedAt
+	schedule.PreviousPrice = nil
+	r.store.priceSchedules[schedule.ID] = *schedule
+	return nil
+}
+
+func (r *MemoryPriceRepository) GetSchedule(ctx context.Context, id uuid.UUID) (*models.PriceSchedule, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	schedule, ok := r.store.priceSchedules[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &schedule, nil
+}
+
+func (r *MemoryPriceRepository) GetSchedules(ctx context.Context, productID uuid.UUID) ([]models.PriceSchedule, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	return r.store.productSchedules(productID), nil
+}
+
+// CancelSchedule cancels a pending schedule, or ends an active one now and
+// restores the price it replaced
+func (r *MemoryPriceRepository) CancelSchedule(ctx context.Context, id uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	schedule, ok := r.store.priceSchedules[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	now := time.Now()
+	switch schedule.Status {
+	case models.PriceSchedulePending:
+		schedule.Status = models.PriceScheduleCancelled
+		schedule.UpdatedAt = now
+		r.store.priceSchedules[id] = schedule
+	case models.PriceScheduleActive:
+		r.store.endPriceSchedule(schedule, now)
+	default:
+		return ErrScheduleClosed
+	}
+	return nil
+}
+
+// ApplySchedules ends the active schedules due by now and then starts the
+// pending ones, so that a sale ending as another starts hands the price over
+func (r *MemoryPriceRepository) ApplySchedules(ctx context.Context, now time.Time) (started, ended int, err error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, 0, err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	var ending, starting []models.PriceSchedule
+	for _, schedule := range r.store.priceSchedules {
+		switch {
+		case schedule.Status == models.PriceScheduleActive && schedule.EndsAt != nil && !schedule.EndsAt.After(now):
+			ending = append(ending, schedule)
+		case schedule.Status == models.PriceSchedulePending && !schedule.StartsAt.After(now):
+			starting = append(starting, schedule)
+		}
+	}
+	sortSchedules(ending, func(schedule models.PriceSchedule) time.Time { return *schedule.EndsAt })
+	sortSchedules(starting, func(schedule models.PriceSchedule) time.Time { return schedule.StartsAt })
+
+	for _, schedule := range ending {
+		r.store.endPriceSchedule(schedule, now)
+		ended++
+	}
+	for _, schedule := range starting {
+		if schedule.EndsAt != nil && !schedule.EndsAt.After(now) {
+			schedule.Status = models.PriceScheduleExpired
+			schedule.UpdatedAt = now
+			r.store.priceSchedules[schedule.ID] = schedule
+			continue
+		}
+		if r.store.startPriceSchedule(schedule, now) {
+			started++
+		}
+	}
+	return started, ended, nil
+}
+
+// startPriceSchedule sets the product's price to the schedule's, keeping the
+// price it replaces, and reports whether it did. A schedule whose currency no
+// longer matches the product's is cancelled instead. Callers must hold the write lock.
+func (s *memoryStore) startPriceSchedule(schedule models.PriceSchedule, now time.Time) bool {
+	product := s.products[schedule.ProductID]
+	previous := product.Price
+	schedule.UpdatedAt = now
+	if previous.Currency != schedule.Price.Currency {
+		schedule.Status = models.PriceScheduleCancelled
+		s.priceSchedules[schedule.ID] = schedule
+		return false
+	}
+
+	product.Price = schedule.Price
+	product.UpdatedAt = now
+	s.products[product.ID] = product
+
+	schedule.Status = models.PriceScheduleCompleted
+	if schedule.EndsAt != nil {
+		schedule.Status = models.PriceScheduleActive
+	}
+	schedule.PreviousPrice = &previous
+	s.priceSchedules[schedule.ID] = schedule
+	if previous != schedule.Price {
+		s.recordPriceChange(models.PriceChange{
+			ProductID:  schedule.ProductID,
+			OldPrice:   &previous,
+			NewPrice:   schedule.Price,
+			Source:     models.PriceSourceScheduled,
+			ScheduleID: &schedule.ID,
+			ChangedBy:  schedule.CreatedBy,
+			ChangedAt:  now,
+		})
+	}
+	return true
+}
+
+// endPriceSchedule completes an active schedule, restoring the price it
+// replaced unless the price was changed again while it ran. Callers must hold the write lock.
+func (s *memoryStore) endPriceSchedule(schedule models.PriceSchedule, now time.Time) {
+	if schedule.EndsAt == nil || schedule.EndsAt.After(now) {
+		schedule.EndsAt = &now
+	}
+	schedule.Status = models.PriceScheduleCompleted
+	schedule.UpdatedAt = now
+	s.priceSchedules[schedule.ID] = schedule
+
+	product := s.products[schedule.ProductID]
+	current := product.Price
+	if schedule.PreviousPrice == nil || current != schedule.Price || current == *schedule.PreviousPrice {
+		return
+	}
+
+	product.Price = *schedule.PreviousPrice
+	product.UpdatedAt = now
+	s.products[product.ID] = product
+	s.recordPriceChange(models.PriceChange{
+		ProductID:  schedule.ProductID,
+		OldPrice:   &current,
+		NewPrice:   *schedule.PreviousPrice,
+		Source:     models.PriceSourceScheduleEnd,
+		ScheduleID: &schedule.ID,
+		ChangedBy:  schedule.CreatedBy,
+		ChangedAt:  now,
+	})
+}
+
+// MemoryInventoryRepository is a thread-safe in-memory InventoryRepository
+type MemoryInventoryRepository struct {
+	store *memoryStore
+}
+
+func (r *MemoryInventoryRepository) CreateWarehouse(ctx context.Context, warehouse *models.Warehouse) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if r.store.warehouseCodeTaken(warehouse.Code, uuid.Nil) {
+		return ErrDuplicateWarehouseCode
+	}
+
+	warehouse.ID = uuid.New()
+	warehouse.IsDefault = false
+	warehouse.CreatedAt = time.Now()
+	warehouse.UpdatedAt = time.Now()
+	r.store.warehouses[warehouse.ID] = storedWarehouse(*warehouse)
+	return nil
+}
+
+func (r *MemoryInventoryRepository) GetWarehouse(ctx context.Context, id uuid.UUID) (*models.Warehouse, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	warehouse, ok := r.store.warehouses[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	warehouse = storedWarehouse(warehouse)
+	return &warehouse, nil
+}
+
+func (r *MemoryInventoryRepository) GetWarehouses(ctx context.Context) ([]models.Warehouse, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	warehouses := []models.Warehouse{}
+	for _, warehouse := range r.store.warehouses {
+		warehouses = append(warehouses, storedWarehouse(warehouse))
+	}
+	sort.Slice(warehouses, func(i, j int) bool {
+		if warehouses[i].Priority != warehouses[j].Priority {
+			return warehouses[i].Priority < warehouses[j].Priority
+		}
+		return warehouses[i].Code < warehouses[j].Code
+	})
+	return warehouses, nil
+}
+
+func (r *MemoryInventoryRepository) UpdateWarehouse(ctx context.Context, warehouse *models.Warehouse) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, ok := r.store.warehouses[warehouse.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	warehouse.IsDefault = stored.IsDefault
+	warehouse.CreatedAt = stored.CreatedAt
+
+	if !warehouse.Active {
+		if warehouse.IsDefault {
+			return ErrDefaultWarehouse
+		}
+		for key, level := range r.store.inventory {
+			if key.warehouseID == warehouse.ID && level.OnHand > 0 {
+				return ErrWarehouseNotEmpty
+			}
+		}
+	}
+	if r.store.warehouseCodeTaken(warehouse.Code, warehouse.ID) {
+		return ErrDuplicateWarehouseCode
+	}
+
+	warehouse.UpdatedAt = time.Now()
+	r.store.warehouses[warehouse.ID] = storedWarehouse(*warehouse)
+	return nil
+}
+
+// warehouseCodeTaken reports whether a warehouse other than except uses code. Callers must hold the read lock.
+func (s *memoryStore) warehouseCodeTaken(code string, except uuid.UUID) bool {
+	for id, warehouse := range s.warehouses {
+		if warehouse.Code == code && id != except {
+			return true
+		}
+	}
+	return false
+}
+
+// storedWarehouse copies a warehouse so that the store and its callers do not
+// share its location
+func storedWarehouse(warehouse models.Warehouse) models.Warehouse {
+	if warehouse.Location != nil {
+		location := *warehouse.Location
+		warehouse.Location = &location
+	}
+	return warehouse
+}
+
+// GetLevels returns the inventory levels matching filter ordered by warehouse
+// priority and code, then by product and variant
+func (r *MemoryInventoryRepository) GetLevels(ctx context.Context, filter models.InventoryFilter) ([]models.InventoryLevel, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	levels := []models.InventoryLevel{}
+	for key, level := range r.store.inventory {
+		if filter.WarehouseID != nil && key.warehouseID != *filter.WarehouseID {
+			continue
+		}
+		if filter.ProductID != nil && key.productID != *filter.ProductID {
+			continue
+		}
+		level.WarehouseCode = r.store.warehouses[key.warehouseID].Code
+		level.Available = level.OnHand - level.Reserved
+		levels = append(levels, level)
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		a, b := r.store.warehouses[levels[i].WarehouseID], r.store.warehouses[levels[j].WarehouseID]
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		if a.Code != b.Code {
+			return a.Code < b.Code
+		}
+		return inventoryItemLess(levels[i].ProductID, levels[i].VariantID, levels[j].ProductID, levels[j].VariantID)
+	})
+	return levels, nil
+}
+
+// Transfer moves available stock between two active warehouses, recording a
+// movement out of one and into the other under the transfer's ID
+func (r *MemoryInventoryRepository) Transfer(ctx context.Context, transfer *models.StockTransfer) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	product, ok := r.store.products[transfer.ProductID]
+	if !ok || product.DeletedAt != nil {
+		return foreignKeyError("inventory_movements", "product_id")
+	}
+	stockErr := &InsufficientStockError{ProductID: product.ID, ProductName: product.Name, Requested: transfer.Quantity}
+	if transfer.VariantID != nil {
+		variant, ok := r.store.variants[*transfer.VariantID]
+		if !ok || variant.ProductID != product.ID {
+			return foreignKeyError("inventory_movements", "variant_id")
+		}
+		stockErr.SKU = variant.SKU
+	}
+
+	from, fromOK := r.store.warehouses[transfer.FromWarehouseID]
+	to, toOK := r.store.warehouses[transfer.ToWarehouseID]
+	if !fromOK || !toOK {
+		return foreignKeyError("inventory_movements", "warehouse_id")
+	}
+	if !from.Active || !to.Active {
+		return ErrWarehouseInactive
+	}
+
+	level := r.store.inventory[levelKey(from.ID, product.ID, transfer.VariantID)]
+	if stockErr.Available = level.OnHand - level.Reserved; stockErr.Available < transfer.Quantity {
+		return stockErr
+	}
+
+	transfer.ID = uuid.New()
+	transfer.CreatedAt = time.Now()
+	if transfer.CreatedBy == "" {
+		transfer.CreatedBy = actorFromContext(ctx)
+	}
+
+	transferID := transfer.ID
+	movement := models.InventoryMovement{
+		WarehouseID:  from.ID,
+		ProductID:    product.ID,
+		VariantID:    transfer.VariantID,
+		Type:         models.MovementTransferOut,
+		OnHandChange: -transfer.Quantity,
+		TransferID:   &transferID,
+		Note:         transfer.Note,
+		CreatedBy:    transfer.CreatedBy,
+		CreatedAt:    transfer.CreatedAt,
+	}
+	r.store.moveStock(movement)
+
+	movement.WarehouseID = to.ID
+	movement.Type = models.MovementTransferIn
+	movement.OnHandChange = transfer.Quantity
+	r.store.moveStock(movement)
+	return nil
+}
+
+// Adjust changes the on-hand stock at an active warehouse and the stock total
+// of the product or variant by the same amount, recording the change in the
+// ledger under the adjustment's reason
+func (r *MemoryInventoryRepository) Adjust(ctx context.Context, adjustment *models.StockAdjustment) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	product, ok := r.store.products[adjustment.ProductID]
+	if !ok || product.DeletedAt != nil {
+		return foreignKeyError("inventory_movements", "product_id")
+	}
+	stockErr := &InsufficientStockError{ProductID: product.ID, ProductName: product.Name, Requested: -adjustment.Change}
+	var variant models.ProductVariant
+	if adjustment.VariantID != nil {
+		if variant, ok = r.store.variants[*adjustment.VariantID]; !ok || variant.ProductID != product.ID {
+			return foreignKeyError("inventory_movements", "variant_id")
+		}
+		stockErr.SKU = variant.SKU
+	}
+
+	warehouse, ok := r.store.warehouses[adjustment.WarehouseID]
+	if !ok {
+		return foreignKeyError("inventory_movements", "warehouse_id")
+	}
+	if !warehouse.Active {
+		return ErrWarehouseInactive
+	}
+
+	key := levelKey(warehouse.ID, product.ID, adjustment.VariantID)
+	level := r.store.inventory[key]
+	if stockErr.Available = level.OnHand - level.Reserved; stockErr.Available < -adjustment.Change {
+		return stockErr
+	}
+
+	adjustment.CreatedAt = time.Now()
+	if adjustment.CreatedBy == "" {
+		adjustment.CreatedBy = actorFromContext(ctx)
+	}
+	adjustment.ID = r.store.moveStock(models.InventoryMovement{
+		WarehouseID:  warehouse.ID,
+		ProductID:    product.ID,
+		VariantID:    adjustment.VariantID,
+		Type:         adjustment.Reason,
+		OnHandChange: adjustment.Change,
+		Note:         adjustment.Note,
+		CreatedBy:    adjustment.CreatedBy,
+		CreatedAt:    adjustment.CreatedAt,
+	})
+
+	if adjustment.VariantID != nil {
+		variant.Stock += adjustment.Change
+		variant.UpdatedAt = adjustment.CreatedAt
+		r.store.variants[variant.ID] = variant
+		r.store.syncProductStock(product.ID, adjustment.CreatedAt)
+	} else {
+		product.Stock += adjustment.Change
+		product.UpdatedAt = adjustment.CreatedAt
+		r.store.products[product.ID] = product
+		r.store.syncStockAlert(product.ID, adjustment.CreatedAt)
+	}
+
+	level = r.store.inventory[key]
+	adjustment.OnHand = level.OnHand
+	adjustment.Available = level.OnHand - level.Reserved
+	return nil
+}
+
+// GetMovements returns the movements matching filter, newest first
+func (r *MemoryInventoryRepository) GetMovements(ctx context.Context, filter models.InventoryFilter) ([]models.InventoryMovement, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	movements := []models.InventoryMovement{}
+	for i := len(r.store.movements) - 1; i >= 0 && len(movements) < filter.Limit; i-- {
+		movement := r.store.movements[i]
+		if filter.WarehouseID != nil && movement.WarehouseID != *filter.WarehouseID {
+			continue
+		}
+		if filter.ProductID != nil && movement.ProductID != *filter.ProductID {
+			continue
+		}
+		if filter.OrderID != nil && (movement.OrderID == nil || *movement.OrderID != *filter.OrderID) {
+			continue
+		}
+		movements = append(movements, movement)
+	}
+	return movements, nil
+}
+
+// Reconcile sums the ledger's movements per inventory level and per product
+// and variant, and compares the sums with the stored levels and stock totals
+func (r *MemoryInventoryRepository) Reconcile(ctx context.Context, productID *uuid.UUID) (*models.ReconciliationReport, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	matches := func(id uuid.UUID) bool {
+		return productID == nil || id == *productID
+	}
+
+	byKey := make(map[inventoryKey]*models.LevelReconciliation)
+	level := func(warehouseID, productID uuid.UUID, variantID *uuid.UUID) *models.LevelReconciliation {
+		key := levelKey(warehouseID, productID, variantID)
+		if _, ok := byKey[key]; !ok {
+			byKey[key] = &models.LevelReconciliation{
+				WarehouseID:   warehouseID,
+				WarehouseCode: r.store.warehouses[warehouseID].Code,
+				ProductID:     productID,
+				VariantID:     variantID,
+			}
+		}
+		return byKey[key]
+	}
+	for _, stored := range r.store.inventory {
+		if matches(stored.ProductID) {
+			reconciled := level(stored.WarehouseID, stored.ProductID, stored.VariantID)
+			reconciled.OnHand = stored.OnHand
+			reconciled.Reserved = stored.Reserved
+		}
+	}
+	ledgerStock := make(map[inventoryKey]int)
+	for _, movement := range r.store.movements {
+		if !matches(movement.ProductID) {
+			continue
+		}
+		reconciled := level(movement.WarehouseID, movement.ProductID, movement.VariantID)
+		reconciled.LedgerOnHand += movement.OnHandChange
+		reconciled.LedgerReserved += movement.ReservedChange
+		ledgerStock[levelKey(uuid.Nil, movement.ProductID, nil)] += movement.AvailableChange()
+		if movement.VariantID != nil {
+			ledgerStock[levelKey(uuid.Nil, movement.ProductID, movement.VariantID)] += movement.AvailableChange()
+		}
+	}
+
+	levels := make([]models.LevelReconciliation, 0, len(byKey))
+	for _, reconciled := range byKey {
+		levels = append(levels, *reconciled)
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		a, b := r.store.warehouses[levels[i].WarehouseID], r.store.warehouses[levels[j].WarehouseID]
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		if a.Code != b.Code {
+			return a.Code < b.Code
+		}
+		return inventoryItemLess(levels[i].ProductID, levels[i].VariantID, levels[j].ProductID, levels[j].VariantID)
+	})
+
+	// A product's total covers its variants, and its own stock written off
+	// when its first variant was added
+	stock := []models.StockReconciliation{}
+	for _, product := range r.store.products {
+		if product.DeletedAt != nil || !matches(product.ID) {
+			continue
+		}
+		stock = append(stock, models.StockReconciliation{
+			ProductID:   product.ID,
+			Name:        product.Name,
+			Stock:       product.Stock,
+			LedgerStock: ledgerStock[levelKey(uuid.Nil, product.ID, nil)],
+		})
+		for _, variant := range r.store.productVariants(product.ID) {
+			stock = append(stock, models.StockReconciliation{
+				ProductID:   product.ID,
+				VariantID:   &variant.ID,
+				Name:        product.Name,
+				SKU:         variant.SKU,
+				Stock:       variant.Stock,
+				LedgerStock: ledgerStock[levelKey(uuid.Nil, product.ID, &variant.ID)],
+			})
+		}
+	}
+	sort.SliceStable(stock, func(i, j int) bool {
+		return inventoryItemLess(stock[i].ProductID, stock[i].VariantID, stock[j].ProductID, stock[j].VariantID)
+	})
+	return models.NewReconciliationReport(levels, stock, time.Now()), nil
+}
+
+// inventoryItemLess orders products by ID and a product's own stock before
+// its variants, as the SQL repository does
+func inventoryItemLess(productA uuid.UUID, variantA *uuid.UUID, productB uuid.UUID, variantB *uuid.UUID) bool {
+	if productA != productB {
+		return productA.String() < productB.String()
+	}
+	if variantA == nil || variantB == nil {
+		return variantA == nil && variantB != nil
+	}
+	return variantA.String() < variantB.String()
+}
+
+// MemoryStockAlertRepository is a thread-safe in-memory StockAlertRepository
+type MemoryStockAlertRepository struct {
+	store *memoryStore
+}
+
+func (r *MemoryStockAlertRepository) GetThreshold(ctx context.Context, productID uuid.UUID) (*models.ReorderThreshold, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	product, ok := r.store.products[productID]
+	if !ok || product.DeletedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+	return r.store.reorderThreshold(product), nil
+}
+
+// SetProductThreshold sets a product's own threshold and opens or resolves
+// its alert against the threshold that now applies
+func (r *MemoryStockAlertRepository) SetProductThreshold(ctx context.Context, productID uuid.UUID, threshold *int) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	product, ok := r.store.products[productID]
+	if !ok || product.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+	if threshold != nil {
+		r.store.productThresholds[productID] = *threshold
+	} else {
+		delete(r.store.productThresholds, productID)
+	}
+	r.store.syncStockAlert(productID, time.Now())
+	return nil
+}
+
+// SetCategoryThreshold sets a category's threshold and opens or resolves the
+// alerts of the products of it and its subcategories against the thresholds
+// that now apply
+func (r *MemoryStockAlertRepository) SetCategoryThreshold(ctx context.Context, categoryID uuid.UUID, threshold *int) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	category, ok := r.store.categories[categoryID]
+	if !ok || category.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+	if threshold != nil {
+		r.store.categoryThresholds[categoryID] = *threshold
+	} else {
+		delete(r.store.categoryThresholds, categoryID)
+	}
+	r.store.syncCategoryStockAlerts(category, time.Now())
+	return nil
+}
+
+func (r *MemoryStockAlertRepository) GetAlerts(ctx context.Context, openOnly bool) ([]models.StockAlert, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	alerts := []models.StockAlert{}
+	for i := len(r.store.stockAlerts) - 1; i >= 0 && len(alerts) < models.MaxStockAlerts; i-- {
+		alert := r.store.stockAlerts[i]
+		if openOnly && !alert.IsOpen() {
+			continue
+		}
+		alerts = append(alerts, r.store.withProductName(alert))
+	}
+	return alerts, nil
+}
+
+// ClaimPending marks the pending alerts of products that are not deleted as notified
+func (r *MemoryStockAlertRepository) ClaimPending(ctx context.Context, at time.Time) ([]models.StockAlert, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	alerts := []models.StockAlert{}
+	for i := range r.store.stockAlerts {
+		alert := &r.store.stockAlerts[i]
+		if alert.NotifiedAt != nil || !alert.IsOpen() || r.store.products[alert.ProductID].DeletedAt != nil {
+			continue
+		}
+		notifiedAt := at
+		alert.NotifiedAt = &notifiedAt
+		alerts = append(alerts, r.store.withProductName(*alert))
+	}
+	return alerts, nil
+}
+
+func (r *MemoryStockAlertRepository) ReleaseAlert(ctx context.Context, id uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for i := range r.store.stockAlerts {
+		if r.store.stockAlerts[i].ID == id {
+			r.store.stockAlerts[i].NotifiedAt = nil
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// withProductName fills in the name of an alert's product as the SQL queries
+// join it. Callers must hold the read lock.
+func (s *memoryStore) withProductName(alert models.StockAlert) models.StockAlert {
+	alert.ProductName = s.products[alert.ProductID].Name
+	return alert
+}
+
+// MemoryOrderRepository is a thread-safe in-memory OrderRepository
+type MemoryOrderRepository struct {
+	store *memoryStore
+}
+
+func (r *MemoryOrderRepository) Create(ctx context.Context, order *models.Order) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if _, ok := r.store.customers[order.CustomerID]; !ok {
+		return foreignKeyError("orders", "customer_id")
+	}
+	// Check every line before touching stock so a rejected order reserves nothing
+	requested := make(map[uuid.UUID]int)
+	taken := make(map[inventoryKey]int)
+	allocations := make([][]models.OrderAllocation, len(order.Items))
+	for i, item := range order.Items {
+		product, ok := r.store.products[item.ProductID]
+		if !ok {
+			return foreignKeyError("order_items", "product_id")
+		}
+		if product.DeletedAt != nil {
+			// A deleted product has nothing left to sell
+			product.Stock = 0
+		}
+		requested[item.ProductID] += item.Quantity
+		stockErr := &InsufficientStockError{
+			ProductID:   product.ID,
+			ProductName: product.Name,
+			Requested:   item.Quantity,
+			Available:   product.Stock - (requested[item.ProductID] - item.Quantity),
+		}
+		if product.Stock < requested[item.ProductID] {
+			return stockErr
+		}
+
+		if item.VariantID != nil {
+			variant, ok := r.store.variants[*item.VariantID]
+			if !ok || variant.ProductID != item.ProductID {
+				return foreignKeyError("order_items", "variant_id")
+			}
+			requested[variant.ID] += item.Quantity
+			stockErr.SKU = variant.SKU
+			stockErr.Available = variant.Stock - (requested[variant.ID] - item.Quantity)
+			if variant.Stock < requested[variant.ID] {
+				return stockErr
+			}
+		}
+
+		if allocations[i] = r.store.allocateItem(item, order.ShipTo, taken); allocations[i] == nil {
+			return stockErr
+		}
+	}
+
+	order.ID = uuid.New()
+	order.CreatedAt = time.Now()
+	order.UpdatedAt = time.Now()
+
+	now := time.Now()
+	orderID, actor := order.ID, actorFromContext(ctx)
+	for i := range order.Items {
+		item := &order.Items[i]
+		item.ID = uuid.New()
+		item.OrderID = order.ID
+
+		product := r.store.products[item.ProductID]
+		product.Stock -= item.Quantity
+		product.UpdatedAt = now
+		r.store.products[product.ID] = product
+		item.Product.Stock = product.Stock
+
+		if item.VariantID != nil {
+			variant := r.store.variants[*item.VariantID]
+			variant.Stock -= item.Quantity
+			variant.UpdatedAt = now
+			r.store.variants[variant.ID] = variant
+			if item.Variant != nil {
+				item.Variant.Stock = variant.Stock
+			}
+		}
+
+		for j := range allocations[i] {
+			allocation := &allocations[i][j]
+			allocation.ID = uuid.New()
+			allocation.OrderItemID = item.ID
+			r.store.moveStock(models.InventoryMovement{
+				WarehouseID:    allocation.WarehouseID,
+				ProductID:      item.ProductID,
+				VariantID:      item.VariantID,
+				Type:           models.MovementSale,
+				ReservedChange: allocation.Quantity,
+				OrderID:        &orderID,
+				CreatedBy:      actor,
+				CreatedAt:      now,
+			})
+		}
+		item.Allocations = allocations[i]
+		r.store.allocations[item.ID] = slices.Clone(allocations[i])
+		r.store.syncStockAlert(item.ProductID, now)
+	}
+
+	items := make([]models.OrderItem, len(order.Items))
+	for i := range order.Items {
+		items[i] = order.Items[i]
+		items[i].Product = models.Product{}
+		items[i].Variant = nil
+		items[i].Allocations = nil
+	}
+
+	stored := *order
+	stored.Customer = models.Customer{}
+	stored.Items = nil
+	r.store.orders[order.ID] = stored
+	r.store.orderItems[order.ID] = items
+	return nil
+}
+
+// UpdateStatus moves an order to change.ToStatus if the order state machine
+// allows it, recording the transition. Cancelling returns the order's stock
+// and shipping takes it out of the warehouses holding it.
+func (r *MemoryOrderRepository) UpdateStatus(ctx context.Context, change *models.OrderStatusChange) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, ok := r.store.orders[change.OrderID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	itemCount := 0
+	for _, item := range r.store.orderItems[change.OrderID] {
+		if item.RemainingQuantity() > 0 {
+			itemCount++
+		}
+	}
+
+	change.FromStatus = stored.Status
+	if err := models.ValidateOrderTransition(change.FromStatus, change.ToStatus, itemCount); err != nil {
+		return err
+	}
+
+	change.ID = uuid.New()
+	change.CreatedAt = time.Now()
+
+	stored.Status = change.ToStatus
+	stored.UpdatedAt = change.CreatedAt
+	r.store.orders[change.OrderID] = stored
+	r.store.statusHistory[change.OrderID] = append(r.store.statusHistory[change.OrderID], *change)
+
+	if models.TransitionRestocksInventory(change.ToStatus) {
+		r.store.restockOrder(change.OrderID, actorFromContext(ctx))
+	}
+	if models.TransitionShipsStock(change.ToStatus) {
+		r.store.shipOrder(change.OrderID, actorFromContext(ctx), change.CreatedAt)
+	}
+	return nil
+}
+
+// CancelItem cancels quantity units of one order line, returning them to stock
+// and taking them off the order total. A quantity of 0 cancels everything still
+// outstanding on the line.
+func (r *MemoryOrderRepository) CancelItem(ctx context.Context, orderID, itemID uuid.UUID, quantity int) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, ok := r.store.orders[orderID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	items := r.store.orderItems[orderID]
+	index := slices.IndexFunc(items, func(item models.OrderItem) bool { return item.ID == itemID })
+	if index < 0 {
+		return sql.ErrNoRows
+	}
+
+	quantity, err := validateItemCancellation(stored.Status, itemID, items[index], quantity)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	items[index].CancelledQuantity += quantity
+
+	stored.Total.Amount -= items[index].Price.Amount * int64(quantity)
+	stored.UpdatedAt = now
+	r.store.orders[orderID] = stored
+
+	r.store.restockItem(items[index], quantity, actorFromContext(ctx), now)
+	return nil
+}
+
+// GetStatusHistory returns the status transitions of an order, oldest first
+func (r *MemoryOrderRepository) GetStatusHistory(ctx context.Context, orderID uuid.UUID) ([]models.OrderStatusChange, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	var history []models.OrderStatusChange
+	history = append(history, r.store.statusHistory[orderID]...)
+	return history, nil
+}
+
+func (r *MemoryOrderRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Order, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	order, ok := r.store.orders[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	order.Customer = r.store.customers[order.CustomerID]
+
+	// Get order items
+	for _, item := range r.store.orderItems[id] {
+		item.Product = r.store.productWithCategory(r.store.products[item.ProductID])
+		if item.VariantID != nil {
+			variant := r.store.variants[*item.VariantID]
+			item.Variant = &variant
+		}
+		item.Allocations = r.store.itemAllocations(item.ID)
+		order.Items = append(order.Items, item)
+	}
+
+	return &order, nil
+}
+
+func (r *MemoryOrderRepository) GetByCustomer(ctx context.Context, customerID uuid.UUID) ([]models.Order, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	var orders []models.Order
+	for _, order := range r.store.orders {
+		if order.CustomerID == customerID {
+			order.Customer = r.store.customers[order.CustomerID]
+			orders = append(orders, order)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].CreatedAt.After(orders[j].CreatedAt)
+	})
+	return orders, nil
+}
+
+func (r *MemoryOrderRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	// Return stock still held by the order, as the SQL repository does
+	if order, ok := r.store.orders[id]; ok && models.OrderHoldsStock(order.Status) {
+		r.store.restockOrder(id, actorFromContext(ctx))
+	}
+
+	r.store.deleteOrder(id)
+	return nil
+}
+
+// MemoryCartRepository is a thread-safe in-memory CartRepository
+type MemoryCartRepository struct {
+	store *memoryStore
+}
+
+func (r *MemoryCartRepository) Create(ctx context.Context, cart *models.Cart) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if cart.CustomerID != nil {
+		if _, ok := r.store.customers[*cart.CustomerID]; !ok {
+			return foreignKeyError("carts", "customer_id")
+		}
+		for _, existing := range r.store.carts {
+			if existing.CustomerID != nil && *existing.CustomerID == *cart.CustomerID {
+				return errDuplicateCustomerCart
+			}
+		}
+	}
+
+	cart.ID = uuid.New()
+	cart.CreatedAt = time.Now()
+	cart.UpdatedAt = time.Now()
+
+	stored := *cart
+	stored.Items = nil
+	r.store.carts[cart.ID] = stored
+	return nil
+}
+
+func (r *MemoryCartRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Cart, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	cart, ok := r.store.carts[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return r.store.cartWithItems(cart), nil
+}
+
+func (r *MemoryCartRepository) GetByCustomer(ctx context.Context, customerID uuid.UUID) (*models.Cart, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	for _, cart := range r.store.carts {
+		if cart.CustomerID != nil && *cart.CustomerID == customerID {
+			return r.store.cartWithItems(cart), nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// SetItem sets the quantity of a product, or of one of its variants, in a cart,
+// adding the line if needed
+func (r *MemoryCartRepository) SetItem(ctx context.Context, cartID, productID uuid.UUID, variantID *uuid.UUID, quantity int) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if _, ok := r.store.carts[cartID]; !ok {
+		return sql.ErrNoRows
+	}
+	if _, ok := r.store.products[productID]; !ok {
+		return foreignKeyError("cart_items", "product_id")
+	}
+	if variantID != nil {
+		if _, ok := r.store.variants[*variantID]; !ok {
+			return foreignKeyError("cart_items", "variant_id")
+		}
+	}
+
+	r.store.setCartItem(cartID, productID, variantID, quantity, time.Now())
+	return nil
+}
+
+func (r *MemoryCartRepository) RemoveItem(ctx context.Context, cartID, itemID uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	items := r.store.cartItems[cartID]
+	index := slices.IndexFunc(items, func(item models.CartItem) bool { return item.ID == itemID })
+	if index < 0 {
+		return sql.ErrNoRows
+	}
+	r.store.cartItems[cartID] = slices.Delete(items, index, index+1)
+	r.store.touchCart(cartID, time.Now())
+	return nil
+}
+
+// Merge moves the lines of one cart into another, adding quantities for
+// products and variants both carts hold, and deletes the emptied cart
+func (r *MemoryCartRepository) Merge(ctx context.Context, fromID, intoID uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if _, ok := r.store.carts[intoID]; !ok {
+		return sql.ErrNoRows
+	}
+
+	now := time.Now()
+	for _, item := range r.store.cartItems[fromID] {
+		quantity := item.Quantity
+		for _, existing := range r.store.cartItems[intoID] {
+			if existing.ProductID == item.ProductID && models.SameVariant(existing.VariantID, item.VariantID) {
+				quantity += existing.Quantity
+			}
+		}
+		r.store.setCartItem(intoID, item.ProductID, item.VariantID, quantity, now)
+	}
+	r.store.deleteCart(fromID)
+	return nil
+}
+
+func (r *MemoryCartRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	r.store.deleteCart(id)
+	return nil
+}
+
+// cartWithItems returns a copy of a cart with its items joined to their products
+// and variants. Callers must hold the read lock.
+func (s *memoryStore) cartWithItems(cart models.Cart) *models.Cart {
+	cart.Items = []models.CartItem{}
+	for _, item := range s.cartItems[cart.ID] {
+		item.Product = s.products[item.ProductID]
+		if item.VariantID != nil {
+			variant := s.variants[*item.VariantID]
+			item.Variant = &variant
+		}
+		cart.Items = append(cart.Items, item)
+	}
+	return &cart
+}
+
+// setCartItem upserts a cart line. Callers must hold the write lock.
+func (s *memoryStore) setCartItem(cartID, productID uuid.UUID, variantID *uuid.UUID, quantity int, at time.Time) {
+	items := s.cartItems[cartID]
+	index := slices.IndexFunc(items, func(item models.CartItem) bool {
+		return item.ProductID == productID && models.SameVariant(item.VariantID, variantID)
+	})
+	if index >= 0 {
+		items[index].Quantity = quantity
+		items[index].UpdatedAt = at
+	} else {
+		s.cartItems[cartID] = append(items, models.CartItem{
+			ID:        uuid.New(),
+			CartID:    cartID,
+			ProductID: productID,
+			VariantID: variantID,
+			Quantity:  quantity,
+			CreatedAt: at,
+			UpdatedAt: at,
+		})
+	}
+	s.touchCart(cartID, at)
+}
+
+// touchCart bumps a cart's updated time. Callers must hold the write lock.
+func (s *memoryStore) touchCart(cartID uuid.UUID, at time.Time) {
+	if cart, ok := s.carts[cartID]; ok {
+		cart.UpdatedAt = at
+		s.carts[cartID] = cart
+	}
+}
+
+// MemoryIdempotencyRepository is a thread-safe in-memory IdempotencyRepository
+type MemoryIdempotencyRepository struct {
+	store *memoryStore
+}
+
+// Reserve claims record.Key for a new request. If the key is already held by an
+// unexpired record, that record is returned instead and nothing is stored.
+func (r *MemoryIdempotencyRepository) Reserve(ctx context.Context, record *models.IdempotencyRecord) (*models.IdempotencyRecord, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	record.CreatedAt = time.Now()
+	if existing, ok := r.store.idempotency[record.Key]; ok && existing.ExpiresAt.After(record.CreatedAt) {
+		return &existing, nil
+	}
+
+	r.store.idempotency[record.Key] = *record
+	return nil, nil
+}
+
+// Complete stores the response of the request holding key
+func (r *MemoryIdempotencyRepository) Complete(ctx context.Context, key string, statusCode int, contentType string, body []byte) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if record, ok := r.store.idempotency[key]; ok {
+		record.StatusCode = statusCode
+		record.ContentType = contentType
+		record.ResponseBody = slices.Clone(body)
+		r.store.idempotency[key] = record
+	}
+	return nil
+}
+
+// Release frees a key whose request failed so that it can be retried
+func (r *MemoryIdempotencyRepository) Release(ctx context.Context, key string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if record, ok := r.store.idempotency[key]; ok && !record.Completed() {
+		delete(r.store.idempotency, key)
+	}
+	return nil
+}
+
+func (r *MemoryIdempotencyRepository) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	deleted := 0
+	for key, record := range r.store.idempotency {
+		if !record.ExpiresAt.After(now) {
+			delete(r.store.idempotency, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
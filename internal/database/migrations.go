@@ -1,30 +1,259 @@
 package database
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"log"
+	"sort"
+	"time"
 )
 
-// RunMigrations runs all database migrations
+// migrationLockID is the Postgres advisory lock key held while migrating so that
+// several application replicas booting at once apply migrations one at a time
+const migrationLockID = 7263412001
+
+// Migration is a numbered, reversible schema change
+type Migration struct {
+	Version     int
+	Description string
+	Up          string
+	Down        string
+}
+
+// MigrationState reports whether a migration has been applied
+type MigrationState struct {
+	Migration
+	Applied   bool
+	AppliedAt *time.Time
+}
+
+var migrations = []Migration{
+	{Version: 1, Description: "create customers table", Up: createCustomersTable, Down: `DROP TABLE IF EXISTS customers`},
+	{Version: 2, Description: "create categories table", Up: createCategoriesTable, Down: `DROP TABLE IF EXISTS categories`},
+	{Version: 3, Description: "create products table", Up: createProductsTable, Down: `DROP TABLE IF EXISTS products`},
+	{Version: 4, Description: "create orders table", Up: createOrdersTable, Down: `DROP TABLE IF EXISTS orders`},
+	{Version: 5, Description: "create order_items table", Up: createOrderItemsTable, Down: `DROP TABLE IF EXISTS order_items`},
+	{Version: 6, Description: "store money as integer minor units with currency", Up: convertMoneyToMinorUnits, Down: revertMoneyToDecimal},
+	{Version: 7, Description: "create order_status_history table", Up: createOrderStatusHistoryTable, Down: `DROP TABLE IF EXISTS order_status_history`},
+	{Version: 8, Description: "track cancelled quantity on order items", Up: addOrderItemCancelledQuantity, Down: `ALTER TABLE order_items DROP COLUMN cancelled_quantity`},
+	{Version: 9, Description: "create carts and cart_items tables", Up: createCartTables, Down: `DROP TABLE IF EXISTS cart_items; DROP TABLE IF EXISTS carts`},
+	{Version: 10, Description: "create idempotency_keys table", Up: createIdempotencyKeysTable, Down: `DROP TABLE IF EXISTS idempotency_keys`},
+	{Version: 11, Description: "add full-text search vector to products", Up: addProductSearchVector, Down: `DROP INDEX IF EXISTS idx_products_search_vector; ALTER TABLE products DROP COLUMN search_vector`},
+	{Version: 12, Description: "add soft deletion to customers, categories and products", Up: addSoftDeletion, Down: dropSoftDeletion},
+	{Version: 13, Description: "add product variants to products, order items and cart items", Up: createProductVariantsTable, Down: dropProductVariantsTable},
+	{Version: 14, Description: "add category attribute schemas and product attribute values", Up: createCategoryAttributesTable, Down: dropCategoryAttributesTable},
+	{Version: 15, Description: "create product images table", Up: createProductImagesTable, Down: dropProductImagesTable},
+	{Version: 16, Description: "create price schedule and price history tables", Up: createPriceTables, Down: dropPriceTables},
+	{Version: 17, Description: "track inventory per warehouse with a movements ledger", Up: createInventoryTables, Down: dropInventoryTables},
+	{Version: 18, Description: "make the inventory ledger append-only and check movement reasons", Up: protectInventoryLedger, Down: unprotectInventoryLedger},
+	{Version: 19, Description: "add reorder thresholds and low-stock alerts", Up: createStockAlerts, Down: dropStockAlerts},
+}
+
+// Migrations returns the registered migrations ordered by version
+func Migrations() []Migration {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	return sorted
+}
+
+// validateMigrations checks that versions are positive, unique and reversible
+func validateMigrations(list []Migration) error {
+	seen := make(map[int]bool)
+	for _, m := range list {
+		if m.Version <= 0 {
+			return fmt.Errorf("migration %q has invalid version %d", m.Description, m.Version)
+		}
+		if seen[m.Version] {
+			return fmt.Errorf("duplicate migration version %d", m.Version)
+		}
+		if m.Up == "" || m.Down == "" {
+			return fmt.Errorf("migration %d must define both up and down statements", m.Version)
+		}
+		seen[m.Version] = true
+	}
+	return nil
+}
+
+// RunMigrations applies all pending migrations
 func RunMigrations() error {
-	migrations := []string{
-		createCustomersTable,
-		createCategoriesTable,
-		createProductsTable,
-		createOrdersTable,
-		createOrderItemsTable,
+	return MigrateUp()
+}
+
+// MigrateUp applies every migration that has not been recorded in schema_migrations
+func MigrateUp() error {
+	return withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range Migrations() {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if err := applyMigration(ctx, conn, m, true); err != nil {
+				return err
+			}
+			log.Printf("Applied migration %d: %s", m.Version, m.Description)
+		}
+
+		log.Println("All migrations completed successfully")
+		return nil
+	})
+}
+
+// MigrateDown reverts applied migrations newer than the target version.
+// A target of 0 reverts every migration.
+func MigrateDown(target int) error {
+	if target < 0 {
+		return fmt.Errorf("invalid target version %d", target)
 	}
 
-	for _, migration := range migrations {
-		if _, err := DB.Exec(migration); err != nil {
-			log.Printf("Error running migration: %v", err)
+	return withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
 			return err
 		}
+
+		list := Migrations()
+		for i := len(list) - 1; i >= 0; i-- {
+			m := list[i]
+			if m.Version <= target {
+				break
+			}
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if err := applyMigration(ctx, conn, m, false); err != nil {
+				return err
+			}
+			log.Printf("Reverted migration %d: %s", m.Version, m.Description)
+		}
+
+		log.Printf("Database migrated down to version %d", target)
+		return nil
+	})
+}
+
+// MigrationStatus lists every registered migration with its applied state
+func MigrationStatus() ([]MigrationState, error) {
+	var states []MigrationState
+	err := withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range Migrations() {
+			state := MigrationState{Migration: m}
+			if appliedAt, ok := applied[m.Version]; ok {
+				state.Applied = true
+				state.AppliedAt = &appliedAt
+			}
+			states = append(states, state)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return states, nil
+}
 
-	log.Println("All migrations completed successfully")
-	return nil
+// withMigrationLock runs fn on a dedicated connection holding the migration advisory lock
+func withMigrationLock(fn func(ctx context.Context, conn *sql.Conn) error) error {
+	if err := validateMigrations(migrations); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Advisory locks are held per session, so lock and unlock on the same connection
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return fmt.Errorf("error acquiring migration lock: %w", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID); err != nil {
+			log.Printf("Error releasing migration lock: %v", err)
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, createSchemaMigrationsTable); err != nil {
+		return err
+	}
+
+	return fn(ctx, conn)
 }
 
+// appliedVersions returns the applied migration versions and when they were applied
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// applyMigration runs the up or down statement of a migration and updates the
+// history table in the same transaction
+func applyMigration(ctx context.Context, conn *sql.Conn, m Migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statement := m.Down
+	if up {
+		statement = m.Up
+	}
+
+	if _, err := tx.ExecContext(ctx, statement); err != nil {
+		log.Printf("Error running migration %d: %v", m.Version, err)
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, description, applied_at) VALUES ($1, $2, $3)`,
+			m.Version, m.Description, time.Now())
+	} else {
+		_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const createSchemaMigrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    description VARCHAR(255) NOT NULL,
+    applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+`
+
 const createCustomersTable = `
 CREATE TABLE IF NOT EXISTS customers (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
@@ -84,3 +313,356 @@ CREATE TABLE IF NOT EXISTS order_items (
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 `
+
+const convertMoneyToMinorUnits = `
+ALTER TABLE products ALTER COLUMN price TYPE BIGINT USING ROUND(price * 100)::BIGINT;
+ALTER TABLE products ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'KES';
+ALTER TABLE orders ALTER COLUMN total TYPE BIGINT USING ROUND(total * 100)::BIGINT;
+ALTER TABLE orders ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'KES';
+ALTER TABLE order_items ALTER COLUMN price TYPE BIGINT USING ROUND(price * 100)::BIGINT;
+ALTER TABLE order_items ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'KES';
+`
+
+const revertMoneyToDecimal = `
+ALTER TABLE order_items DROP COLUMN currency;
+ALTER TABLE order_items ALTER COLUMN price TYPE DECIMAL(10,2) USING price / 100.0;
+ALTER TABLE orders DROP COLUMN currency;
+ALTER TABLE orders ALTER COLUMN total TYPE DECIMAL(10,2) USING total / 100.0;
+ALTER TABLE products DROP COLUMN currency;
+ALTER TABLE products ALTER COLUMN price TYPE DECIMAL(10,2) USING price / 100.0;
+`
+
+const createOrderStatusHistoryTable = `
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    from_status VARCHAR(50) NOT NULL,
+    to_status VARCHAR(50) NOT NULL,
+    changed_by VARCHAR(255) NOT NULL,
+    reason TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_order_status_history_order_id ON order_status_history (order_id, created_at);
+`
+
+const addOrderItemCancelledQuantity = `
+ALTER TABLE order_items
+    ADD COLUMN cancelled_quantity INTEGER NOT NULL DEFAULT 0,
+    ADD CONSTRAINT order_items_cancelled_quantity_check CHECK (cancelled_quantity >= 0 AND cancelled_quantity <= quantity);
+`
+
+const createCartTables = `
+CREATE TABLE IF NOT EXISTS carts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    customer_id UUID REFERENCES customers(id) ON DELETE CASCADE,
+    token VARCHAR(64),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_carts_customer_id ON carts (customer_id) WHERE customer_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS cart_items (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    cart_id UUID NOT NULL REFERENCES carts(id) ON DELETE CASCADE,
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (cart_id, product_id)
+);
+`
+
+const createIdempotencyKeysTable = `
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key VARCHAR(255) PRIMARY KEY,
+    request_hash CHAR(64) NOT NULL,
+    status_code INTEGER NOT NULL DEFAULT 0,
+    content_type VARCHAR(255),
+    response_body BYTEA,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys (expires_at);
+`
+
+const addProductSearchVector = `
+ALTER TABLE products ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', COALESCE(name, '')), 'A') ||
+    setweight(to_tsvector('english', COALESCE(description, '')), 'B')
+) STORED;
+CREATE INDEX IF NOT EXISTS idx_products_search_vector ON products USING GIN (search_vector);
+`
+
+// Soft-deleted rows keep their deleted_at until they are purged; the partial
+// indexes serve the deleted listings and the purge without growing for live rows
+const addSoftDeletion = `
+ALTER TABLE customers ADD COLUMN deleted_at TIMESTAMP;
+ALTER TABLE categories ADD COLUMN deleted_at TIMESTAMP;
+ALTER TABLE products ADD COLUMN deleted_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS idx_customers_deleted_at ON customers (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_categories_deleted_at ON categories (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_products_deleted_at ON products (deleted_at) WHERE deleted_at IS NOT NULL;
+`
+
+const dropSoftDeletion = `
+ALTER TABLE products DROP COLUMN deleted_at;
+ALTER TABLE categories DROP COLUMN deleted_at;
+ALTER TABLE customers DROP COLUMN deleted_at;
+`
+
+// Cart lines are unique per product and variant; lines without a variant
+// compare equal through the nil UUID
+const createProductVariantsTable = `
+CREATE TABLE IF NOT EXISTS product_variants (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    sku VARCHAR(64) NOT NULL,
+    options JSONB NOT NULL DEFAULT '{}',
+    price BIGINT,
+    stock INTEGER NOT NULL DEFAULT 0,
+    image_url VARCHAR(500),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT product_variants_sku_key UNIQUE (sku)
+);
+CREATE INDEX IF NOT EXISTS idx_product_variants_product_id ON product_variants (product_id);
+ALTER TABLE order_items ADD COLUMN variant_id UUID REFERENCES product_variants(id);
+ALTER TABLE cart_items ADD COLUMN variant_id UUID REFERENCES product_variants(id) ON DELETE CASCADE;
+ALTER TABLE cart_items DROP CONSTRAINT IF EXISTS cart_items_cart_id_product_id_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cart_items_line
+    ON cart_items (cart_id, product_id, COALESCE(variant_id, '00000000-0000-0000-0000-000000000000'));
+`
+
+const dropProductVariantsTable = `
+DROP INDEX IF EXISTS idx_cart_items_line;
+DELETE FROM cart_items WHERE variant_id IS NOT NULL;
+ALTER TABLE cart_items DROP COLUMN variant_id;
+ALTER TABLE cart_items ADD CONSTRAINT cart_items_cart_id_product_id_key UNIQUE (cart_id, product_id);
+ALTER TABLE order_items DROP COLUMN variant_id;
+DROP TABLE IF EXISTS product_variants;
+`
+
+const createCategoryAttributesTable = `
+CREATE TABLE IF NOT EXISTS category_attributes (
+    category_id UUID NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+    name VARCHAR(64) NOT NULL,
+    type VARCHAR(16) NOT NULL CHECK (type IN ('text', 'number', 'boolean', 'enum')),
+    unit VARCHAR(32),
+    allowed_values TEXT[],
+    required BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (category_id, name)
+);
+ALTER TABLE products ADD COLUMN attributes JSONB NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS idx_products_attributes ON products USING GIN (attributes);
+`
+
+const dropCategoryAttributesTable = `
+DROP INDEX IF EXISTS idx_products_attributes;
+ALTER TABLE products DROP COLUMN attributes;
+DROP TABLE IF EXISTS category_attributes;
+`
+
+// Positions only have to be unique once a reorder commits, so the constraint is deferred
+const createProductImagesTable = `
+CREATE TABLE IF NOT EXISTS product_images (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL CHECK (position > 0),
+    content_type VARCHAR(32) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    storage_key VARCHAR(255) NOT NULL,
+    thumbnail_key VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT product_images_position_key UNIQUE (product_id, position) DEFERRABLE INITIALLY DEFERRED
+);
+`
+
+const dropProductImagesTable = `
+DROP TABLE IF EXISTS product_images;
+`
+
+// A permanent price change has no end. Open schedules are found by status and
+// start time.
+const createPriceTables = `
+CREATE TABLE IF NOT EXISTS price_schedules (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    price BIGINT NOT NULL CHECK (price >= 0),
+    currency CHAR(3) NOT NULL,
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    previous_price BIGINT,
+    previous_currency CHAR(3),
+    created_by VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT price_schedules_period_check CHECK (ends_at IS NULL OR ends_at > starts_at)
+);
+CREATE INDEX IF NOT EXISTS idx_price_schedules_product_id ON price_schedules (product_id, starts_at);
+CREATE INDEX IF NOT EXISTS idx_price_schedules_status ON price_schedules (status, starts_at);
+
+CREATE TABLE IF NOT EXISTS price_history (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    old_price BIGINT,
+    old_currency CHAR(3),
+    new_price BIGINT NOT NULL,
+    new_currency CHAR(3) NOT NULL,
+    source VARCHAR(20) NOT NULL,
+    schedule_id UUID REFERENCES price_schedules(id) ON DELETE SET NULL,
+    changed_by VARCHAR(255) NOT NULL,
+    changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_price_history_product_id ON price_history (product_id, changed_at);
+`
+
+const dropPriceTables = `
+DROP TABLE IF EXISTS price_history;
+DROP TABLE IF EXISTS price_schedules;
+`
+
+// Existing stock starts out on hand at the default warehouse, with an initial
+// movement explaining it. Stock already reserved by open orders is no longer
+// on hand, so it is not allocated to any warehouse.
+const createInventoryTables = `
+CREATE TABLE IF NOT EXISTS warehouses (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    code VARCHAR(32) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    latitude DOUBLE PRECISION,
+    longitude DOUBLE PRECISION,
+    priority INTEGER NOT NULL DEFAULT 0,
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT warehouses_code_key UNIQUE (code),
+    CONSTRAINT warehouses_location_check CHECK ((latitude IS NULL) = (longitude IS NULL))
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_warehouses_default ON warehouses (is_default) WHERE is_default;
+INSERT INTO warehouses (code, name, is_default) VALUES ('MAIN', 'Main warehouse', TRUE);
+
+CREATE TABLE IF NOT EXISTS inventory_levels (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    warehouse_id UUID NOT NULL REFERENCES warehouses(id),
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    variant_id UUID REFERENCES product_variants(id) ON DELETE CASCADE,
+    on_hand INTEGER NOT NULL DEFAULT 0,
+    reserved INTEGER NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT inventory_levels_quantity_check CHECK (reserved >= 0 AND reserved <= on_hand)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_inventory_levels_item
+    ON inventory_levels (warehouse_id, product_id, COALESCE(variant_id, '00000000-0000-0000-0000-000000000000'));
+CREATE INDEX IF NOT EXISTS idx_inventory_levels_product_id ON inventory_levels (product_id);
+
+CREATE TABLE IF NOT EXISTS inventory_movements (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    warehouse_id UUID NOT NULL REFERENCES warehouses(id),
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    variant_id UUID REFERENCES product_variants(id) ON DELETE CASCADE,
+    type VARCHAR(20) NOT NULL,
+    on_hand_change INTEGER NOT NULL,
+    reserved_change INTEGER NOT NULL,
+    order_id UUID REFERENCES orders(id) ON DELETE SET NULL,
+    transfer_id UUID,
+    note TEXT,
+    created_by VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_inventory_movements_product_id ON inventory_movements (product_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_inventory_movements_warehouse_id ON inventory_movements (warehouse_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_inventory_movements_order_id ON inventory_movements (order_id);
+
+CREATE TABLE IF NOT EXISTS order_allocations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    order_item_id UUID NOT NULL REFERENCES order_items(id) ON DELETE CASCADE,
+    warehouse_id UUID NOT NULL REFERENCES warehouses(id),
+    quantity INTEGER NOT NULL CHECK (quantity >= 0)
+);
+CREATE INDEX IF NOT EXISTS idx_order_allocations_order_item_id ON order_allocations (order_item_id);
+
+ALTER TABLE orders ADD COLUMN ship_latitude DOUBLE PRECISION, ADD COLUMN ship_longitude DOUBLE PRECISION;
+
+INSERT INTO inventory_levels (warehouse_id, product_id, on_hand)
+SELECT w.id, p.id, p.stock FROM products p CROSS JOIN warehouses w
+WHERE w.is_default AND p.stock > 0
+  AND NOT EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = p.id);
+INSERT INTO inventory_levels (warehouse_id, product_id, variant_id, on_hand)
+SELECT w.id, v.product_id, v.id, v.stock FROM product_variants v CROSS JOIN warehouses w
+WHERE w.is_default AND v.stock > 0;
+INSERT INTO inventory_movements (warehouse_id, product_id, variant_id, type, on_hand_change, reserved_change, created_by)
+SELECT warehouse_id, product_id, variant_id, 'initial', on_hand, 0, 'system' FROM inventory_levels;
+`
+
+const dropInventoryTables = `
+ALTER TABLE orders DROP COLUMN ship_latitude, DROP COLUMN ship_longitude;
+DROP TABLE IF EXISTS order_allocations;
+DROP TABLE IF EXISTS inventory_movements;
+DROP TABLE IF EXISTS inventory_levels;
+DROP TABLE IF EXISTS warehouses;
+`
+
+// Movements are never changed or removed once recorded. The only exceptions
+// are the foreign key actions: an order's deletion clears its order_id, and a
+// purged product or deleted variant takes its movements with it.
+const protectInventoryLedger = `
+ALTER TABLE inventory_movements ADD CONSTRAINT inventory_movements_type_check CHECK (type IN (
+    'initial', 'adjustment', 'stock_take', 'damage', 'sale', 'cancellation', 'shipment', 'transfer_out', 'transfer_in'
+));
+
+CREATE OR REPLACE FUNCTION inventory_movements_append_only() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' THEN
+        IF NEW.order_id IS NULL AND to_jsonb(NEW) - 'order_id' = to_jsonb(OLD) - 'order_id'
+           AND NOT EXISTS (SELECT 1 FROM orders WHERE id = OLD.order_id) THEN
+            RETURN NEW;
+        END IF;
+    ELSIF NOT EXISTS (SELECT 1 FROM products WHERE id = OLD.product_id)
+          OR (OLD.variant_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM product_variants WHERE id = OLD.variant_id)) THEN
+        RETURN OLD;
+    END IF;
+    RAISE EXCEPTION 'inventory movement % cannot be changed', OLD.id USING ERRCODE = 'integrity_constraint_violation';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER inventory_movements_append_only
+    BEFORE UPDATE OR DELETE ON inventory_movements
+    FOR EACH ROW EXECUTE FUNCTION inventory_movements_append_only();
+`
+
+const unprotectInventoryLedger = `
+DROP TRIGGER IF EXISTS inventory_movements_append_only ON inventory_movements;
+DROP FUNCTION IF EXISTS inventory_movements_append_only();
+ALTER TABLE inventory_movements DROP CONSTRAINT IF EXISTS inventory_movements_type_check;
+`
+
+// A product's own reorder threshold takes precedence over its category's. At
+// most one alert per product is open at a time.
+const createStockAlerts = `
+ALTER TABLE products ADD COLUMN reorder_threshold INTEGER CHECK (reorder_threshold >= 0);
+ALTER TABLE categories ADD COLUMN reorder_threshold INTEGER CHECK (reorder_threshold >= 0);
+
+CREATE TABLE IF NOT EXISTS stock_alerts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    threshold INTEGER NOT NULL,
+    stock INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    notified_at TIMESTAMP,
+    resolved_at TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_stock_alerts_open ON stock_alerts (product_id) WHERE resolved_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_stock_alerts_pending ON stock_alerts (created_at) WHERE notified_at IS NULL AND resolved_at IS NULL;
+`
+
+const dropStockAlerts = `
+DROP TABLE IF EXISTS stock_alerts;
+ALTER TABLE categories DROP COLUMN reorder_threshold;
+ALTER TABLE products DROP COLUMN reorder_threshold;
+`
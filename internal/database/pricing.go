@@ -0,0 +1,37 @@
+package database
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const defaultPriceScheduleInterval = time.Minute
+
+// RunPriceScheduler starts and ends the price schedules that are due, then
+// again every interval, until ctx is cancelled
+func (r *Repositories) RunPriceScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		started, ended, err := r.Prices.ApplySchedules(ctx, time.Now())
+		if err != nil {
+			log.Printf("Error applying price schedules: %v", err)
+		} else if started > 0 || ended > 0 {
+			log.Printf("Started %d and ended %d price schedules", started, ended)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PriceScheduleIntervalFromEnv reads PRICE_SCHEDULE_INTERVAL, how often due
+// price schedules are applied (a Go duration such as "30s")
+func PriceScheduleIntervalFromEnv() time.Duration {
+	return durationFromEnv("PRICE_SCHEDULE_INTERVAL", defaultPriceScheduleInterval)
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	defaultDeletedRetention = 30 * 24 * time.Hour
+	defaultPurgeInterval    = time.Hour
+)
+
+// PurgeResult counts the rows removed by one purge
+type PurgeResult struct {
+	Products   int
+	Categories int
+	Customers  int
+}
+
+// PurgeDeleted permanently deletes the rows soft-deleted before the cutoff.
+// Products go first so that the categories they held can be purged in the same run.
+func (r *Repositories) PurgeDeleted(ctx context.Context, before time.Time) (PurgeResult, error) {
+	var result PurgeResult
+	var err error
+
+	if result.Products, err = r.Products.Purge(ctx, before); err != nil {
+		return result, err
+	}
+	if result.Categories, err = r.Categories.Purge(ctx, before); err != nil {
+		return result, err
+	}
+	if result.Customers, err = r.Customers.Purge(ctx, before); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// RunPurger purges the rows deleted more than retention ago, then again every
+// interval, until ctx is cancelled
+func (r *Repositories) RunPurger(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		result, err := r.PurgeDeleted(ctx, time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("Error purging deleted rows: %v", err)
+		} else if result != (PurgeResult{}) {
+			log.Printf("Purged %d products, %d categories and %d customers deleted before the %s retention period",
+				result.Products, result.Categories, result.Customers, retention)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeSettingsFromEnv reads DELETED_RETENTION, how long soft-deleted rows are
+// kept, and PURGE_INTERVAL, how often they are purged (Go durations such as "720h")
+func PurgeSettingsFromEnv() (retention, interval time.Duration) {
+	return durationFromEnv("DELETED_RETENTION", defaultDeletedRetention), durationFromEnv("PURGE_INTERVAL", defaultPurgeInterval)
+}
+
+// durationFromEnv reads a positive duration from an environment variable
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
@@ -1,17 +1,27 @@
 package database
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"commerce-app/internal/models"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
-// CustomerRepository handles customer database operations
-type CustomerRepository struct{}
+// PostgresCustomerRepository handles customer database operations
+type PostgresCustomerRepository struct{}
+
+func (r *PostgresCustomerRepository) Create(ctx context.Context, customer *models.Customer) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
 
-func (r *CustomerRepository) Create(customer *models.Customer) error {
 	customer.ID = uuid.New()
 	customer.CreatedAt = time.Now()
 	customer.UpdatedAt = time.Now()
@@ -19,56 +29,136 @@ func (r *CustomerRepository) Create(customer *models.Customer) error {
 	query := `INSERT INTO customers (id, email, name, phone, created_at, updated_at)
 			  VALUES ($1, $2, $3, $4, $5, $6)`
 
-	_, err := DB.Exec(query, customer.ID, customer.Email, customer.Name, customer.Phone,
+	_, err := DB.ExecContext(ctx, query, customer.ID, customer.Email, customer.Name, customer.Phone,
 		customer.CreatedAt, customer.UpdatedAt)
-	return err
+	return wrapQueryError(ctx, err)
 }
 
-func (r *CustomerRepository) GetByID(id uuid.UUID) (*models.Customer, error) {
+func (r *PostgresCustomerRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Customer, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	customer := &models.Customer{}
-	query := `SELECT id, email, name, phone, created_at, updated_at FROM customers WHERE id = $1`
+	query := `SELECT id, email, name, phone, created_at, updated_at FROM customers WHERE id = $1 AND deleted_at IS NULL`
 
-	err := DB.QueryRow(query, id).Scan(&customer.ID, &customer.Email, &customer.Name,
+	err := DB.QueryRowContext(ctx, query, id).Scan(&customer.ID, &customer.Email, &customer.Name,
 		&customer.Phone, &customer.CreatedAt, &customer.UpdatedAt)
 	if err != nil {
-		return nil, err
+		return nil, wrapQueryError(ctx, err)
 	}
 	return customer, nil
 }
 
-func (r *CustomerRepository) GetByEmail(email string) (*models.Customer, error) {
+func (r *PostgresCustomerRepository) GetByEmail(ctx context.Context, email string) (*models.Customer, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	customer := &models.Customer{}
-	query := `SELECT id, email, name, phone, created_at, updated_at FROM customers WHERE email = $1`
+	query := `SELECT id, email, name, phone, created_at, updated_at FROM customers WHERE email = $1 AND deleted_at IS NULL`
 
-	err := DB.QueryRow(query, email).Scan(&customer.ID, &customer.Email, &customer.Name,
+	err := DB.QueryRowContext(ctx, query, email).Scan(&customer.ID, &customer.Email, &customer.Name,
 		&customer.Phone, &customer.CreatedAt, &customer.UpdatedAt)
 	if err != nil {
-		return nil, err
+		return nil, wrapQueryError(ctx, err)
 	}
 	return customer, nil
 }
 
-func (r *CustomerRepository) Delete(id uuid.UUID) error {
+func (r *PostgresCustomerRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	query := `DELETE FROM customers WHERE id = $1`
 
-	_, err := DB.Exec(query, id)
+	_, err := DB.ExecContext(ctx, query, id)
 	if err != nil {
-		return err
+		return wrapQueryError(ctx, err)
 	}
 	return nil
 }
 
-// CategoryRepository handles category database operations
-type CategoryRepository struct{}
+// SoftDelete marks a customer deleted, hiding it from the other queries until it
+// is restored or purged. Its orders are kept.
+func (r *PostgresCustomerRepository) SoftDelete(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `UPDATE customers SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL`
+	return wrapQueryError(ctx, execOne(ctx, DB, query, time.Now(), id))
+}
+
+// Restore undoes SoftDelete
+func (r *PostgresCustomerRepository) Restore(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `UPDATE customers SET deleted_at = NULL, updated_at = $1 WHERE id = $2 AND deleted_at IS NOT NULL`
+	return wrapQueryError(ctx, execOne(ctx, DB, query, time.Now(), id))
+}
+
+// GetDeleted returns the soft-deleted customers, most recently deleted first
+func (r *PostgresCustomerRepository) GetDeleted(ctx context.Context) ([]models.Customer, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, email, name, phone, created_at, updated_at, deleted_at
+			  FROM customers WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, id`
+
+	rows, err := DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	customers := []models.Customer{}
+	for rows.Next() {
+		var customer models.Customer
+		err := rows.Scan(&customer.ID, &customer.Email, &customer.Name, &customer.Phone,
+			&customer.CreatedAt, &customer.UpdatedAt, &customer.DeletedAt)
+		if err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		customers = append(customers, customer)
+	}
+	return customers, wrapQueryError(ctx, rows.Err())
+}
+
+// Purge permanently deletes customers soft-deleted before the cutoff. Customers
+// with orders are kept so that the order history survives.
+func (r *PostgresCustomerRepository) Purge(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `DELETE FROM customers c
+			  WHERE c.deleted_at < $1
+			  AND NOT EXISTS (SELECT 1 FROM orders o WHERE o.customer_id = c.id)`
+
+	result, err := DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, wrapQueryError(ctx, err)
+	}
+	purged, err := result.RowsAffected()
+	return int(purged), wrapQueryError(ctx, err)
+}
+
+// categoryTreeLockID is the Postgres advisory lock key held while moving a
+// category, so that concurrent moves cannot together form a cycle
+const categoryTreeLockID = 7263412002
+
+// PostgresCategoryRepository handles category database operations
+type PostgresCategoryRepository struct{}
+
+func (r *PostgresCategoryRepository) Create(ctx context.Context, category *models.Category) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
 
-func (r *CategoryRepository) Create(category *models.Category) error {
 	category.ID = uuid.New()
 	category.CreatedAt = time.Now()
 	category.UpdatedAt = time.Now()
 
 	// Calculate level and path
 	if category.ParentID != nil {
-		parent, err := r.GetByID(*category.ParentID)
+		parent, err := r.GetByID(ctx, *category.ParentID)
 		if err != nil {
 			return err
 		}
@@ -82,31 +172,37 @@ func (r *CategoryRepository) Create(category *models.Category) error {
 	query := `INSERT INTO categories (id, name, description, parent_id, level, path, created_at, updated_at)
 			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
 
-	_, err := DB.Exec(query, category.ID, category.Name, category.Description,
+	_, err := DB.ExecContext(ctx, query, category.ID, category.Name, category.Description,
 		category.ParentID, category.Level, category.Path, category.CreatedAt, category.UpdatedAt)
-	return err
+	return wrapQueryError(ctx, err)
 }
 
-func (r *CategoryRepository) GetByID(id uuid.UUID) (*models.Category, error) {
+func (r *PostgresCategoryRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Category, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	category := &models.Category{}
 	query := `SELECT id, name, description, parent_id, level, path, created_at, updated_at
-			  FROM categories WHERE id = $1`
+			  FROM categories WHERE id = $1 AND deleted_at IS NULL`
 
-	err := DB.QueryRow(query, id).Scan(&category.ID, &category.Name, &category.Description,
+	err := DB.QueryRowContext(ctx, query, id).Scan(&category.ID, &category.Name, &category.Description,
 		&category.ParentID, &category.Level, &category.Path, &category.CreatedAt, &category.UpdatedAt)
 	if err != nil {
-		return nil, err
+		return nil, wrapQueryError(ctx, err)
 	}
 	return category, nil
 }
 
-func (r *CategoryRepository) GetAll() ([]models.Category, error) {
+func (r *PostgresCategoryRepository) GetAll(ctx context.Context) ([]models.Category, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	query := `SELECT id, name, description, parent_id, level, path, created_at, updated_at
-			  FROM categories ORDER BY path`
+			  FROM categories WHERE deleted_at IS NULL ORDER BY path`
 
-	rows, err := DB.Query(query)
+	rows, err := DB.QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return nil, wrapQueryError(ctx, err)
 	}
 	defer rows.Close()
 
@@ -116,20 +212,23 @@ func (r *CategoryRepository) GetAll() ([]models.Category, error) {
 		err := rows.Scan(&category.ID, &category.Name, &category.Description,
 			&category.ParentID, &category.Level, &category.Path, &category.CreatedAt, &category.UpdatedAt)
 		if err != nil {
-			return nil, err
+			return nil, wrapQueryError(ctx, err)
 		}
 		categories = append(categories, category)
 	}
 	return categories, nil
 }
 
-func (r *CategoryRepository) GetChildren(parentID uuid.UUID) ([]models.Category, error) {
+func (r *PostgresCategoryRepository) GetChildren(ctx context.Context, parentID uuid.UUID) ([]models.Category, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	query := `SELECT id, name, description, parent_id, level, path, created_at, updated_at
-			  FROM categories WHERE parent_id = $1 ORDER BY name`
+			  FROM categories WHERE parent_id = $1 AND deleted_at IS NULL ORDER BY name`
 
-	rows, err := DB.Query(query, parentID)
+	rows, err := DB.QueryContext(ctx, query, parentID)
 	if err != nil {
-		return nil, err
+		return nil, wrapQueryError(ctx, err)
 	}
 	defer rows.Close()
 
@@ -139,281 +238,4008 @@ func (r *CategoryRepository) GetChildren(parentID uuid.UUID) ([]models.Category,
 		err := rows.Scan(&category.ID, &category.Name, &category.Description,
 			&category.ParentID, &category.Level, &category.Path, &category.CreatedAt, &category.UpdatedAt)
 		if err != nil {
-			return nil, err
+			return nil, wrapQueryError(ctx, err)
 		}
 		categories = append(categories, category)
 	}
 	return categories, nil
 }
 
-func (r *CategoryRepository) Delete(id uuid.UUID, level int) error {
-	query := `DELETE FROM categories WHERE id = $1 and level = $2`
+// GetTree loads the tree with its product counts in one query
+func (r *PostgresCategoryRepository) GetTree(ctx context.Context, rootID *uuid.UUID, depth int) ([]models.Category, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
 
-	_, err := DB.Exec(query, id, level)
-	return err
+	query := `SELECT c.id, c.name, c.description, c.parent_id, c.level, c.path, c.created_at, c.updated_at,
+				(SELECT COUNT(*) FROM products p JOIN categories pc ON pc.id = p.category_id
+				 WHERE p.deleted_at IS NULL AND (pc.id = c.id OR pc.path LIKE ` + pathPrefixPattern("c.path") + `))
+			  FROM categories c`
+	where := ` WHERE c.deleted_at IS NULL`
+	rootLevel := "0"
+	var args []interface{}
+	if rootID != nil {
+		args = append(args, *rootID)
+		query += ` JOIN categories root ON root.id = $1 AND root.deleted_at IS NULL`
+		where += ` AND (c.id = root.id OR c.path LIKE ` + pathPrefixPattern("root.path") + `)`
+		rootLevel = "root.level"
+	}
+	if depth >= 0 {
+		args = append(args, depth)
+		where += fmt.Sprintf(` AND c.level <= %s + $%d`, rootLevel, len(args))
+	}
+
+	rows, err := DB.QueryContext(ctx, query+where+` ORDER BY c.path`, args...)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	var categories []models.Category
+	for rows.Next() {
+		var category models.Category
+		var count int
+		err := rows.Scan(&category.ID, &category.Name, &category.Description, &category.ParentID,
+			&category.Level, &category.Path, &category.CreatedAt, &category.UpdatedAt, &count)
+		if err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		category.ProductCount = &count
+		categories = append(categories, category)
+	}
+	if rootID != nil && len(categories) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return models.CategoryTree(categories), nil
 }
 
-// ProductRepository handles product database operations
-type ProductRepository struct{}
+// Update renames and reparents a category in one transaction, rewriting the
+// path and level of its whole subtree. Deleted subcategories are rewritten too
+// so that they are restored in place.
+func (r *PostgresCategoryRepository) Update(ctx context.Context, category *models.Category) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
 
-func (r *ProductRepository) Create(product *models.Product) error {
-	product.ID = uuid.New()
-	product.CreatedAt = time.Now()
-	product.UpdatedAt = time.Now()
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
 
-	query := `INSERT INTO products (id, name, description, price, category_id, stock, image_url, created_at, updated_at)
-			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, categoryTreeLockID); err != nil {
+		return wrapQueryError(ctx, err)
+	}
 
-	_, err := DB.Exec(query, product.ID, product.Name, product.Description, product.Price,
-		product.CategoryID, product.Stock, product.ImageURL, product.CreatedAt, product.UpdatedAt)
-	return err
-}
+	var oldPath string
+	var oldLevel int
+	err = tx.QueryRowContext(ctx, `SELECT path, level, created_at FROM categories
+			WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, category.ID).Scan(&oldPath, &oldLevel, &category.CreatedAt)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
 
-func (r *ProductRepository) GetByID(id uuid.UUID) (*models.Product, error) {
-	product := &models.Product{}
-	query := `SELECT p.id, p.name, p.description, p.price, p.category_id, p.stock, p.image_url,
-			  p.created_at, p.updated_at, c.id, c.name, c.description, c.parent_id, c.level, c.path,
-			  c.created_at, c.updated_at
-			  FROM products p
-			  LEFT JOIN categories c ON p.category_id = c.id
-			  WHERE p.id = $1`
+	category.Level = 0
+	category.Path = "/" + category.Name
+	if category.ParentID != nil {
+		var parentPath string
+		var parentLevel int
+		err = tx.QueryRowContext(ctx, `SELECT path, level FROM categories WHERE id = $1 AND deleted_at IS NULL`,
+			*category.ParentID).Scan(&parentPath, &parentLevel)
+		if errors.Is(err, sql.ErrNoRows) {
+			return foreignKeyError("categories", "parent_id")
+		}
+		if err != nil {
+			return wrapQueryError(ctx, err)
+		}
+		if *category.ParentID == category.ID || parentPath == oldPath || strings.HasPrefix(parentPath, oldPath+"/") {
+			return ErrCategoryCycle
+		}
+		category.Level = parentLevel + 1
+		category.Path = parentPath + "/" + category.Name
 
-	err := DB.QueryRow(query, id).Scan(&product.ID, &product.Name, &product.Description,
-		&product.Price, &product.CategoryID, &product.Stock, &product.ImageURL,
-		&product.CreatedAt, &product.UpdatedAt, &product.Category.ID, &product.Category.Name,
-		&product.Category.Description, &product.Category.ParentID, &product.Category.Level,
-		&product.Category.Path, &product.Category.CreatedAt, &product.Category.UpdatedAt)
+		// Attribute names must stay unique along every path through the tree
+		var clash bool
+		err = tx.QueryRowContext(ctx, `SELECT EXISTS (
+				SELECT 1 FROM category_attributes a
+				JOIN categories ac ON ac.id = a.category_id
+				JOIN category_attributes b ON b.name = a.name
+				JOIN categories bc ON bc.id = b.category_id
+				WHERE (ac.id = $1 OR ac.path LIKE `+pathPrefixPattern("$2")+`)
+					AND (bc.id = $3 OR $4 LIKE `+pathPrefixPattern("bc.path")+`))`,
+			category.ID, oldPath, *category.ParentID, parentPath).Scan(&clash)
+		if err != nil {
+			return wrapQueryError(ctx, err)
+		}
+		if clash {
+			return ErrDuplicateAttribute
+		}
+	}
+	category.UpdatedAt = time.Now()
+
+	// Subcategories keep the part of their path below the category
+	subtree := `UPDATE categories SET path = $1 || substr(path, length($2) + 1), level = level + $3, updated_at = $4
+				WHERE path LIKE ` + pathPrefixPattern("$2")
+	_, err = tx.ExecContext(ctx, subtree, category.Path, oldPath, category.Level-oldLevel, category.UpdatedAt)
 	if err != nil {
-		return nil, err
+		return wrapQueryError(ctx, err)
 	}
-	return product, nil
+
+	query := `UPDATE categories SET name = $1, description = $2, parent_id = $3, level = $4, path = $5, updated_at = $6
+			  WHERE id = $7`
+	_, err = tx.ExecContext(ctx, query, category.Name, category.Description, category.ParentID,
+		category.Level, category.Path, category.UpdatedAt, category.ID)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	// Moved products may inherit a different reorder threshold
+	if err := syncStockAlerts(ctx, tx, categorySubtreeProducts, category.ID); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+func (r *PostgresCategoryRepository) Delete(ctx context.Context, id uuid.UUID, level int) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `DELETE FROM categories WHERE id = $1 and level = $2`
+
+	_, err := DB.ExecContext(ctx, query, id, level)
+	return wrapQueryError(ctx, err)
 }
 
-func (r *ProductRepository) UpdateStock(product *models.Product) error {
-	query := `UPDATE products SET stock = $1, updated_at = $2 WHERE id = $3`
+// SoftDelete marks a category, its subcategories and their products deleted
+// with one timestamp, so that Restore can bring back exactly what was deleted
+// together. The deleted products are taken out of carts.
+func (r *PostgresCategoryRepository) SoftDelete(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
 
-	_, err := DB.Exec(query, product.Stock, time.Now(), product.ID)
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return wrapQueryError(ctx, err)
 	}
-	return nil
+	defer tx.Rollback()
+
+	var path string
+	err = tx.QueryRowContext(ctx, `SELECT path FROM categories WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, id).Scan(&path)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	// Postgres keeps microseconds, so truncate to compare equal on restore
+	now := time.Now().Truncate(time.Microsecond)
+	subtree := `SELECT id FROM categories WHERE id = $2 OR path LIKE ` + pathPrefixPattern("$3")
+
+	queries := []string{
+		`UPDATE categories SET deleted_at = $1 WHERE deleted_at IS NULL AND id IN (` + subtree + `)`,
+		`UPDATE products SET deleted_at = $1 WHERE deleted_at IS NULL AND category_id IN (` + subtree + `)`,
+		`DELETE FROM cart_items WHERE product_id IN (
+			SELECT id FROM products WHERE deleted_at = $1 AND category_id IN (` + subtree + `))`,
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query, now, id, path); err != nil {
+			return wrapQueryError(ctx, err)
+		}
+	}
+
+	return wrapQueryError(ctx, tx.Commit())
 }
 
-func (r *ProductRepository) GetAll() ([]models.Product, error) {
-	query := `SELECT p.id, p.name, p.description, p.price, p.category_id, p.stock, p.image_url,
-			  p.created_at, p.updated_at, c.id, c.name, c.description, c.parent_id, c.level, c.path,
-			  c.created_at, c.updated_at
-			  FROM products p
-			  LEFT JOIN categories c ON p.category_id = c.id
-			  ORDER BY p.name`
+// Restore undoes SoftDelete, restoring the subcategories and products that were
+// deleted along with the category. A category whose parent is deleted cannot
+// be restored on its own.
+func (r *PostgresCategoryRepository) Restore(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
 
-	rows, err := DB.Query(query)
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return wrapQueryError(ctx, err)
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	var products []models.Product
-	for rows.Next() {
-		var product models.Product
-		err := rows.Scan(&product.ID, &product.Name, &product.Description,
-			&product.Price, &product.CategoryID, &product.Stock, &product.ImageURL,
-			&product.CreatedAt, &product.UpdatedAt, &product.Category.ID, &product.Category.Name,
-			&product.Category.Description, &product.Category.ParentID, &product.Category.Level,
-			&product.Category.Path, &product.Category.CreatedAt, &product.Category.UpdatedAt)
+	var parentID *uuid.UUID
+	var path string
+	var deletedAt time.Time
+	err = tx.QueryRowContext(ctx, `SELECT parent_id, path, deleted_at FROM categories
+			WHERE id = $1 AND deleted_at IS NOT NULL FOR UPDATE`, id).Scan(&parentID, &path, &deletedAt)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if parentID != nil {
+		var parentDeleted bool
+		err = tx.QueryRowContext(ctx, `SELECT deleted_at IS NOT NULL FROM categories WHERE id = $1 FOR SHARE`, *parentID).Scan(&parentDeleted)
 		if err != nil {
-			return nil, err
+			return wrapQueryError(ctx, err)
+		}
+		if parentDeleted {
+			return ErrParentDeleted
 		}
-		products = append(products, product)
 	}
-	return products, nil
+
+	subtree := `SELECT id FROM categories WHERE deleted_at = $2 AND (id = $3 OR path LIKE ` + pathPrefixPattern("$4") + `)`
+
+	// Products first, while their categories still carry the deletion timestamp
+	queries := []string{
+		`UPDATE products SET deleted_at = NULL, updated_at = $1 WHERE deleted_at = $2 AND category_id IN (` + subtree + `)`,
+		`UPDATE categories SET deleted_at = NULL, updated_at = $1 WHERE deleted_at = $2 AND id IN (` + subtree + `)`,
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query, time.Now(), deletedAt, id, path); err != nil {
+			return wrapQueryError(ctx, err)
+		}
+	}
+
+	return wrapQueryError(ctx, tx.Commit())
 }
 
-func (r *ProductRepository) GetByCategory(categoryID uuid.UUID) ([]models.Product, error) {
-	query := `SELECT p.id, p.name, p.description, p.price, p.category_id, p.stock, p.image_url,
-			  p.created_at, p.updated_at, c.id, c.name, c.description, c.parent_id, c.level, c.path,
-			  c.created_at, c.updated_at
-			  FROM products p
-			  LEFT JOIN categories c ON p.category_id = c.id
-			  WHERE p.category_id = $1
-			  ORDER BY p.name`
+// GetDeleted returns the soft-deleted categories, most recently deleted first
+func (r *PostgresCategoryRepository) GetDeleted(ctx context.Context) ([]models.Category, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
 
-	rows, err := DB.Query(query, categoryID)
+	query := `SELECT id, name, description, parent_id, level, path, created_at, updated_at, deleted_at
+			  FROM categories WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, path`
+
+	rows, err := DB.QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return nil, wrapQueryError(ctx, err)
 	}
 	defer rows.Close()
 
-	var products []models.Product
+	categories := []models.Category{}
 	for rows.Next() {
-		var product models.Product
-		err := rows.Scan(&product.ID, &product.Name, &product.Description,
-			&product.Price, &product.CategoryID, &product.Stock, &product.ImageURL,
-			&product.CreatedAt, &product.UpdatedAt, &product.Category.ID, &product.Category.Name,
-			&product.Category.Description, &product.Category.ParentID, &product.Category.Level,
-			&product.Category.Path, &product.Category.CreatedAt, &product.Category.UpdatedAt)
+		var category models.Category
+		err := rows.Scan(&category.ID, &category.Name, &category.Description, &category.ParentID,
+			&category.Level, &category.Path, &category.CreatedAt, &category.UpdatedAt, &category.DeletedAt)
 		if err != nil {
-			return nil, err
+			return nil, wrapQueryError(ctx, err)
 		}
-		products = append(products, product)
+		categories = append(categories, category)
 	}
-	return products, nil
+	return categories, wrapQueryError(ctx, rows.Err())
 }
 
-// GetAveragePriceByCategory returns average price for a category
-func (r *ProductRepository) GetAveragePriceByCategory(categoryID uuid.UUID) (*models.CategoryPrice, error) {
-	query := `SELECT c.id, c.name, AVG(p.price) as average_price, COUNT(p.id) as product_count
-			  FROM categories c
-			  LEFT JOIN products p ON c.id = p.category_id
-			  WHERE c.id = $1
-			  GROUP BY c.id, c.name`
+// Purge permanently deletes categories soft-deleted before the cutoff. A
+// category is only purged once its whole subtree is purgeable and holds no
+// products, so purging never cascades into live rows or order history.
+func (r *PostgresCategoryRepository) Purge(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
 
-	var categoryPrice models.CategoryPrice
-	err := DB.QueryRow(query, categoryID).Scan(&categoryPrice.CategoryID, &categoryPrice.CategoryName,
-		&categoryPrice.AveragePrice, &categoryPrice.ProductCount)
+	query := `DELETE FROM categories c
+			  WHERE c.deleted_at < $1
+			  AND NOT EXISTS (
+				  SELECT 1 FROM categories d
+				  WHERE d.path LIKE ` + pathPrefixPattern("c.path") + `
+				  AND (d.deleted_at IS NULL OR d.deleted_at >= $1))
+			  AND NOT EXISTS (
+				  SELECT 1 FROM products p
+				  JOIN categories d ON d.id = p.category_id
+				  WHERE d.id = c.id OR d.path LIKE ` + pathPrefixPattern("c.path") + `)`
+
+	result, err := DB.ExecContext(ctx, query, before)
 	if err != nil {
-		return nil, err
+		return 0, wrapQueryError(ctx, err)
 	}
-	return &categoryPrice, nil
+	purged, err := result.RowsAffected()
+	return int(purged), wrapQueryError(ctx, err)
 }
 
-func (r *ProductRepository) Delete(id uuid.UUID) error {
-	query := `DELETE FROM products WHERE id = $1`
+// PostgresProductRepository handles product database operations
+// CreateAttribute defines an attribute on a category. The category and its
+// ancestors are locked root first, so definitions made concurrently anywhere
+// in one tree cannot both pass the duplicate check.
+func (r *PostgresCategoryRepository) CreateAttribute(ctx context.Context, attribute *models.AttributeDefinition) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
 
-	_, err := DB.Exec(query, id)
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return wrapQueryError(ctx, err)
 	}
-	return nil
-}
+	defer tx.Rollback()
 
-// OrderRepository handles order database operations
-type OrderRepository struct{}
+	var path string
+	err = tx.QueryRowContext(ctx, `SELECT path FROM categories WHERE id = $1 AND deleted_at IS NULL`,
+		attribute.CategoryID).Scan(&path)
+	if errors.Is(err, sql.ErrNoRows) {
+		return foreignKeyError("category_attributes", "category_id")
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
 
-func (r *OrderRepository) Create(order *models.Order) error {
-	order.ID = uuid.New()
-	order.CreatedAt = time.Now()
-	order.UpdatedAt = time.Now()
+	lock := `SELECT id FROM categories WHERE id = $1 OR $2 LIKE ` + pathPrefixPattern("path") + ` ORDER BY level FOR UPDATE`
+	if _, err := tx.ExecContext(ctx, lock, attribute.CategoryID, path); err != nil {
+		return wrapQueryError(ctx, err)
+	}
 
-	tx, err := DB.Begin()
+	// The name must not appear on the category, above it or below it
+	var exists bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (
+			SELECT 1 FROM category_attributes a
+			JOIN categories c ON c.id = a.category_id
+			WHERE a.name = $1 AND (c.id = $2 OR $3 LIKE `+pathPrefixPattern("c.path")+`
+				OR c.path LIKE `+pathPrefixPattern("$3")+`))`,
+		attribute.Name, attribute.CategoryID, path).Scan(&exists)
 	if err != nil {
-		return err
+		return wrapQueryError(ctx, err)
+	}
+	if exists {
+		return ErrDuplicateAttribute
 	}
 
-	// Insert order
-	query := `INSERT INTO orders (id, customer_id, status, total, created_at, updated_at)
-			  VALUES ($1, $2, $3, $4, $5, $6)`
+	attribute.CreatedAt = time.Now()
+	attribute.UpdatedAt = time.Now()
+
+	query := `INSERT INTO category_attributes (category_id, name, type, unit, allowed_values, required, created_at, updated_at)
+			  VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8)`
 
-	_, err = tx.Exec(query, order.ID, order.CustomerID, order.Status, order.Total,
-		order.CreatedAt, order.UpdatedAt)
+	_, err = tx.ExecContext(ctx, query, attribute.CategoryID, attribute.Name, attribute.Type, attribute.Unit,
+		pq.Array(attribute.Values), attribute.Required, attribute.CreatedAt, attribute.UpdatedAt)
 	if err != nil {
-		return err
+		return wrapQueryError(ctx, err)
 	}
+	return wrapQueryError(ctx, tx.Commit())
+}
 
-	// Insert order items
-	for i := range order.Items {
-		order.Items[i].ID = uuid.New()
-		order.Items[i].OrderID = order.ID
+// GetAttributeSchema returns the attributes defined on a category and its
+// ancestors. A missing category has an empty schema.
+func (r *PostgresCategoryRepository) GetAttributeSchema(ctx context.Context, categoryID uuid.UUID) (models.AttributeSchema, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
 
-		itemQuery := `INSERT INTO order_items (id, order_id, product_id, quantity, price)
-					  VALUES ($1, $2, $3, $4, $5)`
+	query := `SELECT a.category_id, a.name, a.type, COALESCE(a.unit, ''), a.allowed_values, a.required,
+			  a.created_at, a.updated_at
+			  FROM categories t
+			  JOIN categories c ON c.id = t.id OR t.path LIKE ` + pathPrefixPattern("c.path") + `
+			  JOIN category_attributes a ON a.category_id = c.id
+			  WHERE t.id = $1 AND t.deleted_at IS NULL AND c.deleted_at IS NULL
+			  ORDER BY a.name`
+
+	rows, err := DB.QueryContext(ctx, query, categoryID)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
 
-		_, err = tx.Exec(itemQuery, order.Items[i].ID, order.Items[i].OrderID,
-			order.Items[i].ProductID, order.Items[i].Quantity, order.Items[i].Price)
+	schema := models.AttributeSchema{}
+	for rows.Next() {
+		var attribute models.AttributeDefinition
+		err := rows.Scan(&attribute.CategoryID, &attribute.Name, &attribute.Type, &attribute.Unit,
+			pq.Array(&attribute.Values), &attribute.Required, &attribute.CreatedAt, &attribute.UpdatedAt)
 		if err != nil {
-			return err
+			return nil, wrapQueryError(ctx, err)
 		}
+		schema = append(schema, attribute)
 	}
-
-	return tx.Commit()
+	return schema, nil
 }
 
-func (r *OrderRepository) UpdateStatus(order *models.Order) error {
-	query := `UPDATE orders SET status = $1, updated_at = $2 WHERE id = $3`
+// DeleteAttribute removes an attribute definition and the values stored for
+// it on the products of the category and its subcategories
+func (r *PostgresCategoryRepository) DeleteAttribute(ctx context.Context, categoryID uuid.UUID, name string) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
 
-	_, err := DB.Exec(query, order.Status, time.Now(), order.ID)
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return wrapQueryError(ctx, err)
 	}
+	defer tx.Rollback()
 
-	return nil
+	err = execOne(ctx, tx, `DELETE FROM category_attributes WHERE category_id = $1 AND name = $2`, categoryID, name)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	query := `UPDATE products SET attributes = attributes - $2, updated_at = $3
+			  WHERE attributes ? $2 AND category_id IN (
+				SELECT d.id FROM categories root
+				JOIN categories d ON d.id = root.id OR d.path LIKE ` + pathPrefixPattern("root.path") + `
+				WHERE root.id = $1)`
+
+	if _, err := tx.ExecContext(ctx, query, categoryID, name, time.Now()); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
 }
 
-func (r *OrderRepository) GetByID(id uuid.UUID) (*models.Order, error) {
-	order := &models.Order{}
-	query := `SELECT o.id, o.customer_id, o.status, o.total, o.created_at, o.updated_at,
-			  c.id, c.email, c.name, c.phone, c.created_at, c.updated_at
-			  FROM orders o
-			  LEFT JOIN customers c ON o.customer_id = c.id
-			  WHERE o.id = $1`
+type PostgresProductRepository struct{}
 
-	err := DB.QueryRow(query, id).Scan(&order.ID, &order.CustomerID, &order.Status, &order.Total,
-		&order.CreatedAt, &order.UpdatedAt, &order.Customer.ID, &order.Customer.Email,
-		&order.Customer.Name, &order.Customer.Phone, &order.Customer.CreatedAt, &order.Customer.UpdatedAt)
+func (r *PostgresProductRepository) Create(ctx context.Context, product *models.Product) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	product.ID = uuid.New()
+	product.CreatedAt = time.Now()
+	product.UpdatedAt = time.Now()
+
+	if product.Price.Currency == "" {
+		product.Price.Currency = models.DefaultCurrency
+	}
+
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return wrapQueryError(ctx, err)
 	}
+	defer tx.Rollback()
 
-	// Get order items
-	itemsQuery := `SELECT oi.id, oi.order_id, oi.product_id, oi.quantity, oi.price,
-				   p.id, p.name, p.description, p.price, p.category_id, p.stock, p.image_url,
-				   p.created_at, p.updated_at
-				   FROM order_items oi
-				   LEFT JOIN products p ON oi.product_id = p.id
-				   WHERE oi.order_id = $1`
+	// Selecting from categories keeps products out of deleted categories, which
+	// the foreign key alone would allow
+	query := `INSERT INTO products (id, name, description, price, currency, category_id, stock, image_url, attributes, created_at, updated_at)
+			  SELECT $1, $2, $3, $4, $5, id, $6, $7, $8, $9, $10
+			  FROM categories WHERE id = $11 AND deleted_at IS NULL`
 
-	rows, err := DB.Query(itemsQuery, id)
+	err = execOne(ctx, tx, query, product.ID, product.Name, product.Description, product.Price.Amount,
+		product.Price.Currency, product.Stock, product.ImageURL, product.Attributes, product.CreatedAt, product.UpdatedAt,
+		product.CategoryID)
+	if err == sql.ErrNoRows {
+		return foreignKeyError("products", "category_id")
+	}
 	if err != nil {
-		return nil, err
+		return wrapQueryError(ctx, err)
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var item models.OrderItem
-		err := rows.Scan(&item.ID, &item.OrderID, &item.ProductID, &item.Quantity, &item.Price,
-			&item.Product.ID, &item.Product.Name, &item.Product.Description, &item.Product.Price,
-			&item.Product.CategoryID, &item.Product.Stock, &item.Product.ImageURL,
-			&item.Product.CreatedAt, &item.Product.UpdatedAt)
-		if err != nil {
-			return nil, err
-		}
-		order.Items = append(order.Items, item)
+	err = recordPriceChange(ctx, tx, &models.PriceChange{
+		ProductID: product.ID,
+		NewPrice:  product.Price,
+		Source:    models.PriceSourceCreated,
+		ChangedAt: product.CreatedAt,
+	})
+	if err != nil {
+		return wrapQueryError(ctx, err)
 	}
-
-	return order, nil
+	if err := adjustStock(ctx, tx, product.ID, nil, product.Stock, models.MovementInitial); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	if err := syncStockAlert(ctx, tx, product.ID); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
 }
 
-func (r *OrderRepository) GetByCustomer(customerID uuid.UUID) ([]models.Order, error) {
-	query := `SELECT o.id, o.customer_id, o.status, o.total, o.created_at, o.updated_at,
-          		     c.id, c.email, c.name, c.phone, c.created_at, c.updated_at
-			   FROM orders o
-			   LEFT JOIN customers c ON o.customer_id = c.id
-			   WHERE o.customer_id = $1
-			   ORDER BY o.created_at DESC`
+func (r *PostgresProductRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Product, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	product := &models.Product{}
+	query := `SELECT p.id, p.name, p.description, p.price, p.currency, p.category_id, p.stock, p.image_url, p.attributes,
+			  p.created_at, p.updated_at, c.id, c.name, c.description, c.parent_id, c.level, c.path,
+			  c.created_at, c.updated_at, sale.previous_price, sale.previous_currency
+			  FROM products p
+			  LEFT JOIN categories c ON p.category_id = c.id
+			  ` + productSaleJoin + `
+			  WHERE p.id = $1 AND p.deleted_at IS NULL`
 
-	rows, err := DB.Query(query, customerID)
+	var regularAmount sql.NullInt64
+	var regularCurrency sql.NullString
+	err := DB.QueryRowContext(ctx, query, id).Scan(&product.ID, &product.Name, &product.Description,
+		&product.Price.Amount, &product.Price.Currency, &product.CategoryID, &product.Stock, &product.ImageURL, &product.Attributes,
+		&product.CreatedAt, &product.UpdatedAt, &product.Category.ID, &product.Category.Name,
+		&product.Category.Description, &product.Category.ParentID, &product.Category.Level,
+		&product.Category.Path, &product.Category.CreatedAt, &product.Category.UpdatedAt,
+		&regularAmount, &regularCurrency)
 	if err != nil {
-		return nil, err
+		return nil, wrapQueryError(ctx, err)
 	}
-	defer rows.Close()
-
-	var orders []models.Order
-	for rows.Next() {
-		var order models.Order
-		err := rows.Scan(&order.ID, &order.CustomerID, &order.Status, &order.Total,
-			&order.CreatedAt, &order.UpdatedAt, &order.Customer.ID, &order.Customer.Email,
-			&order.Customer.Name, &order.Customer.Phone, &order.Customer.CreatedAt, &order.Customer.UpdatedAt)
+	product.RegularPrice = nullMoney(regularAmount, regularCurrency)
 
-		if err != nil {
-			return nil, err
-		}
-		orders = append(orders, order)
+	product.Variants, err = queryVariants(ctx, DB, `WHERE v.product_id = $1`, id)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
 	}
-	return orders, nil
+	product.SetPriceRange(product.Variants)
+	return product, nil
 }
 
-func (r *OrderRepository) Delete(id uuid.UUID) error {
-	query := `DELETE FROM orders WHERE id = $1`
-	_, err := DB.Exec(query, id)
-	return err
+// Update changes the fields set in update. Unset fields are left as stored
+// rather than rewritten, so concurrent stock reservations are not lost. A
+// changed price is recorded in the product's price history and a changed
+// stock in the inventory ledger.
+func (r *PostgresProductRepository) Update(ctx context.Context, id uuid.UUID, update models.ProductUpdate) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var amount *int64
+	var currency *string
+	if update.Price != nil {
+		amount, currency = &update.Price.Amount, &update.Price.Currency
+	}
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	// The subquery locks the row and keeps the price it had before the update
+	query := `UPDATE products p
+			  SET name = COALESCE($1, p.name), description = COALESCE($2, p.description),
+			      price = COALESCE($3, p.price), currency = COALESCE($4, p.currency),
+			      category_id = COALESCE($5, p.category_id), stock = COALESCE($6, p.stock),
+			      image_url = COALESCE($7, p.image_url), attributes = COALESCE($8, p.attributes), updated_at = $9
+			  FROM (SELECT id, price, currency, stock FROM products WHERE id = $10 FOR UPDATE) old
+			  WHERE p.id = old.id AND p.deleted_at IS NULL
+			  RETURNING old.price, old.currency, p.price, p.currency, old.stock, p.stock`
+
+	now := time.Now()
+	var oldPrice, newPrice models.Money
+	var oldStock, newStock int
+	err = tx.QueryRowContext(ctx, query, update.Name, update.Description, amount, currency,
+		update.CategoryID, update.Stock, update.ImageURL, update.Attributes, now, id).Scan(
+		&oldPrice.Amount, &oldPrice.Currency, &newPrice.Amount, &newPrice.Currency, &oldStock, &newStock)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if err := adjustStock(ctx, tx, id, nil, newStock-oldStock, models.MovementAdjustment); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	if err := syncStockAlert(ctx, tx, id); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if newPrice != oldPrice {
+		err := recordPriceChange(ctx, tx, &models.PriceChange{
+			ProductID: id,
+			OldPrice:  &oldPrice,
+			NewPrice:  newPrice,
+			Source:    models.PriceSourceUpdated,
+			ChangedAt: now,
+		})
+		if err != nil {
+			return wrapQueryError(ctx, err)
+		}
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// Upsert creates the products whose ID is unset or unknown and replaces the
+// fields of the rest, all in one transaction. Each existing product is locked
+// before it is checked, so orders reserving its stock wait for the import.
+func (r *PostgresProductRepository) Upsert(ctx context.Context, products []models.Product) (int, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	created := 0
+	for i := range products {
+		product := &products[i]
+		if product.ID == uuid.Nil {
+			product.ID = uuid.New()
+		}
+		product.UpdatedAt = time.Now()
+		if product.Price.Currency == "" {
+			product.Price.Currency = models.DefaultCurrency
+		}
+
+		inserted, err := upsertProduct(ctx, tx, product)
+		if err == nil {
+			err = syncStockAlert(ctx, tx, product.ID)
+		}
+		if err != nil {
+			return 0, &BatchError{Index: i, Err: wrapQueryError(ctx, err)}
+		}
+		if inserted {
+			created++
+		}
+	}
+	return created, wrapQueryError(ctx, tx.Commit())
+}
+
+// upsertProduct inserts or replaces one product within an import, reporting
+// whether it was inserted
+func upsertProduct(ctx context.Context, tx *sql.Tx, product *models.Product) (bool, error) {
+	var deleted, hasVariants, variantPriced bool
+	var oldPrice models.Money
+	var oldStock int
+	query := `SELECT p.deleted_at IS NOT NULL, p.price, p.currency, p.stock,
+			  EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = p.id),
+			  EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = p.id AND v.price IS NOT NULL)
+			  FROM products p WHERE p.id = $1 FOR UPDATE`
+
+	err := tx.QueryRowContext(ctx, query, product.ID).Scan(&deleted, &oldPrice.Amount, &oldPrice.Currency,
+		&oldStock, &hasVariants, &variantPriced)
+	if err == sql.ErrNoRows {
+		product.CreatedAt = product.UpdatedAt
+		query := `INSERT INTO products (id, name, description, price, currency, category_id, stock, image_url, attributes, created_at, updated_at)
+				  SELECT $1, $2, $3, $4, $5, id, $6, $7, $8, $9, $10
+				  FROM categories WHERE id = $11 AND deleted_at IS NULL`
+
+		err := execOne(ctx, tx, query, product.ID, product.Name, product.Description, product.Price.Amount,
+			product.Price.Currency, product.Stock, product.ImageURL, product.Attributes, product.CreatedAt,
+			product.UpdatedAt, product.CategoryID)
+		if err == sql.ErrNoRows {
+			return false, foreignKeyError("products", "category_id")
+		}
+		if err != nil {
+			return false, err
+		}
+		if err := adjustStock(ctx, tx, product.ID, nil, product.Stock, models.MovementInitial); err != nil {
+			return false, err
+		}
+		return true, recordPriceChange(ctx, tx, &models.PriceChange{
+			ProductID: product.ID,
+			NewPrice:  product.Price,
+			Source:    models.PriceSourceImported,
+			ChangedAt: product.CreatedAt,
+		})
+	}
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case deleted:
+		return false, ErrProductDeleted
+	case variantPriced && oldPrice.Currency != product.Price.Currency:
+		return false, ErrVariantCurrency
+	}
+
+	// The stock of a product with variants is the total of theirs, so it is kept
+	query = `UPDATE products p
+			 SET name = $1, description = $2, price = $3, currency = $4, category_id = c.id,
+			     stock = CASE WHEN $5 THEN p.stock ELSE $6 END, image_url = $7, attributes = $8, updated_at = $9
+			 FROM categories c
+			 WHERE p.id = $10 AND c.id = $11 AND c.deleted_at IS NULL
+			 RETURNING p.stock, p.created_at`
+
+	err = tx.QueryRowContext(ctx, query, product.Name, product.Description, product.Price.Amount,
+		product.Price.Currency, hasVariants, product.Stock, product.ImageURL, product.Attributes,
+		product.UpdatedAt, product.ID, product.CategoryID).Scan(&product.Stock, &product.CreatedAt)
+	if err == sql.ErrNoRows {
+		return false, foreignKeyError("products", "category_id")
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := adjustStock(ctx, tx, product.ID, nil, product.Stock-oldStock, models.MovementAdjustment); err != nil {
+		return false, err
+	}
+	if oldPrice == product.Price {
+		return false, nil
+	}
+	return false, recordPriceChange(ctx, tx, &models.PriceChange{
+		ProductID: product.ID,
+		OldPrice:  &oldPrice,
+		NewPrice:  product.Price,
+		Source:    models.PriceSourceImported,
+		ChangedAt: product.UpdatedAt,
+	})
+}
+
+// List returns one page of products matching filter. Pages are keyset
+// paginated on the sort column and ID, so rows added or removed between
+// requests neither repeat nor shift later pages.
+func (r *PostgresProductRepository) List(ctx context.Context, filter models.ProductFilter) (*models.ProductPage, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	conditions := productFilterConditions(filter, arg)
+
+	orderBy := "p.name, p.id"
+	if cursor := filter.Cursor; cursor != nil {
+		switch filter.Sort {
+		case models.ProductSortPriceAsc:
+			conditions = append(conditions, fmt.Sprintf("(p.price, p.id) > (%s, %s)", arg(cursor.Price), arg(cursor.ID)))
+		case models.ProductSortPriceDesc:
+			conditions = append(conditions, fmt.Sprintf("(p.price, p.id) < (%s, %s)", arg(cursor.Price), arg(cursor.ID)))
+		case models.ProductSortNewest:
+			conditions = append(conditions, fmt.Sprintf("(p.created_at, p.id) < (%s, %s)", arg(cursor.CreatedAt), arg(cursor.ID)))
+		default:
+			conditions = append(conditions, fmt.Sprintf("(p.name, p.id) > (%s, %s)", arg(cursor.Name), arg(cursor.ID)))
+		}
+	}
+	switch filter.Sort {
+	case models.ProductSortPriceAsc:
+		orderBy = "p.price, p.id"
+	case models.ProductSortPriceDesc:
+		orderBy = "p.price DESC, p.id DESC"
+	case models.ProductSortNewest:
+		orderBy = "p.created_at DESC, p.id DESC"
+	}
+
+	where := "WHERE " + strings.Join(conditions, " AND ")
+
+	limit := productPageSize(filter.Limit)
+	query := `SELECT p.id, p.name, p.description, p.price, p.currency, p.category_id, p.stock, p.image_url, p.attributes,
+			  p.created_at, p.updated_at, c.id, c.name, c.description, c.parent_id, c.level, c.path,
+			  c.created_at, c.updated_at, pr.min_price, pr.max_price, sale.previous_price, sale.previous_currency
+			  FROM products p
+			  LEFT JOIN categories c ON p.category_id = c.id
+			  ` + productPriceRangeJoin + `
+			  ` + productSaleJoin + `
+			  ` + where + `
+			  ORDER BY ` + orderBy + `
+			  LIMIT ` + arg(limit+1)
+
+	rows, err := DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	products := []models.Product{}
+	for rows.Next() {
+		var product models.Product
+		var minPrice, maxPrice int64
+		var regularAmount sql.NullInt64
+		var regularCurrency sql.NullString
+		err := rows.Scan(&product.ID, &product.Name, &product.Description,
+			&product.Price.Amount, &product.Price.Currency, &product.CategoryID, &product.Stock, &product.ImageURL, &product.Attributes,
+			&product.CreatedAt, &product.UpdatedAt, &product.Category.ID, &product.Category.Name,
+			&product.Category.Description, &product.Category.ParentID, &product.Category.Level,
+			&product.Category.Path, &product.Category.CreatedAt, &product.Category.UpdatedAt,
+			&minPrice, &maxPrice, &regularAmount, &regularCurrency)
+		if err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		setPriceRange(&product, minPrice, maxPrice)
+		product.RegularPrice = nullMoney(regularAmount, regularCurrency)
+		products = append(products, product)
+	}
+	return newProductPage(filter.Sort, products, limit), nil
+}
+
+// Search finds products whose name or description match every term of query,
+// treating each term as a prefix. Results are ranked by relevance, with name
+// matches weighted above description matches.
+func (r *PostgresProductRepository) Search(ctx context.Context, query string, limit int) ([]models.ProductSearchResult, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	terms := models.SearchTerms(query)
+	if len(terms) == 0 {
+		return []models.ProductSearchResult{}, nil
+	}
+	// Terms hold only letters and digits, so they are safe tsquery operands
+	for i := range terms {
+		terms[i] += ":*"
+	}
+
+	headlineOptions := fmt.Sprintf("StartSel=%s, StopSel=%s, HighlightAll=true", models.HighlightStart, models.HighlightStop)
+	searchQuery := `SELECT p.id, p.name, p.description, p.price, p.currency, p.category_id, p.stock, p.image_url, p.attributes,
+					p.created_at, p.updated_at, c.id, c.name, c.description, c.parent_id, c.level, c.path,
+					c.created_at, c.updated_at, pr.min_price, pr.max_price,
+					ts_rank(p.search_vector, q.query) AS rank,
+					ts_headline('english', ` + htmlEscape("p.name") + `, q.query, $3),
+					ts_headline('english', ` + htmlEscape("COALESCE(p.description, '')") + `, q.query, $3)
+					FROM products p
+					CROSS JOIN (SELECT to_tsquery('english', $1) AS query) q
+					LEFT JOIN categories c ON p.category_id = c.id
+					` + productPriceRangeJoin + `
+					WHERE p.search_vector @@ q.query AND p.deleted_at IS NULL
+					ORDER BY rank DESC, p.name, p.id
+					LIMIT $2`
+
+	rows, err := DB.QueryContext(ctx, searchQuery, strings.Join(terms, " & "), searchLimit(limit), headlineOptions)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	results := []models.ProductSearchResult{}
+	for rows.Next() {
+		var result models.ProductSearchResult
+		var minPrice, maxPrice int64
+		product := &result.Product
+		err := rows.Scan(&product.ID, &product.Name, &product.Description,
+			&product.Price.Amount, &product.Price.Currency, &product.CategoryID, &product.Stock, &product.ImageURL, &product.Attributes,
+			&product.CreatedAt, &product.UpdatedAt, &product.Category.ID, &product.Category.Name,
+			&product.Category.Description, &product.Category.ParentID, &product.Category.Level,
+			&product.Category.Path, &product.Category.CreatedAt, &product.Category.UpdatedAt,
+			&minPrice, &maxPrice, &result.Rank, &result.Highlights.Name, &result.Highlights.Description)
+		if err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		setPriceRange(product, minPrice, maxPrice)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// searchLimit clamps a requested number of search results to the allowed range
+func searchLimit(limit int) int {
+	if limit <= 0 {
+		return models.DefaultSearchLimit
+	}
+	return min(limit, models.MaxSearchLimit)
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// execOne runs a statement that must affect a row, returning sql.ErrNoRows
+// when it matched none
+func execOne(ctx context.Context, db execer, query string, args ...interface{}) error {
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// productFilterConditions returns the SQL conditions on live products p selected
+// by a listing filter, excluding its cursor. arg binds a value and returns its placeholder.
+func productFilterConditions(filter models.ProductFilter, arg func(value interface{}) string) []string {
+	conditions := []string{"p.deleted_at IS NULL"}
+	if filter.CategoryID != nil {
+		// Descendants share the category's path as a prefix; LIKE wildcards in names are escaped
+		conditions = append(conditions, `p.category_id IN (
+				SELECT d.id FROM categories root
+				JOIN categories d ON d.id = root.id
+					OR d.path LIKE `+pathPrefixPattern("root.path")+`
+				WHERE root.id = `+arg(*filter.CategoryID)+`)`)
+	}
+	if filter.MinPrice != nil {
+		conditions = append(conditions, "p.currency = "+arg(filter.MinPrice.Currency), "p.price >= "+arg(filter.MinPrice.Amount))
+	}
+	if filter.MaxPrice != nil {
+		conditions = append(conditions, "p.currency = "+arg(filter.MaxPrice.Currency), "p.price <= "+arg(filter.MaxPrice.Amount))
+	}
+	if filter.InStock {
+		conditions = append(conditions, "p.stock > 0")
+	}
+	for _, attribute := range filter.Attributes {
+		name := arg(attribute.Name)
+		if attribute.Value != nil {
+			conditions = append(conditions, "p.attributes ->> "+name+" = "+arg(*attribute.Value))
+		}
+		// The CASE keeps non-number values from reaching the cast
+		number := "(CASE WHEN jsonb_typeof(p.attributes -> " + name + ") = 'number' THEN (p.attributes ->> " + name + ")::numeric END)"
+		if attribute.Min != nil {
+			conditions = append(conditions, number+" >= "+arg(*attribute.Min))
+		}
+		if attribute.Max != nil {
+			conditions = append(conditions, number+" <= "+arg(*attribute.Max))
+		}
+		if attribute.Value == nil && attribute.Min == nil && attribute.Max == nil {
+			conditions = append(conditions, "p.attributes ? "+name)
+		}
+	}
+	return conditions
+}
+
+// pathPrefixPattern returns a LIKE pattern matching the paths below the category
+// path held in column, with LIKE wildcards in the path escaped
+func pathPrefixPattern(column string) string {
+	return `replace(replace(replace(` + column + `, '\', '\\'), '%', '\%'), '_', '\_') || '/%'`
+}
+
+// htmlEscape returns an SQL expression that escapes the text of expression as
+// html.EscapeString does, so that search highlights can be rendered as HTML
+func htmlEscape(expression string) string {
+	return `replace(replace(replace(replace(replace(` + expression +
+		`, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&#34;'), '''', '&#39;')`
+}
+
+// productPriceRangeJoin joins the lowest and highest selling price of product p
+// across its variants as pr.min_price and pr.max_price. Products without
+// variants sell at their own price.
+const productPriceRangeJoin = `CROSS JOIN LATERAL (
+	SELECT COALESCE(MIN(COALESCE(v.price, p.price)), p.price) AS min_price,
+	       COALESCE(MAX(COALESCE(v.price, p.price)), p.price) AS max_price
+	FROM product_variants v WHERE v.product_id = p.id) pr`
+
+// productSaleJoin joins the active sale that set product p's current price as
+// sale. Its previous price is the product's regular price.
+const productSaleJoin = `LEFT JOIN price_schedules sale ON sale.product_id = p.id AND sale.status = 'active'
+	AND sale.price = p.price AND sale.currency = p.currency`
+
+// setPriceRange sets a product's price range from amounts in its currency
+func setPriceRange(product *models.Product, minAmount, maxAmount int64) {
+	minPrice := models.NewMoney(minAmount, product.Price.Currency)
+	maxPrice := models.NewMoney(maxAmount, product.Price.Currency)
+	product.MinPrice, product.MaxPrice = &minPrice, &maxPrice
+}
+
+// GetFacets counts the products matching filter per category (including
+// descendants), per price bucket and by availability. The counts are taken
+// from one snapshot so they agree with each other.
+func (r *PostgresProductRepository) GetFacets(ctx context.Context, filter models.ProductFilter, bucketEdges []models.Money) (*models.ProductFacets, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	// filtered builds the WHERE clause for filter with its own argument list
+	filtered := func() (string, []interface{}, func(interface{}) string) {
+		var args []interface{}
+		arg := func(value interface{}) string {
+			args = append(args, value)
+			return fmt.Sprintf("$%d", len(args))
+		}
+		return "WHERE " + strings.Join(productFilterConditions(filter, arg), " AND "), args, arg
+	}
+
+	facets := &models.ProductFacets{Categories: []models.CategoryFacet{}}
+
+	where, args, _ := filtered()
+	query := `SELECT COUNT(*), COUNT(*) FILTER (WHERE p.stock > 0) FROM products p ` + where
+	if err := tx.QueryRowContext(ctx, query, args...).Scan(&facets.Total, &facets.Availability.InStock); err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	facets.Availability.OutOfStock = facets.Total - facets.Availability.InStock
+
+	where, args, _ = filtered()
+	query = `SELECT c.id, c.name, c.path, c.level, COUNT(p.id)
+			 FROM categories c
+			 JOIN categories pc ON pc.id = c.id OR pc.path LIKE ` + pathPrefixPattern("c.path") + `
+			 JOIN products p ON p.category_id = pc.id
+			 ` + where + ` AND c.deleted_at IS NULL
+			 GROUP BY c.id, c.name, c.path, c.level
+			 ORDER BY c.path`
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	for rows.Next() {
+		var facet models.CategoryFacet
+		if err := rows.Scan(&facet.CategoryID, &facet.CategoryName, &facet.Path, &facet.Level, &facet.ProductCount); err != nil {
+			rows.Close()
+			return nil, wrapQueryError(ctx, err)
+		}
+		facets.Categories = append(facets.Categories, facet)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+
+	facets.PriceBuckets = models.NewPriceBuckets(bucketEdges)
+	if len(bucketEdges) > 0 {
+		amounts := make([]int64, len(bucketEdges))
+		for i, edge := range bucketEdges {
+			amounts[i] = edge.Amount
+		}
+
+		// width_bucket returns 0 below the first edge and i for edges[i-1] <= price < edges[i]
+		where, args, arg := filtered()
+		where += " AND p.currency = " + arg(bucketEdges[0].Currency)
+		query = `SELECT width_bucket(p.price, ` + arg(pq.Array(amounts)) + `::BIGINT[]) AS bucket, COUNT(*)
+				 FROM products p ` + where + `
+				 GROUP BY bucket`
+
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var bucket, count int
+			if err := rows.Scan(&bucket, &count); err != nil {
+				return nil, wrapQueryError(ctx, err)
+			}
+			if bucket > 0 {
+				facets.PriceBuckets[bucket-1].ProductCount = count
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+	}
+
+	return facets, nil
+}
+
+// productPageSize clamps a requested page size to the allowed range
+func productPageSize(limit int) int {
+	if limit <= 0 {
+		return models.DefaultProductPageSize
+	}
+	return min(limit, models.MaxProductPageSize)
+}
+
+// newProductPage trims a result fetched with one extra row to the page size,
+// using the extra row to tell whether another page follows
+func newProductPage(sort string, products []models.Product, limit int) *models.ProductPage {
+	page := &models.ProductPage{Products: products}
+	if len(products) > limit {
+		page.Products = products[:limit]
+		page.NextCursor = models.NewProductCursor(sort, products[limit-1]).Encode()
+	}
+	return page
+}
+
+func (r *PostgresProductRepository) GetByCategory(ctx context.Context, categoryID uuid.UUID) ([]models.Product, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT p.id, p.name, p.description, p.price, p.currency, p.category_id, p.stock, p.image_url, p.attributes,
+			  p.created_at, p.updated_at, c.id, c.name, c.description, c.parent_id, c.level, c.path,
+			  c.created_at, c.updated_at, pr.min_price, pr.max_price
+			  FROM products p
+			  LEFT JOIN categories c ON p.category_id = c.id
+			  ` + productPriceRangeJoin + `
+			  WHERE p.category_id = $1 AND p.deleted_at IS NULL
+			  ORDER BY p.name`
+
+	rows, err := DB.QueryContext(ctx, query, categoryID)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	var products []models.Product
+	for rows.Next() {
+		var product models.Product
+		var minPrice, maxPrice int64
+		err := rows.Scan(&product.ID, &product.Name, &product.Description,
+			&product.Price.Amount, &product.Price.Currency, &product.CategoryID, &product.Stock, &product.ImageURL, &product.Attributes,
+			&product.CreatedAt, &product.UpdatedAt, &product.Category.ID, &product.Category.Name,
+			&product.Category.Description, &product.Category.ParentID, &product.Category.Level,
+			&product.Category.Path, &product.Category.CreatedAt, &product.Category.UpdatedAt,
+			&minPrice, &maxPrice)
+		if err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		setPriceRange(&product, minPrice, maxPrice)
+		products = append(products, product)
+	}
+	return products, nil
+}
+
+// GetAveragePriceByCategory returns average price for a category
+func (r *PostgresProductRepository) GetAveragePriceByCategory(ctx context.Context, categoryID uuid.UUID) (*models.CategoryPrice, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT c.id, c.name, COALESCE(ROUND(AVG(p.price)), 0)::BIGINT as average_price,
+			  COALESCE(MIN(p.currency), $2) as currency, COUNT(p.id) as product_count
+			  FROM categories c
+			  LEFT JOIN products p ON c.id = p.category_id AND p.deleted_at IS NULL
+			  WHERE c.id = $1 AND c.deleted_at IS NULL
+			  GROUP BY c.id, c.name`
+
+	var categoryPrice models.CategoryPrice
+	err := DB.QueryRowContext(ctx, query, categoryID, models.DefaultCurrency).Scan(&categoryPrice.CategoryID,
+		&categoryPrice.CategoryName, &categoryPrice.AveragePrice.Amount, &categoryPrice.AveragePrice.Currency,
+		&categoryPrice.ProductCount)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	return &categoryPrice, nil
+}
+
+func (r *PostgresProductRepository) GetCategoryStats(ctx context.Context, categoryID uuid.UUID, currency string, recursive bool) (*models.CategoryStats, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	scope := `p.category_id = c.id`
+	if recursive {
+		scope = `p.category_id IN (SELECT pc.id FROM categories pc
+				 WHERE pc.id = c.id OR pc.path LIKE ` + pathPrefixPattern("c.path") + `)`
+	}
+
+	query := `SELECT c.id, c.name, COUNT(p.id), ROUND(AVG(p.price))::BIGINT, MIN(p.price), MAX(p.price),
+			  ROUND(percentile_cont(0.5) WITHIN GROUP (ORDER BY p.price)::NUMERIC)::BIGINT,
+			  COALESCE(SUM(sv.value), 0)::BIGINT
+			  FROM categories c
+			  LEFT JOIN products p ON ` + scope + ` AND p.currency = $2 AND p.deleted_at IS NULL
+			  LEFT JOIN LATERAL (
+				SELECT CASE WHEN COUNT(v.id) = 0 THEN p.price * p.stock
+				       ELSE SUM(COALESCE(v.price, p.price) * v.stock) END AS value
+				FROM product_variants v WHERE v.product_id = p.id) sv ON true
+			  WHERE c.id = $1 AND c.deleted_at IS NULL
+			  GROUP BY c.id, c.name`
+
+	stats := models.CategoryStats{Recursive: recursive, TotalStockValue: models.NewMoney(0, currency)}
+	stats.Currency = stats.TotalStockValue.Currency
+	var average, min, max, median *int64
+	err := DB.QueryRowContext(ctx, query, categoryID, stats.Currency).Scan(&stats.CategoryID, &stats.CategoryName,
+		&stats.ProductCount, &average, &min, &max, &median, &stats.TotalStockValue.Amount)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	stats.SetPrices(average, min, max, median)
+	return &stats, nil
+}
+
+func (r *PostgresProductRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	// Locking the product makes orders being placed for it wait, since they
+	// reserve its stock first; they then find it gone
+	var productID uuid.UUID
+	err = tx.QueryRowContext(ctx, `SELECT id FROM products WHERE id = $1 FOR UPDATE`, id).Scan(&productID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	// Deleting would cascade to the order items, so keep the product while orders reference it
+	var referenced bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM order_items WHERE product_id = $1)`, id).Scan(&referenced)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	if referenced {
+		return ErrProductInUse
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM products WHERE id = $1`, id); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// SoftDelete marks a product deleted, hiding it from listings and new orders
+// while existing orders keep referring to it. It is taken out of carts.
+func (r *PostgresProductRepository) SoftDelete(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE products SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL`
+	if err := execOne(ctx, tx, query, time.Now(), id); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM cart_items WHERE product_id = $1`, id); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// Restore undoes SoftDelete. A product in a deleted category cannot be restored.
+func (r *PostgresProductRepository) Restore(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var categoryDeleted bool
+	err = tx.QueryRowContext(ctx, `SELECT c.deleted_at IS NOT NULL
+			FROM products p JOIN categories c ON c.id = p.category_id
+			WHERE p.id = $1 AND p.deleted_at IS NOT NULL
+			FOR UPDATE OF p FOR SHARE OF c`, id).Scan(&categoryDeleted)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	if categoryDeleted {
+		return ErrParentDeleted
+	}
+
+	query := `UPDATE products SET deleted_at = NULL, updated_at = $1 WHERE id = $2`
+	if _, err := tx.ExecContext(ctx, query, time.Now(), id); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// GetDeleted returns the soft-deleted products, most recently deleted first
+func (r *PostgresProductRepository) GetDeleted(ctx context.Context) ([]models.Product, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT p.id, p.name, p.description, p.price, p.currency, p.category_id, p.stock, p.image_url, p.attributes,
+			  p.created_at, p.updated_at, p.deleted_at, c.id, c.name, c.description, c.parent_id, c.level, c.path,
+			  c.created_at, c.updated_at, c.deleted_at
+			  FROM products p
+			  LEFT JOIN categories c ON p.category_id = c.id
+			  WHERE p.deleted_at IS NOT NULL
+			  ORDER BY p.deleted_at DESC, p.id`
+
+	rows, err := DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	products := []models.Product{}
+	for rows.Next() {
+		var product models.Product
+		err := rows.Scan(&product.ID, &product.Name, &product.Description,
+			&product.Price.Amount, &product.Price.Currency, &product.CategoryID, &product.Stock, &product.ImageURL, &product.Attributes,
+			&product.CreatedAt, &product.UpdatedAt, &product.DeletedAt, &product.Category.ID, &product.Category.Name,
+			&product.Category.Description, &product.Category.ParentID, &product.Category.Level,
+			&product.Category.Path, &product.Category.CreatedAt, &product.Category.UpdatedAt, &product.Category.DeletedAt)
+		if err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		products = append(products, product)
+	}
+	return products, wrapQueryError(ctx, rows.Err())
+}
+
+// Purge permanently deletes products soft-deleted before the cutoff. Products
+// that orders reference are kept so that the order history survives.
+func (r *PostgresProductRepository) Purge(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `DELETE FROM products p
+			  WHERE p.deleted_at < $1
+			  AND NOT EXISTS (SELECT 1 FROM order_items oi WHERE oi.product_id = p.id)`
+
+	result, err := DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, wrapQueryError(ctx, err)
+	}
+	purged, err := result.RowsAffected()
+	return int(purged), wrapQueryError(ctx, err)
+}
+
+// PostgresVariantRepository handles product variant database operations.
+// Changes lock the product row before the variant's, the order reserveStock
+// takes them in, so that they cannot deadlock with orders being placed.
+type PostgresVariantRepository struct{}
+
+func (r *PostgresVariantRepository) Create(ctx context.Context, variant *models.ProductVariant) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var productStock int
+	var hasVariants bool
+	query := `SELECT p.stock, EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = p.id)
+			  FROM products p WHERE p.id = $1 AND p.deleted_at IS NULL FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, variant.ProductID).Scan(&productStock, &hasVariants)
+	if err == sql.ErrNoRows {
+		return foreignKeyError("product_variants", "product_id")
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	variant.ID = uuid.New()
+	variant.CreatedAt = time.Now()
+	variant.UpdatedAt = time.Now()
+
+	query = `INSERT INTO product_variants (id, product_id, sku, options, price, stock, image_url, created_at, updated_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	_, err = tx.ExecContext(ctx, query, variant.ID, variant.ProductID, variant.SKU, variant.Options,
+		variantPriceAmount(variant), variant.Stock, variant.ImageURL, variant.CreatedAt, variant.UpdatedAt)
+	if isUniqueViolation(err, "product_variants_sku_key") {
+		return ErrDuplicateSKU
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	// Once a product has variants its stock is theirs, so the stock it held
+	// of its own is written off
+	if !hasVariants {
+		if err := adjustStock(ctx, tx, variant.ProductID, nil, -productStock, models.MovementAdjustment); err != nil {
+			return wrapQueryError(ctx, err)
+		}
+	}
+	if err := adjustStock(ctx, tx, variant.ProductID, &variant.ID, variant.Stock, models.MovementInitial); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	if err := syncProductStock(ctx, tx, variant.ProductID); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+func (r *PostgresVariantRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.ProductVariant, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	variants, err := queryVariants(ctx, DB, `WHERE v.id = $1`, id)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	if len(variants) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &variants[0], nil
+}
+
+// GetByProduct returns a product's variants ordered by SKU
+func (r *PostgresVariantRepository) GetByProduct(ctx context.Context, productID uuid.UUID) ([]models.ProductVariant, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	variants, err := queryVariants(ctx, DB, `WHERE v.product_id = $1`, productID)
+	return variants, wrapQueryError(ctx, err)
+}
+
+// Update replaces a variant's SKU, options, price, stock and image
+func (r *PostgresVariantRepository) Update(ctx context.Context, variant *models.ProductVariant) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	if variant.ProductID, err = lockVariantProduct(ctx, tx, variant.ID); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	var oldStock int
+	err = tx.QueryRowContext(ctx, `SELECT stock FROM product_variants WHERE id = $1`, variant.ID).Scan(&oldStock)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	variant.UpdatedAt = time.Now()
+	query := `UPDATE product_variants
+			  SET sku = $1, options = $2, price = $3, stock = $4, image_url = $5, updated_at = $6
+			  WHERE id = $7`
+
+	_, err = tx.ExecContext(ctx, query, variant.SKU, variant.Options, variantPriceAmount(variant),
+		variant.Stock, variant.ImageURL, variant.UpdatedAt, variant.ID)
+	if isUniqueViolation(err, "product_variants_sku_key") {
+		return ErrDuplicateSKU
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if err := adjustStock(ctx, tx, variant.ProductID, &variant.ID, variant.Stock-oldStock, models.MovementAdjustment); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if err := syncProductStock(ctx, tx, variant.ProductID); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// Delete removes a variant and takes it out of carts. Variants that orders
+// reference are kept so that the order history stays intact.
+func (r *PostgresVariantRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	productID, err := lockVariantProduct(ctx, tx, id)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	var referenced bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM order_items WHERE variant_id = $1)`, id).Scan(&referenced)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	if referenced {
+		return ErrVariantInUse
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM product_variants WHERE id = $1`, id); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if err := syncProductStock(ctx, tx, productID); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// lockVariantProduct locks the product of a variant inside tx and returns its ID
+func lockVariantProduct(ctx context.Context, tx *sql.Tx, variantID uuid.UUID) (uuid.UUID, error) {
+	var productID uuid.UUID
+	err := tx.QueryRowContext(ctx, `SELECT p.id FROM product_variants v
+			JOIN products p ON p.id = v.product_id
+			WHERE v.id = $1 FOR UPDATE OF p`, variantID).Scan(&productID)
+	return productID, err
+}
+
+// syncProductStock sets a product's stock to the total of its variants' stock
+// inside tx, leaving none once its last variant is deleted, and syncs its
+// low-stock alert
+func syncProductStock(ctx context.Context, tx *sql.Tx, productID uuid.UUID) error {
+	query := `UPDATE products SET stock = v.total, updated_at = $2
+			  FROM (SELECT COALESCE(SUM(stock), 0) AS total FROM product_variants WHERE product_id = $1) v
+			  WHERE id = $1`
+
+	if _, err := tx.ExecContext(ctx, query, productID, time.Now()); err != nil {
+		return err
+	}
+	return syncStockAlert(ctx, tx, productID)
+}
+
+// syncStockAlert opens a low-stock alert inside tx for a product at or below
+// its reorder threshold that has none open, or resolves its open alert once it
+// is back above the threshold or no longer has one
+func syncStockAlert(ctx context.Context, tx *sql.Tx, productID uuid.UUID) error {
+	return syncStockAlerts(ctx, tx, "p.id = $1", productID)
+}
+
+// categoryThresholdJoin joins the reorder threshold of category c, or of its
+// nearest ancestor that has one, as ct.threshold
+var categoryThresholdJoin = `LEFT JOIN LATERAL (
+	SELECT t.reorder_threshold AS threshold FROM categories t
+	WHERE (t.id = c.id OR c.path LIKE ` + pathPrefixPattern("t.path") + `) AND t.reorder_threshold IS NOT NULL
+	ORDER BY t.level DESC LIMIT 1) ct ON true`
+
+// categorySubtreeProducts matches the products p of the category $1 and all
+// its subcategories, for syncStockAlerts
+var categorySubtreeProducts = `p.category_id IN (
+	SELECT d.id FROM categories root
+	JOIN categories d ON d.id = root.id OR d.path LIKE ` + pathPrefixPattern("root.path") + `
+	WHERE root.id = $1)`
+
+// syncStockAlerts opens and resolves the low-stock alerts of the products p
+// matching where, which refers to arg as $1. A product's own threshold takes
+// precedence over its category's, and a category without one inherits it from
+// its nearest ancestor that has one.
+func syncStockAlerts(ctx context.Context, tx *sql.Tx, where string, arg interface{}) error {
+	now := time.Now()
+	query := `INSERT INTO stock_alerts (product_id, threshold, stock, created_at)
+			  SELECT p.id, COALESCE(p.reorder_threshold, ct.threshold), p.stock, $2
+			  FROM products p JOIN categories c ON c.id = p.category_id
+			  ` + categoryThresholdJoin + `
+			  WHERE ` + where + ` AND p.deleted_at IS NULL
+			    AND p.stock <= COALESCE(p.reorder_threshold, ct.threshold)
+			  ON CONFLICT (product_id) WHERE resolved_at IS NULL DO NOTHING`
+
+	if _, err := tx.ExecContext(ctx, query, arg, now); err != nil {
+		return err
+	}
+
+	query = `UPDATE stock_alerts a SET resolved_at = $2
+			 FROM products p JOIN categories c ON c.id = p.category_id
+			 ` + categoryThresholdJoin + `
+			 WHERE a.product_id = p.id AND a.resolved_at IS NULL AND ` + where + `
+			   AND (p.stock <= COALESCE(p.reorder_threshold, ct.threshold)) IS NOT TRUE`
+
+	_, err := tx.ExecContext(ctx, query, arg, now)
+	return err
+}
+
+// variantPriceAmount returns a variant's price override for storage, or nil
+// when it sells at the product's price
+func variantPriceAmount(variant *models.ProductVariant) *int64 {
+	if variant.Price == nil {
+		return nil
+	}
+	return &variant.Price.Amount
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryVariants returns the variants v matching where, ordered by SKU. Price
+// overrides are in the currency of their product.
+func queryVariants(ctx context.Context, db queryer, where string, args ...interface{}) ([]models.ProductVariant, error) {
+	query := `SELECT v.id, v.product_id, v.sku, v.options, v.price, p.currency, v.stock,
+			  COALESCE(v.image_url, ''), v.created_at, v.updated_at
+			  FROM product_variants v
+			  JOIN products p ON p.id = v.product_id
+			  ` + where + `
+			  ORDER BY v.sku`
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := []models.ProductVariant{}
+	for rows.Next() {
+		var variant models.ProductVariant
+		var price *int64
+		var currency string
+		err := rows.Scan(&variant.ID, &variant.ProductID, &variant.SKU, &variant.Options, &price, &currency,
+			&variant.Stock, &variant.ImageURL, &variant.CreatedAt, &variant.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if price != nil {
+			money := models.NewMoney(*price, currency)
+			variant.Price = &money
+		}
+		variants = append(variants, variant)
+	}
+	return variants, rows.Err()
+}
+
+// variantsByID loads the variants with the given IDs, keyed by ID
+func variantsByID(ctx context.Context, db queryer, ids []uuid.UUID) (map[uuid.UUID]models.ProductVariant, error) {
+	byID := make(map[uuid.UUID]models.ProductVariant)
+	if len(ids) == 0 {
+		return byID, nil
+	}
+
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = id.String()
+	}
+	variants, err := queryVariants(ctx, db, `WHERE v.id = ANY($1::UUID[])`, pq.Array(values))
+	if err != nil {
+		return nil, err
+	}
+	for _, variant := range variants {
+		byID[variant.ID] = variant
+	}
+	return byID, nil
+}
+
+// isUniqueViolation reports whether err is Postgres rejecting a duplicate value
+// of the named unique constraint
+func isUniqueViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == constraint
+}
+
+// PostgresProductImageRepository handles product image database operations.
+// Changes lock the product row first, so that concurrent uploads and
+// reorders of one product's images are numbered one after another.
+type PostgresProductImageRepository struct{}
+
+func (r *PostgresProductImageRepository) Create(ctx context.Context, image *models.ProductImage) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var productID uuid.UUID
+	err = tx.QueryRowContext(ctx, `SELECT id FROM products WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`,
+		image.ProductID).Scan(&productID)
+	if err == sql.ErrNoRows {
+		return foreignKeyError("product_images", "product_id")
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	var count int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM product_images WHERE product_id = $1`, image.ProductID).Scan(&count)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	if count >= models.MaxProductImages {
+		return ErrTooManyImages
+	}
+
+	image.ID = uuid.New()
+	image.Position = count + 1
+	image.CreatedAt = time.Now()
+
+	query := `INSERT INTO product_images (id, product_id, position, content_type, size_bytes, width, height,
+			  storage_key, thumbnail_key, created_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+	_, err = tx.ExecContext(ctx, query, image.ID, image.ProductID, image.Position, image.ContentType, image.Size,
+		image.Width, image.Height, image.StorageKey, image.ThumbnailKey, image.CreatedAt)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+func (r *PostgresProductImageRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.ProductImage, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	images, err := queryProductImages(ctx, DB, `WHERE id = $1`, id)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	if len(images) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &images[0], nil
+}
+
+// GetByProduct returns a product's images in display order
+func (r *PostgresProductImageRepository) GetByProduct(ctx context.Context, productID uuid.UUID) ([]models.ProductImage, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	images, err := queryProductImages(ctx, DB, `WHERE product_id = $1`, productID)
+	return images, wrapQueryError(ctx, err)
+}
+
+func (r *PostgresProductImageRepository) Reorder(ctx context.Context, productID uuid.UUID, ids []uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var locked uuid.UUID
+	err = tx.QueryRowContext(ctx, `SELECT id FROM products WHERE id = $1 FOR UPDATE`, productID).Scan(&locked)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	images, err := queryProductImages(ctx, tx, `WHERE product_id = $1`, productID)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	if !sameImages(images, ids) {
+		return ErrImageOrder
+	}
+
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = id.String()
+	}
+	query := `UPDATE product_images i SET position = o.position
+			  FROM unnest($2::UUID[]) WITH ORDINALITY AS o(id, position)
+			  WHERE i.id = o.id AND i.product_id = $1`
+
+	if _, err := tx.ExecContext(ctx, query, productID, pq.Array(values)); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+func (r *PostgresProductImageRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var productID uuid.UUID
+	var position int
+	err = tx.QueryRowContext(ctx, `SELECT i.product_id, i.position FROM product_images i
+			JOIN products p ON p.id = i.product_id
+			WHERE i.id = $1 FOR UPDATE OF p`, id).Scan(&productID, &position)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM product_images WHERE id = $1`, id); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE product_images SET position = position - 1
+			WHERE product_id = $1 AND position > $2`, productID, position)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// queryProductImages returns the product images matching where, in display order
+func queryProductImages(ctx context.Context, db queryer, where string, args ...interface{}) ([]models.ProductImage, error) {
+	query := `SELECT id, product_id, position, content_type, size_bytes, width, height,
+			  storage_key, thumbnail_key, created_at
+			  FROM product_images
+			  ` + where + `
+			  ORDER BY position`
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []models.ProductImage{}
+	for rows.Next() {
+		var image models.ProductImage
+		err := rows.Scan(&image.ID, &image.ProductID, &image.Position, &image.ContentType, &image.Size,
+			&image.Width, &image.Height, &image.StorageKey, &image.ThumbnailKey, &image.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
+
+// sameImages reports whether ids lists each of the images exactly once
+func sameImages(images []models.ProductImage, ids []uuid.UUID) bool {
+	if len(ids) != len(images) {
+		return false
+	}
+	listed := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		listed[id] = true
+	}
+	for _, image := range images {
+		if !listed[image.ID] {
+			return false
+		}
+	}
+	return len(listed) == len(images)
+}
+
+// PostgresPriceRepository handles product price history and price schedule
+// database operations. Schedules are locked before their product, and each one
+// is started or ended in its own transaction.
+type PostgresPriceRepository struct{}
+
+func (r *PostgresPriceRepository) GetHistory(ctx context.Context, productID uuid.UUID) ([]models.PriceChange, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, product_id, old_price, old_currency, new_price, new_currency, source, schedule_id,
+			  changed_by, changed_at
+			  FROM price_history WHERE product_id = $1
+			  ORDER BY changed_at, id`
+
+	rows, err := DB.QueryContext(ctx, query, productID)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	history := []models.PriceChange{}
+	for rows.Next() {
+		var change models.PriceChange
+		var oldAmount sql.NullInt64
+		var oldCurrency sql.NullString
+		err := rows.Scan(&change.ID, &change.ProductID, &oldAmount, &oldCurrency, &change.NewPrice.Amount,
+			&change.NewPrice.Currency, &change.Source, &change.ScheduleID, &change.ChangedBy, &change.ChangedAt)
+		if err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		change.OldPrice = nullMoney(oldAmount, oldCurrency)
+		history = append(history, change)
+	}
+	return history, wrapQueryError(ctx, rows.Err())
+}
+
+func (r *PostgresPriceRepository) CreateSchedule(ctx context.Context, schedule *models.PriceSchedule) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	// Locking the product keeps concurrent schedules for it from both passing
+	// the overlap check
+	var productID uuid.UUID
+	err = tx.QueryRowContext(ctx, `SELECT id FROM products WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`,
+		schedule.ProductID).Scan(&productID)
+	if err == sql.ErrNoRows {
+		return foreignKeyError("price_schedules", "product_id")
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	// A permanent change holds the price for the instant it starts
+	end := schedule.StartsAt.Add(time.Microsecond)
+	if schedule.EndsAt != nil {
+		end = *schedule.EndsAt
+	}
+	var overlaps bool
+	query := `SELECT EXISTS (SELECT 1 FROM price_schedules
+			  WHERE product_id = $1 AND status IN ($2, $3)
+			  AND starts_at < $4 AND $5 < COALESCE(ends_at, starts_at + INTERVAL '1 microsecond'))`
+	err = tx.QueryRowContext(ctx, query, schedule.ProductID, models.PriceSchedulePending, models.PriceScheduleActive,
+		end, schedule.StartsAt).Scan(&overlaps)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	if overlaps {
+		return ErrScheduleOverlap
+	}
+
+	schedule.ID = uuid.New()
+	schedule.Status = models.PriceSchedulePending
+	schedule.CreatedBy = actorFromContext(ctx)
+	schedule.CreatedAt = time.Now()
+	schedule.UpdatedAt = schedule.CreatedAt
+	schedule.PreviousPrice = nil
+
+	query = `INSERT INTO price_schedules (id, product_id, price, currency, starts_at, ends_at, status, created_by, created_at, updated_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+	_, err = tx.ExecContext(ctx, query, schedule.ID, schedule.ProductID, schedule.Price.Amount, schedule.Price.Currency,
+		schedule.StartsAt, schedule.EndsAt, schedule.Status, schedule.CreatedBy, schedule.CreatedAt, schedule.UpdatedAt)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+func (r *PostgresPriceRepository) GetSchedule(ctx context.Context, id uuid.UUID) (*models.PriceSchedule, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	schedules, err := queryPriceSchedules(ctx, DB, false, `WHERE id = $1`, id)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	if len(schedules) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &schedules[0], nil
+}
+
+func (r *PostgresPriceRepository) GetSchedules(ctx context.Context, productID uuid.UUID) ([]models.PriceSchedule, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	schedules, err := queryPriceSchedules(ctx, DB, false, `WHERE product_id = $1`, productID)
+	return schedules, wrapQueryError(ctx, err)
+}
+
+// CancelSchedule cancels a pending schedule, or ends an active one now and
+// restores the price it replaced
+func (r *PostgresPriceRepository) CancelSchedule(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	schedules, err := queryPriceSchedules(ctx, tx, true, `WHERE id = $1`, id)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	if len(schedules) == 0 {
+		return sql.ErrNoRows
+	}
+
+	schedule, now := &schedules[0], time.Now()
+	switch schedule.Status {
+	case models.PriceSchedulePending:
+		_, err = tx.ExecContext(ctx, `UPDATE price_schedules SET status = $1, updated_at = $2 WHERE id = $3`,
+			models.PriceScheduleCancelled, now, id)
+	case models.PriceScheduleActive:
+		err = endPriceSchedule(ctx, tx, schedule, now)
+	default:
+		return ErrScheduleClosed
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// ApplySchedules ends the active schedules due by now and then starts the
+// pending ones, so that a sale ending as another starts hands the price over
+func (r *PostgresPriceRepository) ApplySchedules(ctx context.Context, now time.Time) (started, ended int, err error) {
+	due, err := r.dueSchedules(ctx, `WHERE status = $1 AND ends_at <= $2 ORDER BY ends_at, id`, models.PriceScheduleActive, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, id := range due {
+		changed, err := r.transition(ctx, id, models.PriceScheduleActive, now)
+		if err != nil {
+			return started, ended, err
+		}
+		if changed {
+			ended++
+		}
+	}
+
+	due, err = r.dueSchedules(ctx, `WHERE status = $1 AND starts_at <= $2 ORDER BY starts_at, id`, models.PriceSchedulePending, now)
+	if err != nil {
+		return started, ended, err
+	}
+	for _, id := range due {
+		changed, err := r.transition(ctx, id, models.PriceSchedulePending, now)
+		if err != nil {
+			return started, ended, err
+		}
+		if changed {
+			started++
+		}
+	}
+	return started, ended, nil
+}
+
+// dueSchedules returns the IDs of the schedules matching where
+func (r *PostgresPriceRepository) dueSchedules(ctx context.Context, where string, args ...interface{}) ([]uuid.UUID, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := DB.QueryContext(ctx, `SELECT id FROM price_schedules `+where, args...)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, wrapQueryError(ctx, rows.Err())
+}
+
+// transition starts or ends one due schedule if it is still in status,
+// reporting whether it changed the product's price. Another server may have
+// got to it first.
+func (r *PostgresPriceRepository) transition(ctx context.Context, id uuid.UUID, status string, now time.Time) (bool, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	schedules, err := queryPriceSchedules(ctx, tx, true, `WHERE id = $1 AND status = $2`, id, status)
+	if err != nil || len(schedules) == 0 {
+		return false, wrapQueryError(ctx, err)
+	}
+
+	schedule := &schedules[0]
+	changed := true
+	switch {
+	case status == models.PriceScheduleActive:
+		err = endPriceSchedule(ctx, tx, schedule, now)
+	case schedule.EndsAt != nil && !schedule.EndsAt.After(now):
+		changed = false
+		_, err = tx.ExecContext(ctx, `UPDATE price_schedules SET status = $1, updated_at = $2 WHERE id = $3`,
+			models.PriceScheduleExpired, now, id)
+	default:
+		changed, err = startPriceSchedule(ctx, tx, schedule, now)
+	}
+	if err != nil {
+		return false, wrapQueryError(ctx, err)
+	}
+	return changed, wrapQueryError(ctx, tx.Commit())
+}
+
+// startPriceSchedule sets the product's price to the schedule's, keeping the
+// price it replaces, and reports whether it did. A schedule whose currency no
+// longer matches the product's is cancelled instead.
+func startPriceSchedule(ctx context.Context, tx *sql.Tx, schedule *models.PriceSchedule, now time.Time) (bool, error) {
+	var previous models.Money
+	err := tx.QueryRowContext(ctx, `SELECT price, currency FROM products WHERE id = $1 FOR UPDATE`,
+		schedule.ProductID).Scan(&previous.Amount, &previous.Currency)
+	if err != nil {
+		return false, err
+	}
+
+	if previous.Currency != schedule.Price.Currency {
+		_, err := tx.ExecContext(ctx, `UPDATE price_schedules SET status = $1, updated_at = $2 WHERE id = $3`,
+			models.PriceScheduleCancelled, now, schedule.ID)
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE products SET price = $1, updated_at = $2 WHERE id = $3`,
+		schedule.Price.Amount, now, schedule.ProductID)
+	if err != nil {
+		return false, err
+	}
+
+	status := models.PriceScheduleCompleted
+	if schedule.EndsAt != nil {
+		status = models.PriceScheduleActive
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE price_schedules
+			SET status = $1, previous_price = $2, previous_currency = $3, updated_at = $4 WHERE id = $5`,
+		status, previous.Amount, previous.Currency, now, schedule.ID)
+	if err != nil || previous == schedule.Price {
+		return true, err
+	}
+
+	return true, recordPriceChange(ctx, tx, &models.PriceChange{
+		ProductID:  schedule.ProductID,
+		OldPrice:   &previous,
+		NewPrice:   schedule.Price,
+		Source:     models.PriceSourceScheduled,
+		ScheduleID: &schedule.ID,
+		ChangedBy:  schedule.CreatedBy,
+		ChangedAt:  now,
+	})
+}
+
+// endPriceSchedule completes an active schedule, restoring the price it
+// replaced unless the price was changed again while it ran
+func endPriceSchedule(ctx context.Context, tx *sql.Tx, schedule *models.PriceSchedule, now time.Time) error {
+	var current models.Money
+	err := tx.QueryRowContext(ctx, `SELECT price, currency FROM products WHERE id = $1 FOR UPDATE`,
+		schedule.ProductID).Scan(&current.Amount, &current.Currency)
+	if err != nil {
+		return err
+	}
+
+	endsAt := now
+	if schedule.EndsAt != nil && schedule.EndsAt.Before(now) {
+		endsAt = *schedule.EndsAt
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE price_schedules SET status = $1, ends_at = $2, updated_at = $3 WHERE id = $4`,
+		models.PriceScheduleCompleted, endsAt, now, schedule.ID)
+	if err != nil || schedule.PreviousPrice == nil || current != schedule.Price || current == *schedule.PreviousPrice {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE products SET price = $1, currency = $2, updated_at = $3 WHERE id = $4`,
+		schedule.PreviousPrice.Amount, schedule.PreviousPrice.Currency, now, schedule.ProductID)
+	if err != nil {
+		return err
+	}
+	return recordPriceChange(ctx, tx, &models.PriceChange{
+		ProductID:  schedule.ProductID,
+		OldPrice:   &current,
+		NewPrice:   *schedule.PreviousPrice,
+		Source:     models.PriceSourceScheduleEnd,
+		ScheduleID: &schedule.ID,
+		ChangedBy:  schedule.CreatedBy,
+		ChangedAt:  now,
+	})
+}
+
+// recordPriceChange adds an entry to a product's price history, attributed to
+// the actor of ctx unless the change names its own
+func recordPriceChange(ctx context.Context, db execer, change *models.PriceChange) error {
+	change.ID = uuid.New()
+	if change.ChangedBy == "" {
+		change.ChangedBy = actorFromContext(ctx)
+	}
+
+	var oldAmount *int64
+	var oldCurrency *string
+	if change.OldPrice != nil {
+		oldAmount, oldCurrency = &change.OldPrice.Amount, &change.OldPrice.Currency
+	}
+
+	query := `INSERT INTO price_history (id, product_id, old_price, old_currency, new_price, new_currency, source,
+			  schedule_id, changed_by, changed_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+	_, err := db.ExecContext(ctx, query, change.ID, change.ProductID, oldAmount, oldCurrency, change.NewPrice.Amount,
+		change.NewPrice.Currency, change.Source, change.ScheduleID, change.ChangedBy, change.ChangedAt)
+	return err
+}
+
+// queryPriceSchedules returns the price schedules matching where ordered by
+// start time, locking them for update when lock is set
+func queryPriceSchedules(ctx context.Context, db queryer, lock bool, where string, args ...interface{}) ([]models.PriceSchedule, error) {
+	query := `SELECT id, product_id, price, currency, starts_at, ends_at, status, previous_price, previous_currency,
+			  created_by, created_at, updated_at
+			  FROM price_schedules
+			  ` + where + `
+			  ORDER BY starts_at, id`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []models.PriceSchedule{}
+	for rows.Next() {
+		var schedule models.PriceSchedule
+		var previousAmount sql.NullInt64
+		var previousCurrency sql.NullString
+		err := rows.Scan(&schedule.ID, &schedule.ProductID, &schedule.Price.Amount, &schedule.Price.Currency,
+			&schedule.StartsAt, &schedule.EndsAt, &schedule.Status, &previousAmount, &previousCurrency,
+			&schedule.CreatedBy, &schedule.CreatedAt, &schedule.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		schedule.PreviousPrice = nullMoney(previousAmount, previousCurrency)
+		schedules = append(schedules, schedule)
+	}
+	return schedules, rows.Err()
+}
+
+// nullMoney returns the amount held by nullable price and currency columns
+func nullMoney(amount sql.NullInt64, currency sql.NullString) *models.Money {
+	if !amount.Valid || !currency.Valid {
+		return nil
+	}
+	return &models.Money{Amount: amount.Int64, Currency: currency.String}
+}
+
+// locationColumns returns a location's coordinates for storage, or nils when
+// there is no location
+func locationColumns(location *models.Location) (*float64, *float64) {
+	if location == nil {
+		return nil, nil
+	}
+	return &location.Latitude, &location.Longitude
+}
+
+// nullLocation returns the location held by nullable coordinate columns
+func nullLocation(latitude, longitude sql.NullFloat64) *models.Location {
+	if !latitude.Valid || !longitude.Valid {
+		return nil
+	}
+	return &models.Location{Latitude: latitude.Float64, Longitude: longitude.Float64}
+}
+
+// PostgresInventoryRepository handles warehouse and inventory database
+// operations. Stock changes lock the product row before its inventory levels,
+// the order reserveStock takes them in.
+type PostgresInventoryRepository struct{}
+
+func (r *PostgresInventoryRepository) CreateWarehouse(ctx context.Context, warehouse *models.Warehouse) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	warehouse.ID = uuid.New()
+	warehouse.IsDefault = false
+	warehouse.CreatedAt = time.Now()
+	warehouse.UpdatedAt = time.Now()
+
+	query := `INSERT INTO warehouses (id, code, name, latitude, longitude, priority, active, created_at, updated_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	latitude, longitude := locationColumns(warehouse.Location)
+	_, err := DB.ExecContext(ctx, query, warehouse.ID, warehouse.Code, warehouse.Name, latitude, longitude,
+		warehouse.Priority, warehouse.Active, warehouse.CreatedAt, warehouse.UpdatedAt)
+	if isUniqueViolation(err, "warehouses_code_key") {
+		return ErrDuplicateWarehouseCode
+	}
+	return wrapQueryError(ctx, err)
+}
+
+func (r *PostgresInventoryRepository) GetWarehouse(ctx context.Context, id uuid.UUID) (*models.Warehouse, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	warehouses, err := queryWarehouses(ctx, DB, `WHERE id = $1`, id)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	if len(warehouses) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &warehouses[0], nil
+}
+
+func (r *PostgresInventoryRepository) GetWarehouses(ctx context.Context) ([]models.Warehouse, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	warehouses, err := queryWarehouses(ctx, DB, ``)
+	return warehouses, wrapQueryError(ctx, err)
+}
+
+func (r *PostgresInventoryRepository) UpdateWarehouse(ctx context.Context, warehouse *models.Warehouse) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	// Locking the warehouse keeps transfers from moving stock into it while
+	// it is checked
+	query := `SELECT is_default, created_at FROM warehouses WHERE id = $1 FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, warehouse.ID).Scan(&warehouse.IsDefault, &warehouse.CreatedAt)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if !warehouse.Active {
+		if warehouse.IsDefault {
+			return ErrDefaultWarehouse
+		}
+		var holdsStock bool
+		query := `SELECT EXISTS (SELECT 1 FROM inventory_levels WHERE warehouse_id = $1 AND on_hand > 0)`
+		if err := tx.QueryRowContext(ctx, query, warehouse.ID).Scan(&holdsStock); err != nil {
+			return wrapQueryError(ctx, err)
+		}
+		if holdsStock {
+			return ErrWarehouseNotEmpty
+		}
+	}
+
+	warehouse.UpdatedAt = time.Now()
+	query = `UPDATE warehouses
+			 SET code = $1, name = $2, latitude = $3, longitude = $4, priority = $5, active = $6, updated_at = $7
+			 WHERE id = $8`
+
+	latitude, longitude := locationColumns(warehouse.Location)
+	_, err = tx.ExecContext(ctx, query, warehouse.Code, warehouse.Name, latitude, longitude, warehouse.Priority,
+		warehouse.Active, warehouse.UpdatedAt, warehouse.ID)
+	if isUniqueViolation(err, "warehouses_code_key") {
+		return ErrDuplicateWarehouseCode
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// queryWarehouses runs a warehouse query with the given WHERE clause, ordering
+// the rows by priority and code
+func queryWarehouses(ctx context.Context, db queryer, where string, args ...interface{}) ([]models.Warehouse, error) {
+	query := `SELECT id, code, name, latitude, longitude, priority, is_default, active, created_at, updated_at
+			  FROM warehouses ` + where + `
+			  ORDER BY priority, code`
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	warehouses := []models.Warehouse{}
+	for rows.Next() {
+		var warehouse models.Warehouse
+		var latitude, longitude sql.NullFloat64
+		err := rows.Scan(&warehouse.ID, &warehouse.Code, &warehouse.Name, &latitude, &longitude, &warehouse.Priority,
+			&warehouse.IsDefault, &warehouse.Active, &warehouse.CreatedAt, &warehouse.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		warehouse.Location = nullLocation(latitude, longitude)
+		warehouses = append(warehouses, warehouse)
+	}
+	return warehouses, rows.Err()
+}
+
+// GetLevels returns the inventory levels matching filter ordered by warehouse
+// priority and code, then by product and variant
+func (r *PostgresInventoryRepository) GetLevels(ctx context.Context, filter models.InventoryFilter) ([]models.InventoryLevel, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var args []interface{}
+	var conditions []string
+	if filter.WarehouseID != nil {
+		args = append(args, *filter.WarehouseID)
+		conditions = append(conditions, fmt.Sprintf("l.warehouse_id = $%d", len(args)))
+	}
+	if filter.ProductID != nil {
+		args = append(args, *filter.ProductID)
+		conditions = append(conditions, fmt.Sprintf("l.product_id = $%d", len(args)))
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	query := `SELECT l.warehouse_id, w.code, l.product_id, l.variant_id, l.on_hand, l.reserved, l.updated_at
+			  FROM inventory_levels l
+			  JOIN warehouses w ON w.id = l.warehouse_id
+			  ` + where + `
+			  ORDER BY w.priority, w.code, l.product_id, l.variant_id NULLS FIRST`
+
+	rows, err := DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	levels := []models.InventoryLevel{}
+	for rows.Next() {
+		var level models.InventoryLevel
+		err := rows.Scan(&level.WarehouseID, &level.WarehouseCode, &level.ProductID, &level.VariantID,
+			&level.OnHand, &level.Reserved, &level.UpdatedAt)
+		if err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		level.Available = level.OnHand - level.Reserved
+		levels = append(levels, level)
+	}
+	return levels, wrapQueryError(ctx, rows.Err())
+}
+
+// Transfer moves available stock between two active warehouses, recording a
+// movement out of one and into the other under the transfer's ID. The stock
+// total of the product is unchanged.
+func (r *PostgresInventoryRepository) Transfer(ctx context.Context, transfer *models.StockTransfer) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	stockErr := &InsufficientStockError{ProductID: transfer.ProductID, Requested: transfer.Quantity}
+	err = tx.QueryRowContext(ctx, `SELECT name FROM products WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`,
+		transfer.ProductID).Scan(&stockErr.ProductName)
+	if err == sql.ErrNoRows {
+		return foreignKeyError("inventory_movements", "product_id")
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if transfer.VariantID != nil {
+		err := tx.QueryRowContext(ctx, `SELECT sku FROM product_variants WHERE id = $1 AND product_id = $2 FOR UPDATE`,
+			*transfer.VariantID, transfer.ProductID).Scan(&stockErr.SKU)
+		if err == sql.ErrNoRows {
+			return foreignKeyError("inventory_movements", "variant_id")
+		}
+		if err != nil {
+			return wrapQueryError(ctx, err)
+		}
+	}
+
+	// Sharing the warehouse locks keeps them from being deactivated meanwhile
+	rows, err := tx.QueryContext(ctx, `SELECT active FROM warehouses WHERE id IN ($1, $2) ORDER BY id FOR SHARE`,
+		transfer.FromWarehouseID, transfer.ToWarehouseID)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	found, active := 0, true
+	for rows.Next() {
+		var warehouseActive bool
+		if err := rows.Scan(&warehouseActive); err != nil {
+			rows.Close()
+			return wrapQueryError(ctx, err)
+		}
+		found++
+		active = active && warehouseActive
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	if found < 2 {
+		return foreignKeyError("inventory_movements", "warehouse_id")
+	}
+	if !active {
+		return ErrWarehouseInactive
+	}
+
+	query := `SELECT on_hand - reserved FROM inventory_levels
+			  WHERE warehouse_id = $1 AND product_id = $2 AND variant_id IS NOT DISTINCT FROM $3
+			  FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, transfer.FromWarehouseID, transfer.ProductID, transfer.VariantID).
+		Scan(&stockErr.Available)
+	if err != nil && err != sql.ErrNoRows {
+		return wrapQueryError(ctx, err)
+	}
+	if stockErr.Available < transfer.Quantity {
+		return stockErr
+	}
+
+	transfer.ID = uuid.New()
+	transfer.CreatedAt = time.Now()
+	if transfer.CreatedBy == "" {
+		transfer.CreatedBy = actorFromContext(ctx)
+	}
+
+	for _, movement := range []models.InventoryMovement{
+		{WarehouseID: transfer.FromWarehouseID, Type: models.MovementTransferOut, OnHandChange: -transfer.Quantity},
+		{WarehouseID: transfer.ToWarehouseID, Type: models.MovementTransferIn, OnHandChange: transfer.Quantity},
+	} {
+		movement.ProductID = transfer.ProductID
+		movement.VariantID = transfer.VariantID
+		movement.TransferID = &transfer.ID
+		movement.Note = transfer.Note
+		movement.CreatedBy = transfer.CreatedBy
+		if err := moveStock(ctx, tx, &movement); err != nil {
+			return wrapQueryError(ctx, err)
+		}
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// Adjust changes the on-hand stock at an active warehouse and the stock total
+// of the product or variant by the same amount, recording the change in the
+// ledger under the adjustment's reason
+func (r *PostgresInventoryRepository) Adjust(ctx context.Context, adjustment *models.StockAdjustment) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	stockErr := &InsufficientStockError{ProductID: adjustment.ProductID, Requested: -adjustment.Change}
+	err = tx.QueryRowContext(ctx, `SELECT name FROM products WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`,
+		adjustment.ProductID).Scan(&stockErr.ProductName)
+	if err == sql.ErrNoRows {
+		return foreignKeyError("inventory_movements", "product_id")
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if adjustment.VariantID != nil {
+		err := tx.QueryRowContext(ctx, `SELECT sku FROM product_variants WHERE id = $1 AND product_id = $2 FOR UPDATE`,
+			*adjustment.VariantID, adjustment.ProductID).Scan(&stockErr.SKU)
+		if err == sql.ErrNoRows {
+			return foreignKeyError("inventory_movements", "variant_id")
+		}
+		if err != nil {
+			return wrapQueryError(ctx, err)
+		}
+	}
+
+	var active bool
+	err = tx.QueryRowContext(ctx, `SELECT active FROM warehouses WHERE id = $1 FOR SHARE`, adjustment.WarehouseID).
+		Scan(&active)
+	if err == sql.ErrNoRows {
+		return foreignKeyError("inventory_movements", "warehouse_id")
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	if !active {
+		return ErrWarehouseInactive
+	}
+
+	if adjustment.Change < 0 {
+		query := `SELECT on_hand - reserved FROM inventory_levels
+				  WHERE warehouse_id = $1 AND product_id = $2 AND variant_id IS NOT DISTINCT FROM $3
+				  FOR UPDATE`
+		err := tx.QueryRowContext(ctx, query, adjustment.WarehouseID, adjustment.ProductID, adjustment.VariantID).
+			Scan(&stockErr.Available)
+		if err != nil && err != sql.ErrNoRows {
+			return wrapQueryError(ctx, err)
+		}
+		if stockErr.Available < -adjustment.Change {
+			return stockErr
+		}
+	}
+
+	movement := models.InventoryMovement{
+		WarehouseID:  adjustment.WarehouseID,
+		ProductID:    adjustment.ProductID,
+		VariantID:    adjustment.VariantID,
+		Type:         adjustment.Reason,
+		OnHandChange: adjustment.Change,
+		Note:         adjustment.Note,
+		CreatedBy:    adjustment.CreatedBy,
+	}
+	if err := moveStock(ctx, tx, &movement); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	adjustment.ID = movement.ID
+	adjustment.CreatedBy = movement.CreatedBy
+	adjustment.CreatedAt = movement.CreatedAt
+
+	if adjustment.VariantID != nil {
+		_, err = tx.ExecContext(ctx, `UPDATE product_variants SET stock = stock + $1, updated_at = $2 WHERE id = $3`,
+			adjustment.Change, adjustment.CreatedAt, *adjustment.VariantID)
+		if err == nil {
+			err = syncProductStock(ctx, tx, adjustment.ProductID)
+		}
+	} else {
+		_, err = tx.ExecContext(ctx, `UPDATE products SET stock = stock + $1, updated_at = $2 WHERE id = $3`,
+			adjustment.Change, adjustment.CreatedAt, adjustment.ProductID)
+		if err == nil {
+			err = syncStockAlert(ctx, tx, adjustment.ProductID)
+		}
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	query := `SELECT on_hand, on_hand - reserved FROM inventory_levels
+			  WHERE warehouse_id = $1 AND product_id = $2 AND variant_id IS NOT DISTINCT FROM $3`
+	err = tx.QueryRowContext(ctx, query, adjustment.WarehouseID, adjustment.ProductID, adjustment.VariantID).
+		Scan(&adjustment.OnHand, &adjustment.Available)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+func (r *PostgresInventoryRepository) GetMovements(ctx context.Context, filter models.InventoryFilter) ([]models.InventoryMovement, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var args []interface{}
+	var conditions []string
+	if filter.WarehouseID != nil {
+		args = append(args, *filter.WarehouseID)
+		conditions = append(conditions, fmt.Sprintf("warehouse_id = $%d", len(args)))
+	}
+	if filter.ProductID != nil {
+		args = append(args, *filter.ProductID)
+		conditions = append(conditions, fmt.Sprintf("product_id = $%d", len(args)))
+	}
+	if filter.OrderID != nil {
+		args = append(args, *filter.OrderID)
+		conditions = append(conditions, fmt.Sprintf("order_id = $%d", len(args)))
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit)
+
+	query := `SELECT id, warehouse_id, product_id, variant_id, type, on_hand_change, reserved_change, order_id,
+			  transfer_id, COALESCE(note, ''), created_by, created_at
+			  FROM inventory_movements
+			  ` + where + `
+			  ORDER BY created_at DESC, id DESC
+			  ` + fmt.Sprintf("LIMIT $%d", len(args))
+
+	rows, err := DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	movements := []models.InventoryMovement{}
+	for rows.Next() {
+		var movement models.InventoryMovement
+		err := rows.Scan(&movement.ID, &movement.WarehouseID, &movement.ProductID, &movement.VariantID, &movement.Type,
+			&movement.OnHandChange, &movement.ReservedChange, &movement.OrderID, &movement.TransferID, &movement.Note,
+			&movement.CreatedBy, &movement.CreatedAt)
+		if err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		movements = append(movements, movement)
+	}
+	return movements, wrapQueryError(ctx, rows.Err())
+}
+
+// Reconcile sums the ledger's movements per inventory level and per product
+// and variant, and compares the sums with the stored levels and stock totals.
+// A level without movements, or movements whose level is gone, count as zero
+// on the other side.
+func (r *PostgresInventoryRepository) Reconcile(ctx context.Context, productID *uuid.UUID) (*models.ReconciliationReport, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	// One snapshot for both queries, so that a movement recorded in between
+	// does not show up as drift
+	tx, err := DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	// The variant is compared through a placeholder UUID, since a full join
+	// needs an equality condition
+	query := `WITH levels AS (
+			      SELECT warehouse_id, product_id, variant_id, on_hand, reserved FROM inventory_levels
+			      WHERE $1::uuid IS NULL OR product_id = $1
+			  ), ledger AS (
+			      SELECT warehouse_id, product_id, variant_id,
+			             SUM(on_hand_change) AS on_hand, SUM(reserved_change) AS reserved
+			      FROM inventory_movements
+			      WHERE $1::uuid IS NULL OR product_id = $1
+			      GROUP BY warehouse_id, product_id, variant_id
+			  )
+			  SELECT w.id, w.code, COALESCE(l.product_id, m.product_id), COALESCE(l.variant_id, m.variant_id),
+			         COALESCE(l.on_hand, 0), COALESCE(l.reserved, 0), COALESCE(m.on_hand, 0), COALESCE(m.reserved, 0)
+			  FROM levels l
+			  FULL JOIN ledger m ON m.warehouse_id = l.warehouse_id AND m.product_id = l.product_id
+			      AND COALESCE(m.variant_id, '00000000-0000-0000-0000-000000000000') = COALESCE(l.variant_id, '00000000-0000-0000-0000-000000000000')
+			  JOIN warehouses w ON w.id = COALESCE(l.warehouse_id, m.warehouse_id)
+			  ORDER BY w.priority, w.code, 3, 4 NULLS FIRST`
+
+	rows, err := tx.QueryContext(ctx, query, productID)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	levels := []models.LevelReconciliation{}
+	for rows.Next() {
+		var level models.LevelReconciliation
+		err := rows.Scan(&level.WarehouseID, &level.WarehouseCode, &level.ProductID, &level.VariantID,
+			&level.OnHand, &level.Reserved, &level.LedgerOnHand, &level.LedgerReserved)
+		if err != nil {
+			rows.Close()
+			return nil, wrapQueryError(ctx, err)
+		}
+		levels = append(levels, level)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+
+	// A product's total covers its variants, and its own stock written off
+	// when its first variant was added
+	query = `WITH ledger AS (
+			     SELECT product_id, variant_id, SUM(on_hand_change - reserved_change) AS available
+			     FROM inventory_movements
+			     WHERE $1::uuid IS NULL OR product_id = $1
+			     GROUP BY product_id, variant_id
+			 )
+			 SELECT p.id, NULL::uuid, p.name, '', p.stock,
+			        COALESCE((SELECT SUM(available) FROM ledger WHERE product_id = p.id), 0)
+			 FROM products p
+			 WHERE p.deleted_at IS NULL AND ($1::uuid IS NULL OR p.id = $1)
+			 UNION ALL
+			 SELECT v.product_id, v.id, p.name, v.sku, v.stock,
+			        COALESCE((SELECT available FROM ledger WHERE variant_id = v.id), 0)
+			 FROM product_variants v
+			 JOIN products p ON p.id = v.product_id
+			 WHERE p.deleted_at IS NULL AND ($1::uuid IS NULL OR p.id = $1)
+			 ORDER BY 1, 2 NULLS FIRST`
+
+	rows, err = tx.QueryContext(ctx, query, productID)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	stock := []models.StockReconciliation{}
+	for rows.Next() {
+		var item models.StockReconciliation
+		err := rows.Scan(&item.ProductID, &item.VariantID, &item.Name, &item.SKU, &item.Stock, &item.LedgerStock)
+		if err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		stock = append(stock, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	return models.NewReconciliationReport(levels, stock, time.Now()), nil
+}
+
+// inventoryLevelConflict is the conflict target of the unique index on inventory levels
+const inventoryLevelConflict = `(warehouse_id, product_id, COALESCE(variant_id, '00000000-0000-0000-0000-000000000000'))`
+
+// moveStock applies a movement to its inventory level inside tx and records
+// it in the inventory ledger, attributed to the actor of ctx unless the
+// movement names its own. The level is created on its first movement; the
+// level's check constraint rejects a movement that would take more stock than
+// it holds.
+func moveStock(ctx context.Context, tx *sql.Tx, movement *models.InventoryMovement) error {
+	movement.ID = uuid.New()
+	movement.CreatedAt = time.Now()
+	if movement.CreatedBy == "" {
+		movement.CreatedBy = actorFromContext(ctx)
+	}
+
+	// The level is created empty and then changed, since the check constraint
+	// would reject a negative change on the inserted row even when it conflicts
+	query := `INSERT INTO inventory_levels (warehouse_id, product_id, variant_id, updated_at)
+			  VALUES ($1, $2, $3, $4)
+			  ON CONFLICT ` + inventoryLevelConflict + ` DO NOTHING`
+
+	_, err := tx.ExecContext(ctx, query, movement.WarehouseID, movement.ProductID, movement.VariantID, movement.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	query = `UPDATE inventory_levels SET on_hand = on_hand + $1, reserved = reserved + $2, updated_at = $3
+			 WHERE warehouse_id = $4 AND product_id = $5 AND variant_id IS NOT DISTINCT FROM $6`
+
+	_, err = tx.ExecContext(ctx, query, movement.OnHandChange, movement.ReservedChange, movement.CreatedAt,
+		movement.WarehouseID, movement.ProductID, movement.VariantID)
+	if err != nil {
+		return err
+	}
+
+	query = `INSERT INTO inventory_movements (id, warehouse_id, product_id, variant_id, type, on_hand_change,
+			 reserved_change, order_id, transfer_id, note, created_by, created_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), $11, $12)`
+
+	_, err = tx.ExecContext(ctx, query, movement.ID, movement.WarehouseID, movement.ProductID, movement.VariantID,
+		movement.Type, movement.OnHandChange, movement.ReservedChange, movement.OrderID, movement.TransferID,
+		movement.Note, movement.CreatedBy, movement.CreatedAt)
+	return err
+}
+
+// defaultWarehouseID returns the ID of the warehouse stock is added to
+func defaultWarehouseID(ctx context.Context, tx *sql.Tx) (uuid.UUID, error) {
+	var id uuid.UUID
+	err := tx.QueryRowContext(ctx, `SELECT id FROM warehouses WHERE is_default`).Scan(&id)
+	return id, err
+}
+
+// adjustStock records a change of change units to the stock total of a
+// product, or of one of its variants, inside tx. Stock added goes to the
+// default warehouse. Stock taken away comes out of what is available at the
+// default warehouse first and then at the least preferred warehouses; stock
+// reserved for orders is left alone, and an InsufficientStockError is returned
+// when what is available cannot cover the change. Callers must hold the lock on
+// the product and roll tx back on error.
+func adjustStock(ctx context.Context, tx *sql.Tx, productID uuid.UUID, variantID *uuid.UUID, change int, movementType string) error {
+	if change == 0 {
+		return nil
+	}
+	if change > 0 {
+		warehouseID, err := defaultWarehouseID(ctx, tx)
+		if err != nil {
+			return err
+		}
+		return moveStock(ctx, tx, &models.InventoryMovement{
+			WarehouseID:  warehouseID,
+			ProductID:    productID,
+			VariantID:    variantID,
+			Type:         movementType,
+			OnHandChange: change,
+		})
+	}
+
+	// Levels are locked in warehouse ID order, as allocateItem locks them
+	query := `SELECT l.warehouse_id, l.on_hand - l.reserved
+			  FROM (SELECT warehouse_id, on_hand, reserved FROM inventory_levels
+			        WHERE product_id = $1 AND variant_id IS NOT DISTINCT FROM $2
+			        ORDER BY warehouse_id FOR UPDATE) l
+			  JOIN warehouses w ON w.id = l.warehouse_id
+			  WHERE l.on_hand > l.reserved
+			  ORDER BY w.is_default DESC, w.priority DESC, w.code DESC`
+
+	rows, err := tx.QueryContext(ctx, query, productID, variantID)
+	if err != nil {
+		return err
+	}
+
+	var movements []models.InventoryMovement
+	remaining := -change
+	for rows.Next() && remaining > 0 {
+		var warehouseID uuid.UUID
+		var available int
+		if err := rows.Scan(&warehouseID, &available); err != nil {
+			rows.Close()
+			return err
+		}
+		taken := min(available, remaining)
+		movements = append(movements, models.InventoryMovement{
+			WarehouseID:  warehouseID,
+			ProductID:    productID,
+			VariantID:    variantID,
+			Type:         movementType,
+			OnHandChange: -taken,
+		})
+		remaining -= taken
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Taking less would leave the product's stock and its levels disagreeing
+	if remaining > 0 {
+		stockErr := &InsufficientStockError{ProductID: productID, Requested: -change, Available: -change - remaining}
+		query := `SELECT p.name, COALESCE(v.sku, '')
+				  FROM products p LEFT JOIN product_variants v ON v.id = $2
+				  WHERE p.id = $1`
+		if err := tx.QueryRowContext(ctx, query, productID, variantID).Scan(&stockErr.ProductName, &stockErr.SKU); err != nil {
+			return err
+		}
+		return stockErr
+	}
+
+	for i := range movements {
+		if err := moveStock(ctx, tx, &movements[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocateItem reserves an order line at the active warehouses inside tx,
+// ranked by their distance from the order's destination and their priority
+// and picked by models.AllocateStock. It returns sql.ErrNoRows when the
+// warehouses hold too little available stock.
+func allocateItem(ctx context.Context, tx *sql.Tx, order *models.Order, item *models.OrderItem) error {
+	query := `SELECT w.id, w.code, w.latitude, w.longitude, w.priority, l.on_hand - l.reserved
+			  FROM (SELECT warehouse_id, on_hand, reserved FROM inventory_levels
+			        WHERE product_id = $1 AND variant_id IS NOT DISTINCT FROM $2
+			        ORDER BY warehouse_id FOR UPDATE) l
+			  JOIN warehouses w ON w.id = l.warehouse_id
+			  WHERE w.active AND l.on_hand > l.reserved`
+
+	rows, err := tx.QueryContext(ctx, query, item.ProductID, item.VariantID)
+	if err != nil {
+		return err
+	}
+
+	var warehouses []models.Warehouse
+	available := make(map[uuid.UUID]int)
+	for rows.Next() {
+		var warehouse models.Warehouse
+		var latitude, longitude sql.NullFloat64
+		var quantity int
+		err := rows.Scan(&warehouse.ID, &warehouse.Code, &latitude, &longitude, &warehouse.Priority, &quantity)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		warehouse.Location = nullLocation(latitude, longitude)
+		warehouses = append(warehouses, warehouse)
+		available[warehouse.ID] = quantity
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	models.RankWarehouses(warehouses, order.ShipTo)
+	levels := make([]models.InventoryLevel, len(warehouses))
+	for i, warehouse := range warehouses {
+		levels[i] = models.InventoryLevel{WarehouseID: warehouse.ID, Available: available[warehouse.ID]}
+	}
+	allocations := models.AllocateStock(levels, item.Quantity)
+	if allocations == nil {
+		return sql.ErrNoRows
+	}
+
+	for i := range allocations {
+		allocation := &allocations[i]
+		allocation.ID = uuid.New()
+		allocation.OrderItemID = item.ID
+
+		_, err := tx.ExecContext(ctx, `INSERT INTO order_allocations (id, order_item_id, warehouse_id, quantity)
+				VALUES ($1, $2, $3, $4)`, allocation.ID, allocation.OrderItemID, allocation.WarehouseID, allocation.Quantity)
+		if err != nil {
+			return err
+		}
+
+		err = moveStock(ctx, tx, &models.InventoryMovement{
+			WarehouseID:    allocation.WarehouseID,
+			ProductID:      item.ProductID,
+			VariantID:      item.VariantID,
+			Type:           models.MovementSale,
+			ReservedChange: allocation.Quantity,
+			OrderID:        &order.ID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	item.Allocations = allocations
+	return nil
+}
+
+// releaseItem releases quantity units reserved for an order line inside tx,
+// shrinking its allocations in warehouse ID order. Lines placed before stock
+// was tracked per warehouse have no allocations; their units go back on hand
+// at the default warehouse.
+func releaseItem(ctx context.Context, tx *sql.Tx, item models.OrderItem, quantity int) error {
+	query := `SELECT id, warehouse_id, quantity FROM order_allocations
+			  WHERE order_item_id = $1
+			  ORDER BY warehouse_id FOR UPDATE`
+
+	rows, err := tx.QueryContext(ctx, query, item.ID)
+	if err != nil {
+		return err
+	}
+
+	var allocations []models.OrderAllocation
+	for rows.Next() {
+		var allocation models.OrderAllocation
+		if err := rows.Scan(&allocation.ID, &allocation.WarehouseID, &allocation.Quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		allocations = append(allocations, allocation)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	remaining := quantity
+	for _, allocation := range allocations {
+		if remaining == 0 {
+			break
+		}
+		released := min(allocation.Quantity, remaining)
+		if released == allocation.Quantity {
+			_, err = tx.ExecContext(ctx, `DELETE FROM order_allocations WHERE id = $1`, allocation.ID)
+		} else {
+			_, err = tx.ExecContext(ctx, `UPDATE order_allocations SET quantity = quantity - $1 WHERE id = $2`,
+				released, allocation.ID)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = moveStock(ctx, tx, &models.InventoryMovement{
+			WarehouseID:    allocation.WarehouseID,
+			ProductID:      item.ProductID,
+			VariantID:      item.VariantID,
+			Type:           models.MovementCancellation,
+			ReservedChange: -released,
+			OrderID:        &item.OrderID,
+		})
+		if err != nil {
+			return err
+		}
+		remaining -= released
+	}
+	if remaining == 0 {
+		return nil
+	}
+
+	warehouseID, err := defaultWarehouseID(ctx, tx)
+	if err != nil {
+		return err
+	}
+	return moveStock(ctx, tx, &models.InventoryMovement{
+		WarehouseID:  warehouseID,
+		ProductID:    item.ProductID,
+		VariantID:    item.VariantID,
+		Type:         models.MovementCancellation,
+		OnHandChange: remaining,
+		OrderID:      &item.OrderID,
+	})
+}
+
+// shipOrder takes the stock reserved for an order out of the warehouses
+// holding it inside tx. The allocations are kept as the record of where each
+// line shipped from.
+func shipOrder(ctx context.Context, tx *sql.Tx, orderID uuid.UUID) error {
+	query := `SELECT a.warehouse_id, oi.product_id, oi.variant_id, a.quantity
+			  FROM order_allocations a
+			  JOIN order_items oi ON oi.id = a.order_item_id
+			  WHERE oi.order_id = $1
+			  ORDER BY oi.product_id, oi.variant_id, a.warehouse_id`
+
+	rows, err := tx.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return err
+	}
+
+	var movements []models.InventoryMovement
+	for rows.Next() {
+		var movement models.InventoryMovement
+		var quantity int
+		if err := rows.Scan(&movement.WarehouseID, &movement.ProductID, &movement.VariantID, &quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		movement.Type = models.MovementShipment
+		movement.OnHandChange = -quantity
+		movement.ReservedChange = -quantity
+		movement.OrderID = &orderID
+		movements = append(movements, movement)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range movements {
+		if err := moveStock(ctx, tx, &movements[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryAllocations returns the allocations of an order's lines keyed by line
+// ID, each line's in warehouse ID order
+func queryAllocations(ctx context.Context, db queryer, orderID uuid.UUID) (map[uuid.UUID][]models.OrderAllocation, error) {
+	query := `SELECT a.id, a.order_item_id, a.warehouse_id, a.quantity
+			  FROM order_allocations a
+			  JOIN order_items oi ON oi.id = a.order_item_id
+			  WHERE oi.order_id = $1
+			  ORDER BY a.order_item_id, a.warehouse_id`
+
+	rows, err := db.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	allocations := make(map[uuid.UUID][]models.OrderAllocation)
+	for rows.Next() {
+		var allocation models.OrderAllocation
+		err := rows.Scan(&allocation.ID, &allocation.OrderItemID, &allocation.WarehouseID, &allocation.Quantity)
+		if err != nil {
+			return nil, err
+		}
+		allocations[allocation.OrderItemID] = append(allocations[allocation.OrderItemID], allocation)
+	}
+	return allocations, rows.Err()
+}
+
+// PostgresStockAlertRepository handles reorder threshold and low-stock alert
+// database operations
+type PostgresStockAlertRepository struct{}
+
+func (r *PostgresStockAlertRepository) GetThreshold(ctx context.Context, productID uuid.UUID) (*models.ReorderThreshold, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT p.reorder_threshold, ct.threshold, p.stock
+			  FROM products p JOIN categories c ON c.id = p.category_id
+			  ` + categoryThresholdJoin + `
+			  WHERE p.id = $1 AND p.deleted_at IS NULL`
+
+	var own, category sql.NullInt64
+	var stock int
+	if err := DB.QueryRowContext(ctx, query, productID).Scan(&own, &category, &stock); err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	return models.NewReorderThreshold(productID, nullableInt(own), nullableInt(category), stock), nil
+}
+
+// SetProductThreshold sets a product's own threshold and opens or resolves
+// its alert against the threshold that now applies
+func (r *PostgresStockAlertRepository) SetProductThreshold(ctx context.Context, productID uuid.UUID, threshold *int) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE products SET reorder_threshold = $1 WHERE id = $2 AND deleted_at IS NULL`
+	if err := execOne(ctx, tx, query, threshold, productID); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	if err := syncStockAlert(ctx, tx, productID); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// SetCategoryThreshold sets a category's threshold and opens or resolves the
+// alerts of the products of it and its subcategories against the thresholds
+// that now apply
+func (r *PostgresStockAlertRepository) SetCategoryThreshold(ctx context.Context, categoryID uuid.UUID, threshold *int) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE categories SET reorder_threshold = $1 WHERE id = $2 AND deleted_at IS NULL`
+	if err := execOne(ctx, tx, query, threshold, categoryID); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	if err := syncStockAlerts(ctx, tx, categorySubtreeProducts, categoryID); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+func (r *PostgresStockAlertRepository) GetAlerts(ctx context.Context, openOnly bool) ([]models.StockAlert, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT a.id, a.product_id, p.name, a.threshold, a.stock, a.created_at, a.notified_at, a.resolved_at
+			  FROM stock_alerts a JOIN products p ON p.id = a.product_id
+			  WHERE NOT $1 OR a.resolved_at IS NULL
+			  ORDER BY a.created_at DESC, a.id DESC
+			  LIMIT $2`
+
+	rows, err := DB.QueryContext(ctx, query, openOnly, models.MaxStockAlerts)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	alerts, err := scanStockAlerts(rows)
+	return alerts, wrapQueryError(ctx, err)
+}
+
+// ClaimPending marks the pending alerts of products that are not deleted as
+// notified. A pending alert claimed by another server is skipped once that
+// server's claim commits.
+func (r *PostgresStockAlertRepository) ClaimPending(ctx context.Context, at time.Time) ([]models.StockAlert, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `UPDATE stock_alerts a SET notified_at = $1
+			  FROM products p
+			  WHERE p.id = a.product_id AND p.deleted_at IS NULL
+			    AND a.notified_at IS NULL AND a.resolved_at IS NULL
+			  RETURNING a.id, a.product_id, p.name, a.threshold, a.stock, a.created_at, a.notified_at, a.resolved_at`
+
+	rows, err := DB.QueryContext(ctx, query, at)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	alerts, err := scanStockAlerts(rows)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if !alerts[i].CreatedAt.Equal(alerts[j].CreatedAt) {
+			return alerts[i].CreatedAt.Before(alerts[j].CreatedAt)
+		}
+		return alerts[i].ID.String() < alerts[j].ID.String()
+	})
+	return alerts, nil
+}
+
+func (r *PostgresStockAlertRepository) ReleaseAlert(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	return wrapQueryError(ctx, execOne(ctx, DB, `UPDATE stock_alerts SET notified_at = NULL WHERE id = $1`, id))
+}
+
+// scanStockAlerts reads the stock alerts selected by GetAlerts and ClaimPending
+func scanStockAlerts(rows *sql.Rows) ([]models.StockAlert, error) {
+	alerts := []models.StockAlert{}
+	for rows.Next() {
+		var alert models.StockAlert
+		err := rows.Scan(&alert.ID, &alert.ProductID, &alert.ProductName, &alert.Threshold, &alert.Stock,
+			&alert.CreatedAt, &alert.NotifiedAt, &alert.ResolvedAt)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts, rows.Err()
+}
+
+// nullableInt returns a nullable column's value, or nil when it is NULL
+func nullableInt(value sql.NullInt64) *int {
+	if !value.Valid {
+		return nil
+	}
+	n := int(value.Int64)
+	return &n
+}
+
+// PostgresOrderRepository handles order database operations
+type PostgresOrderRepository struct{}
+
+func (r *PostgresOrderRepository) Create(ctx context.Context, order *models.Order) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	order.ID = uuid.New()
+	order.CreatedAt = time.Now()
+	order.UpdatedAt = time.Now()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	// Insert order
+	query := `INSERT INTO orders (id, customer_id, status, total, currency, ship_latitude, ship_longitude, created_at, updated_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	latitude, longitude := locationColumns(order.ShipTo)
+	_, err = tx.ExecContext(ctx, query, order.ID, order.CustomerID, order.Status, order.Total.Amount,
+		order.Total.Currency, latitude, longitude, order.CreatedAt, order.UpdatedAt)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	// Insert order items
+	for i := range order.Items {
+		order.Items[i].ID = uuid.New()
+		order.Items[i].OrderID = order.ID
+
+		itemQuery := `INSERT INTO order_items (id, order_id, product_id, variant_id, quantity, price, currency)
+					  VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+		_, err = tx.ExecContext(ctx, itemQuery, order.Items[i].ID, order.Items[i].OrderID, order.Items[i].ProductID,
+			order.Items[i].VariantID, order.Items[i].Quantity, order.Items[i].Price.Amount, order.Items[i].Price.Currency)
+		if err != nil {
+			return wrapQueryError(ctx, err)
+		}
+	}
+
+	// Reserve stock in the same transaction so a failed insert releases it
+	if err := reserveStock(ctx, tx, order); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// reserveStock decrements the stock of every ordered product and variant inside
+// tx and reserves it at the warehouses allocateItem picks. The conditional
+// UPDATEs only succeed while enough stock remains. Lines are taken in product
+// and then variant ID order, and a product is always updated before its
+// variant and its inventory levels, so concurrent orders lock rows in the same
+// sequence.
+func reserveStock(ctx context.Context, tx *sql.Tx, order *models.Order) error {
+	items := order.Items
+	indexes := make([]int, len(items))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.Slice(indexes, func(a, b int) bool {
+		return orderLineKey(items[indexes[a]]) < orderLineKey(items[indexes[b]])
+	})
+
+	for _, i := range indexes {
+		err := reserveItem(ctx, tx, &items[i])
+		if err == nil {
+			err = allocateItem(ctx, tx, order, &items[i])
+		}
+		if err == nil {
+			err = syncStockAlert(ctx, tx, items[i].ProductID)
+		}
+		if err == sql.ErrNoRows {
+			return insufficientStock(ctx, tx, &items[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reserveItem takes an order line's quantity off its product's stock and then
+// off its variant's, returning sql.ErrNoRows when either has too little left
+func reserveItem(ctx context.Context, tx *sql.Tx, item *models.OrderItem) error {
+	query := `UPDATE products SET stock = stock - $1, updated_at = $2
+			  WHERE id = $3 AND stock >= $1 AND deleted_at IS NULL
+			  RETURNING stock`
+
+	err := tx.QueryRowContext(ctx, query, item.Quantity, time.Now(), item.ProductID).Scan(&item.Product.Stock)
+	if err != nil || item.VariantID == nil {
+		return err
+	}
+
+	query = `UPDATE product_variants SET stock = stock - $1, updated_at = $2
+			 WHERE id = $3 AND product_id = $4 AND stock >= $1
+			 RETURNING stock`
+
+	var stock int
+	err = tx.QueryRowContext(ctx, query, item.Quantity, time.Now(), *item.VariantID, item.ProductID).Scan(&stock)
+	if err == nil && item.Variant != nil {
+		item.Variant.Stock = stock
+	}
+	return err
+}
+
+// orderLineKey orders lines by product and then variant
+func orderLineKey(item models.OrderItem) string {
+	key := item.ProductID.String()
+	if item.VariantID != nil {
+		key += "/" + item.VariantID.String()
+	}
+	return key
+}
+
+// insufficientStock describes an order line whose stock could not be reserved
+func insufficientStock(ctx context.Context, tx *sql.Tx, item *models.OrderItem) error {
+	stockErr := &InsufficientStockError{ProductID: item.ProductID, Requested: item.Quantity}
+	// A deleted product has nothing left to sell
+	err := tx.QueryRowContext(ctx, `SELECT name, CASE WHEN deleted_at IS NULL THEN stock ELSE 0 END
+			FROM products WHERE id = $1`, item.ProductID).
+		Scan(&stockErr.ProductName, &stockErr.Available)
+	if err != nil {
+		return err
+	}
+
+	if item.VariantID != nil {
+		var sku string
+		var stock int
+		err := tx.QueryRowContext(ctx, `SELECT sku, stock FROM product_variants WHERE id = $1 AND product_id = $2`,
+			*item.VariantID, item.ProductID).Scan(&sku, &stock)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		stockErr.SKU = sku
+		stockErr.Available = min(stockErr.Available, stock)
+	}
+	return stockErr
+}
+
+// UpdateStatus moves an order to change.ToStatus if the order state machine
+// allows it, recording the transition in order_status_history. Cancelling
+// returns the order's stock to inventory and shipping takes it out of the
+// warehouses holding it, in the same transaction.
+func (r *PostgresOrderRepository) UpdateStatus(ctx context.Context, change *models.OrderStatusChange) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	// Lock the order so concurrent transitions are applied one at a time
+	var itemCount int
+	query := `SELECT o.status, (SELECT COUNT(*) FROM order_items oi
+			  WHERE oi.order_id = o.id AND oi.quantity > oi.cancelled_quantity)
+			  FROM orders o WHERE o.id = $1 FOR UPDATE`
+
+	err = tx.QueryRowContext(ctx, query, change.OrderID).Scan(&change.FromStatus, &itemCount)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if err := models.ValidateOrderTransition(change.FromStatus, change.ToStatus, itemCount); err != nil {
+		return err
+	}
+
+	change.ID = uuid.New()
+	change.CreatedAt = time.Now()
+
+	_, err = tx.ExecContext(ctx, `UPDATE orders SET status = $1, updated_at = $2 WHERE id = $3`,
+		change.ToStatus, change.CreatedAt, change.OrderID)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	historyQuery := `INSERT INTO order_status_history (id, order_id, from_status, to_status, changed_by, reason, created_at)
+					 VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err = tx.ExecContext(ctx, historyQuery, change.ID, change.OrderID, change.FromStatus, change.ToStatus,
+		change.ChangedBy, change.Reason, change.CreatedAt)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if models.TransitionRestocksInventory(change.ToStatus) {
+		if err := restockOrder(ctx, tx, change.OrderID); err != nil {
+			return wrapQueryError(ctx, err)
+		}
+	}
+	if models.TransitionShipsStock(change.ToStatus) {
+		if err := shipOrder(ctx, tx, change.OrderID); err != nil {
+			return wrapQueryError(ctx, err)
+		}
+	}
+
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// restockOrder returns the uncancelled quantity of every line of an order to
+// product and variant stock inside tx. Lines are restocked in the order
+// reserveStock takes them in.
+func restockOrder(ctx context.Context, tx *sql.Tx, orderID uuid.UUID) error {
+	query := `SELECT id, order_id, product_id, variant_id, quantity - cancelled_quantity
+			  FROM order_items
+			  WHERE order_id = $1 AND quantity > cancelled_quantity
+			  ORDER BY product_id, variant_id`
+
+	rows, err := tx.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return err
+	}
+
+	var items []models.OrderItem
+	for rows.Next() {
+		var item models.OrderItem
+		if err := rows.Scan(&item.ID, &item.OrderID, &item.ProductID, &item.VariantID, &item.Quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err := restockItem(ctx, tx, item, item.Quantity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restockItem returns quantity units of an order line to its product's stock,
+// and to its variant's if it has one, and releases them at the warehouses
+// holding them inside tx
+func restockItem(ctx context.Context, tx *sql.Tx, item models.OrderItem, quantity int) error {
+	now := time.Now()
+	_, err := tx.ExecContext(ctx, `UPDATE products SET stock = stock + $1, updated_at = $2 WHERE id = $3`,
+		quantity, now, item.ProductID)
+	if err != nil {
+		return err
+	}
+
+	if item.VariantID != nil {
+		_, err = tx.ExecContext(ctx, `UPDATE product_variants SET stock = stock + $1, updated_at = $2 WHERE id = $3`,
+			quantity, now, *item.VariantID)
+		if err != nil {
+			return err
+		}
+	}
+	if err := syncStockAlert(ctx, tx, item.ProductID); err != nil {
+		return err
+	}
+	return releaseItem(ctx, tx, item, quantity)
+}
+
+// CancelItem cancels quantity units of one order line, returning them to stock
+// and taking them off the order total. A quantity of 0 cancels everything still
+// outstanding on the line. Only orders that still hold their stock can be changed.
+func (r *PostgresOrderRepository) CancelItem(ctx context.Context, orderID, itemID uuid.UUID, quantity int) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(ctx, `SELECT status FROM orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&status)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	item := models.OrderItem{ID: itemID, OrderID: orderID}
+	query := `SELECT product_id, variant_id, quantity, cancelled_quantity, price
+			  FROM order_items WHERE id = $1 AND order_id = $2 FOR UPDATE`
+
+	err = tx.QueryRowContext(ctx, query, itemID, orderID).Scan(&item.ProductID, &item.VariantID, &item.Quantity,
+		&item.CancelledQuantity, &item.Price.Amount)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if quantity, err = validateItemCancellation(status, itemID, item, quantity); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `UPDATE order_items SET cancelled_quantity = cancelled_quantity + $1 WHERE id = $2`,
+		quantity, itemID)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE orders SET total = total - $1, updated_at = $2 WHERE id = $3`,
+		item.Price.Amount*int64(quantity), now, orderID)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if err := restockItem(ctx, tx, item, quantity); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// validateItemCancellation checks a line cancellation against the order status
+// and the quantity still outstanding, returning the quantity to cancel
+func validateItemCancellation(status string, itemID uuid.UUID, item models.OrderItem, quantity int) (int, error) {
+	if !models.OrderHoldsStock(status) {
+		return 0, &models.OrderItemCancellationError{ItemID: itemID, Reason: fmt.Sprintf("order is %s", status)}
+	}
+	remaining := item.RemainingQuantity()
+	if remaining == 0 {
+		return 0, &models.OrderItemCancellationError{ItemID: itemID, Reason: "item is already cancelled"}
+	}
+	if quantity == 0 {
+		return remaining, nil
+	}
+	if quantity < 0 || quantity > remaining {
+		return 0, &models.OrderItemCancellationError{
+			ItemID: itemID,
+			Reason: fmt.Sprintf("quantity %d is outside the %d still outstanding", quantity, remaining),
+		}
+	}
+	return quantity, nil
+}
+
+// GetStatusHistory returns the status transitions of an order, oldest first
+func (r *PostgresOrderRepository) GetStatusHistory(ctx context.Context, orderID uuid.UUID) ([]models.OrderStatusChange, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, order_id, from_status, to_status, changed_by, COALESCE(reason, ''), created_at
+			  FROM order_status_history
+			  WHERE order_id = $1
+			  ORDER BY created_at`
+
+	rows, err := DB.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	var history []models.OrderStatusChange
+	for rows.Next() {
+		var change models.OrderStatusChange
+		err := rows.Scan(&change.ID, &change.OrderID, &change.FromStatus, &change.ToStatus,
+			&change.ChangedBy, &change.Reason, &change.CreatedAt)
+		if err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		history = append(history, change)
+	}
+	return history, nil
+}
+
+func (r *PostgresOrderRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Order, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	order := &models.Order{}
+	query := `SELECT o.id, o.customer_id, o.status, o.total, o.currency, o.ship_latitude, o.ship_longitude,
+			  o.created_at, o.updated_at, c.id, c.email, c.name, c.phone, c.created_at, c.updated_at
+			  FROM orders o
+			  LEFT JOIN customers c ON o.customer_id = c.id
+			  WHERE o.id = $1`
+
+	var latitude, longitude sql.NullFloat64
+	err := DB.QueryRowContext(ctx, query, id).Scan(&order.ID, &order.CustomerID, &order.Status, &order.Total.Amount, &order.Total.Currency,
+		&latitude, &longitude, &order.CreatedAt, &order.UpdatedAt, &order.Customer.ID, &order.Customer.Email,
+		&order.Customer.Name, &order.Customer.Phone, &order.Customer.CreatedAt, &order.Customer.UpdatedAt)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	order.ShipTo = nullLocation(latitude, longitude)
+
+	// Get order items. Their categories are joined even when deleted, so that
+	// orders stay readable.
+	itemsQuery := `SELECT oi.id, oi.order_id, oi.product_id, oi.variant_id, oi.quantity, oi.cancelled_quantity, oi.price, oi.currency,
+				   p.id, p.name, p.description, p.price, p.currency, p.category_id, p.stock, p.image_url, p.attributes,
+				   p.created_at, p.updated_at, c.id, c.name, c.description, c.parent_id, c.level, c.path,
+				   c.created_at, c.updated_at, c.deleted_at
+				   FROM order_items oi
+				   LEFT JOIN products p ON oi.product_id = p.id
+				   LEFT JOIN categories c ON p.category_id = c.id
+				   WHERE oi.order_id = $1`
+
+	rows, err := DB.QueryContext(ctx, itemsQuery, id)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	var variantIDs []uuid.UUID
+	for rows.Next() {
+		var item models.OrderItem
+		err := rows.Scan(&item.ID, &item.OrderID, &item.ProductID, &item.VariantID, &item.Quantity, &item.CancelledQuantity, &item.Price.Amount,
+			&item.Price.Currency, &item.Product.ID, &item.Product.Name, &item.Product.Description,
+			&item.Product.Price.Amount, &item.Product.Price.Currency,
+			&item.Product.CategoryID, &item.Product.Stock, &item.Product.ImageURL, &item.Product.Attributes,
+			&item.Product.CreatedAt, &item.Product.UpdatedAt, &item.Product.Category.ID, &item.Product.Category.Name,
+			&item.Product.Category.Description, &item.Product.Category.ParentID, &item.Product.Category.Level,
+			&item.Product.Category.Path, &item.Product.Category.CreatedAt, &item.Product.Category.UpdatedAt,
+			&item.Product.Category.DeletedAt)
+		if err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		if item.VariantID != nil {
+			variantIDs = append(variantIDs, *item.VariantID)
+		}
+		order.Items = append(order.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+
+	variants, err := variantsByID(ctx, DB, variantIDs)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	for i, item := range order.Items {
+		if item.VariantID != nil {
+			variant := variants[*item.VariantID]
+			order.Items[i].Variant = &variant
+		}
+	}
+
+	allocations, err := queryAllocations(ctx, DB, id)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	for i, item := range order.Items {
+		order.Items[i].Allocations = allocations[item.ID]
+	}
+
+	return order, nil
+}
+
+func (r *PostgresOrderRepository) GetByCustomer(ctx context.Context, customerID uuid.UUID) ([]models.Order, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT o.id, o.customer_id, o.status, o.total, o.currency, o.ship_latitude, o.ship_longitude,
+			         o.created_at, o.updated_at, c.id, c.email, c.name, c.phone, c.created_at, c.updated_at
+			   FROM orders o
+			   LEFT JOIN customers c ON o.customer_id = c.id
+			   WHERE o.customer_id = $1
+			   ORDER BY o.created_at DESC`
+
+	rows, err := DB.QueryContext(ctx, query, customerID)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	var orders []models.Order
+	for rows.Next() {
+		var order models.Order
+		var latitude, longitude sql.NullFloat64
+		err := rows.Scan(&order.ID, &order.CustomerID, &order.Status, &order.Total.Amount, &order.Total.Currency,
+			&latitude, &longitude, &order.CreatedAt, &order.UpdatedAt, &order.Customer.ID, &order.Customer.Email,
+			&order.Customer.Name, &order.Customer.Phone, &order.Customer.CreatedAt, &order.Customer.UpdatedAt)
+
+		if err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		order.ShipTo = nullLocation(latitude, longitude)
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+// Delete removes an order. Stock still held by a pending or processing order is
+// returned to inventory in the same transaction.
+func (r *PostgresOrderRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(ctx, `SELECT status FROM orders WHERE id = $1 FOR UPDATE`, id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if models.OrderHoldsStock(status) {
+		if err := restockOrder(ctx, tx, id); err != nil {
+			return wrapQueryError(ctx, err)
+		}
+	}
+
+	query := `DELETE FROM orders WHERE id = $1`
+	if _, err := tx.ExecContext(ctx, query, id); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// PostgresCartRepository handles cart database operations
+type PostgresCartRepository struct{}
+
+func (r *PostgresCartRepository) Create(ctx context.Context, cart *models.Cart) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	cart.ID = uuid.New()
+	cart.CreatedAt = time.Now()
+	cart.UpdatedAt = time.Now()
+
+	query := `INSERT INTO carts (id, customer_id, token, created_at, updated_at)
+			  VALUES ($1, $2, $3, $4, $5)`
+
+	_, err := DB.ExecContext(ctx, query, cart.ID, cart.CustomerID, cart.Token, cart.CreatedAt, cart.UpdatedAt)
+	return wrapQueryError(ctx, err)
+}
+
+func (r *PostgresCartRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Cart, error) {
+	return r.get(ctx, `WHERE id = $1`, id)
+}
+
+func (r *PostgresCartRepository) GetByCustomer(ctx context.Context, customerID uuid.UUID) (*models.Cart, error) {
+	return r.get(ctx, `WHERE customer_id = $1`, customerID)
+}
+
+// get loads a single cart matching where, with its items joined to their products and variants
+func (r *PostgresCartRepository) get(ctx context.Context, where string, arg interface{}) (*models.Cart, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	cart := &models.Cart{Items: []models.CartItem{}}
+	query := `SELECT id, customer_id, COALESCE(token, ''), created_at, updated_at FROM carts ` + where
+
+	err := DB.QueryRowContext(ctx, query, arg).Scan(&cart.ID, &cart.CustomerID, &cart.Token,
+		&cart.CreatedAt, &cart.UpdatedAt)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+
+	itemsQuery := `SELECT ci.id, ci.cart_id, ci.product_id, ci.variant_id, ci.quantity, ci.created_at, ci.updated_at,
+				   p.id, p.name, p.description, p.price, p.currency, p.category_id, p.stock, p.image_url, p.attributes,
+				   p.created_at, p.updated_at
+				   FROM cart_items ci
+				   JOIN products p ON ci.product_id = p.id
+				   WHERE ci.cart_id = $1
+				   ORDER BY ci.created_at`
+
+	rows, err := DB.QueryContext(ctx, itemsQuery, cart.ID)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer rows.Close()
+
+	var variantIDs []uuid.UUID
+	for rows.Next() {
+		var item models.CartItem
+		err := rows.Scan(&item.ID, &item.CartID, &item.ProductID, &item.VariantID, &item.Quantity, &item.CreatedAt, &item.UpdatedAt,
+			&item.Product.ID, &item.Product.Name, &item.Product.Description,
+			&item.Product.Price.Amount, &item.Product.Price.Currency,
+			&item.Product.CategoryID, &item.Product.Stock, &item.Product.ImageURL, &item.Product.Attributes,
+			&item.Product.CreatedAt, &item.Product.UpdatedAt)
+		if err != nil {
+			return nil, wrapQueryError(ctx, err)
+		}
+		if item.VariantID != nil {
+			variantIDs = append(variantIDs, *item.VariantID)
+		}
+		cart.Items = append(cart.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+
+	variants, err := variantsByID(ctx, DB, variantIDs)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	for i, item := range cart.Items {
+		if item.VariantID != nil {
+			variant := variants[*item.VariantID]
+			cart.Items[i].Variant = &variant
+		}
+	}
+
+	return cart, nil
+}
+
+// SetItem sets the quantity of a product, or of one of its variants, in a cart,
+// adding the line if needed
+func (r *PostgresCartRepository) SetItem(ctx context.Context, cartID, productID uuid.UUID, variantID *uuid.UUID, quantity int) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	query := `INSERT INTO cart_items (id, cart_id, product_id, variant_id, quantity, created_at, updated_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $6)
+			  ON CONFLICT ` + cartLineConflict + ` DO UPDATE SET quantity = EXCLUDED.quantity, updated_at = EXCLUDED.updated_at`
+
+	if err := touchCart(ctx, tx, cartID, now); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, query, uuid.New(), cartID, productID, variantID, quantity, now); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+func (r *PostgresCartRepository) RemoveItem(ctx context.Context, cartID, itemID uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM cart_items WHERE id = $1 AND cart_id = $2`, itemID, cartID)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	if removed, err := result.RowsAffected(); err != nil {
+		return wrapQueryError(ctx, err)
+	} else if removed == 0 {
+		return sql.ErrNoRows
+	}
+
+	if err := touchCart(ctx, tx, cartID, time.Now()); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+// Merge moves the lines of one cart into another, adding quantities for
+// products and variants both carts hold, and deletes the emptied cart
+func (r *PostgresCartRepository) Merge(ctx context.Context, fromID, intoID uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	query := `INSERT INTO cart_items (id, cart_id, product_id, variant_id, quantity, created_at, updated_at)
+			  SELECT gen_random_uuid(), $2, product_id, variant_id, quantity, created_at, $3
+			  FROM cart_items WHERE cart_id = $1
+			  ON CONFLICT ` + cartLineConflict + ` DO UPDATE
+			  SET quantity = cart_items.quantity + EXCLUDED.quantity, updated_at = EXCLUDED.updated_at`
+
+	if err := touchCart(ctx, tx, intoID, now); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, query, fromID, intoID, now); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM carts WHERE id = $1`, fromID); err != nil {
+		return wrapQueryError(ctx, err)
+	}
+
+	return wrapQueryError(ctx, tx.Commit())
+}
+
+func (r *PostgresCartRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `DELETE FROM carts WHERE id = $1`
+	_, err := DB.ExecContext(ctx, query, id)
+	return wrapQueryError(ctx, err)
+}
+
+// cartLineConflict is the conflict target of the unique index on cart lines
+const cartLineConflict = `(cart_id, product_id, COALESCE(variant_id, '00000000-0000-0000-0000-000000000000'))`
+
+// touchCart bumps a cart's updated_at inside tx, reporting sql.ErrNoRows for a missing cart
+func touchCart(ctx context.Context, tx *sql.Tx, cartID uuid.UUID, at time.Time) error {
+	result, err := tx.ExecContext(ctx, `UPDATE carts SET updated_at = $1 WHERE id = $2`, at, cartID)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// PostgresIdempotencyRepository handles idempotency key database operations
+type PostgresIdempotencyRepository struct{}
+
+// Reserve claims record.Key for a new request. If the key is already held by an
+// unexpired record, that record is returned instead and nothing is stored.
+func (r *PostgresIdempotencyRepository) Reserve(ctx context.Context, record *models.IdempotencyRecord) (*models.IdempotencyRecord, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	record.CreatedAt = time.Now()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	// An expired key may be reused
+	if _, err := tx.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE key = $1 AND expires_at <= $2`,
+		record.Key, record.CreatedAt); err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+
+	query := `INSERT INTO idempotency_keys (key, request_hash, created_at, expires_at)
+			  VALUES ($1, $2, $3, $4)
+			  ON CONFLICT (key) DO NOTHING`
+
+	result, err := tx.ExecContext(ctx, query, record.Key, record.RequestHash, record.CreatedAt, record.ExpiresAt)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return nil, wrapQueryError(ctx, err)
+	} else if inserted == 1 {
+		return nil, wrapQueryError(ctx, tx.Commit())
+	}
+
+	existing := &models.IdempotencyRecord{}
+	query = `SELECT key, request_hash, status_code, COALESCE(content_type, ''), response_body, created_at, expires_at
+			 FROM idempotency_keys WHERE key = $1`
+
+	err = tx.QueryRowContext(ctx, query, record.Key).Scan(&existing.Key, &existing.RequestHash, &existing.StatusCode,
+		&existing.ContentType, &existing.ResponseBody, &existing.CreatedAt, &existing.ExpiresAt)
+	if err != nil {
+		return nil, wrapQueryError(ctx, err)
+	}
+	return existing, wrapQueryError(ctx, tx.Commit())
+}
+
+// Complete stores the response of the request holding key
+func (r *PostgresIdempotencyRepository) Complete(ctx context.Context, key string, statusCode int, contentType string, body []byte) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `UPDATE idempotency_keys SET status_code = $1, content_type = $2, response_body = $3 WHERE key = $4`
+	_, err := DB.ExecContext(ctx, query, statusCode, contentType, body, key)
+	return wrapQueryError(ctx, err)
+}
+
+// Release frees a key whose request failed so that it can be retried
+func (r *PostgresIdempotencyRepository) Release(ctx context.Context, key string) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	query := `DELETE FROM idempotency_keys WHERE key = $1 AND status_code = 0`
+	_, err := DB.ExecContext(ctx, query, key)
+	return wrapQueryError(ctx, err)
+}
+
+func (r *PostgresIdempotencyRepository) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= $1`, now)
+	if err != nil {
+		return 0, wrapQueryError(ctx, err)
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), wrapQueryError(ctx, err)
 }
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"commerce-app/internal/database"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// AdminHandler lists and restores soft-deleted products, categories and customers
+type AdminHandler struct {
+	customerRepo database.CustomerRepository
+	categoryRepo database.CategoryRepository
+	productRepo  database.ProductRepository
+}
+
+func NewAdminHandler(customerRepo database.CustomerRepository, categoryRepo database.CategoryRepository,
+	productRepo database.ProductRepository) *AdminHandler {
+	return &AdminHandler{
+		customerRepo: customerRepo,
+		categoryRepo: categoryRepo,
+		productRepo:  productRepo,
+	}
+}
+
+// GetDeletedProducts lists the soft-deleted products
+func (h *AdminHandler) GetDeletedProducts(w http.ResponseWriter, r *http.Request) {
+	writeDeleted(w, r, h.productRepo)
+}
+
+// GetDeletedCategories lists the soft-deleted categories
+func (h *AdminHandler) GetDeletedCategories(w http.ResponseWriter, r *http.Request) {
+	writeDeleted(w, r, h.categoryRepo)
+}
+
+// GetDeletedCustomers lists the soft-deleted customers
+func (h *AdminHandler) GetDeletedCustomers(w http.ResponseWriter, r *http.Request) {
+	writeDeleted(w, r, h.customerRepo)
+}
+
+// RestoreProduct restores a soft-deleted product
+func (h *AdminHandler) RestoreProduct(w http.ResponseWriter, r *http.Request) {
+	restore(w, r, h.productRepo, h.productRepo.GetByID, "Product")
+}
+
+// RestoreCategory restores a soft-deleted category along with the subcategories
+// and products deleted with it
+func (h *AdminHandler) RestoreCategory(w http.ResponseWriter, r *http.Request) {
+	restore(w, r, h.categoryRepo, h.categoryRepo.GetByID, "Category")
+}
+
+// RestoreCustomer restores a soft-deleted customer
+func (h *AdminHandler) RestoreCustomer(w http.ResponseWriter, r *http.Request) {
+	restore(w, r, h.customerRepo, h.customerRepo.GetByID, "Customer")
+}
+
+// writeDeleted writes the rows a repository has soft-deleted
+func writeDeleted[T any](w http.ResponseWriter, r *http.Request, repo database.SoftDeleter[T]) {
+	deleted, err := repo.GetDeleted(r.Context())
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deleted)
+}
+
+// restore restores the row named in the URL and responds with it
+func restore[T any](w http.ResponseWriter, r *http.Request, repo database.SoftDeleter[T],
+	get func(ctx context.Context, id uuid.UUID) (*T, error), name string) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid "+name+" ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := repo.Restore(r.Context(), id); err != nil {
+		if errors.Is(err, database.ErrParentDeleted) {
+			http.Error(w, name+" is in a deleted category; restore the category first", http.StatusConflict)
+			return
+		}
+		writeRepositoryError(w, err, "Deleted "+name+" not found", http.StatusNotFound)
+		return
+	}
+
+	restored, err := get(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(restored)
+}
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"commerce-app/internal/database"
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Column limits of the category_attributes table
+const (
+	maxAttributeNameLength = 64
+	maxAttributeUnitLength = 32
+)
+
+// attributeNamePattern keeps attribute names usable as attr.<name> query parameters
+var attributeNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// GetCategoryAttributes lists the attributes of a category's products, including
+// those inherited from its ancestors
+func (h *ProductHandler) GetCategoryAttributes(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.categoryRepo.GetByID(r.Context(), id); err != nil {
+		writeRepositoryError(w, err, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	schema, err := h.categoryRepo.GetAttributeSchema(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schema)
+}
+
+// CreateCategoryAttribute defines an attribute for the products of a category
+// and its subcategories
+func (h *ProductHandler) CreateCategoryAttribute(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	var attribute models.AttributeDefinition
+	if err := json.NewDecoder(r.Body).Decode(&attribute); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if problems := validateAttributeDefinition(&attribute); len(problems) > 0 {
+		http.Error(w, "Invalid attribute: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.categoryRepo.GetByID(r.Context(), id); err != nil {
+		writeRepositoryError(w, err, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	attribute.CategoryID = id
+	if err := h.categoryRepo.CreateAttribute(r.Context(), &attribute); err != nil {
+		if errors.Is(err, database.ErrDuplicateAttribute) {
+			http.Error(w, fmt.Sprintf("Invalid attribute: %s %s", attribute.Name, err), http.StatusConflict)
+			return
+		}
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attribute)
+}
+
+// DeleteCategoryAttribute removes an attribute defined on a category, along with
+// the values its products hold for it
+func (h *ProductHandler) DeleteCategoryAttribute(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.categoryRepo.DeleteAttribute(r.Context(), id, vars["name"]); err != nil {
+		writeRepositoryError(w, err, "Attribute not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// attributeProblems checks the attribute values a product will hold after an
+// update against the schema of its category. Values are checked when they
+// change and when the product moves to another category.
+func (h *ProductHandler) attributeProblems(ctx context.Context, update models.ProductUpdate, existing *models.Product) ([]string, error) {
+	categoryID := existing.CategoryID
+	if update.CategoryID != nil {
+		categoryID = *update.CategoryID
+	}
+
+	attributes := update.Attributes
+	if attributes == nil {
+		if categoryID == existing.CategoryID {
+			return nil, nil
+		}
+		attributes = &existing.Attributes
+	}
+
+	schema, err := h.categoryRepo.GetAttributeSchema(ctx, categoryID)
+	if err != nil {
+		return nil, err
+	}
+	return schema.Validate(*attributes), nil
+}
+
+// validateAttributeDefinition trims and checks an attribute definition, returning
+// a description of every invalid field
+func validateAttributeDefinition(attribute *models.AttributeDefinition) []string {
+	var problems []string
+
+	attribute.Name = strings.TrimSpace(attribute.Name)
+	switch {
+	case attribute.Name == "":
+		problems = append(problems, "name must not be empty")
+	case utf8.RuneCountInString(attribute.Name) > maxAttributeNameLength:
+		problems = append(problems, fmt.Sprintf("name must be at most %d characters", maxAttributeNameLength))
+	case !attributeNamePattern.MatchString(attribute.Name):
+		problems = append(problems, "name must start with a lowercase letter and hold only lowercase letters, digits and underscores")
+	}
+
+	if !models.IsValidAttributeType(attribute.Type) {
+		problems = append(problems, fmt.Sprintf("type must be one of %s, %s, %s, %s", models.AttributeTypeText,
+			models.AttributeTypeNumber, models.AttributeTypeBoolean, models.AttributeTypeEnum))
+	}
+
+	attribute.Unit = strings.TrimSpace(attribute.Unit)
+	switch {
+	case attribute.Unit != "" && attribute.Type != models.AttributeTypeNumber:
+		problems = append(problems, "unit is only allowed for number attributes")
+	case utf8.RuneCountInString(attribute.Unit) > maxAttributeUnitLength:
+		problems = append(problems, fmt.Sprintf("unit must be at most %d characters", maxAttributeUnitLength))
+	}
+
+	if attribute.Type != models.AttributeTypeEnum {
+		if len(attribute.Values) > 0 {
+			problems = append(problems, "values are only allowed for enum attributes")
+		}
+		return problems
+	}
+
+	if len(attribute.Values) == 0 {
+		problems = append(problems, "values must list the allowed values of an enum attribute")
+	}
+	for i, value := range attribute.Values {
+		value = strings.TrimSpace(value)
+		if value == "" || slices.Contains(attribute.Values[:i], value) {
+			problems = append(problems, "values must be distinct and not empty")
+			break
+		}
+		attribute.Values[i] = value
+	}
+	return problems
+}
+
+// parseAttributeFilters reads the attr.<name>, attr.<name>.min and
+// attr.<name>.max product listing parameters
+func parseAttributeFilters(query url.Values) ([]models.AttributeFilter, error) {
+	filters := make(map[string]*models.AttributeFilter)
+	for key := range query {
+		name, ok := strings.CutPrefix(key, "attr.")
+		if !ok {
+			continue
+		}
+
+		name, bound, _ := strings.Cut(name, ".")
+		if !attributeNamePattern.MatchString(name) || (bound != "" && bound != "min" && bound != "max") {
+			return nil, fmt.Errorf("Invalid attribute filter %s: use attr.<name>, attr.<name>.min or attr.<name>.max", key)
+		}
+
+		filter, ok := filters[name]
+		if !ok {
+			filter = &models.AttributeFilter{Name: name}
+			filters[name] = filter
+		}
+
+		// A name without a value lists the products that have the attribute
+		value := query.Get(key)
+		if bound == "" {
+			if value != "" {
+				filter.Value = &value
+			}
+			continue
+		}
+
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+			return nil, fmt.Errorf("Invalid attribute filter %s: %q is not a number", key, value)
+		}
+		if bound == "min" {
+			filter.Min = &number
+		} else {
+			filter.Max = &number
+		}
+	}
+
+	attributes := make([]models.AttributeFilter, 0, len(filters))
+	for _, filter := range filters {
+		attributes = append(attributes, *filter)
+	}
+	sort.Slice(attributes, func(i, j int) bool {
+		return attributes[i].Name < attributes[j].Name
+	})
+	return attributes, nil
+}
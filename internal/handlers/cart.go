@@ -0,0 +1,399 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"commerce-app/internal/auth"
+	"commerce-app/internal/database"
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// cartTokenHeader carries the token that grants access to an anonymous cart
+const cartTokenHeader = "X-Cart-Token"
+
+type CartHandler struct {
+	cartRepo     database.CartRepository
+	productRepo  database.ProductRepository
+	customerRepo database.CustomerRepository
+	orderHandler *OrderHandler
+}
+
+func NewCartHandler(cartRepo database.CartRepository, productRepo database.ProductRepository,
+	customerRepo database.CustomerRepository, orderHandler *OrderHandler) *CartHandler {
+	return &CartHandler{
+		cartRepo:     cartRepo,
+		productRepo:  productRepo,
+		customerRepo: customerRepo,
+		orderHandler: orderHandler,
+	}
+}
+
+// CreateCart creates an anonymous cart, or returns the authenticated
+// customer's cart, creating it on first use
+func (h *CartHandler) CreateCart(w http.ResponseWriter, r *http.Request) {
+	if customerID, _, _ := auth.GetUserFromContext(r.Context()); customerID != uuid.Nil {
+		cart, created, err := h.customerCart(r, customerID)
+		if err != nil {
+			writeRepositoryError(w, err, "Customer not found", http.StatusNotFound)
+			return
+		}
+
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		h.writeCart(w, cart, status)
+		return
+	}
+
+	token, err := auth.GenerateRandomString(24)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cart := &models.Cart{Token: token, Items: []models.CartItem{}}
+	if err := h.cartRepo.Create(r.Context(), cart); err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The token is only revealed here; clients send it back in the X-Cart-Token header
+	if err := cart.Reprice(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(cart)
+}
+
+// GetCart gets a cart with current prices and availability
+func (h *CartHandler) GetCart(w http.ResponseWriter, r *http.Request) {
+	cart, ok := h.loadCart(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeCart(w, cart, http.StatusOK)
+}
+
+// AddCartItem adds a quantity of a product to a cart
+func (h *CartHandler) AddCartItem(w http.ResponseWriter, r *http.Request) {
+	cart, ok := h.loadCart(w, r)
+	if !ok {
+		return
+	}
+
+	var line orderLine
+	if err := json.NewDecoder(r.Body).Decode(&line); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if line.ProductID == uuid.Nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	if line.Quantity <= 0 {
+		http.Error(w, "Invalid quantity", http.StatusBadRequest)
+		return
+	}
+
+	quantity := line.Quantity
+	if existing, ok := cart.Item(line.ProductID, line.VariantID); ok {
+		quantity += existing.Quantity
+	}
+
+	h.setItem(w, r, cart, line.ProductID, line.VariantID, quantity)
+}
+
+// UpdateCartItem sets the quantity of a cart line. A quantity of 0 removes it.
+func (h *CartHandler) UpdateCartItem(w http.ResponseWriter, r *http.Request) {
+	cart, ok := h.loadCart(w, r)
+	if !ok {
+		return
+	}
+
+	itemID, err := uuid.Parse(mux.Vars(r)["itemId"])
+	if err != nil {
+		http.Error(w, "Invalid cart item ID", http.StatusBadRequest)
+		return
+	}
+
+	var update struct {
+		Quantity int `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if update.Quantity < 0 {
+		http.Error(w, "Invalid quantity", http.StatusBadRequest)
+		return
+	}
+
+	var item *models.CartItem
+	for i := range cart.Items {
+		if cart.Items[i].ID == itemID {
+			item = &cart.Items[i]
+		}
+	}
+	if item == nil {
+		http.Error(w, "Cart item not found", http.StatusNotFound)
+		return
+	}
+
+	if update.Quantity == 0 {
+		h.removeItem(w, r, cart.ID, itemID)
+		return
+	}
+
+	h.setItem(w, r, cart, item.ProductID, item.VariantID, update.Quantity)
+}
+
+// RemoveCartItem removes a line from a cart
+func (h *CartHandler) RemoveCartItem(w http.ResponseWriter, r *http.Request) {
+	cart, ok := h.loadCart(w, r)
+	if !ok {
+		return
+	}
+
+	itemID, err := uuid.Parse(mux.Vars(r)["itemId"])
+	if err != nil {
+		http.Error(w, "Invalid cart item ID", http.StatusBadRequest)
+		return
+	}
+
+	h.removeItem(w, r, cart.ID, itemID)
+}
+
+// MergeCart moves an anonymous cart into the authenticated customer's cart,
+// typically right after the visitor logs in, and returns the customer's cart
+func (h *CartHandler) MergeCart(w http.ResponseWriter, r *http.Request) {
+	cart, ok := h.loadCart(w, r)
+	if !ok {
+		return
+	}
+
+	if cart.CustomerID != nil {
+		http.Error(w, "Only anonymous carts can be merged", http.StatusConflict)
+		return
+	}
+
+	customerID, _, _ := auth.GetUserFromContext(r.Context())
+	if customerID == uuid.Nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	customerCart, _, err := h.customerCart(r, customerID)
+	if err != nil {
+		writeRepositoryError(w, err, "Customer not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.cartRepo.Merge(r.Context(), cart.ID, customerCart.ID); err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	customerCart, err = h.cartRepo.GetByID(r.Context(), customerCart.ID)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeCart(w, customerCart, http.StatusOK)
+}
+
+// Checkout places an order for the cart's lines through the same path as
+// POST /api/orders and empties the cart. The body may name the ship_to
+// location; an empty body ships without one.
+func (h *CartHandler) Checkout(w http.ResponseWriter, r *http.Request) {
+	cart, ok := h.loadCart(w, r)
+	if !ok {
+		return
+	}
+
+	var checkout struct {
+		ShipTo *models.Location `json:"ship_to,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&checkout); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if cart.CustomerID == nil {
+		http.Error(w, "Anonymous carts must be merged into a customer's cart before checkout", http.StatusConflict)
+		return
+	}
+
+	if len(cart.Items) == 0 {
+		http.Error(w, "Cart is empty", http.StatusBadRequest)
+		return
+	}
+
+	lines := make([]orderLine, len(cart.Items))
+	for i, item := range cart.Items {
+		lines[i] = orderLine{ProductID: item.ProductID, VariantID: item.VariantID, Quantity: item.Quantity}
+	}
+
+	order, ok := h.orderHandler.placeOrder(w, r, *cart.CustomerID, lines, checkout.ShipTo)
+	if !ok {
+		return
+	}
+
+	// The order is placed; a cart left behind only costs the customer a second checkout attempt
+	if err := h.cartRepo.Delete(r.Context(), cart.ID); err != nil {
+		fmt.Printf("Failed to clear cart %s after checkout: %v\n", cart.ID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(order)
+}
+
+// loadCart loads the cart named in the URL, checking the token of anonymous
+// carts. A customer's cart is reported as not found to anyone but that customer.
+func (h *CartHandler) loadCart(w http.ResponseWriter, r *http.Request) (*models.Cart, bool) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid cart ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	cart, err := h.cartRepo.GetByID(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, "Cart not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	if cart.CustomerID != nil {
+		userID, _, _ := auth.GetUserFromContext(r.Context())
+		if userID != *cart.CustomerID {
+			http.Error(w, "Cart not found", http.StatusNotFound)
+			return nil, false
+		}
+		return cart, true
+	}
+
+	token := r.Header.Get(cartTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cart.Token)) != 1 {
+		http.Error(w, "Invalid cart token", http.StatusForbidden)
+		return nil, false
+	}
+
+	return cart, true
+}
+
+// customerCart returns a customer's cart, creating it if the customer has none
+func (h *CartHandler) customerCart(r *http.Request, customerID uuid.UUID) (*models.Cart, bool, error) {
+	if _, err := h.customerRepo.GetByID(r.Context(), customerID); err != nil {
+		return nil, false, err
+	}
+
+	cart, err := h.cartRepo.GetByCustomer(r.Context(), customerID)
+	if err == nil {
+		return cart, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, err
+	}
+
+	cart = &models.Cart{CustomerID: &customerID, Items: []models.CartItem{}}
+	if err := h.cartRepo.Create(r.Context(), cart); err != nil {
+		// Another request may have created the cart first
+		existing, getErr := h.cartRepo.GetByCustomer(r.Context(), customerID)
+		if getErr != nil {
+			return nil, false, err
+		}
+		return existing, false, nil
+	}
+	return cart, true, nil
+}
+
+// setItem validates a line against the current stock and price of its product
+// or variant and stores it, responding with the updated cart
+func (h *CartHandler) setItem(w http.ResponseWriter, r *http.Request, cart *models.Cart, productID uuid.UUID,
+	variantID *uuid.UUID, quantity int) {
+	product, err := h.productRepo.GetByID(r.Context(), productID)
+	if err != nil {
+		writeRepositoryError(w, err, fmt.Sprintf("Product not found: %s", productID), http.StatusNotFound)
+		return
+	}
+
+	variant, ok := lineVariant(w, product, variantID)
+	if !ok {
+		return
+	}
+
+	switch {
+	case variant != nil && variant.Stock < quantity:
+		http.Error(w, fmt.Sprintf("Insufficient stock for product: %s (%s)", product.Name, variant.SKU), http.StatusConflict)
+		return
+	case product.Stock < quantity:
+		http.Error(w, fmt.Sprintf("Insufficient stock for product: %s", product.Name), http.StatusConflict)
+		return
+	}
+
+	for _, item := range cart.Items {
+		if item.ProductID != productID && item.Product.Price.Currency != product.Price.Currency {
+			http.Error(w, fmt.Sprintf("Product %s is priced in a different currency: %s", product.Name, product.Price.Currency), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.cartRepo.SetItem(r.Context(), cart.ID, productID, variantID, quantity); err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeUpdatedCart(w, r, cart.ID)
+}
+
+// removeItem removes a cart line, responding with the updated cart
+func (h *CartHandler) removeItem(w http.ResponseWriter, r *http.Request, cartID, itemID uuid.UUID) {
+	if err := h.cartRepo.RemoveItem(r.Context(), cartID, itemID); err != nil {
+		writeRepositoryError(w, err, "Cart item not found", http.StatusNotFound)
+		return
+	}
+
+	h.writeUpdatedCart(w, r, cartID)
+}
+
+// writeUpdatedCart reloads a cart after a change and writes it
+func (h *CartHandler) writeUpdatedCart(w http.ResponseWriter, r *http.Request, cartID uuid.UUID) {
+	cart, err := h.cartRepo.GetByID(r.Context(), cartID)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeCart(w, cart, http.StatusOK)
+}
+
+// writeCart prices a cart from its products' current prices and writes it
+// without its access token
+func (h *CartHandler) writeCart(w http.ResponseWriter, cart *models.Cart, status int) {
+	if err := cart.Reprice(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	cart.Token = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(cart)
+}
@@ -14,12 +14,12 @@ import (
 )
 
 type CustomerHandler struct {
-	customerRepo *database.CustomerRepository
+	customerRepo database.CustomerRepository
 }
 
-func NewCustomerHandler() *CustomerHandler {
+func NewCustomerHandler(customerRepo database.CustomerRepository) *CustomerHandler {
 	return &CustomerHandler{
-		customerRepo: &database.CustomerRepository{},
+		customerRepo: customerRepo,
 	}
 }
 
@@ -58,8 +58,8 @@ func (h *CustomerHandler) CreateCustomer(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Create customer
-	if err := h.customerRepo.Create(&customer); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.customerRepo.Create(r.Context(), &customer); err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -89,12 +89,28 @@ func (h *CustomerHandler) GetCustomer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	customer, err := h.customerRepo.GetByID(id)
+	customer, err := h.customerRepo.GetByID(r.Context(), id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeRepositoryError(w, err, err.Error(), http.StatusNotFound)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(customer)
 }
+
+// DeleteCustomer soft-deletes a customer. Their orders are kept.
+func (h *CustomerHandler) DeleteCustomer(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.customerRepo.SoftDelete(r.Context(), id); err != nil {
+		writeRepositoryError(w, err, "Customer not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"commerce-app/internal/database"
+)
+
+// statusClientClosedRequest is the non-standard status used when the client
+// went away before the response was ready
+const statusClientClosedRequest = 499
+
+// writeRepositoryError responds to a failed repository call. Queries that were
+// cancelled or timed out are reported with their own status codes; any other
+// error is answered with the given message and status.
+func writeRepositoryError(w http.ResponseWriter, err error, message string, status int) {
+	switch {
+	case errors.Is(err, database.ErrQueryCanceled):
+		http.Error(w, err.Error(), statusClientClosedRequest)
+	case errors.Is(err, database.ErrQueryTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		http.Error(w, message, status)
+	}
+}
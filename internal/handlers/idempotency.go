@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"commerce-app/internal/auth"
+	"commerce-app/internal/database"
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	defaultIdempotencyKeysTTL = 24 * time.Hour
+)
+
+// IdempotencyMiddleware makes requests carrying an Idempotency-Key header safe
+// to retry. The first request with a key runs normally and its response is
+// stored; identical retries get the stored response without running the
+// handler again, and reusing the key for a different request is rejected.
+// Keys are scoped to the authenticated user, or to the cart token of an
+// anonymous caller, so clients never see each other's responses.
+type IdempotencyMiddleware struct {
+	repo database.IdempotencyRepository
+	ttl  time.Duration
+}
+
+func NewIdempotencyMiddleware(repo database.IdempotencyRepository, ttl time.Duration) *IdempotencyMiddleware {
+	return &IdempotencyMiddleware{
+		repo: repo,
+		ttl:  ttl,
+	}
+}
+
+// IdempotencyKeyTTLFromEnv reads IDEMPOTENCY_KEY_TTL (a Go duration such as "24h")
+func IdempotencyKeyTTLFromEnv() time.Duration {
+	value := os.Getenv("IDEMPOTENCY_KEY_TTL")
+	if value == "" {
+		return defaultIdempotencyKeysTTL
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid IDEMPOTENCY_KEY_TTL %q, using %s", value, defaultIdempotencyKeysTTL)
+		return defaultIdempotencyKeysTTL
+	}
+	return d
+}
+
+// Handle wraps a handler with idempotency key support
+func (m *IdempotencyMiddleware) Handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key must be at most "+strconv.Itoa(maxIdempotencyKeyLength)+" characters", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		key = scopedIdempotencyKey(r, key)
+		record := &models.IdempotencyRecord{
+			Key:         key,
+			RequestHash: requestHash(r, body),
+			ExpiresAt:   time.Now().Add(m.ttl),
+		}
+
+		existing, err := m.repo.Reserve(r.Context(), record)
+		if err != nil {
+			writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.RequestHash != record.RequestHash:
+				http.Error(w, "Idempotency-Key has already been used for a different request", http.StatusUnprocessableEntity)
+			case !existing.Completed():
+				http.Error(w, "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+			default:
+				if existing.ContentType != "" {
+					w.Header().Set("Content-Type", existing.ContentType)
+				}
+				w.Header().Set(idempotentReplayedHeader, "true")
+				w.WriteHeader(existing.StatusCode)
+				w.Write(existing.ResponseBody)
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		// Store the outcome even if the client has gone away, since that is
+		// exactly when it will retry
+		ctx := context.WithoutCancel(r.Context())
+		if recorder.status >= http.StatusInternalServerError || recorder.status == statusClientClosedRequest {
+			// Nothing was committed, so let a retry run the request again
+			if err := m.repo.Release(ctx, key); err != nil {
+				log.Printf("Error releasing idempotency key: %v", err)
+			}
+			return
+		}
+
+		if err := m.repo.Complete(ctx, key, recorder.status, recorder.Header().Get("Content-Type"), recorder.body.Bytes()); err != nil {
+			log.Printf("Error storing idempotent response: %v", err)
+		}
+	})
+}
+
+// scopedIdempotencyKey derives the stored key from the client's key and the
+// caller it belongs to. Hashing keeps it within the key column's length.
+func scopedIdempotencyKey(r *http.Request, key string) string {
+	scope := "anonymous"
+	if userID, _, _ := auth.GetUserFromContext(r.Context()); userID != uuid.Nil {
+		scope = "user:" + userID.String()
+	} else if token := r.Header.Get(cartTokenHeader); token != "" {
+		scope = "cart:" + token
+	}
+
+	hash := sha256.Sum256([]byte(scope + "\n" + key))
+	return hex.EncodeToString(hash[:])
+}
+
+// requestHash fingerprints the method, path and body of a request
+func requestHash(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.Path+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseRecorder passes a response through while keeping a copy of its status and body
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,350 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"commerce-app/internal/database"
+	"commerce-app/internal/images"
+	"commerce-app/internal/models"
+	"commerce-app/internal/storage"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultImageMaxBytes = 10 << 20
+	// maxImagesPerUpload bounds the files one upload request may carry
+	maxImagesPerUpload = 10
+	// multipartMemory is how much of an upload is held in memory before the
+	// rest is spooled to temporary files
+	multipartMemory = 32 << 20
+)
+
+// ImageMaxBytesFromEnv returns the largest image file accepted, from
+// IMAGE_MAX_BYTES
+func ImageMaxBytesFromEnv() int64 {
+	value := os.Getenv("IMAGE_MAX_BYTES")
+	if value == "" {
+		return defaultImageMaxBytes
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid IMAGE_MAX_BYTES %q, using %d", value, defaultImageMaxBytes)
+		return defaultImageMaxBytes
+	}
+	return n
+}
+
+// ImageHandler manages the uploaded images of a product and serves the files
+// of local image storage
+type ImageHandler struct {
+	imageRepo   database.ProductImageRepository
+	productRepo database.ProductRepository
+	storage     storage.Storage
+	maxBytes    int64
+}
+
+func NewImageHandler(imageRepo database.ProductImageRepository, productRepo database.ProductRepository,
+	imageStorage storage.Storage, maxBytes int64) *ImageHandler {
+	return &ImageHandler{
+		imageRepo:   imageRepo,
+		productRepo: productRepo,
+		storage:     imageStorage,
+		maxBytes:    maxBytes,
+	}
+}
+
+// GetImages lists a product's images in display order
+func (h *ImageHandler) GetImages(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.loadProduct(w, r)
+	if !ok {
+		return
+	}
+
+	productImages, err := h.imageRepo.GetByProduct(r.Context(), product.ID)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeImages(r.Context(), w, http.StatusOK, productImages)
+}
+
+// UploadImages adds the files of the multipart "images" field to the end of a
+// product's images. Every file is checked before any is stored.
+func (h *ImageHandler) UploadImages(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.loadProduct(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxBytes*maxImagesPerUpload+1<<20)
+	if err := r.ParseMultipartForm(multipartMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Upload is too large: send at most %d images of %d bytes each",
+				maxImagesPerUpload, h.maxBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File["images"]
+	switch {
+	case len(files) == 0:
+		http.Error(w, "Invalid upload: the images field must hold at least one file", http.StatusBadRequest)
+		return
+	case len(files) > maxImagesPerUpload:
+		http.Error(w, fmt.Sprintf("Invalid upload: send at most %d images at once", maxImagesPerUpload),
+			http.StatusBadRequest)
+		return
+	}
+
+	type upload struct {
+		data      []byte
+		processed *images.Image
+	}
+	uploads := make([]upload, 0, len(files))
+	for _, file := range files {
+		if file.Size > h.maxBytes {
+			http.Error(w, fmt.Sprintf("Image %s is larger than %d bytes", file.Filename, h.maxBytes),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		data, err := readUpload(file)
+		if err != nil {
+			http.Error(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		processed, err := images.Process(data)
+		if errors.Is(err, images.ErrUnsupportedType) {
+			http.Error(w, fmt.Sprintf("Invalid image %s: %v", file.Filename, err), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid image %s: %v", file.Filename, err), http.StatusBadRequest)
+			return
+		}
+		uploads = append(uploads, upload{data: data, processed: processed})
+	}
+
+	existing, err := h.imageRepo.GetByProduct(r.Context(), product.ID)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(existing)+len(uploads) > models.MaxProductImages {
+		http.Error(w, fmt.Sprintf("Invalid upload: %v, and the product has %d", database.ErrTooManyImages, len(existing)),
+			http.StatusConflict)
+		return
+	}
+
+	created := make([]models.ProductImage, 0, len(uploads))
+	for _, upload := range uploads {
+		image, err := h.storeImage(r.Context(), product.ID, upload.data, upload.processed)
+		if err != nil {
+			switch {
+			case errors.Is(err, database.ErrTooManyImages):
+				http.Error(w, "Invalid upload: "+err.Error(), http.StatusConflict)
+			default:
+				writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		created = append(created, *image)
+	}
+
+	h.writeImages(r.Context(), w, http.StatusCreated, created)
+}
+
+// ReorderImages sets the display order of a product's images to the order of
+// image_ids, which must list each of them once
+func (h *ImageHandler) ReorderImages(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.loadProduct(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		ImageIDs []uuid.UUID `json:"image_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.imageRepo.Reorder(r.Context(), product.ID, request.ImageIDs); err != nil {
+		if errors.Is(err, database.ErrImageOrder) {
+			http.Error(w, "Invalid image order: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeRepositoryError(w, err, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	productImages, err := h.imageRepo.GetByProduct(r.Context(), product.ID)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeImages(r.Context(), w, http.StatusOK, productImages)
+}
+
+// DeleteImage removes one of a product's images and its files
+func (h *ImageHandler) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.loadProduct(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := uuid.Parse(mux.Vars(r)["imageId"])
+	if err != nil {
+		http.Error(w, "Invalid image ID", http.StatusBadRequest)
+		return
+	}
+
+	image, err := h.imageRepo.GetByID(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, "Image not found", http.StatusNotFound)
+		return
+	}
+	if image.ProductID != product.ID {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.imageRepo.Delete(r.Context(), id); err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The image is gone once its row is; files left behind are only logged
+	h.deleteFiles(r.Context(), image.StorageKey, image.ThumbnailKey)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ServeFile serves a stored image file. Keys hold the image ID, so a file never
+// changes and can be cached for good.
+func (h *ImageHandler) ServeFile(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	file, err := h.storage.Get(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidKey) {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading image %s: %v", key, err)
+		http.Error(w, "Image could not be read", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.Copy(w, file)
+}
+
+// storeImage stores an image's files and then records it, removing the files
+// again if the image cannot be recorded
+func (h *ImageHandler) storeImage(ctx context.Context, productID uuid.UUID, data []byte, processed *images.Image) (*models.ProductImage, error) {
+	fileID := uuid.New()
+	image := &models.ProductImage{
+		ProductID:    productID,
+		ContentType:  processed.ContentType,
+		Size:         int64(len(data)),
+		Width:        processed.Width,
+		Height:       processed.Height,
+		StorageKey:   fmt.Sprintf("products/%s/%s%s", productID, fileID, processed.Extension),
+		ThumbnailKey: fmt.Sprintf("products/%s/%s_thumb%s", productID, fileID, processed.ThumbnailExtension),
+	}
+
+	if err := h.storage.Put(ctx, image.StorageKey, processed.ContentType, data); err != nil {
+		return nil, fmt.Errorf("storing image: %w", err)
+	}
+	err := h.storage.Put(ctx, image.ThumbnailKey, processed.ThumbnailContentType, processed.Thumbnail)
+	if err == nil {
+		err = h.imageRepo.Create(ctx, image)
+	}
+	if err != nil {
+		h.deleteFiles(context.WithoutCancel(ctx), image.StorageKey, image.ThumbnailKey)
+		return nil, err
+	}
+	return image, nil
+}
+
+// deleteFiles removes stored files, logging the ones that could not be removed
+func (h *ImageHandler) deleteFiles(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		if err := h.storage.Delete(ctx, key); err != nil {
+			log.Printf("Error deleting image file %s: %v", key, err)
+		}
+	}
+}
+
+// writeImages fills in the URLs of images and writes them with the given status
+func (h *ImageHandler) writeImages(ctx context.Context, w http.ResponseWriter, status int, productImages []models.ProductImage) {
+	for i := range productImages {
+		var err error
+		if productImages[i].URL, err = h.storage.URL(ctx, productImages[i].StorageKey); err == nil {
+			productImages[i].ThumbnailURL, err = h.storage.URL(ctx, productImages[i].ThumbnailKey)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(productImages)
+}
+
+// loadProduct gets the product named in the URL, writing an error response if
+// it cannot
+func (h *ImageHandler) loadProduct(w http.ResponseWriter, r *http.Request) (*models.Product, bool) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	product, err := h.productRepo.GetByID(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, "Product not found", http.StatusNotFound)
+		return nil, false
+	}
+	return product, true
+}
+
+// readUpload reads an uploaded file into memory
+func readUpload(file *multipart.FileHeader) ([]byte, error) {
+	f, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
@@ -0,0 +1,554 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"commerce-app/internal/database"
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// importBatchSize is how many rows are written in one transaction
+	importBatchSize = 500
+	// maxImportBytes bounds the size of an import file
+	maxImportBytes = 256 << 20
+	// maxImportLineBytes bounds one line of an NDJSON import
+	maxImportLineBytes = 1 << 20
+)
+
+// Import and export file formats
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+)
+
+// importFormats maps the content types an import may be sent as to its format
+var importFormats = map[string]string{
+	"text/csv":             formatCSV,
+	"application/csv":      formatCSV,
+	"application/x-ndjson": formatNDJSON,
+	"application/ndjson":   formatNDJSON,
+	"application/jsonl":    formatNDJSON,
+}
+
+// errInvalidRow marks a row that could not be parsed; the rows after it are
+// still read
+type errInvalidRow struct {
+	err error
+}
+
+func (e *errInvalidRow) Error() string {
+	return e.err.Error()
+}
+
+// productRecordReader reads the rows of an import file. Read returns io.EOF
+// after the last row and an *errInvalidRow for a row it cannot parse; any
+// other error ends the import.
+type productRecordReader interface {
+	Read() (*models.ProductRecord, error)
+}
+
+// importRow is a parsed row waiting to be written
+type importRow struct {
+	row     int
+	product models.Product
+}
+
+// productImporter resolves the categories and checks the attributes of
+// imported rows, caching what it looks up for the rest of the file
+type productImporter struct {
+	productRepo  database.ProductRepository
+	categoryRepo database.CategoryRepository
+	report       *models.ImportReport
+	// categories maps the paths of known categories to their IDs
+	categories map[string]uuid.UUID
+	schemas    map[uuid.UUID]models.AttributeSchema
+}
+
+// ImportProducts creates or replaces products from a CSV or NDJSON file, read
+// as it streams in. Rows are validated one by one and written in batches,
+// each in its own transaction; a row that fails is left out of its batch and
+// listed in the report.
+func (h *ProductHandler) ImportProducts(w http.ResponseWriter, r *http.Request) {
+	format, err := importFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+	var reader productRecordReader
+	if format == formatCSV {
+		reader, err = newCSVRecordReader(body)
+	} else {
+		reader = newNDJSONRecordReader(body)
+	}
+	if err != nil {
+		http.Error(w, "Invalid import: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := database.WithQueryTimeout(r.Context(), h.bulkQueryTimeout)
+	categories, err := h.categoryRepo.GetAll(ctx)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	report := &models.ImportReport{Errors: []models.ImportRowError{}}
+	importer := &productImporter{
+		productRepo:  h.productRepo,
+		categoryRepo: h.categoryRepo,
+		report:       report,
+		categories:   make(map[string]uuid.UUID, len(categories)),
+		schemas:      make(map[uuid.UUID]models.AttributeSchema),
+	}
+	for _, category := range categories {
+		if _, ok := importer.categories[category.Path]; !ok {
+			importer.categories[category.Path] = category.ID
+		}
+	}
+
+	report.Complete = importer.run(database.WithActor(ctx, actorFromRequest(r)), reader)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// ExportProducts streams the products matching the listing filters as CSV or
+// NDJSON, in the format of an import file
+func (h *ProductHandler) ExportProducts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = formatCSV
+	}
+	if format != formatCSV && format != formatNDJSON {
+		http.Error(w, "Invalid format: must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseProductFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Limit = models.MaxProductPageSize
+
+	// The first page is read before anything is written, so that a failure
+	// can still be answered with an error status
+	ctx := database.WithQueryTimeout(r.Context(), h.bulkQueryTimeout)
+	page, err := h.productRepo.List(ctx, *filter)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var writeRecord func(models.ProductRecord) error
+	var flush func() error
+	if format == formatCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="products.csv"`)
+		writer := csv.NewWriter(w)
+		writer.Write(models.ProductRecordFields)
+		writeRecord = func(record models.ProductRecord) error {
+			return writer.Write(csvRecordFields(record))
+		}
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="products.ndjson"`)
+		encoder := json.NewEncoder(w)
+		writeRecord = func(record models.ProductRecord) error {
+			return encoder.Encode(record)
+		}
+		flush = func() error { return nil }
+	}
+
+	flusher, _ := w.(http.Flusher)
+	for {
+		for _, product := range page.Products {
+			if err := writeRecord(models.NewProductRecord(product)); err != nil {
+				log.Println("Error writing product export:", err)
+				return
+			}
+		}
+		if err := flush(); err != nil {
+			log.Println("Error writing product export:", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if page.NextCursor == "" {
+			return
+		}
+		filter.Cursor = models.NewProductCursor(filter.Sort, page.Products[len(page.Products)-1])
+		if page, err = h.productRepo.List(ctx, *filter); err != nil {
+			// The status has been sent, so the export can only be cut short
+			log.Println("Error reading product export:", err)
+			return
+		}
+	}
+}
+
+// importFormat tells the format of an import from the format query parameter
+// or, failing that, the content type
+func importFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if format != formatCSV && format != formatNDJSON {
+			return "", errors.New("Unsupported import format: use csv or ndjson")
+		}
+		return format, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if format, ok := importFormats[mediaType]; ok {
+		return format, nil
+	}
+	return "", errors.New("Unsupported import format: send text/csv or application/x-ndjson")
+}
+
+// run imports every row of the file, reporting whether it got to the end
+func (im *productImporter) run(ctx context.Context, reader productRecordReader) bool {
+	batch := make([]importRow, 0, importBatchSize)
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var invalid *errInvalidRow
+		if errors.As(err, &invalid) {
+			im.report.Rows++
+			im.fail(row, "", invalid.err.Error())
+			continue
+		}
+		if err != nil {
+			// The rows read so far are still written
+			im.write(ctx, batch)
+			im.fail(row, "", "file could not be read: "+err.Error())
+			return false
+		}
+		im.report.Rows++
+
+		product, problems, err := im.product(ctx, record)
+		if err != nil {
+			im.write(ctx, batch)
+			im.fail(row, record.ID, err.Error())
+			return false
+		}
+		if len(problems) > 0 {
+			im.fail(row, record.ID, "Invalid product: "+strings.Join(problems, "; "))
+			continue
+		}
+
+		batch = append(batch, importRow{row: row, product: *product})
+		if len(batch) == importBatchSize {
+			if err := im.write(ctx, batch); err != nil {
+				return false
+			}
+			batch = batch[:0]
+		}
+	}
+	return im.write(ctx, batch) == nil
+}
+
+// write upserts a batch of rows. A row the repository rejects is reported and
+// the batch is written again without it; any other failure fails the whole
+// batch and is returned.
+func (im *productImporter) write(ctx context.Context, batch []importRow) error {
+	for len(batch) > 0 {
+		products := make([]models.Product, len(batch))
+		for i, row := range batch {
+			products[i] = row.product
+		}
+
+		created, err := im.productRepo.Upsert(ctx, products)
+		var batchErr *database.BatchError
+		if errors.As(err, &batchErr) && !errors.Is(err, database.ErrQueryCanceled) && !errors.Is(err, database.ErrQueryTimeout) {
+			row := batch[batchErr.Index]
+			im.fail(row.row, importRowID(row.product), batchErr.Err.Error())
+			batch = slices.Delete(batch, batchErr.Index, batchErr.Index+1)
+			continue
+		}
+		if err != nil {
+			for _, row := range batch {
+				im.fail(row.row, importRowID(row.product), err.Error())
+			}
+			return err
+		}
+
+		im.report.Created += created
+		im.report.Updated += len(products) - created
+		return nil
+	}
+	return nil
+}
+
+// product turns a record into the product to write, returning the problems
+// that keep the row from being imported. An error means a lookup failed and
+// the import cannot go on.
+func (im *productImporter) product(ctx context.Context, record *models.ProductRecord) (*models.Product, []string, error) {
+	var problems []string
+	product := &models.Product{Stock: record.Stock}
+
+	if record.ID != "" {
+		id, err := uuid.Parse(record.ID)
+		if err != nil || id == uuid.Nil {
+			problems = append(problems, "id must be a UUID")
+		}
+		product.ID = id
+	}
+
+	if record.Price == "" {
+		problems = append(problems, "price is required")
+	} else {
+		price, err := models.ParseMoney(record.Price.String(), strings.ToUpper(record.Currency))
+		if err != nil {
+			problems = append(problems, "price: "+err.Error())
+		}
+		product.Price = price
+	}
+
+	update := models.ProductUpdate{
+		Name:        &record.Name,
+		Description: &record.Description,
+		Stock:       &record.Stock,
+		ImageURL:    &record.ImageURL,
+	}
+	if product.Price.Currency != "" {
+		update.Price = &product.Price
+	}
+	problems = append(problems, validateProductUpdate(&update)...)
+	product.Name = *update.Name
+	product.Description = record.Description
+	product.ImageURL = record.ImageURL
+	if len(problems) > 0 {
+		return nil, problems, nil
+	}
+
+	categoryID, categoryProblems, err := im.category(ctx, record.CategoryPath)
+	if err != nil || len(categoryProblems) > 0 {
+		return nil, categoryProblems, err
+	}
+	product.CategoryID = categoryID
+
+	schema, ok := im.schemas[categoryID]
+	if !ok {
+		if schema, err = im.categoryRepo.GetAttributeSchema(ctx, categoryID); err != nil {
+			return nil, nil, err
+		}
+		im.schemas[categoryID] = schema
+	}
+	if problems := schema.Validate(record.Attributes); len(problems) > 0 {
+		return nil, problems, nil
+	}
+	product.Attributes = record.Attributes
+	return product, nil, nil
+}
+
+// category returns the ID of the category at path, creating it and any of its
+// ancestors that do not exist yet. Every name on the path is validated as
+// CreateCategory would before any category is created.
+func (im *productImporter) category(ctx context.Context, path string) (uuid.UUID, []string, error) {
+	names := strings.Split(path, "/")
+	if path == "" || names[0] != "" {
+		return uuid.Nil, []string{"category_path must be a path such as /Electronics/Phones"}, nil
+	}
+
+	names = names[1:]
+	prefixes := make([]string, len(names))
+	prefix := ""
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+		prefix += "/" + names[i]
+		prefixes[i] = prefix
+		if problems := validateCategory(&models.Category{Name: names[i]}); len(problems) > 0 {
+			return uuid.Nil, []string{fmt.Sprintf("category %q: %s", prefix, strings.Join(problems, "; "))}, nil
+		}
+	}
+
+	var parentID *uuid.UUID
+	for i, name := range names {
+		if id, ok := im.categories[prefixes[i]]; ok {
+			parentID = &id
+			continue
+		}
+
+		category := &models.Category{Name: name, ParentID: parentID}
+		if err := im.categoryRepo.Create(ctx, category); err != nil {
+			return uuid.Nil, nil, err
+		}
+		im.categories[prefixes[i]] = category.ID
+		im.report.CategoriesCreated++
+		parentID = &category.ID
+	}
+	return *parentID, nil, nil
+}
+
+// fail records a row that was not imported
+func (im *productImporter) fail(row int, id, message string) {
+	im.report.Failed++
+	im.report.Errors = append(im.report.Errors, models.ImportRowError{Row: row, ID: id, Error: message})
+}
+
+// importRowID is the ID a row is reported under; rows without one have none
+func importRowID(product models.Product) string {
+	if product.ID == uuid.Nil {
+		return ""
+	}
+	return product.ID.String()
+}
+
+// csvRecordReader reads CSV import files. The first line names the columns,
+// which may come in any order; name, price and category_path are required.
+type csvRecordReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+}
+
+func newCSVRecordReader(r io.Reader) (*csvRecordReader, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("the file is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		if i == 0 {
+			// Spreadsheets often start UTF-8 files with a byte order mark
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !slices.Contains(models.ProductRecordFields, name) {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		if _, ok := columns[name]; ok {
+			return nil, fmt.Errorf("column %q appears twice", name)
+		}
+		columns[name] = i
+	}
+
+	var missing []string
+	for _, name := range []string{"name", "price", "category_path"} {
+		if _, ok := columns[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing columns: %s", strings.Join(missing, ", "))
+	}
+	return &csvRecordReader{reader: reader, columns: columns}, nil
+}
+
+func (r *csvRecordReader) Read() (*models.ProductRecord, error) {
+	fields, err := r.reader.Read()
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return nil, &errInvalidRow{err}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	field := func(name string) string {
+		if i, ok := r.columns[name]; ok {
+			return fields[i]
+		}
+		return ""
+	}
+
+	record := &models.ProductRecord{
+		ID:           strings.TrimSpace(field("id")),
+		Name:         field("name"),
+		Description:  field("description"),
+		Price:        json.Number(strings.TrimSpace(field("price"))),
+		Currency:     strings.TrimSpace(field("currency")),
+		CategoryPath: field("category_path"),
+		ImageURL:     strings.TrimSpace(field("image_url")),
+	}
+
+	if value := strings.TrimSpace(field("stock")); value != "" {
+		if record.Stock, err = strconv.Atoi(value); err != nil {
+			return nil, &errInvalidRow{errors.New("stock must be a whole number")}
+		}
+	}
+	if value := strings.TrimSpace(field("attributes")); value != "" {
+		if err := json.Unmarshal([]byte(value), &record.Attributes); err != nil {
+			return nil, &errInvalidRow{errors.New("attributes must be a JSON object")}
+		}
+	}
+	return record, nil
+}
+
+// csvRecordFields returns the CSV row of an export record
+func csvRecordFields(record models.ProductRecord) []string {
+	attributes := ""
+	if len(record.Attributes) > 0 {
+		data, _ := json.Marshal(record.Attributes)
+		attributes = string(data)
+	}
+	return []string{
+		record.ID, record.Name, record.Description, record.Price.String(), record.Currency,
+		record.CategoryPath, strconv.Itoa(record.Stock), record.ImageURL, attributes,
+	}
+}
+
+// ndjsonRecordReader reads NDJSON import files, one record object per line.
+// Blank lines are skipped.
+type ndjsonRecordReader struct {
+	scanner *bufio.Scanner
+}
+
+func newNDJSONRecordReader(r io.Reader) *ndjsonRecordReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxImportLineBytes)
+	return &ndjsonRecordReader{scanner: scanner}
+}
+
+func (r *ndjsonRecordReader) Read() (*models.ProductRecord, error) {
+	for r.scanner.Scan() {
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.DisallowUnknownFields()
+		var record models.ProductRecord
+		if err := decoder.Decode(&record); err != nil {
+			return nil, &errInvalidRow{err}
+		}
+		return &record, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, fmt.Errorf("a line is longer than %d bytes", maxImportLineBytes)
+		}
+		return nil, err
+	}
+	return nil, io.EOF
+}
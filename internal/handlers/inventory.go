@@ -0,0 +1,450 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"commerce-app/internal/database"
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Column limits of the warehouses table
+const (
+	maxWarehouseCodeLength = 32
+	maxWarehouseNameLength = 255
+)
+
+// InventoryHandler serves warehouses, the stock held at each of them, stock
+// transfers between them and adjustments at them, and the inventory ledger
+// with its reconciliation
+type InventoryHandler struct {
+	inventoryRepo database.InventoryRepository
+	productRepo   database.ProductRepository
+}
+
+func NewInventoryHandler(inventoryRepo database.InventoryRepository, productRepo database.ProductRepository) *InventoryHandler {
+	return &InventoryHandler{
+		inventoryRepo: inventoryRepo,
+		productRepo:   productRepo,
+	}
+}
+
+// CreateWarehouse creates a warehouse. Stock reaches it by transfer.
+func (h *InventoryHandler) CreateWarehouse(w http.ResponseWriter, r *http.Request) {
+	var request models.WarehouseRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	warehouse, problems := warehouseFromRequest(request)
+	if len(problems) > 0 {
+		http.Error(w, "Invalid warehouse: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.inventoryRepo.CreateWarehouse(r.Context(), warehouse); err != nil {
+		writeWarehouseError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(warehouse)
+}
+
+// GetWarehouses gets every warehouse ordered by priority and code
+func (h *InventoryHandler) GetWarehouses(w http.ResponseWriter, r *http.Request) {
+	warehouses, err := h.inventoryRepo.GetWarehouses(r.Context())
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(warehouses)
+}
+
+// GetWarehouse gets a warehouse by ID
+func (h *InventoryHandler) GetWarehouse(w http.ResponseWriter, r *http.Request) {
+	warehouse, ok := h.loadWarehouse(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(warehouse)
+}
+
+// UpdateWarehouse replaces a warehouse's code, name, location, priority and
+// active flag. The default warehouse and warehouses holding stock cannot be
+// deactivated.
+func (h *InventoryHandler) UpdateWarehouse(w http.ResponseWriter, r *http.Request) {
+	existing, ok := h.loadWarehouse(w, r)
+	if !ok {
+		return
+	}
+
+	var request models.WarehouseRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	warehouse, problems := warehouseFromRequest(request)
+	if len(problems) > 0 {
+		http.Error(w, "Invalid warehouse: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	warehouse.ID = existing.ID
+	if err := h.inventoryRepo.UpdateWarehouse(r.Context(), warehouse); err != nil {
+		writeWarehouseError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(warehouse)
+}
+
+// GetWarehouseInventory gets the stock of every product and variant held at a warehouse
+func (h *InventoryHandler) GetWarehouseInventory(w http.ResponseWriter, r *http.Request) {
+	warehouse, ok := h.loadWarehouse(w, r)
+	if !ok {
+		return
+	}
+
+	levels, err := h.inventoryRepo.GetLevels(r.Context(), models.InventoryFilter{WarehouseID: &warehouse.ID})
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(levels)
+}
+
+// GetProductInventory gets the stock of a product and its variants at every
+// warehouse holding any
+func (h *InventoryHandler) GetProductInventory(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	product, err := h.productRepo.GetByID(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	levels, err := h.inventoryRepo.GetLevels(r.Context(), models.InventoryFilter{ProductID: &product.ID})
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(levels)
+}
+
+// CreateTransfer moves available stock of a product, or of one of its
+// variants, from one active warehouse to another
+func (h *InventoryHandler) CreateTransfer(w http.ResponseWriter, r *http.Request) {
+	var transfer models.StockTransfer
+	if err := json.NewDecoder(r.Body).Decode(&transfer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var problems []string
+	if transfer.ProductID == uuid.Nil {
+		problems = append(problems, "product_id is required")
+	}
+	if transfer.FromWarehouseID == uuid.Nil || transfer.ToWarehouseID == uuid.Nil {
+		problems = append(problems, "from_warehouse_id and to_warehouse_id are required")
+	} else if transfer.FromWarehouseID == transfer.ToWarehouseID {
+		problems = append(problems, "from_warehouse_id and to_warehouse_id must differ")
+	}
+	if transfer.Quantity <= 0 {
+		problems = append(problems, "quantity must be positive")
+	}
+	if len(problems) > 0 {
+		http.Error(w, "Invalid transfer: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	if !h.checkStockTarget(w, r, "transferred", transfer.ProductID, transfer.VariantID,
+		transfer.FromWarehouseID, transfer.ToWarehouseID) {
+		return
+	}
+
+	transfer.Note = strings.TrimSpace(transfer.Note)
+	transfer.CreatedBy = actorFromRequest(r)
+	if err := h.inventoryRepo.Transfer(r.Context(), &transfer); err != nil {
+		writeStockChangeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(transfer)
+}
+
+// CreateAdjustment adds stock to, or takes available stock from, a product or
+// one of its variants at an active warehouse. The change is recorded in the
+// inventory ledger under its reason: a manual adjustment, a stock-take
+// correction or damage, which can only take stock away.
+func (h *InventoryHandler) CreateAdjustment(w http.ResponseWriter, r *http.Request) {
+	var adjustment models.StockAdjustment
+	if err := json.NewDecoder(r.Body).Decode(&adjustment); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var problems []string
+	if adjustment.ProductID == uuid.Nil {
+		problems = append(problems, "product_id is required")
+	}
+	if adjustment.WarehouseID == uuid.Nil {
+		problems = append(problems, "warehouse_id is required")
+	}
+	if adjustment.Change == 0 {
+		problems = append(problems, "change must not be zero")
+	}
+	switch {
+	case !slices.Contains(models.AdjustmentReasons, adjustment.Reason):
+		problems = append(problems, "reason must be one of "+strings.Join(models.AdjustmentReasons, ", "))
+	case adjustment.Reason == models.MovementDamage && adjustment.Change > 0:
+		problems = append(problems, "damage can only take stock away")
+	}
+	if len(problems) > 0 {
+		http.Error(w, "Invalid adjustment: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	if !h.checkStockTarget(w, r, "adjusted", adjustment.ProductID, adjustment.VariantID, adjustment.WarehouseID) {
+		return
+	}
+
+	adjustment.Note = strings.TrimSpace(adjustment.Note)
+	adjustment.CreatedBy = actorFromRequest(r)
+	if err := h.inventoryRepo.Adjust(r.Context(), &adjustment); err != nil {
+		writeStockChangeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(adjustment)
+}
+
+// GetMovements lists inventory movements newest first. They can be narrowed
+// with the product_id, warehouse_id and order_id query parameters; limit
+// bounds how many are returned.
+func (h *InventoryHandler) GetMovements(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseInventoryFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	movements, err := h.inventoryRepo.GetMovements(r.Context(), *filter)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(movements)
+}
+
+// GetReconciliation recomputes the inventory levels and stock totals from the
+// ledger, of every product or of the one named by product_id, and flags those
+// that have drifted from it. With drift=true only those are listed.
+func (h *InventoryHandler) GetReconciliation(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var productID *uuid.UUID
+	if value := query.Get("product_id"); value != "" {
+		id, err := uuid.Parse(value)
+		if err != nil {
+			http.Error(w, "Invalid product_id", http.StatusBadRequest)
+			return
+		}
+		if _, err := h.productRepo.GetByID(r.Context(), id); err != nil {
+			writeRepositoryError(w, err, "Product not found", http.StatusNotFound)
+			return
+		}
+		productID = &id
+	}
+
+	driftOnly := false
+	if value := query.Get("drift"); value != "" {
+		var err error
+		if driftOnly, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "Invalid drift", http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := h.inventoryRepo.Reconcile(r.Context(), productID)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if driftOnly {
+		report = report.DriftOnly()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// checkStockTarget checks that the product and variant whose stock is about
+// to be moved, and the warehouses it is moved at, exist, writing the error
+// response and returning false if not. A product with variants must name one.
+func (h *InventoryHandler) checkStockTarget(w http.ResponseWriter, r *http.Request, verb string, productID uuid.UUID, variantID *uuid.UUID, warehouseIDs ...uuid.UUID) bool {
+	product, err := h.productRepo.GetByID(r.Context(), productID)
+	if err != nil {
+		writeRepositoryError(w, err, fmt.Sprintf("Product not found: %s", productID), http.StatusNotFound)
+		return false
+	}
+	if variantID == nil && len(product.Variants) > 0 {
+		http.Error(w, fmt.Sprintf("Product %s must be %s by variant_id", product.Name, verb), http.StatusBadRequest)
+		return false
+	}
+	if variantID != nil {
+		if _, ok := product.Variant(*variantID); !ok {
+			http.Error(w, fmt.Sprintf("Variant not found: %s", *variantID), http.StatusNotFound)
+			return false
+		}
+	}
+	for _, id := range warehouseIDs {
+		if _, err := h.inventoryRepo.GetWarehouse(r.Context(), id); err != nil {
+			writeRepositoryError(w, err, fmt.Sprintf("Warehouse not found: %s", id), http.StatusNotFound)
+			return false
+		}
+	}
+	return true
+}
+
+// loadWarehouse gets the warehouse named in the URL, writing the error
+// response and returning false if there is none
+func (h *InventoryHandler) loadWarehouse(w http.ResponseWriter, r *http.Request) (*models.Warehouse, bool) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid warehouse ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	warehouse, err := h.inventoryRepo.GetWarehouse(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, "Warehouse not found", http.StatusNotFound)
+		return nil, false
+	}
+	return warehouse, true
+}
+
+// warehouseFromRequest builds the warehouse a request describes, returning a
+// description of every invalid field
+func warehouseFromRequest(request models.WarehouseRequest) (*models.Warehouse, []string) {
+	var problems []string
+
+	warehouse := &models.Warehouse{
+		Code:     strings.ToUpper(strings.TrimSpace(request.Code)),
+		Name:     strings.TrimSpace(request.Name),
+		Location: request.Location,
+		Priority: request.Priority,
+		Active:   request.Active == nil || *request.Active,
+	}
+
+	switch {
+	case warehouse.Code == "":
+		problems = append(problems, "code must not be empty")
+	case utf8.RuneCountInString(warehouse.Code) > maxWarehouseCodeLength:
+		problems = append(problems, fmt.Sprintf("code must be at most %d characters", maxWarehouseCodeLength))
+	}
+	switch {
+	case warehouse.Name == "":
+		problems = append(problems, "name must not be empty")
+	case utf8.RuneCountInString(warehouse.Name) > maxWarehouseNameLength:
+		problems = append(problems, fmt.Sprintf("name must be at most %d characters", maxWarehouseNameLength))
+	}
+	if warehouse.Location != nil {
+		problems = append(problems, warehouse.Location.Validate()...)
+	}
+	if warehouse.Priority < 0 {
+		problems = append(problems, "priority must not be negative")
+	}
+	return warehouse, problems
+}
+
+// writeWarehouseError responds to a failed warehouse create or update
+func writeWarehouseError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, database.ErrDuplicateWarehouseCode),
+		errors.Is(err, database.ErrDefaultWarehouse),
+		errors.Is(err, database.ErrWarehouseNotEmpty):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeStockChangeError responds to a failed transfer, adjustment or other
+// change to a product's stock
+func writeStockChangeError(w http.ResponseWriter, err error) {
+	var stockErr *database.InsufficientStockError
+	switch {
+	case errors.As(err, &stockErr):
+		http.Error(w, fmt.Sprintf("Insufficient stock for product: %s", stockErr.Item()), http.StatusConflict)
+	case errors.Is(err, database.ErrWarehouseInactive):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// parseInventoryFilter reads the product_id, warehouse_id, order_id and limit
+// query parameters of a movements listing
+func parseInventoryFilter(query url.Values) (*models.InventoryFilter, error) {
+	filter := &models.InventoryFilter{Limit: models.DefaultMovementLimit}
+
+	for _, param := range []struct {
+		name string
+		id   **uuid.UUID
+	}{
+		{"product_id", &filter.ProductID},
+		{"warehouse_id", &filter.WarehouseID},
+		{"order_id", &filter.OrderID},
+	} {
+		if value := query.Get(param.name); value != "" {
+			id, err := uuid.Parse(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s", param.name)
+			}
+			*param.id = &id
+		}
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > models.MaxMovementLimit {
+			return nil, fmt.Errorf("Invalid limit: must be between 1 and %d", models.MaxMovementLimit)
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
@@ -1,15 +1,17 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"slices"
-	"strconv"
 
 	"strings"
 
+	"commerce-app/internal/auth"
 	"commerce-app/internal/database"
 	"commerce-app/internal/models"
 	"commerce-app/internal/notifications"
@@ -19,33 +21,57 @@ import (
 )
 
 type OrderHandler struct {
-	orderRepo    *database.OrderRepository
-	customerRepo *database.CustomerRepository
-	productRepo  *database.ProductRepository
+	orderRepo    database.OrderRepository
+	customerRepo database.CustomerRepository
+	productRepo  database.ProductRepository
 	smsService   *notifications.SMSService
-	categoryRepo *database.CategoryRepository
 	emailService *notifications.EmailService
 }
 
-func NewOrderHandler() *OrderHandler {
+func NewOrderHandler(orderRepo database.OrderRepository, customerRepo database.CustomerRepository,
+	productRepo database.ProductRepository) *OrderHandler {
 	return &OrderHandler{
-		orderRepo:    &database.OrderRepository{},
-		customerRepo: &database.CustomerRepository{},
-		productRepo:  &database.ProductRepository{},
-		categoryRepo: &database.CategoryRepository{},
+		orderRepo:    orderRepo,
+		customerRepo: customerRepo,
+		productRepo:  productRepo,
 		smsService:   notifications.NewSMSService(),
 		emailService: notifications.NewEmailService(),
 	}
 }
 
+// orderLine is a product, or one of its variants, and the quantity requested for an order
+type orderLine struct {
+	ProductID uuid.UUID  `json:"product_id"`
+	VariantID *uuid.UUID `json:"variant_id,omitempty"`
+	Quantity  int        `json:"quantity"`
+}
+
+// lineVariant finds the variant a line names among its product's variants. A
+// product with variants can only be bought by variant. On failure it writes
+// the error response itself and returns false.
+func lineVariant(w http.ResponseWriter, product *models.Product, variantID *uuid.UUID) (*models.ProductVariant, bool) {
+	if variantID == nil {
+		if len(product.Variants) > 0 {
+			http.Error(w, fmt.Sprintf("Product %s must be ordered by variant_id", product.Name), http.StatusBadRequest)
+			return nil, false
+		}
+		return nil, true
+	}
+
+	variant, ok := product.Variant(*variantID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Variant not found: %s", *variantID), http.StatusNotFound)
+		return nil, false
+	}
+	return &variant, true
+}
+
 // CreateOrder creates a new order
 func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	var orderRequest struct {
-		CustomerID uuid.UUID `json:"customer_id"`
-		Items      []struct {
-			ProductID uuid.UUID `json:"product_id"`
-			Quantity  int       `json:"quantity"`
-		} `json:"items"`
+		CustomerID uuid.UUID        `json:"customer_id"`
+		Items      []orderLine      `json:"items"`
+		ShipTo     *models.Location `json:"ship_to,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&orderRequest); err != nil {
@@ -58,83 +84,113 @@ func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	order, ok := h.placeOrder(w, r, orderRequest.CustomerID, orderRequest.Items, orderRequest.ShipTo)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(order)
+}
+
+// placeOrder prices the lines, reserves their stock and stores the order for a
+// customer, then sends the order notifications. Stock is reserved at the
+// warehouses nearest shipTo when it is set. On failure it writes the error
+// response itself and returns false.
+func (h *OrderHandler) placeOrder(w http.ResponseWriter, r *http.Request, customerID uuid.UUID, lines []orderLine, shipTo *models.Location) (*models.Order, bool) {
+	if shipTo != nil {
+		if problems := shipTo.Validate(); len(problems) > 0 {
+			http.Error(w, "Invalid ship_to: "+strings.Join(problems, "; "), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+
 	// Get customer
-	customer, err := h.customerRepo.GetByID(orderRequest.CustomerID)
+	customer, err := h.customerRepo.GetByID(r.Context(), customerID)
 	if err != nil {
 		log.Printf("Error getting customer: %v", err)
-		http.Error(w, "Customer not found", http.StatusNotFound)
-		return
+		writeRepositoryError(w, err, "Customer not found", http.StatusNotFound)
+		return nil, false
 	}
 
 	// Create order
 	order := &models.Order{
-		CustomerID: orderRequest.CustomerID,
-		Status:     "pending",
-		Total:      0,
+		CustomerID: customerID,
+		Status:     models.OrderStatusPending,
+		ShipTo:     shipTo,
 		Customer:   *customer,
 		Items:      []models.OrderItem{},
 	}
 
 	// Process items and calculate total
 	var itemDetails []string
-	for _, item := range orderRequest.Items {
+	for _, item := range lines {
 
 		if item.ProductID == uuid.Nil {
 			http.Error(w, "Invalid product ID", http.StatusBadRequest)
-			return
+			return nil, false
 		}
 
 		if item.Quantity <= 0 {
 			http.Error(w, "Invalid quantity", http.StatusBadRequest)
-			return
+			return nil, false
 		}
 
-		product, err := h.productRepo.GetByID(item.ProductID)
+		product, err := h.productRepo.GetByID(r.Context(), item.ProductID)
 		if err != nil {
 			log.Printf("Error getting product: %v", err)
-			http.Error(w, fmt.Sprintf("Product not found: %s", item.ProductID), http.StatusNotFound)
-			return
+			writeRepositoryError(w, err, fmt.Sprintf("Product not found: %s", item.ProductID), http.StatusNotFound)
+			return nil, false
 		}
 
-		if product.Stock < item.Quantity {
-			http.Error(w, fmt.Sprintf("Insufficient stock for product: %s", product.Name), http.StatusBadRequest)
-			return
+		variant, ok := lineVariant(w, product, item.VariantID)
+		if !ok {
+			return nil, false
 		}
 
-		//Update stock
-		error := h.productRepo.UpdateStock(&models.Product{
-			ID:    product.ID,
-			Stock: product.Stock - item.Quantity,
-		})
-		if error != nil {
-			http.Error(w, fmt.Sprintf("Failed to update stock for product: %s", product.Name), http.StatusInternalServerError)
-			return
+		price, name := product.Price, product.Name
+		if variant != nil {
+			price = variant.UnitPrice(product.Price)
+			name = fmt.Sprintf("%s (%s)", product.Name, variant.SKU)
 		}
 
-		itemTotal := product.Price * float64(item.Quantity)
-		order.Total += itemTotal
+		itemTotal := price.Mul(item.Quantity)
+		order.Total, err = order.Total.Add(itemTotal)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Product %s is priced in a different currency: %v", product.Name, err), http.StatusBadRequest)
+			return nil, false
+		}
 
 		orderItem := models.OrderItem{
 			ProductID: item.ProductID,
+			VariantID: item.VariantID,
 			Quantity:  item.Quantity,
-			Price:     product.Price,
+			Price:     price,
 			Product:   *product,
+			Variant:   variant,
 		}
 		order.Items = append(order.Items, orderItem)
 
-		itemDetails = append(itemDetails, fmt.Sprintf("- %s x%d @ Ksh%.2f = Ksh%.2f",
-			product.Name, item.Quantity, product.Price, itemTotal))
+		itemDetails = append(itemDetails, fmt.Sprintf("- %s x%d @ %s = %s",
+			name, item.Quantity, price, itemTotal))
 	}
 
-	// Create order in database
-	if err := h.orderRepo.Create(order); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// Create order in database. Stock is checked and reserved in the same
+	// transaction, so concurrent orders cannot oversell.
+	if err := h.orderRepo.Create(database.WithActor(r.Context(), actorFromRequest(r)), order); err != nil {
+		var stockErr *database.InsufficientStockError
+		if errors.As(err, &stockErr) {
+			http.Error(w, fmt.Sprintf("Insufficient stock for product: %s", stockErr.Item()), http.StatusConflict)
+			return nil, false
+		}
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return nil, false
 	}
 
 	msgOrderID := order.ID.String()[0:8] + "..." + order.ID.String()[len(order.ID.String())-4:]
 
-	currentCustomer, err := h.customerRepo.GetByID(order.CustomerID)
+	currentCustomer, err := h.customerRepo.GetByID(r.Context(), order.CustomerID)
 	if err != nil {
 		log.Printf("Failed to get customer by ID: %v", err)
 	}
@@ -142,7 +198,7 @@ func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	if currentCustomer.Name != "Test User" {
 		// Send SMS notification to customer
 		go func() {
-			// "New Order Placed has been received.Order ID: #%s,\ncustomer name: %s,\nphone: %s,\nemail: %s,\ntotal: $%.2f,\nproduct: %s,\nqty: x%d",
+			// "New Order Placed has been received.Order ID: #%s,\ncustomer name: %s,\nphone: %s,\nemail: %s,\ntotal: %s,\nproduct: %s,\nqty: x%d",
 
 			message := fmt.Sprintf(`
 									New order has been Received!
@@ -151,7 +207,7 @@ func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 									- Order ID: %s
 									- Name: %s
 									- Phone: %s
-									- Total Amount: Ksh%.2f
+									- Total Amount: %s
 
 									Order Items:
 									%s
@@ -185,9 +241,7 @@ func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(order)
+	return order, true
 }
 
 // GetOrder gets an order by ID
@@ -199,57 +253,13 @@ func (h *OrderHandler) GetOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	order, err := h.orderRepo.GetByID(id)
+	order, err := h.orderRepo.GetByID(r.Context(), id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeRepositoryError(w, err, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	responseOrder := &models.Order{
-		ID:         order.ID,
-		CustomerID: order.CustomerID,
-		Total:      order.Total,
-		Status:     order.Status,
-		CreatedAt:  order.CreatedAt,
-		UpdatedAt:  order.UpdatedAt,
-		Customer:   order.Customer,
-		Items:      []models.OrderItem{},
-	}
-
-	for _, item := range order.Items {
-		category_id := item.Product.CategoryID
-		category, err := h.categoryRepo.GetByID(category_id)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-		product := &models.Product{
-			ID:          item.Product.ID,
-			Name:        item.Product.Name,
-			Description: item.Product.Description,
-			Price:       item.Product.Price,
-			CategoryID:  item.Product.CategoryID,
-			Stock:       item.Product.Stock,
-			ImageURL:    item.Product.ImageURL,
-			Category:    *category,
-		}
-
-		itemPrice, err := strconv.ParseFloat(fmt.Sprintf("%.2f", item.Price*float64(item.Quantity)), 64)
-		if err != nil {
-			log.Printf("Failed to parse item price: %v", err)
-			return
-		}
-
-		responseOrder.Items = append(responseOrder.Items, models.OrderItem{
-			ID:        item.ID,
-			OrderID:   item.OrderID,
-			ProductID: item.ProductID,
-			Quantity:  item.Quantity,
-			Price:     itemPrice,
-			Product:   *product,
-		})
-
-	}
+	responseOrder := orderResponse(order)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(responseOrder)
@@ -264,9 +274,9 @@ func (h *OrderHandler) GetOrdersByCustomer(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	orders, err := h.orderRepo.GetByCustomer(customerID)
+	orders, err := h.orderRepo.GetByCustomer(r.Context(), customerID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -274,9 +284,9 @@ func (h *OrderHandler) GetOrdersByCustomer(w http.ResponseWriter, r *http.Reques
 
 	for _, orderItems := range orders {
 
-		order, err := h.orderRepo.GetByID(orderItems.ID)
+		order, err := h.orderRepo.GetByID(r.Context(), orderItems.ID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
+			writeRepositoryError(w, err, err.Error(), http.StatusNotFound)
 			return
 		}
 
@@ -285,6 +295,7 @@ func (h *OrderHandler) GetOrdersByCustomer(w http.ResponseWriter, r *http.Reques
 			CustomerID: order.CustomerID,
 			Total:      order.Total,
 			Status:     order.Status,
+			ShipTo:     order.ShipTo,
 			CreatedAt:  order.CreatedAt,
 			UpdatedAt:  order.UpdatedAt,
 			Customer:   order.Customer,
@@ -292,12 +303,6 @@ func (h *OrderHandler) GetOrdersByCustomer(w http.ResponseWriter, r *http.Reques
 		}
 
 		for _, item := range order.Items {
-			category_id := item.Product.CategoryID
-			category, err := h.categoryRepo.GetByID(category_id)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusNotFound)
-				return
-			}
 			product := &models.Product{
 				ID:          item.Product.ID,
 				Name:        item.Product.Name,
@@ -306,22 +311,22 @@ func (h *OrderHandler) GetOrdersByCustomer(w http.ResponseWriter, r *http.Reques
 				CategoryID:  item.Product.CategoryID,
 				Stock:       item.Product.Stock,
 				ImageURL:    item.Product.ImageURL,
-				Category:    *category,
+				Category:    item.Product.Category,
 			}
 
-			itemPrice, err := strconv.ParseFloat(fmt.Sprintf("%.2f", item.Price*float64(item.Quantity)), 64)
-			if err != nil {
-				log.Printf("Failed to parse item price: %v", err)
-				return
-			}
+			itemPrice := item.Price.Mul(item.RemainingQuantity())
 
 			responseOrder.Items = append(responseOrder.Items, models.OrderItem{
-				ID:        item.ID,
-				OrderID:   item.OrderID,
-				ProductID: item.ProductID,
-				Quantity:  item.Quantity,
-				Price:     itemPrice,
-				Product:   *product,
+				ID:                item.ID,
+				OrderID:           item.OrderID,
+				ProductID:         item.ProductID,
+				VariantID:         item.VariantID,
+				Quantity:          item.Quantity,
+				CancelledQuantity: item.CancelledQuantity,
+				Price:             itemPrice,
+				Product:           *product,
+				Variant:           item.Variant,
+				Allocations:       item.Allocations,
 			})
 
 			responseOrders = append(responseOrders, *responseOrder)
@@ -346,6 +351,7 @@ func (h *OrderHandler) UpdateOrderStatus(w http.ResponseWriter, r *http.Request)
 
 	var statusUpdate struct {
 		Status string `json:"status"`
+		Reason string `json:"reason"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&statusUpdate); err != nil {
@@ -354,33 +360,150 @@ func (h *OrderHandler) UpdateOrderStatus(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Validate status
-	validStatuses := []string{"pending", "processing", "shipped", "delivered", "cancelled"}
-	isValid := slices.Contains(validStatuses, statusUpdate.Status)
-
-	if !isValid {
+	if !models.IsValidOrderStatus(statusUpdate.Status) {
 		http.Error(w, "Invalid status", http.StatusBadRequest)
 		return
 	}
 
-	order, err := h.orderRepo.GetByID(id)
+	// Apply the transition through the order state machine
+	change := &models.OrderStatusChange{
+		OrderID:   id,
+		ToStatus:  statusUpdate.Status,
+		ChangedBy: actorFromRequest(r),
+		Reason:    statusUpdate.Reason,
+	}
+	if err := h.orderRepo.UpdateStatus(database.WithActor(r.Context(), change.ChangedBy), change); err != nil {
+		var transitionErr *models.OrderTransitionError
+		switch {
+		case errors.As(err, &transitionErr):
+			http.Error(w, transitionErr.Error(), http.StatusConflict)
+		case errors.Is(err, sql.ErrNoRows):
+			http.Error(w, "Order not found", http.StatusNotFound)
+		default:
+			writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	order, err := h.orderRepo.GetByID(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	responseOrder := orderResponse(order)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(responseOrder)
+}
+
+// CancelOrderItem cancels all or part of one line of an order and returns its stock
+func (h *OrderHandler) CancelOrderItem(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	itemID, err := uuid.Parse(vars["itemId"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Invalid order item ID", http.StatusBadRequest)
 		return
 	}
 
-	// Update order status in productRepo
-	h.orderRepo.UpdateStatus(&models.Order{
-		ID:     id,
-		Status: statusUpdate.Status,
-	})
+	// An empty body cancels the whole line
+	var cancellation struct {
+		Quantity int `json:"quantity"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&cancellation); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	order.Status = statusUpdate.Status
+	if cancellation.Quantity < 0 {
+		http.Error(w, "Invalid quantity", http.StatusBadRequest)
+		return
+	}
 
+	ctx := database.WithActor(r.Context(), actorFromRequest(r))
+	if err := h.orderRepo.CancelItem(ctx, id, itemID, cancellation.Quantity); err != nil {
+		var cancelErr *models.OrderItemCancellationError
+		switch {
+		case errors.As(err, &cancelErr):
+			http.Error(w, cancelErr.Error(), http.StatusConflict)
+		case errors.Is(err, sql.ErrNoRows):
+			http.Error(w, "Order item not found", http.StatusNotFound)
+		default:
+			writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	order, err := h.orderRepo.GetByID(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	responseOrder := orderResponse(order)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(responseOrder)
+}
+
+// GetOrderHistory gets the status history of an order
+func (h *OrderHandler) GetOrderHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.orderRepo.GetByID(r.Context(), id); err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	history, err := h.orderRepo.GetStatusHistory(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if history == nil {
+		history = []models.OrderStatusChange{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// actorFromRequest identifies who made a change, falling back to "anonymous"
+// on routes that do not require authentication
+func actorFromRequest(r *http.Request) string {
+	userID, email, _ := auth.GetUserFromContext(r.Context())
+	if userID == uuid.Nil {
+		return "anonymous"
+	}
+	if email != "" {
+		return email
+	}
+	return userID.String()
+}
+
+// orderResponse builds the order returned by the single-order endpoints, with
+// each item's product joined to its category and priced for the quantity
+// still outstanding. The category is included even when it has been deleted.
+func orderResponse(order *models.Order) *models.Order {
 	responseOrder := &models.Order{
 		ID:         order.ID,
 		CustomerID: order.CustomerID,
 		Total:      order.Total,
 		Status:     order.Status,
+		ShipTo:     order.ShipTo,
 		CreatedAt:  order.CreatedAt,
 		UpdatedAt:  order.UpdatedAt,
 		Customer:   order.Customer,
@@ -388,12 +511,6 @@ func (h *OrderHandler) UpdateOrderStatus(w http.ResponseWriter, r *http.Request)
 	}
 
 	for _, item := range order.Items {
-		category_id := item.Product.CategoryID
-		category, err := h.categoryRepo.GetByID(category_id)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
 		product := &models.Product{
 			ID:          item.Product.ID,
 			Name:        item.Product.Name,
@@ -402,27 +519,24 @@ func (h *OrderHandler) UpdateOrderStatus(w http.ResponseWriter, r *http.Request)
 			CategoryID:  item.Product.CategoryID,
 			Stock:       item.Product.Stock,
 			ImageURL:    item.Product.ImageURL,
-			Category:    *category,
+			Category:    item.Product.Category,
 		}
 
-		itemPrice, err := strconv.ParseFloat(fmt.Sprintf("%.2f", item.Price*float64(item.Quantity)), 64)
-		if err != nil {
-			log.Printf("Failed to parse item price: %v", err)
-			return
-		}
+		itemPrice := item.Price.Mul(item.RemainingQuantity())
 
 		responseOrder.Items = append(responseOrder.Items, models.OrderItem{
-			ID:        item.ID,
-			OrderID:   item.OrderID,
-			ProductID: item.ProductID,
-			Quantity:  item.Quantity,
-			Price:     itemPrice,
-			Product:   *product,
+			ID:                item.ID,
+			OrderID:           item.OrderID,
+			ProductID:         item.ProductID,
+			VariantID:         item.VariantID,
+			Quantity:          item.Quantity,
+			CancelledQuantity: item.CancelledQuantity,
+			Price:             itemPrice,
+			Product:           *product,
+			Variant:           item.Variant,
+			Allocations:       item.Allocations,
 		})
-
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(responseOrder)
-
+	return responseOrder
 }
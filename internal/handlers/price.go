@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"commerce-app/internal/database"
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// PriceHandler serves a product's price history and schedules its future
+// price changes
+type PriceHandler struct {
+	priceRepo   database.PriceRepository
+	productRepo database.ProductRepository
+}
+
+func NewPriceHandler(priceRepo database.PriceRepository, productRepo database.ProductRepository) *PriceHandler {
+	return &PriceHandler{
+		priceRepo:   priceRepo,
+		productRepo: productRepo,
+	}
+}
+
+// GetPriceTimeline gets a product's current and regular price, every change to
+// its price and its price schedules
+func (h *PriceHandler) GetPriceTimeline(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.loadProduct(w, r)
+	if !ok {
+		return
+	}
+
+	history, err := h.priceRepo.GetHistory(r.Context(), product.ID)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	schedules, err := h.priceRepo.GetSchedules(r.Context(), product.ID)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.PriceTimeline{
+		ProductID:    product.ID,
+		Price:        product.Price,
+		RegularPrice: product.RegularPrice,
+		History:      history,
+		Schedules:    schedules,
+	})
+}
+
+// CreateSchedule schedules a change to a product's price. One that starts now
+// is applied straight away rather than at the scheduler's next run.
+func (h *PriceHandler) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.loadProduct(w, r)
+	if !ok {
+		return
+	}
+
+	var request models.PriceScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	schedule := models.PriceSchedule{
+		ProductID: product.ID,
+		Price:     request.Price,
+		StartsAt:  now,
+		EndsAt:    request.EndsAt,
+	}
+	if request.StartsAt != nil {
+		schedule.StartsAt = *request.StartsAt
+	}
+	if problems := validatePriceSchedule(&schedule, product, now); len(problems) > 0 {
+		http.Error(w, "Invalid price schedule: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	ctx := database.WithActor(r.Context(), actorFromRequest(r))
+	if err := h.priceRepo.CreateSchedule(ctx, &schedule); err != nil {
+		if errors.Is(err, database.ErrScheduleOverlap) {
+			http.Error(w, "Invalid price schedule: "+err.Error(), http.StatusConflict)
+			return
+		}
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !schedule.StartsAt.After(now) {
+		if _, _, err := h.priceRepo.ApplySchedules(ctx, now); err != nil {
+			writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		applied, err := h.priceRepo.GetSchedule(ctx, schedule.ID)
+		if err != nil {
+			writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		schedule = *applied
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// CancelSchedule cancels a schedule that has not started, or ends a running
+// sale now and restores the price it replaced
+func (h *PriceHandler) CancelSchedule(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.loadProduct(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := uuid.Parse(mux.Vars(r)["scheduleId"])
+	if err != nil {
+		http.Error(w, "Invalid schedule ID", http.StatusBadRequest)
+		return
+	}
+
+	schedule, err := h.priceRepo.GetSchedule(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, "Price schedule not found", http.StatusNotFound)
+		return
+	}
+	if schedule.ProductID != product.ID {
+		http.Error(w, "Price schedule not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.priceRepo.CancelSchedule(r.Context(), id); err != nil {
+		if errors.Is(err, database.ErrScheduleClosed) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadProduct gets the product named in the URL, writing the error response
+// and returning false if there is none
+func (h *PriceHandler) loadProduct(w http.ResponseWriter, r *http.Request) (*models.Product, bool) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	product, err := h.productRepo.GetByID(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, "Product not found", http.StatusNotFound)
+		return nil, false
+	}
+	return product, true
+}
+
+// validatePriceSchedule checks a schedule against its product and the current
+// time, returning a description of every invalid field
+func validatePriceSchedule(schedule *models.PriceSchedule, product *models.Product, now time.Time) []string {
+	var problems []string
+
+	if schedule.Price.IsNegative() {
+		problems = append(problems, "price must not be negative")
+	}
+	if schedule.Price.Currency != product.Price.Currency {
+		problems = append(problems, fmt.Sprintf("price must be in the product's currency %s", product.Price.Currency))
+	}
+	if schedule.EndsAt != nil {
+		if !schedule.EndsAt.After(schedule.StartsAt) {
+			problems = append(problems, "ends_at must be after starts_at")
+		} else if !schedule.EndsAt.After(now) {
+			problems = append(problems, "ends_at must be in the future")
+		}
+	}
+	return problems
+}
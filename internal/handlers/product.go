@@ -2,8 +2,15 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"commerce-app/internal/database"
 	"commerce-app/internal/models"
@@ -12,15 +19,29 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// Column limits of the products table
+const (
+	maxProductNameLength     = 255
+	maxProductImageURLLength = 500
+)
+
+// maxCategoryNameLength is the column limit of categories.name
+const maxCategoryNameLength = 255
+
 type ProductHandler struct {
-	productRepo  *database.ProductRepository
-	categoryRepo *database.CategoryRepository
+	productRepo  database.ProductRepository
+	categoryRepo database.CategoryRepository
+	// bulkQueryTimeout replaces the default deadline of each repository call
+	// made by imports and exports, which read and write many rows at a time
+	bulkQueryTimeout time.Duration
 }
 
-func NewProductHandler() *ProductHandler {
+func NewProductHandler(productRepo database.ProductRepository, categoryRepo database.CategoryRepository,
+	bulkQueryTimeout time.Duration) *ProductHandler {
 	return &ProductHandler{
-		productRepo:  &database.ProductRepository{},
-		categoryRepo: &database.CategoryRepository{},
+		productRepo:      productRepo,
+		categoryRepo:     categoryRepo,
+		bulkQueryTimeout: bulkQueryTimeout,
 	}
 }
 
@@ -32,14 +53,30 @@ func (h *ProductHandler) CreateProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.productRepo.Create(&productRequest); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if productRequest.Price.IsNegative() {
+		http.Error(w, "Price must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	schema, err := h.categoryRepo.GetAttributeSchema(r.Context(), productRequest.CategoryID)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if problems := schema.Validate(productRequest.Attributes); len(problems) > 0 {
+		http.Error(w, "Invalid product: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	ctx := database.WithActor(r.Context(), actorFromRequest(r))
+	if err := h.productRepo.Create(ctx, &productRequest); err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	category, err := h.categoryRepo.GetByID(productRequest.CategoryID)
+	category, err := h.categoryRepo.GetByID(r.Context(), productRequest.CategoryID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -51,6 +88,7 @@ func (h *ProductHandler) CreateProduct(w http.ResponseWriter, r *http.Request) {
 		CategoryID:  productRequest.CategoryID,
 		Stock:       productRequest.Stock,
 		ImageURL:    productRequest.ImageURL,
+		Attributes:  productRequest.Attributes,
 		Category:    *category,
 	}
 
@@ -68,10 +106,137 @@ func (h *ProductHandler) GetProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	product, err := h.productRepo.GetByID(id)
+	product, err := h.productRepo.GetByID(r.Context(), id)
 	if err != nil {
 		log.Println("Error getting product:", err)
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeRepositoryError(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(product)
+}
+
+// UpdateProduct replaces a product's fields. Name, price, category and stock
+// are required; a missing description, image URL or attributes are cleared.
+func (h *ProductHandler) UpdateProduct(w http.ResponseWriter, r *http.Request) {
+	var update models.ProductUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var missing []string
+	if update.Name == nil {
+		missing = append(missing, "name")
+	}
+	if update.Price == nil {
+		missing = append(missing, "price")
+	}
+	if update.CategoryID == nil {
+		missing = append(missing, "category_id")
+	}
+	if update.Stock == nil {
+		missing = append(missing, "stock")
+	}
+	if len(missing) > 0 {
+		http.Error(w, "Missing required fields: "+strings.Join(missing, ", "), http.StatusBadRequest)
+		return
+	}
+
+	empty := ""
+	if update.Description == nil {
+		update.Description = &empty
+	}
+	if update.ImageURL == nil {
+		update.ImageURL = &empty
+	}
+	if update.Attributes == nil {
+		update.Attributes = &models.ProductAttributes{}
+	}
+
+	h.updateProduct(w, r, update)
+}
+
+// PatchProduct changes only the product fields present in the request
+func (h *ProductHandler) PatchProduct(w http.ResponseWriter, r *http.Request) {
+	var update models.ProductUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.updateProduct(w, r, update)
+}
+
+// DeleteProduct soft-deletes a product. Orders placed for it keep their
+// history, and it can be restored until it is purged.
+func (h *ProductHandler) DeleteProduct(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.productRepo.SoftDelete(r.Context(), id); err != nil {
+		writeRepositoryError(w, err, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateProduct validates and applies an update to the product named in the
+// URL, responding with the updated product
+func (h *ProductHandler) updateProduct(w http.ResponseWriter, r *http.Request, update models.ProductUpdate) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	if problems := validateProductUpdate(&update); len(problems) > 0 {
+		http.Error(w, "Invalid product: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	existing, err := h.productRepo.GetByID(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	if problems := validateVariantChanges(&update, existing); len(problems) > 0 {
+		http.Error(w, "Invalid product: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	if update.CategoryID != nil {
+		if _, err := h.categoryRepo.GetByID(r.Context(), *update.CategoryID); err != nil {
+			writeRepositoryError(w, err, "Invalid product: category_id does not exist", http.StatusBadRequest)
+			return
+		}
+	}
+
+	problems, err := h.attributeProblems(r.Context(), update, existing)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(problems) > 0 {
+		http.Error(w, "Invalid product: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	ctx := database.WithActor(r.Context(), actorFromRequest(r))
+	if err := h.productRepo.Update(ctx, id, update); err != nil {
+		writeStockChangeError(w, err)
+		return
+	}
+
+	product, err := h.productRepo.GetByID(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -79,16 +244,251 @@ func (h *ProductHandler) GetProduct(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(product)
 }
 
+// validateProductUpdate trims the name and checks each field present in an
+// update against the column limits, returning a description of every invalid one
+func validateProductUpdate(update *models.ProductUpdate) []string {
+	var problems []string
+	if update.Name != nil {
+		name := strings.TrimSpace(*update.Name)
+		switch {
+		case name == "":
+			problems = append(problems, "name must not be empty")
+		case utf8.RuneCountInString(name) > maxProductNameLength:
+			problems = append(problems, fmt.Sprintf("name must be at most %d characters", maxProductNameLength))
+		}
+		update.Name = &name
+	}
+	if update.Price != nil {
+		if update.Price.IsNegative() {
+			problems = append(problems, "price must not be negative")
+		}
+		if len(update.Price.Currency) != 3 {
+			problems = append(problems, "price currency must be a 3-letter code")
+		}
+	}
+	if update.CategoryID != nil && *update.CategoryID == uuid.Nil {
+		problems = append(problems, "category_id must not be empty")
+	}
+	if update.Stock != nil && *update.Stock < 0 {
+		problems = append(problems, "stock must not be negative")
+	}
+	if update.ImageURL != nil {
+		if problem := validateImageURL(*update.ImageURL); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+// validateImageURL checks that an image URL, if set, is an absolute http or
+// https URL that fits its column, returning the problem if it is not
+func validateImageURL(value string) string {
+	if value == "" {
+		return ""
+	}
+	imageURL, err := url.Parse(value)
+	switch {
+	case err != nil || (imageURL.Scheme != "http" && imageURL.Scheme != "https") || imageURL.Host == "":
+		return "image_url must be an absolute http or https URL"
+	case utf8.RuneCountInString(value) > maxProductImageURLLength:
+		return fmt.Sprintf("image_url must be at most %d characters", maxProductImageURLLength)
+	}
+	return ""
+}
+
+// validateVariantChanges checks an update against the product's variants. The
+// stock of a product with variants is the total of theirs, so it can only be
+// changed through the variants, and variant prices must stay in the product's
+// currency.
+func validateVariantChanges(update *models.ProductUpdate, product *models.Product) []string {
+	var problems []string
+	if update.Stock != nil && len(product.Variants) > 0 {
+		if *update.Stock != product.Stock {
+			problems = append(problems, "stock of a product with variants must be changed through its variants")
+		}
+		// Leave the total to the repository so concurrent orders are not overwritten
+		update.Stock = nil
+	}
+	if update.Price != nil {
+		for _, variant := range product.Variants {
+			if variant.Price != nil && variant.Price.Currency != update.Price.Currency {
+				problems = append(problems, fmt.Sprintf("price currency must match variant %s priced in %s",
+					variant.SKU, variant.Price.Currency))
+				break
+			}
+		}
+	}
+	return problems
+}
+
 // GetAllProducts gets all products
 func (h *ProductHandler) GetAllProducts(w http.ResponseWriter, r *http.Request) {
-	products, err := h.productRepo.GetAll()
+	filter, err := parseProductFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := h.productRepo.List(r.Context(), *filter)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(products)
+	json.NewEncoder(w).Encode(page)
+}
+
+// SearchProducts finds products by name and description, most relevant first
+func (h *ProductHandler) SearchProducts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if len(models.SearchTerms(query)) == 0 {
+		http.Error(w, "Search query is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > models.MaxSearchLimit {
+			http.Error(w, fmt.Sprintf("Invalid limit: must be between 1 and %d", models.MaxSearchLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	results, err := h.productRepo.Search(r.Context(), query, limit)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// GetProductFacets counts the products matching the listing filters per
+// category, price bucket and availability. buckets optionally lists the
+// ascending lower bounds of the price buckets in the requested currency.
+func (h *ProductHandler) GetProductFacets(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseProductFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Cursor = nil
+
+	edges, err := parsePriceBucketEdges(query.Get("buckets"), strings.ToUpper(query.Get("currency")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	facets, err := h.productRepo.GetFacets(r.Context(), *filter, edges)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(facets)
+}
+
+// parsePriceBucketEdges reads a comma separated list of ascending prices,
+// falling back to the default edges when value is empty
+func parsePriceBucketEdges(value, currency string) ([]models.Money, error) {
+	values := models.DefaultPriceBucketEdges
+	if value != "" {
+		values = strings.Split(value, ",")
+	}
+	if len(values) > models.MaxPriceBuckets {
+		return nil, fmt.Errorf("Invalid buckets: at most %d are allowed", models.MaxPriceBuckets)
+	}
+
+	edges := make([]models.Money, len(values))
+	for i, v := range values {
+		edge, err := models.ParseMoney(v, currency)
+		if err != nil || edge.Amount < 0 {
+			return nil, fmt.Errorf("Invalid buckets: %q is not a price", v)
+		}
+		if i > 0 && edge.Amount <= edges[i-1].Amount {
+			return nil, errors.New("Invalid buckets: prices must be ascending")
+		}
+		edges[i] = edge
+	}
+	return edges, nil
+}
+
+// parseProductFilter reads the product listing query parameters: category,
+// min_price, max_price, currency, in_stock, attr.<name>, sort, limit and cursor
+func parseProductFilter(query url.Values) (*models.ProductFilter, error) {
+	filter := &models.ProductFilter{Sort: models.ProductSortName}
+
+	if value := query.Get("category"); value != "" {
+		categoryID, err := uuid.Parse(value)
+		if err != nil {
+			return nil, errors.New("Invalid category ID")
+		}
+		filter.CategoryID = &categoryID
+	}
+
+	currency := strings.ToUpper(query.Get("currency"))
+	for _, bound := range []struct {
+		name  string
+		price **models.Money
+	}{
+		{"min_price", &filter.MinPrice},
+		{"max_price", &filter.MaxPrice},
+	} {
+		if value := query.Get(bound.name); value != "" {
+			price, err := models.ParseMoney(value, currency)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s: %v", bound.name, err)
+			}
+			*bound.price = &price
+		}
+	}
+
+	if value := query.Get("in_stock"); value != "" {
+		inStock, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New("Invalid in_stock")
+		}
+		filter.InStock = inStock
+	}
+
+	attributes, err := parseAttributeFilters(query)
+	if err != nil {
+		return nil, err
+	}
+	filter.Attributes = attributes
+
+	if value := query.Get("sort"); value != "" {
+		if !models.IsValidProductSort(value) {
+			return nil, fmt.Errorf("Invalid sort: must be one of %s, %s, %s, %s", models.ProductSortName,
+				models.ProductSortPriceAsc, models.ProductSortPriceDesc, models.ProductSortNewest)
+		}
+		filter.Sort = value
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > models.MaxProductPageSize {
+			return nil, fmt.Errorf("Invalid limit: must be between 1 and %d", models.MaxProductPageSize)
+		}
+		filter.Limit = limit
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := models.DecodeProductCursor(value)
+		if err != nil || cursor.Sort != filter.Sort {
+			return nil, errors.New("Invalid cursor")
+		}
+		filter.Cursor = cursor
+	}
+
+	return filter, nil
 }
 
 // GetProductsByCategory gets products by category
@@ -100,9 +500,9 @@ func (h *ProductHandler) GetProductsByCategory(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	products, err := h.productRepo.GetByCategory(categoryID)
+	products, err := h.productRepo.GetByCategory(r.Context(), categoryID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -119,9 +519,9 @@ func (h *ProductHandler) GetAveragePriceByCategory(w http.ResponseWriter, r *htt
 		return
 	}
 
-	categoryPrice, err := h.productRepo.GetAveragePriceByCategory(categoryID)
+	categoryPrice, err := h.productRepo.GetAveragePriceByCategory(r.Context(), categoryID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -129,6 +529,41 @@ func (h *ProductHandler) GetAveragePriceByCategory(w http.ResponseWriter, r *htt
 	json.NewEncoder(w).Encode(categoryPrice)
 }
 
+// GetCategoryStats gets price and stock statistics for the products of a
+// category, including those of its subcategories unless recursive=false
+func (h *ProductHandler) GetCategoryStats(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	recursive := true
+	if value := query.Get("recursive"); value != "" {
+		recursive, err = strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "Invalid recursive", http.StatusBadRequest)
+			return
+		}
+	}
+
+	currency := strings.ToUpper(query.Get("currency"))
+	if currency != "" && len(currency) != 3 {
+		http.Error(w, "Invalid currency: must be a 3-letter code", http.StatusBadRequest)
+		return
+	}
+
+	stats, err := h.productRepo.GetCategoryStats(r.Context(), id, currency, recursive)
+	if err != nil {
+		writeRepositoryError(w, err, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
 // CreateCategory creates a new category
 func (h *ProductHandler) CreateCategory(w http.ResponseWriter, r *http.Request) {
 	var category models.Category
@@ -137,8 +572,14 @@ func (h *ProductHandler) CreateCategory(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if err := h.categoryRepo.Create(&category); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	category.Name = strings.TrimSpace(category.Name)
+	if problems := validateCategory(&category); len(problems) > 0 {
+		http.Error(w, "Invalid category: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.categoryRepo.Create(r.Context(), &category); err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -156,9 +597,9 @@ func (h *ProductHandler) GetCategory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	category, err := h.categoryRepo.GetByID(id)
+	category, err := h.categoryRepo.GetByID(r.Context(), id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeRepositoryError(w, err, err.Error(), http.StatusNotFound)
 		return
 	}
 
@@ -166,11 +607,125 @@ func (h *ProductHandler) GetCategory(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(category)
 }
 
+// UpdateCategory renames a category and moves it under another parent, or to
+// the top of the tree when parent_id is null. Its subcategories move with it.
+func (h *ProductHandler) UpdateCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Name        string     `json:"name"`
+		Description string     `json:"description"`
+		ParentID    *uuid.UUID `json:"parent_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	category := models.Category{
+		ID:          id,
+		Name:        strings.TrimSpace(request.Name),
+		Description: request.Description,
+		ParentID:    request.ParentID,
+	}
+	if problems := validateCategory(&category); len(problems) > 0 {
+		http.Error(w, "Invalid category: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.categoryRepo.GetByID(r.Context(), id); err != nil {
+		writeRepositoryError(w, err, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	if category.ParentID != nil {
+		if _, err := h.categoryRepo.GetByID(r.Context(), *category.ParentID); err != nil {
+			writeRepositoryError(w, err, "Invalid category: parent_id does not exist", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.categoryRepo.Update(r.Context(), &category); err != nil {
+		switch {
+		case errors.Is(err, database.ErrCategoryCycle):
+			http.Error(w, "Invalid category: "+err.Error(), http.StatusConflict)
+		case errors.Is(err, database.ErrDuplicateAttribute):
+			http.Error(w, "Invalid category: the new parent defines an attribute the category's subtree also defines",
+				http.StatusConflict)
+		default:
+			writeRepositoryError(w, err, "Category not found", http.StatusNotFound)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(category)
+}
+
+// validateCategory checks the fields of a category that is being created,
+// renamed or moved, returning a description of every invalid field
+func validateCategory(category *models.Category) []string {
+	var problems []string
+
+	switch {
+	case category.Name == "":
+		problems = append(problems, "name must not be empty")
+	case utf8.RuneCountInString(category.Name) > maxCategoryNameLength:
+		problems = append(problems, fmt.Sprintf("name must be at most %d characters", maxCategoryNameLength))
+	case strings.Contains(category.Name, "/"):
+		problems = append(problems, "name must not contain /")
+	}
+
+	if category.ParentID != nil && *category.ParentID == uuid.Nil {
+		problems = append(problems, "parent_id must be a valid category ID or null")
+	}
+	return problems
+}
+
+// GetCategoryTree gets the category hierarchy with the product count of every
+// subtree, optionally rooted at one category and limited to a depth below it
+func (h *ProductHandler) GetCategoryTree(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var rootID *uuid.UUID
+	if value := query.Get("root"); value != "" {
+		id, err := uuid.Parse(value)
+		if err != nil {
+			http.Error(w, "Invalid root category ID", http.StatusBadRequest)
+			return
+		}
+		rootID = &id
+	}
+
+	depth := -1
+	if value := query.Get("depth"); value != "" {
+		var err error
+		depth, err = strconv.Atoi(value)
+		if err != nil || depth < 0 {
+			http.Error(w, "Invalid depth: must be 0 or more", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tree, err := h.categoryRepo.GetTree(r.Context(), rootID, depth)
+	if err != nil {
+		writeRepositoryError(w, err, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tree)
+}
+
 // GetAllCategories gets all categories
 func (h *ProductHandler) GetAllCategories(w http.ResponseWriter, r *http.Request) {
-	categories, err := h.categoryRepo.GetAll()
+	categories, err := h.categoryRepo.GetAll(r.Context())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -178,6 +733,23 @@ func (h *ProductHandler) GetAllCategories(w http.ResponseWriter, r *http.Request
 	json.NewEncoder(w).Encode(categories)
 }
 
+// DeleteCategory soft-deletes a category together with its subcategories and
+// their products
+func (h *ProductHandler) DeleteCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.categoryRepo.SoftDelete(r.Context(), id); err != nil {
+		writeRepositoryError(w, err, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // GetCategoryChildren gets children of a category
 func (h *ProductHandler) GetCategoryChildren(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -187,9 +759,9 @@ func (h *ProductHandler) GetCategoryChildren(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	categories, err := h.categoryRepo.GetChildren(parentID)
+	categories, err := h.categoryRepo.GetChildren(r.Context(), parentID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
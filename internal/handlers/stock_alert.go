@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"commerce-app/internal/database"
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// StockAlertHandler serves the reorder thresholds of products and categories
+// and the low-stock alerts raised against them
+type StockAlertHandler struct {
+	alertRepo    database.StockAlertRepository
+	productRepo  database.ProductRepository
+	categoryRepo database.CategoryRepository
+}
+
+func NewStockAlertHandler(alertRepo database.StockAlertRepository, productRepo database.ProductRepository, categoryRepo database.CategoryRepository) *StockAlertHandler {
+	return &StockAlertHandler{
+		alertRepo:    alertRepo,
+		productRepo:  productRepo,
+		categoryRepo: categoryRepo,
+	}
+}
+
+// GetProductThreshold gets a product's own reorder threshold, its category's
+// and the one that applies
+func (h *StockAlertHandler) GetProductThreshold(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.loadProduct(w, r)
+	if !ok {
+		return
+	}
+
+	threshold, err := h.alertRepo.GetThreshold(r.Context(), product.ID)
+	if err != nil {
+		writeRepositoryError(w, err, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(threshold)
+}
+
+// SetProductThreshold sets a product's own reorder threshold, or clears it
+// with a null threshold so that its category's applies
+func (h *StockAlertHandler) SetProductThreshold(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.loadProduct(w, r)
+	if !ok {
+		return
+	}
+
+	threshold, ok := decodeThreshold(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.alertRepo.SetProductThreshold(r.Context(), product.ID, threshold); err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	updated, err := h.alertRepo.GetThreshold(r.Context(), product.ID)
+	if err != nil {
+		writeRepositoryError(w, err, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// SetCategoryThreshold sets the reorder threshold of the products of a
+// category and its subcategories that have none of their own, or clears it
+// with a null threshold
+func (h *StockAlertHandler) SetCategoryThreshold(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	category, err := h.categoryRepo.GetByID(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	threshold, ok := decodeThreshold(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.alertRepo.SetCategoryThreshold(r.Context(), category.ID, threshold); err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.CategoryReorderThreshold{CategoryID: category.ID, Threshold: threshold})
+}
+
+// GetAlerts lists low-stock alerts newest first: the open ones, or with
+// status=all the resolved ones as well
+func (h *StockAlertHandler) GetAlerts(w http.ResponseWriter, r *http.Request) {
+	openOnly := true
+	switch r.URL.Query().Get("status") {
+	case "", "open":
+	case "all":
+		openOnly = false
+	default:
+		http.Error(w, "Invalid status: must be open or all", http.StatusBadRequest)
+		return
+	}
+
+	alerts, err := h.alertRepo.GetAlerts(r.Context(), openOnly)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
+
+// loadProduct gets the product named in the URL, writing the error response
+// and returning false if there is none
+func (h *StockAlertHandler) loadProduct(w http.ResponseWriter, r *http.Request) (*models.Product, bool) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	product, err := h.productRepo.GetByID(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, "Product not found", http.StatusNotFound)
+		return nil, false
+	}
+	return product, true
+}
+
+// decodeThreshold reads the threshold of a request to set one, writing the
+// error response and returning false if it is invalid
+func decodeThreshold(w http.ResponseWriter, r *http.Request) (*int, bool) {
+	var request models.ThresholdRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if request.Threshold != nil && *request.Threshold < 0 {
+		http.Error(w, "Invalid threshold: must not be negative", http.StatusBadRequest)
+		return nil, false
+	}
+	return request.Threshold, true
+}
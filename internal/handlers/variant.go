@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"commerce-app/internal/database"
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// maxVariantSKULength is the column limit of product_variants.sku
+const maxVariantSKULength = 64
+
+// VariantHandler manages the variants of a product
+type VariantHandler struct {
+	variantRepo database.VariantRepository
+	productRepo database.ProductRepository
+}
+
+func NewVariantHandler(variantRepo database.VariantRepository, productRepo database.ProductRepository) *VariantHandler {
+	return &VariantHandler{
+		variantRepo: variantRepo,
+		productRepo: productRepo,
+	}
+}
+
+// GetVariants lists a product's variants ordered by SKU
+func (h *VariantHandler) GetVariants(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.loadProduct(w, r)
+	if !ok {
+		return
+	}
+
+	variants, err := h.variantRepo.GetByProduct(r.Context(), product.ID)
+	if err != nil {
+		writeRepositoryError(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(variants)
+}
+
+// CreateVariant adds a variant to a product
+func (h *VariantHandler) CreateVariant(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.loadProduct(w, r)
+	if !ok {
+		return
+	}
+
+	var variant models.ProductVariant
+	if err := json.NewDecoder(r.Body).Decode(&variant); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if problems := validateVariant(&variant, product); len(problems) > 0 {
+		http.Error(w, "Invalid variant: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	variant.ProductID = product.ID
+	if err := h.variantRepo.Create(database.WithActor(r.Context(), actorFromRequest(r)), &variant); err != nil {
+		writeVariantError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(variant)
+}
+
+// GetVariant gets one of a product's variants
+func (h *VariantHandler) GetVariant(w http.ResponseWriter, r *http.Request) {
+	_, variant, ok := h.loadVariant(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(variant)
+}
+
+// UpdateVariant replaces a variant's SKU, options, price, stock and image. A
+// missing price makes the variant sell at the product's price.
+func (h *VariantHandler) UpdateVariant(w http.ResponseWriter, r *http.Request) {
+	product, existing, ok := h.loadVariant(w, r)
+	if !ok {
+		return
+	}
+
+	var variant models.ProductVariant
+	if err := json.NewDecoder(r.Body).Decode(&variant); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if problems := validateVariant(&variant, product); len(problems) > 0 {
+		http.Error(w, "Invalid variant: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	variant.ID = existing.ID
+	if err := h.variantRepo.Update(database.WithActor(r.Context(), actorFromRequest(r)), &variant); err != nil {
+		writeVariantError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(variant)
+}
+
+// DeleteVariant removes a variant that no order references
+func (h *VariantHandler) DeleteVariant(w http.ResponseWriter, r *http.Request) {
+	_, variant, ok := h.loadVariant(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.variantRepo.Delete(r.Context(), variant.ID); err != nil {
+		writeVariantError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadProduct gets the product named in the URL, writing the error response
+// and returning false if there is none
+func (h *VariantHandler) loadProduct(w http.ResponseWriter, r *http.Request) (*models.Product, bool) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	product, err := h.productRepo.GetByID(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, "Product not found", http.StatusNotFound)
+		return nil, false
+	}
+	return product, true
+}
+
+// loadVariant gets the product and variant named in the URL, treating a
+// variant of another product as missing
+func (h *VariantHandler) loadVariant(w http.ResponseWriter, r *http.Request) (*models.Product, *models.ProductVariant, bool) {
+	product, ok := h.loadProduct(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	id, err := uuid.Parse(mux.Vars(r)["variantId"])
+	if err != nil {
+		http.Error(w, "Invalid variant ID", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	variant, err := h.variantRepo.GetByID(r.Context(), id)
+	if err != nil {
+		writeRepositoryError(w, err, "Variant not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	if variant.ProductID != product.ID {
+		http.Error(w, "Variant not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	return product, variant, true
+}
+
+// writeVariantError responds to a failed variant change
+func writeVariantError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, database.ErrDuplicateSKU):
+		http.Error(w, "Invalid variant: "+err.Error(), http.StatusConflict)
+	case errors.Is(err, database.ErrVariantInUse):
+		http.Error(w, "Variant is referenced by existing orders", http.StatusConflict)
+	default:
+		writeStockChangeError(w, err)
+	}
+}
+
+// validateVariant trims the SKU and options and checks the variant against the
+// column limits and its product, returning a description of every invalid field
+func validateVariant(variant *models.ProductVariant, product *models.Product) []string {
+	var problems []string
+
+	variant.SKU = strings.TrimSpace(variant.SKU)
+	switch {
+	case variant.SKU == "":
+		problems = append(problems, "sku must not be empty")
+	case utf8.RuneCountInString(variant.SKU) > maxVariantSKULength:
+		problems = append(problems, fmt.Sprintf("sku must be at most %d characters", maxVariantSKULength))
+	}
+
+	options := make(models.VariantOptions, len(variant.Options))
+	for name, value := range variant.Options {
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if name == "" || value == "" {
+			problems = append(problems, "options must have non-empty names and values")
+			break
+		}
+		options[name] = value
+	}
+	variant.Options = options
+
+	if variant.Price != nil {
+		if variant.Price.IsNegative() {
+			problems = append(problems, "price must not be negative")
+		}
+		if variant.Price.Currency != product.Price.Currency {
+			problems = append(problems, fmt.Sprintf("price must be in the product's currency %s", product.Price.Currency))
+		}
+	}
+	if variant.Stock < 0 {
+		problems = append(problems, "stock must not be negative")
+	}
+	if problem := validateImageURL(variant.ImageURL); problem != "" {
+		problems = append(problems, problem)
+	}
+	return problems
+}
@@ -0,0 +1,138 @@
+// Package images checks uploaded product images and makes their thumbnails
+package images
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+const (
+	// ThumbnailSize bounds the longer side of a thumbnail in pixels
+	ThumbnailSize = 320
+	// MaxPixels bounds the decoded size of an image, so that a small file
+	// cannot expand into an image too large to hold in memory
+	MaxPixels = 25_000_000
+
+	thumbnailQuality = 85
+)
+
+// ErrUnsupportedType is returned for files that are not JPEG, PNG or GIF images
+var ErrUnsupportedType = errors.New("image must be a JPEG, PNG or GIF file")
+
+// extensions maps the supported content types to the file extension they are
+// stored with
+var extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// Image is a checked upload and its thumbnail
+type Image struct {
+	ContentType string
+	Extension   string
+	Width       int
+	Height      int
+
+	Thumbnail            []byte
+	ThumbnailContentType string
+	ThumbnailExtension   string
+}
+
+// Process checks that data holds a supported image, telling the type from its
+// content rather than the name or type the client gave it, and makes its
+// thumbnail. JPEG thumbnails stay JPEG; others become PNG to keep transparency.
+func Process(data []byte) (*Image, error) {
+	contentType := http.DetectContentType(data)
+	extension, ok := extensions[contentType]
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("image could not be read: %w", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxPixels {
+		return nil, fmt.Errorf("image must be at most %d megapixels", MaxPixels/1_000_000)
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("image could not be read: %w", err)
+	}
+
+	processed := &Image{
+		ContentType: contentType,
+		Extension:   extension,
+		Width:       config.Width,
+		Height:      config.Height,
+	}
+
+	var thumbnail bytes.Buffer
+	resized := Resize(decoded, ThumbnailSize)
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&thumbnail, resized, &jpeg.Options{Quality: thumbnailQuality})
+		processed.ThumbnailContentType, processed.ThumbnailExtension = "image/jpeg", ".jpg"
+	} else {
+		err = png.Encode(&thumbnail, resized)
+		processed.ThumbnailContentType, processed.ThumbnailExtension = "image/png", ".png"
+	}
+	if err != nil {
+		return nil, err
+	}
+	processed.Thumbnail = thumbnail.Bytes()
+	return processed, nil
+}
+
+// Resize scales an image down so that neither side is longer than size,
+// keeping its aspect ratio. Each output pixel averages the source pixels it
+// covers. Images that already fit are copied unscaled.
+func Resize(img image.Image, size int) *image.RGBA {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+
+	src := image.NewRGBA(image.Rect(0, 0, srcWidth, srcHeight))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	if srcWidth <= size && srcHeight <= size {
+		return src
+	}
+
+	width, height := size, max(1, srcHeight*size/srcWidth)
+	if srcHeight > srcWidth {
+		width, height = max(1, srcWidth*size/srcHeight), size
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcHeight/height, max((y+1)*srcHeight/height, y*srcHeight/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcWidth/width, max((x+1)*srcWidth/width, x*srcWidth/width+1)
+
+			// The pixels are premultiplied by alpha, so plain sums average them correctly
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(row[sx*4+c])
+					}
+				}
+			}
+
+			count := (y1 - y0) * (x1 - x0)
+			offset := y*dst.Stride + x*4
+			for c := 0; c < 4; c++ {
+				dst.Pix[offset+c] = uint8((sum[c] + count/2) / count)
+			}
+		}
+	}
+	return dst
+}
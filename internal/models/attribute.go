@@ -0,0 +1,182 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Attribute value types
+const (
+	AttributeTypeText    = "text"
+	AttributeTypeNumber  = "number"
+	AttributeTypeBoolean = "boolean"
+	AttributeTypeEnum    = "enum"
+)
+
+// IsValidAttributeType reports whether t is a known attribute value type
+func IsValidAttributeType(t string) bool {
+	switch t {
+	case AttributeTypeText, AttributeTypeNumber, AttributeTypeBoolean, AttributeTypeEnum:
+		return true
+	}
+	return false
+}
+
+// AttributeDefinition declares an attribute that the products of a category and
+// of all its subcategories carry, such as a screen size in inches
+type AttributeDefinition struct {
+	CategoryID uuid.UUID `json:"category_id" db:"category_id"`
+	Name       string    `json:"name" db:"name"`
+	Type       string    `json:"type" db:"type"`
+	// Unit describes number values, e.g. "inches"
+	Unit string `json:"unit,omitempty" db:"unit"`
+	// Values lists the allowed values of an enum attribute
+	Values    []string  `json:"values,omitempty" db:"allowed_values"`
+	Required  bool      `json:"required" db:"required"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// AttributeSchema is every attribute the products of a category carry: those
+// defined on the category and those inherited from its ancestors
+type AttributeSchema []AttributeDefinition
+
+// Attribute returns the definition with the given name, if the schema has one
+func (s AttributeSchema) Attribute(name string) (AttributeDefinition, bool) {
+	for _, definition := range s {
+		if definition.Name == name {
+			return definition, true
+		}
+	}
+	return AttributeDefinition{}, false
+}
+
+// Validate checks product attribute values against the schema, returning a
+// description of every unknown, mistyped or missing required attribute
+func (s AttributeSchema) Validate(attributes ProductAttributes) []string {
+	var problems []string
+	for _, name := range attributes.Names() {
+		definition, ok := s.Attribute(name)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("attribute %s is not defined for the category", name))
+			continue
+		}
+		if problem := definition.check(attributes[name]); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	for _, definition := range s {
+		if _, ok := attributes[definition.Name]; definition.Required && !ok {
+			problems = append(problems, fmt.Sprintf("attribute %s is required", definition.Name))
+		}
+	}
+	return problems
+}
+
+// check returns the problem with a value for the attribute, or "" if it is valid
+func (d AttributeDefinition) check(value interface{}) string {
+	switch d.Type {
+	case AttributeTypeNumber:
+		if _, ok := value.(float64); !ok {
+			return fmt.Sprintf("attribute %s must be a number", d.Name)
+		}
+	case AttributeTypeBoolean:
+		if _, ok := value.(bool); !ok {
+			return fmt.Sprintf("attribute %s must be true or false", d.Name)
+		}
+	case AttributeTypeEnum:
+		if text, ok := value.(string); !ok || !slices.Contains(d.Values, text) {
+			return fmt.Sprintf("attribute %s must be one of %v", d.Name, d.Values)
+		}
+	default:
+		if _, ok := value.(string); !ok {
+			return fmt.Sprintf("attribute %s must be a string", d.Name)
+		}
+	}
+	return ""
+}
+
+// ProductAttributes maps attribute names to a product's values: strings for
+// text and enum attributes, float64 for numbers and bool for booleans
+type ProductAttributes map[string]interface{}
+
+// Names returns the attribute names in order
+func (a ProductAttributes) Names() []string {
+	names := make([]string, 0, len(a))
+	for name := range a {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Value stores the attributes as JSON
+func (a ProductAttributes) Value() (driver.Value, error) {
+	if a == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(a)
+}
+
+// Scan reads attributes stored as JSON
+func (a *ProductAttributes) Scan(src interface{}) error {
+	switch data := src.(type) {
+	case nil:
+		*a = ProductAttributes{}
+		return nil
+	case []byte:
+		return json.Unmarshal(data, a)
+	case string:
+		return json.Unmarshal([]byte(data), a)
+	}
+	return fmt.Errorf("cannot scan %T into ProductAttributes", src)
+}
+
+// AttributeFilter selects products by one attribute. Value matches the text
+// form of the value exactly; Min and Max bound a number attribute. A filter
+// with none of them set selects the products that have the attribute.
+type AttributeFilter struct {
+	Name  string
+	Value *string
+	Min   *float64
+	Max   *float64
+}
+
+// Matches reports whether a product's attributes pass the filter
+func (f AttributeFilter) Matches(attributes ProductAttributes) bool {
+	value, ok := attributes[f.Name]
+	if !ok {
+		return false
+	}
+	if f.Value != nil && AttributeText(value) != *f.Value {
+		return false
+	}
+	if f.Min != nil || f.Max != nil {
+		number, ok := value.(float64)
+		if !ok || (f.Min != nil && number < *f.Min) || (f.Max != nil && number > *f.Max) {
+			return false
+		}
+	}
+	return true
+}
+
+// AttributeText returns the text form of an attribute value that exact filters
+// compare against, e.g. "6.1" or "true"
+func AttributeText(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(value)
+}
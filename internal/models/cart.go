@@ -0,0 +1,82 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Cart is a customer's or an anonymous visitor's basket of products. Anonymous
+// carts have no customer and are accessed with their token.
+type Cart struct {
+	ID         uuid.UUID  `json:"id" db:"id"`
+	CustomerID *uuid.UUID `json:"customer_id" db:"customer_id"`
+	Token      string     `json:"token,omitempty" db:"token"`
+	Total      Money      `json:"total"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at" db:"updated_at"`
+	Items      []CartItem `json:"items"`
+}
+
+// CartItem is one product or product variant line in a cart. Prices are not
+// stored; they are taken from the product each time the cart is read.
+type CartItem struct {
+	ID        uuid.UUID       `json:"id" db:"id"`
+	CartID    uuid.UUID       `json:"cart_id" db:"cart_id"`
+	ProductID uuid.UUID       `json:"product_id" db:"product_id"`
+	VariantID *uuid.UUID      `json:"variant_id,omitempty" db:"variant_id"`
+	Quantity  int             `json:"quantity" db:"quantity"`
+	UnitPrice Money           `json:"unit_price"`
+	LineTotal Money           `json:"line_total"`
+	InStock   bool            `json:"in_stock"`
+	CreatedAt time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at" db:"updated_at"`
+	Product   Product         `json:"product"`
+	Variant   *ProductVariant `json:"variant,omitempty"`
+}
+
+// Reprice fills in each line's price and availability from its current product
+// or variant and recomputes the cart total
+func (c *Cart) Reprice() error {
+	c.Total = Money{}
+	for i := range c.Items {
+		item := &c.Items[i]
+		item.UnitPrice = item.Product.Price
+		item.InStock = item.Product.Stock >= item.Quantity
+		if item.Variant != nil {
+			item.UnitPrice = item.Variant.UnitPrice(item.Product.Price)
+			item.InStock = item.Variant.Stock >= item.Quantity
+		}
+		item.LineTotal = item.UnitPrice.Mul(item.Quantity)
+
+		total, err := c.Total.Add(item.LineTotal)
+		if err != nil {
+			return err
+		}
+		c.Total = total
+	}
+	if c.Total.Currency == "" {
+		c.Total.Currency = DefaultCurrency
+	}
+	return nil
+}
+
+// Item returns the cart line for a product and variant, if there is one. A nil
+// variantID names the line for the product itself.
+func (c *Cart) Item(productID uuid.UUID, variantID *uuid.UUID) (CartItem, bool) {
+	for _, item := range c.Items {
+		if item.ProductID == productID && SameVariant(item.VariantID, variantID) {
+			return item, true
+		}
+	}
+	return CartItem{}, false
+}
+
+// SameVariant reports whether two optional variant IDs name the same variant,
+// or are both unset
+func SameVariant(a, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
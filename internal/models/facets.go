@@ -0,0 +1,69 @@
+package models
+
+import "github.com/google/uuid"
+
+// MaxPriceBuckets limits how many price buckets a facet request may ask for
+const MaxPriceBuckets = 20
+
+// DefaultPriceBucketEdges are the lower bounds, in major units, of the price
+// buckets counted when a facet request does not choose its own
+var DefaultPriceBucketEdges = []string{"0", "500", "1000", "5000", "10000", "50000"}
+
+// ProductFacets summarises the products matching a listing filter so that a
+// storefront can render its filter options in one request
+type ProductFacets struct {
+	Total        int               `json:"total"`
+	Categories   []CategoryFacet   `json:"categories"`
+	PriceBuckets []PriceBucket     `json:"price_buckets"`
+	Availability AvailabilityFacet `json:"availability"`
+}
+
+// CategoryFacet counts the matching products in a category and all of its descendants
+type CategoryFacet struct {
+	CategoryID   uuid.UUID `json:"category_id" db:"category_id"`
+	CategoryName string    `json:"category_name" db:"category_name"`
+	Path         string    `json:"path" db:"path"`
+	Level        int       `json:"level" db:"level"`
+	ProductCount int       `json:"product_count" db:"product_count"`
+}
+
+// PriceBucket counts the matching products priced from Min up to, but not
+// including, Max. The last bucket has no Max.
+type PriceBucket struct {
+	Min          Money  `json:"min"`
+	Max          *Money `json:"max"`
+	ProductCount int    `json:"product_count"`
+}
+
+// AvailabilityFacet counts matching products with and without stock
+type AvailabilityFacet struct {
+	InStock    int `json:"in_stock"`
+	OutOfStock int `json:"out_of_stock"`
+}
+
+// NewPriceBuckets returns empty buckets bounded by ascending edges, all in the
+// same currency
+func NewPriceBuckets(edges []Money) []PriceBucket {
+	buckets := make([]PriceBucket, len(edges))
+	for i := range edges {
+		buckets[i].Min = edges[i]
+		if i+1 < len(edges) {
+			upper := edges[i+1]
+			buckets[i].Max = &upper
+		}
+	}
+	return buckets
+}
+
+// PriceBucketIndex returns the bucket a price falls in, or -1 if it is below
+// the first edge or in another currency
+func PriceBucketIndex(edges []Money, price Money) int {
+	index := -1
+	for i, edge := range edges {
+		if price.Currency != edge.Currency || price.Amount < edge.Amount {
+			break
+		}
+		index = i
+	}
+	return index
+}
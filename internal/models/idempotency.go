@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// IdempotencyRecord stores the outcome of a request made with an
+// Idempotency-Key header so that retries can be answered without repeating it.
+// A record with a zero StatusCode is still being processed.
+type IdempotencyRecord struct {
+	Key          string    `json:"key" db:"key"`
+	RequestHash  string    `json:"request_hash" db:"request_hash"`
+	StatusCode   int       `json:"status_code" db:"status_code"`
+	ContentType  string    `json:"content_type" db:"content_type"`
+	ResponseBody []byte    `json:"response_body" db:"response_body"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at" db:"expires_at"`
+}
+
+// Completed reports whether the original request has finished and its
+// response can be replayed
+func (r *IdempotencyRecord) Completed() bool {
+	return r.StatusCode != 0
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxProductImages is the number of images a product can have
+const MaxProductImages = 20
+
+// ProductImage is an uploaded product image and its thumbnail. A product's
+// images are shown in Position order, numbered from 1. The files are kept in
+// storage under StorageKey and ThumbnailKey; URL and ThumbnailURL are where
+// clients fetch them from, and are filled in from the keys on every response
+// since signed URLs expire.
+type ProductImage struct {
+	ID           uuid.UUID `json:"id" db:"id"`
+	ProductID    uuid.UUID `json:"product_id" db:"product_id"`
+	Position     int       `json:"position" db:"position"`
+	ContentType  string    `json:"content_type" db:"content_type"`
+	Size         int64     `json:"size" db:"size_bytes"`
+	Width        int       `json:"width" db:"width"`
+	Height       int       `json:"height" db:"height"`
+	StorageKey   string    `json:"-" db:"storage_key"`
+	ThumbnailKey string    `json:"-" db:"thumbnail_key"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
@@ -0,0 +1,60 @@
+package models
+
+import "encoding/json"
+
+// ProductRecordFields are the fields of a product import or export record, in
+// the order of the CSV columns
+var ProductRecordFields = []string{
+	"id", "name", "description", "price", "currency", "category_path", "stock", "image_url", "attributes",
+}
+
+// ProductRecord is one product in an import or export file. The category is
+// named by its path, such as "/Electronics/Phones", so that files can move
+// between installations, and the price is a decimal in major units.
+type ProductRecord struct {
+	ID           string            `json:"id,omitempty"`
+	Name         string            `json:"name"`
+	Description  string            `json:"description,omitempty"`
+	Price        json.Number       `json:"price"`
+	Currency     string            `json:"currency,omitempty"`
+	CategoryPath string            `json:"category_path"`
+	Stock        int               `json:"stock"`
+	ImageURL     string            `json:"image_url,omitempty"`
+	Attributes   ProductAttributes `json:"attributes,omitempty"`
+}
+
+// NewProductRecord returns the export record of a product
+func NewProductRecord(product Product) ProductRecord {
+	return ProductRecord{
+		ID:           product.ID.String(),
+		Name:         product.Name,
+		Description:  product.Description,
+		Price:        json.Number(product.Price.Decimal()),
+		Currency:     product.Price.Currency,
+		CategoryPath: product.Category.Path,
+		Stock:        product.Stock,
+		ImageURL:     product.ImageURL,
+		Attributes:   product.Attributes,
+	}
+}
+
+// ImportReport summarises a product import. Rows are numbered from 1 in file
+// order, not counting a CSV header or blank NDJSON lines.
+type ImportReport struct {
+	Rows              int `json:"rows"`
+	Created           int `json:"created"`
+	Updated           int `json:"updated"`
+	Failed            int `json:"failed"`
+	CategoriesCreated int `json:"categories_created"`
+	// Complete is false when the import stopped before the end of the file;
+	// the rows written before then are kept
+	Complete bool             `json:"complete"`
+	Errors   []ImportRowError `json:"errors"`
+}
+
+// ImportRowError describes a row that was not imported
+type ImportRowError struct {
+	Row   int    `json:"row"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
@@ -0,0 +1,362 @@
+package models
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Inventory movement types. Every change to the stock held at a warehouse is
+// recorded as a movement of one of these types.
+const (
+	// MovementInitial is stock a product or variant was created with, or held
+	// when inventory started being tracked per warehouse
+	MovementInitial = "initial"
+	// MovementAdjustment is a change to a product's or variant's stock total,
+	// or a manual correction of the stock at a warehouse
+	MovementAdjustment = "adjustment"
+	// MovementStockTake corrects the stock at a warehouse to a physical count
+	MovementStockTake = "stock_take"
+	// MovementDamage writes off damaged or lost stock
+	MovementDamage = "damage"
+	// MovementSale reserves stock for an order
+	MovementSale = "sale"
+	// MovementCancellation releases stock reserved for an order
+	MovementCancellation = "cancellation"
+	// MovementShipment takes reserved stock out of the warehouse when its order ships
+	MovementShipment = "shipment"
+	// MovementTransferOut and MovementTransferIn move stock between warehouses
+	MovementTransferOut = "transfer_out"
+	MovementTransferIn  = "transfer_in"
+)
+
+// AdjustmentReasons are the movement types a manual stock adjustment may be recorded as
+var AdjustmentReasons = []string{MovementAdjustment, MovementStockTake, MovementDamage}
+
+const (
+	// DefaultMovementLimit is how many inventory movements are listed when no limit is given
+	DefaultMovementLimit = 100
+	// MaxMovementLimit bounds the number of inventory movements listed at once
+	MaxMovementLimit = 1000
+	// MaxStockAlerts bounds the number of low-stock alerts listed at once
+	MaxStockAlerts = 1000
+)
+
+// earthRadiusKm is the mean radius of the Earth
+const earthRadiusKm = 6371.0
+
+// Location is a point on the Earth in decimal degrees
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Validate returns a description of every out of range coordinate
+func (l Location) Validate() []string {
+	var problems []string
+	if l.Latitude < -90 || l.Latitude > 90 {
+		problems = append(problems, "latitude must be between -90 and 90")
+	}
+	if l.Longitude < -180 || l.Longitude > 180 {
+		problems = append(problems, "longitude must be between -180 and 180")
+	}
+	return problems
+}
+
+// DistanceKm returns the great-circle distance to another location
+func (l Location) DistanceKm(other Location) float64 {
+	lat1, lat2 := l.Latitude*math.Pi/180, other.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (other.Longitude - l.Longitude) * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// Warehouse is a location holding stock. Orders take stock from active
+// warehouses only. Stock set through a product or variant is kept at the
+// default warehouse.
+type Warehouse struct {
+	ID        uuid.UUID `json:"id" db:"id"`
+	Code      string    `json:"code" db:"code"`
+	Name      string    `json:"name" db:"name"`
+	Location  *Location `json:"location,omitempty"`
+	Priority  int       `json:"priority" db:"priority"`
+	IsDefault bool      `json:"is_default" db:"is_default"`
+	Active    bool      `json:"active" db:"active"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// WarehouseRequest is the body of a request to create or replace a
+// warehouse. A missing active flag means active.
+type WarehouseRequest struct {
+	Code     string    `json:"code"`
+	Name     string    `json:"name"`
+	Location *Location `json:"location,omitempty"`
+	Priority int       `json:"priority"`
+	Active   *bool     `json:"active,omitempty"`
+}
+
+// InventoryLevel is the stock of a product, or of one of its variants, at a
+// warehouse. Reserved units belong to orders that have not shipped yet and are
+// still on hand; the rest are available to new orders.
+type InventoryLevel struct {
+	WarehouseID   uuid.UUID  `json:"warehouse_id" db:"warehouse_id"`
+	WarehouseCode string     `json:"warehouse_code"`
+	ProductID     uuid.UUID  `json:"product_id" db:"product_id"`
+	VariantID     *uuid.UUID `json:"variant_id,omitempty" db:"variant_id"`
+	OnHand        int        `json:"on_hand" db:"on_hand"`
+	Reserved      int        `json:"reserved" db:"reserved"`
+	Available     int        `json:"available"`
+	UpdatedAt     time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// InventoryMovement is one entry of the inventory ledger: a change to the
+// on-hand and reserved stock of a product or variant at a warehouse
+type InventoryMovement struct {
+	ID             uuid.UUID  `json:"id" db:"id"`
+	WarehouseID    uuid.UUID  `json:"warehouse_id" db:"warehouse_id"`
+	ProductID      uuid.UUID  `json:"product_id" db:"product_id"`
+	VariantID      *uuid.UUID `json:"variant_id,omitempty" db:"variant_id"`
+	Type           string     `json:"type" db:"type"`
+	OnHandChange   int        `json:"on_hand_change" db:"on_hand_change"`
+	ReservedChange int        `json:"reserved_change" db:"reserved_change"`
+	OrderID        *uuid.UUID `json:"order_id,omitempty" db:"order_id"`
+	TransferID     *uuid.UUID `json:"transfer_id,omitempty" db:"transfer_id"`
+	Note           string     `json:"note,omitempty" db:"note"`
+	CreatedBy      string     `json:"created_by" db:"created_by"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+}
+
+// AvailableChange returns the change the movement makes to the stock available
+// to new orders
+func (m InventoryMovement) AvailableChange() int {
+	return m.OnHandChange - m.ReservedChange
+}
+
+// StockTransfer moves available stock of a product or variant from one
+// warehouse to another
+type StockTransfer struct {
+	ID              uuid.UUID  `json:"id"`
+	FromWarehouseID uuid.UUID  `json:"from_warehouse_id"`
+	ToWarehouseID   uuid.UUID  `json:"to_warehouse_id"`
+	ProductID       uuid.UUID  `json:"product_id"`
+	VariantID       *uuid.UUID `json:"variant_id,omitempty"`
+	Quantity        int        `json:"quantity"`
+	Note            string     `json:"note,omitempty"`
+	CreatedBy       string     `json:"created_by"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// StockAdjustment is a manual change to the on-hand stock of a product or
+// variant at a warehouse, recorded in the inventory ledger as a movement of
+// type Reason. ID is the movement's; OnHand and Available are the stock left
+// at the warehouse afterwards.
+type StockAdjustment struct {
+	ID          uuid.UUID  `json:"id"`
+	WarehouseID uuid.UUID  `json:"warehouse_id"`
+	ProductID   uuid.UUID  `json:"product_id"`
+	VariantID   *uuid.UUID `json:"variant_id,omitempty"`
+	Change      int        `json:"change"`
+	Reason      string     `json:"reason"`
+	Note        string     `json:"note,omitempty"`
+	OnHand      int        `json:"on_hand"`
+	Available   int        `json:"available"`
+	CreatedBy   string     `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// InventoryFilter selects inventory levels or movements. Unset fields match
+// everything.
+type InventoryFilter struct {
+	WarehouseID *uuid.UUID
+	ProductID   *uuid.UUID
+	OrderID     *uuid.UUID
+	Limit       int
+}
+
+// OrderAllocation is the part of an order line reserved at one warehouse
+type OrderAllocation struct {
+	ID          uuid.UUID `json:"id" db:"id"`
+	OrderItemID uuid.UUID `json:"order_item_id" db:"order_item_id"`
+	WarehouseID uuid.UUID `json:"warehouse_id" db:"warehouse_id"`
+	Quantity    int       `json:"quantity" db:"quantity"`
+}
+
+// RankWarehouses orders warehouses by preference for supplying an order. With
+// a destination the nearest come first, followed by those without a location;
+// otherwise, and between warehouses the same distance away, the lowest
+// priority number comes first.
+func RankWarehouses(warehouses []Warehouse, shipTo *Location) {
+	distance := func(w Warehouse) float64 {
+		if shipTo == nil || w.Location == nil {
+			return math.Inf(1)
+		}
+		return shipTo.DistanceKm(*w.Location)
+	}
+	sort.SliceStable(warehouses, func(i, j int) bool {
+		if di, dj := distance(warehouses[i]), distance(warehouses[j]); di != dj {
+			return di < dj
+		}
+		if warehouses[i].Priority != warehouses[j].Priority {
+			return warehouses[i].Priority < warehouses[j].Priority
+		}
+		return warehouses[i].Code < warehouses[j].Code
+	})
+}
+
+// AllocateStock picks the warehouses an order line of quantity units is
+// reserved at, given the line's inventory levels in ranked order. The first
+// warehouse able to supply the whole line is preferred so that it ships in one
+// parcel; otherwise the line is split across warehouses in rank order. It
+// returns nil when the levels hold too little available stock.
+func AllocateStock(levels []InventoryLevel, quantity int) []OrderAllocation {
+	for _, level := range levels {
+		if level.Available >= quantity {
+			return []OrderAllocation{{WarehouseID: level.WarehouseID, Quantity: quantity}}
+		}
+	}
+
+	var allocations []OrderAllocation
+	remaining := quantity
+	for _, level := range levels {
+		if level.Available <= 0 {
+			continue
+		}
+		taken := min(level.Available, remaining)
+		allocations = append(allocations, OrderAllocation{WarehouseID: level.WarehouseID, Quantity: taken})
+		if remaining -= taken; remaining == 0 {
+			return allocations
+		}
+	}
+	return nil
+}
+
+// LevelReconciliation compares an inventory level with the on-hand and
+// reserved stock its movements in the ledger add up to
+type LevelReconciliation struct {
+	WarehouseID    uuid.UUID  `json:"warehouse_id"`
+	WarehouseCode  string     `json:"warehouse_code"`
+	ProductID      uuid.UUID  `json:"product_id"`
+	VariantID      *uuid.UUID `json:"variant_id,omitempty"`
+	OnHand         int        `json:"on_hand"`
+	Reserved       int        `json:"reserved"`
+	LedgerOnHand   int        `json:"ledger_on_hand"`
+	LedgerReserved int        `json:"ledger_reserved"`
+	Drift          bool       `json:"drift"`
+}
+
+// StockReconciliation compares the stock total of a product, or of one of its
+// variants, with the available stock its movements in the ledger add up to
+// over every warehouse
+type StockReconciliation struct {
+	ProductID   uuid.UUID  `json:"product_id"`
+	VariantID   *uuid.UUID `json:"variant_id,omitempty"`
+	Name        string     `json:"name"`
+	SKU         string     `json:"sku,omitempty"`
+	Stock       int        `json:"stock"`
+	LedgerStock int        `json:"ledger_stock"`
+	Drift       bool       `json:"drift"`
+}
+
+// ReconciliationReport recomputes stock from the inventory ledger and flags
+// every level and stock total that has drifted from it
+type ReconciliationReport struct {
+	GeneratedAt time.Time             `json:"generated_at"`
+	Drifted     int                   `json:"drifted"`
+	Levels      []LevelReconciliation `json:"levels"`
+	Stock       []StockReconciliation `json:"stock"`
+}
+
+// NewReconciliationReport flags the levels and stock totals that differ from
+// the ledger and counts them
+func NewReconciliationReport(levels []LevelReconciliation, stock []StockReconciliation, at time.Time) *ReconciliationReport {
+	report := &ReconciliationReport{GeneratedAt: at, Levels: levels, Stock: stock}
+	for i := range report.Levels {
+		level := &report.Levels[i]
+		level.Drift = level.OnHand != level.LedgerOnHand || level.Reserved != level.LedgerReserved
+		if level.Drift {
+			report.Drifted++
+		}
+	}
+	for i := range report.Stock {
+		item := &report.Stock[i]
+		item.Drift = item.Stock != item.LedgerStock
+		if item.Drift {
+			report.Drifted++
+		}
+	}
+	return report
+}
+
+// DriftOnly returns the report with only the levels and stock totals that
+// have drifted
+func (r ReconciliationReport) DriftOnly() *ReconciliationReport {
+	r.Levels = slices.DeleteFunc(slices.Clone(r.Levels), func(level LevelReconciliation) bool { return !level.Drift })
+	r.Stock = slices.DeleteFunc(slices.Clone(r.Stock), func(item StockReconciliation) bool { return !item.Drift })
+	return &r
+}
+
+// ReorderThreshold is the stock level at or below which a product is low on
+// stock. Its own threshold takes precedence over its category's, which is
+// inherited from the nearest ancestor category that has one; Effective is the
+// one that applies, nil when neither is set.
+type ReorderThreshold struct {
+	ProductID         uuid.UUID `json:"product_id"`
+	Threshold         *int      `json:"threshold"`
+	CategoryThreshold *int      `json:"category_threshold"`
+	Effective         *int      `json:"effective"`
+	Stock             int       `json:"stock"`
+}
+
+// NewReorderThreshold returns a product's thresholds with the one that applies
+func NewReorderThreshold(productID uuid.UUID, own, category *int, stock int) *ReorderThreshold {
+	effective := own
+	if effective == nil {
+		effective = category
+	}
+	return &ReorderThreshold{
+		ProductID:         productID,
+		Threshold:         own,
+		CategoryThreshold: category,
+		Effective:         effective,
+		Stock:             stock,
+	}
+}
+
+// CategoryReorderThreshold is the reorder threshold of a category's products
+// that have none of their own
+type CategoryReorderThreshold struct {
+	CategoryID uuid.UUID `json:"category_id"`
+	Threshold  *int      `json:"threshold"`
+}
+
+// ThresholdRequest is the body of a request to set a reorder threshold. A
+// null threshold clears it.
+type ThresholdRequest struct {
+	Threshold *int `json:"threshold"`
+}
+
+// StockAlert is raised when a product's stock falls to its reorder threshold,
+// and resolved when the stock rises above it again or the threshold is
+// cleared. Threshold and Stock are the values when it was raised. NotifiedAt
+// is set once the admin has been told.
+type StockAlert struct {
+	ID          uuid.UUID  `json:"id" db:"id"`
+	ProductID   uuid.UUID  `json:"product_id" db:"product_id"`
+	ProductName string     `json:"product_name"`
+	Threshold   int        `json:"threshold" db:"threshold"`
+	Stock       int        `json:"stock" db:"stock"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	NotifiedAt  *time.Time `json:"notified_at,omitempty" db:"notified_at"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty" db:"resolved_at"`
+}
+
+// IsOpen reports whether the alert has yet to be resolved
+func (a StockAlert) IsOpen() bool {
+	return a.ResolvedAt == nil
+}
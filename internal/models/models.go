@@ -8,12 +8,13 @@ import (
 
 // Customer represents a customer in the system
 type Customer struct {
-	ID        uuid.UUID `json:"id" db:"id"`
-	Email     string    `json:"email" db:"email"`
-	Name      string    `json:"name" db:"name"`
-	Phone     string    `json:"phone" db:"phone"`
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	ID        uuid.UUID  `json:"id" db:"id"`
+	Email     string     `json:"email" db:"email"`
+	Name      string     `json:"name" db:"name"`
+	Phone     string     `json:"phone" db:"phone"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" db:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
 }
 
 // Category represents a product category with hierarchical structure
@@ -26,7 +27,40 @@ type Category struct {
 	Path        string     `json:"path" db:"path"`
 	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
 	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
-	Children    []Category `json:"children,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	// ProductCount is set in category trees to the number of products in the
+	// category and all of its subcategories
+	ProductCount *int       `json:"product_count,omitempty" db:"product_count"`
+	Children     []Category `json:"children,omitempty"`
+}
+
+// CategoryTree nests categories ordered by path under their parents and
+// returns the categories whose parent is not among them
+func CategoryTree(categories []Category) []Category {
+	included := make(map[uuid.UUID]bool, len(categories))
+	children := make(map[uuid.UUID][]Category)
+	for _, category := range categories {
+		included[category.ID] = true
+		if category.ParentID != nil {
+			children[*category.ParentID] = append(children[*category.ParentID], category)
+		}
+	}
+
+	var nest func(category Category) Category
+	nest = func(category Category) Category {
+		for _, child := range children[category.ID] {
+			category.Children = append(category.Children, nest(child))
+		}
+		return category
+	}
+
+	roots := []Category{}
+	for _, category := range categories {
+		if category.ParentID == nil || !included[*category.ParentID] {
+			roots = append(roots, nest(category))
+		}
+	}
+	return roots
 }
 
 // Product represents a product in the system
@@ -34,41 +68,111 @@ type Product struct {
 	ID          uuid.UUID `json:"id" db:"id"`
 	Name        string    `json:"name" db:"name"`
 	Description string    `json:"description" db:"description"`
-	Price       float64   `json:"price" db:"price"`
+	Price       Money     `json:"price" db:"price"`
 	CategoryID  uuid.UUID `json:"category_id" db:"category_id"`
 	Stock       int       `json:"stock" db:"stock"`
 	ImageURL    string    `json:"image_url" db:"image_url"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
-	Category    Category  `json:"category"`
+	// Attributes holds values for the attributes defined by the category
+	Attributes ProductAttributes `json:"attributes,omitempty" db:"attributes"`
+	CreatedAt  time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at" db:"updated_at"`
+	DeletedAt  *time.Time        `json:"deleted_at,omitempty" db:"deleted_at"`
+	Category   Category          `json:"category"`
+	// MinPrice and MaxPrice span the prices of the product's variants
+	MinPrice *Money `json:"min_price,omitempty"`
+	MaxPrice *Money `json:"max_price,omitempty"`
+	// RegularPrice is set during a sale to the price the product returns to
+	// when the sale ends
+	RegularPrice *Money           `json:"regular_price,omitempty"`
+	Variants     []ProductVariant `json:"variants,omitempty"`
+}
+
+// ProductUpdate holds the product fields to change; nil fields are left unchanged
+type ProductUpdate struct {
+	Name        *string    `json:"name"`
+	Description *string    `json:"description"`
+	Price       *Money     `json:"price"`
+	CategoryID  *uuid.UUID `json:"category_id"`
+	Stock       *int       `json:"stock"`
+	ImageURL    *string    `json:"image_url"`
+	// Attributes replaces all of the product's attribute values
+	Attributes *ProductAttributes `json:"attributes"`
 }
 
-// Order represents an order in the system
+// Order represents an order in the system. Its stock is taken from the
+// warehouses nearest ShipTo when it has a destination.
 type Order struct {
 	ID         uuid.UUID   `json:"id" db:"id"`
 	CustomerID uuid.UUID   `json:"customer_id" db:"customer_id"`
 	Status     string      `json:"status" db:"status"`
-	Total      float64     `json:"total" db:"total"`
+	Total      Money       `json:"total" db:"total"`
 	CreatedAt  time.Time   `json:"created_at" db:"created_at"`
 	UpdatedAt  time.Time   `json:"updated_at" db:"updated_at"`
+	ShipTo     *Location   `json:"ship_to,omitempty"`
 	Customer   Customer    `json:"customer"`
 	Items      []OrderItem `json:"items,omitempty"`
 }
 
 // OrderItem represents an item in an order
 type OrderItem struct {
-	ID        uuid.UUID `json:"id" db:"id"`
-	OrderID   uuid.UUID `json:"order_id" db:"order_id"`
-	ProductID uuid.UUID `json:"product_id" db:"product_id"`
-	Quantity  int       `json:"quantity" db:"quantity"`
-	Price     float64   `json:"price" db:"price"`
-	Product   Product   `json:"product"`
+	ID                uuid.UUID         `json:"id" db:"id"`
+	OrderID           uuid.UUID         `json:"order_id" db:"order_id"`
+	ProductID         uuid.UUID         `json:"product_id" db:"product_id"`
+	VariantID         *uuid.UUID        `json:"variant_id,omitempty" db:"variant_id"`
+	Quantity          int               `json:"quantity" db:"quantity"`
+	CancelledQuantity int               `json:"cancelled_quantity" db:"cancelled_quantity"`
+	Price             Money             `json:"price" db:"price"`
+	Product           Product           `json:"product"`
+	Variant           *ProductVariant   `json:"variant,omitempty"`
+	Allocations       []OrderAllocation `json:"allocations,omitempty"`
+}
+
+// RemainingQuantity returns the ordered quantity that has not been cancelled
+func (i OrderItem) RemainingQuantity() int {
+	return i.Quantity - i.CancelledQuantity
 }
 
 // CategoryPrice represents average price for a category
 type CategoryPrice struct {
 	CategoryID   uuid.UUID `json:"category_id" db:"category_id"`
 	CategoryName string    `json:"category_name" db:"category_name"`
-	AveragePrice float64   `json:"average_price" db:"average_price"`
+	AveragePrice Money     `json:"average_price" db:"average_price"`
 	ProductCount int       `json:"product_count" db:"product_count"`
 }
+
+// CategoryStats summarises the products of a category that are priced in one
+// currency. Recursive stats also cover the products of all its subcategories.
+// The prices are nil when there are no such products.
+type CategoryStats struct {
+	CategoryID   uuid.UUID `json:"category_id"`
+	CategoryName string    `json:"category_name"`
+	Recursive    bool      `json:"recursive"`
+	Currency     string    `json:"currency"`
+	ProductCount int       `json:"product_count"`
+	AveragePrice *Money    `json:"average_price"`
+	MinPrice     *Money    `json:"min_price"`
+	MaxPrice     *Money    `json:"max_price"`
+	MedianPrice  *Money    `json:"median_price"`
+	// TotalStockValue sums price times stock, taken per variant for products
+	// with variants
+	TotalStockValue Money `json:"total_stock_value"`
+}
+
+// SetPrices sets the price statistics from amounts in the stats' currency,
+// leaving nil amounts unset
+func (s *CategoryStats) SetPrices(average, min, max, median *int64) {
+	for _, price := range []struct {
+		amount *int64
+		field  **Money
+	}{
+		{average, &s.AveragePrice},
+		{min, &s.MinPrice},
+		{max, &s.MaxPrice},
+		{median, &s.MedianPrice},
+	} {
+		if price.amount != nil {
+			money := NewMoney(*price.amount, s.Currency)
+			*price.field = &money
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the ISO 4217 code assumed when a price is given without one
+const DefaultCurrency = "KES"
+
+// currencyExponents lists the number of minor-unit digits for currencies that
+// do not use the usual two
+var currencyExponents = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"RWF": 0,
+	"UGX": 0,
+	"BHD": 3,
+	"KWD": 3,
+}
+
+// Money is an amount in integer minor units (e.g. cents) of an ISO 4217 currency.
+// Keeping amounts integral avoids the drift floating-point rounding causes when
+// prices are multiplied and summed.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// NewMoney creates a Money value from minor units
+func NewMoney(amount int64, currency string) Money {
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	return Money{Amount: amount, Currency: strings.ToUpper(currency)}
+}
+
+// CurrencyExponent returns the number of minor-unit digits of a currency
+func CurrencyExponent(currency string) int {
+	if exp, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+// ParseMoney parses a decimal string such as "999.99" into minor units without
+// going through floating point
+func ParseMoney(value, currency string) (Money, error) {
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	exp := CurrencyExponent(currency)
+
+	value = strings.TrimSpace(value)
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(value, "-")
+
+	whole, fraction, _ := strings.Cut(value, ".")
+	if whole == "" && fraction == "" {
+		return Money{}, fmt.Errorf("invalid amount %q", value)
+	}
+	if len(fraction) > exp {
+		return Money{}, fmt.Errorf("amount %q has more than %d decimal places for %s", value, exp, currency)
+	}
+	fraction += strings.Repeat("0", exp-len(fraction))
+
+	digits := whole + fraction
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return Money{}, fmt.Errorf("invalid amount %q", value)
+		}
+	}
+
+	amount, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("invalid amount %q: %w", value, err)
+	}
+	if negative {
+		amount = -amount
+	}
+	return NewMoney(amount, currency), nil
+}
+
+// Mul returns the amount multiplied by a quantity
+func (m Money) Mul(quantity int) Money {
+	return Money{Amount: m.Amount * int64(quantity), Currency: m.Currency}
+}
+
+// Add returns the sum of two amounts in the same currency. A zero value with no
+// currency adopts the currency of the other amount.
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency == "" {
+		m.Currency = other.Currency
+	}
+	if other.Currency != "" && m.Currency != other.Currency {
+		return Money{}, fmt.Errorf("cannot add %s to %s", other.Currency, m.Currency)
+	}
+	return Money{Amount: m.Amount + other.Amount, Currency: m.Currency}, nil
+}
+
+// IsNegative reports whether the amount is below zero
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+// Decimal formats the amount in major units, e.g. "999.99"
+func (m Money) Decimal() string {
+	exp := CurrencyExponent(m.Currency)
+
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	if exp == 0 {
+		return sign + strconv.FormatInt(amount, 10)
+	}
+
+	digits := fmt.Sprintf("%0*d", exp+1, amount)
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+// String formats the amount with its currency, e.g. "KES 999.99"
+func (m Money) String() string {
+	return m.Currency + " " + m.Decimal()
+}
+
+// UnmarshalJSON accepts {"amount": 99999, "currency": "KES"} as well as a plain
+// decimal number or string such as 999.99, which is read in the default currency
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	if len(data) > 0 && data[0] == '{' {
+		var raw struct {
+			Amount   int64  `json:"amount"`
+			Currency string `json:"currency"`
+		}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+		*m = NewMoney(raw.Amount, raw.Currency)
+		return nil
+	}
+
+	value := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+	}
+
+	parsed, err := ParseMoney(value, DefaultCurrency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Order statuses
+const (
+	OrderStatusPending    = "pending"
+	OrderStatusProcessing = "processing"
+	OrderStatusShipped    = "shipped"
+	OrderStatusDelivered  = "delivered"
+	OrderStatusCancelled  = "cancelled"
+)
+
+// orderTransitions lists the statuses an order may move to from each status.
+// Delivered and cancelled are terminal.
+var orderTransitions = map[string][]string{
+	OrderStatusPending:    {OrderStatusProcessing, OrderStatusCancelled},
+	OrderStatusProcessing: {OrderStatusShipped, OrderStatusCancelled},
+	OrderStatusShipped:    {OrderStatusDelivered},
+	OrderStatusDelivered:  {},
+	OrderStatusCancelled:  {},
+}
+
+// OrderStatusChange records a single status transition of an order
+type OrderStatusChange struct {
+	ID         uuid.UUID `json:"id" db:"id"`
+	OrderID    uuid.UUID `json:"order_id" db:"order_id"`
+	FromStatus string    `json:"from_status" db:"from_status"`
+	ToStatus   string    `json:"to_status" db:"to_status"`
+	ChangedBy  string    `json:"changed_by" db:"changed_by"`
+	Reason     string    `json:"reason,omitempty" db:"reason"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// OrderTransitionError reports a status change the state machine does not allow
+type OrderTransitionError struct {
+	From   string
+	To     string
+	Reason string
+}
+
+func (e *OrderTransitionError) Error() string {
+	return fmt.Sprintf("cannot change order status from %s to %s: %s", e.From, e.To, e.Reason)
+}
+
+// OrderItemCancellationError reports a line item cancellation that cannot be applied
+type OrderItemCancellationError struct {
+	ItemID uuid.UUID
+	Reason string
+}
+
+func (e *OrderItemCancellationError) Error() string {
+	return fmt.Sprintf("cannot cancel order item %s: %s", e.ItemID, e.Reason)
+}
+
+// IsValidOrderStatus reports whether status is a known order status
+func IsValidOrderStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+// ValidateOrderTransition checks that an order with itemCount items may move
+// from one status to another
+func ValidateOrderTransition(from, to string, itemCount int) error {
+	if !IsValidOrderStatus(to) {
+		return &OrderTransitionError{From: from, To: to, Reason: "unknown status"}
+	}
+	if !slices.Contains(orderTransitions[from], to) {
+		return &OrderTransitionError{From: from, To: to, Reason: "transition not allowed"}
+	}
+	if to == OrderStatusShipped && itemCount == 0 {
+		return &OrderTransitionError{From: from, To: to, Reason: "order has no items to ship"}
+	}
+	return nil
+}
+
+// OrderHoldsStock reports whether an order in status still holds the stock
+// reserved when it was placed. Shipped and delivered stock has left the
+// warehouse and cancelled stock has already been returned.
+func OrderHoldsStock(status string) bool {
+	return status == OrderStatusPending || status == OrderStatusProcessing
+}
+
+// TransitionRestocksInventory reports whether moving to a status returns the
+// order's reserved stock to inventory
+func TransitionRestocksInventory(to string) bool {
+	return to == OrderStatusCancelled
+}
+
+// TransitionShipsStock reports whether moving to a status takes the order's
+// reserved stock out of the warehouses holding it
+func TransitionShipsStock(to string) bool {
+	return to == OrderStatusShipped
+}
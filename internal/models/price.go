@@ -0,0 +1,95 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Sources of a price change
+const (
+	PriceSourceCreated     = "created"
+	PriceSourceUpdated     = "updated"
+	PriceSourceImported    = "imported"
+	PriceSourceScheduled   = "scheduled"
+	PriceSourceScheduleEnd = "schedule_ended"
+)
+
+// Price schedule statuses. A schedule is pending until it starts. One with an
+// end is active until then, when the price it replaced is restored; one
+// without is completed as soon as it starts. A schedule whose end passed
+// before it could start has expired without changing the price.
+const (
+	PriceSchedulePending   = "pending"
+	PriceScheduleActive    = "active"
+	PriceScheduleCompleted = "completed"
+	PriceScheduleCancelled = "cancelled"
+	PriceScheduleExpired   = "expired"
+)
+
+// PriceScheduleRequest is the body of a request to schedule a price change. A
+// missing start means now; a missing end makes the change permanent.
+type PriceScheduleRequest struct {
+	Price    Money      `json:"price"`
+	StartsAt *time.Time `json:"starts_at,omitempty"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
+}
+
+// PriceChange is one entry of a product's price history. OldPrice is nil for
+// the price the product was created with.
+type PriceChange struct {
+	ID         uuid.UUID  `json:"id" db:"id"`
+	ProductID  uuid.UUID  `json:"product_id" db:"product_id"`
+	OldPrice   *Money     `json:"old_price" db:"old_price"`
+	NewPrice   Money      `json:"new_price" db:"new_price"`
+	Source     string     `json:"source" db:"source"`
+	ScheduleID *uuid.UUID `json:"schedule_id,omitempty" db:"schedule_id"`
+	ChangedBy  string     `json:"changed_by" db:"changed_by"`
+	ChangedAt  time.Time  `json:"changed_at" db:"changed_at"`
+}
+
+// PriceSchedule is a price a product sells at from StartsAt. A schedule with
+// an EndsAt is a sale: the price the product had before it, PreviousPrice, is
+// restored when it ends. One without is a permanent change.
+type PriceSchedule struct {
+	ID            uuid.UUID  `json:"id" db:"id"`
+	ProductID     uuid.UUID  `json:"product_id" db:"product_id"`
+	Price         Money      `json:"price" db:"price"`
+	StartsAt      time.Time  `json:"starts_at" db:"starts_at"`
+	EndsAt        *time.Time `json:"ends_at,omitempty" db:"ends_at"`
+	Status        string     `json:"status" db:"status"`
+	PreviousPrice *Money     `json:"previous_price,omitempty" db:"previous_price"`
+	CreatedBy     string     `json:"created_by" db:"created_by"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// IsOpen reports whether the schedule has yet to start or end
+func (s PriceSchedule) IsOpen() bool {
+	return s.Status == PriceSchedulePending || s.Status == PriceScheduleActive
+}
+
+// Overlaps reports whether two schedules would have the product's price at
+// the same time. A permanent change takes the instant it starts, so it clashes
+// with a sale running then or another change at the same time.
+func (s PriceSchedule) Overlaps(other PriceSchedule) bool {
+	return s.StartsAt.Before(other.end()) && other.StartsAt.Before(s.end())
+}
+
+// end is the exclusive end of the time the schedule holds the price
+func (s PriceSchedule) end() time.Time {
+	if s.EndsAt != nil {
+		return *s.EndsAt
+	}
+	return s.StartsAt.Add(time.Microsecond)
+}
+
+// PriceTimeline is a product's current price with the changes that led to it
+// and its price schedules. RegularPrice is set while a sale holds the price.
+type PriceTimeline struct {
+	ProductID    uuid.UUID       `json:"product_id"`
+	Price        Money           `json:"price"`
+	RegularPrice *Money          `json:"regular_price,omitempty"`
+	History      []PriceChange   `json:"history"`
+	Schedules    []PriceSchedule `json:"schedules"`
+}
@@ -0,0 +1,130 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Product listing sort orders
+const (
+	ProductSortName      = "name"
+	ProductSortPriceAsc  = "price_asc"
+	ProductSortPriceDesc = "price_desc"
+	ProductSortNewest    = "newest"
+)
+
+// Product listing page sizes
+const (
+	DefaultProductPageSize = 20
+	MaxProductPageSize     = 100
+)
+
+// ErrInvalidCursor is returned for a cursor that is malformed or was issued for a different sort
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ProductFilter selects, orders and pages a product listing
+type ProductFilter struct {
+	// CategoryID limits the listing to a category and its descendants
+	CategoryID *uuid.UUID
+	// MinPrice and MaxPrice bound the price; when set, only products priced
+	// in their currency are listed
+	MinPrice *Money
+	MaxPrice *Money
+	InStock  bool
+	// Attributes must all match
+	Attributes []AttributeFilter
+	Sort       string
+	Limit      int
+	Cursor     *ProductCursor
+}
+
+// ProductPage is one page of a product listing. NextCursor is empty on the last page.
+type ProductPage struct {
+	Products   []Product `json:"products"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// ProductCursor marks the last product of a page so the next page can resume
+// after it. It holds every sortable field so one format serves all sort orders.
+type ProductCursor struct {
+	Sort      string    `json:"s"`
+	ID        uuid.UUID `json:"id"`
+	Name      string    `json:"n,omitempty"`
+	Price     int64     `json:"p,omitempty"`
+	CreatedAt time.Time `json:"c,omitempty"`
+}
+
+// IsValidProductSort reports whether sort is a known product sort order
+func IsValidProductSort(sort string) bool {
+	switch sort {
+	case ProductSortName, ProductSortPriceAsc, ProductSortPriceDesc, ProductSortNewest:
+		return true
+	}
+	return false
+}
+
+// NewProductCursor returns the cursor that resumes a listing after product
+func NewProductCursor(sort string, product Product) *ProductCursor {
+	return &ProductCursor{
+		Sort:      sort,
+		ID:        product.ID,
+		Name:      product.Name,
+		Price:     product.Price.Amount,
+		CreatedAt: product.CreatedAt,
+	}
+}
+
+// Encode returns the opaque string form of the cursor
+func (c *ProductCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeProductCursor parses a cursor returned by Encode
+func DecodeProductCursor(value string) (*ProductCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var cursor ProductCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || !IsValidProductSort(cursor.Sort) || cursor.ID == uuid.Nil {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// After reports whether product sorts after the cursor position
+func (c *ProductCursor) After(product Product) bool {
+	switch c.Sort {
+	case ProductSortPriceAsc:
+		if product.Price.Amount != c.Price {
+			return product.Price.Amount > c.Price
+		}
+	case ProductSortPriceDesc:
+		if product.Price.Amount != c.Price {
+			return product.Price.Amount < c.Price
+		}
+		return product.ID.String() < c.ID.String()
+	case ProductSortNewest:
+		if !product.CreatedAt.Equal(c.CreatedAt) {
+			return product.CreatedAt.Before(c.CreatedAt)
+		}
+		return product.ID.String() < c.ID.String()
+	default:
+		if product.Name != c.Name {
+			return product.Name > c.Name
+		}
+	}
+	return product.ID.String() > c.ID.String()
+}
+
+// ProductLess orders two products by sort, breaking ties on ID in the same
+// direction as the sort so that cursors stay stable
+func ProductLess(sort string, a, b Product) bool {
+	return NewProductCursor(sort, a).After(b)
+}
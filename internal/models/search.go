@@ -0,0 +1,57 @@
+package models
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Search limits
+const (
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+	maxSearchTerms     = 10
+)
+
+// Highlight markers placed around matched terms
+const (
+	HighlightStart = "<mark>"
+	HighlightStop  = "</mark>"
+)
+
+// ProductSearchResult is a product matching a search, with its relevance and
+// the matched terms highlighted
+type ProductSearchResult struct {
+	Product
+	Rank       float64          `json:"rank"`
+	Highlights SearchHighlights `json:"highlights"`
+}
+
+// SearchHighlights holds HTML-escaped product text with matched terms wrapped
+// in <mark> tags
+type SearchHighlights struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// SearchTerms splits a search query into lower-cased words of letters and
+// digits, dropping punctuation and repeats. Each term is matched as a prefix
+// so that partially typed words find results.
+func SearchTerms(query string) []string {
+	words := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var terms []string
+	seen := make(map[string]bool)
+	for _, word := range words {
+		if seen[word] {
+			continue
+		}
+		seen[word] = true
+		terms = append(terms, word)
+		if len(terms) == maxSearchTerms {
+			break
+		}
+	}
+	return terms
+}
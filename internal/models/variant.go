@@ -0,0 +1,86 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ProductVariant is one purchasable version of a product, such as a size and
+// colour, identified by its SKU. A product with variants is ordered by
+// variant, and its stock is the total of its variants' stock.
+type ProductVariant struct {
+	ID        uuid.UUID      `json:"id" db:"id"`
+	ProductID uuid.UUID      `json:"product_id" db:"product_id"`
+	SKU       string         `json:"sku" db:"sku"`
+	Options   VariantOptions `json:"options" db:"options"`
+	// Price overrides the product's price when set
+	Price     *Money    `json:"price,omitempty" db:"price"`
+	Stock     int       `json:"stock" db:"stock"`
+	ImageURL  string    `json:"image_url" db:"image_url"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// VariantOptions maps option names to the variant's values, e.g. {"size": "M"}
+type VariantOptions map[string]string
+
+// Value stores the options as JSON
+func (o VariantOptions) Value() (driver.Value, error) {
+	if o == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(o)
+}
+
+// Scan reads options stored as JSON
+func (o *VariantOptions) Scan(src interface{}) error {
+	switch data := src.(type) {
+	case nil:
+		*o = VariantOptions{}
+		return nil
+	case []byte:
+		return json.Unmarshal(data, o)
+	case string:
+		return json.Unmarshal([]byte(data), o)
+	}
+	return fmt.Errorf("cannot scan %T into VariantOptions", src)
+}
+
+// UnitPrice returns the price the variant sells at: its own price, or the
+// product's price when it has none
+func (v ProductVariant) UnitPrice(productPrice Money) Money {
+	if v.Price != nil {
+		return *v.Price
+	}
+	return productPrice
+}
+
+// Variant returns the product's variant with the given ID, if it has one
+func (p Product) Variant(id uuid.UUID) (ProductVariant, bool) {
+	for _, variant := range p.Variants {
+		if variant.ID == id {
+			return variant, true
+		}
+	}
+	return ProductVariant{}, false
+}
+
+// SetPriceRange sets the product's lowest and highest selling price across
+// variants, which is its own price when it has no variants
+func (p *Product) SetPriceRange(variants []ProductVariant) {
+	minPrice, maxPrice := p.Price, p.Price
+	for i, variant := range variants {
+		price := variant.UnitPrice(p.Price)
+		if i == 0 || price.Amount < minPrice.Amount {
+			minPrice = price
+		}
+		if i == 0 || price.Amount > maxPrice.Amount {
+			maxPrice = price
+		}
+	}
+	p.MinPrice, p.MaxPrice = &minPrice, &maxPrice
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/smtp"
 	"strings"
+
+	"commerce-app/internal/models"
 )
 
 // EmailService handles email notifications
@@ -54,7 +56,7 @@ func (e *EmailService) SendEmail(to, subject, body string) error {
 }
 
 // SendOrderNotificationToAdmin sends an order notification to the administrator
-func (e *EmailService) SendOrderNotificationToAdmin(orderID, customerName, customerEmail, customerPhone string, total float64, items []string) error {
+func (e *EmailService) SendOrderNotificationToAdmin(orderID, customerName, customerEmail, customerPhone string, total models.Money, items []string) error {
 	subject := fmt.Sprintf("New Order Placed - Order #%s", orderID)
 
 	body := fmt.Sprintf(`
@@ -65,7 +67,7 @@ Order Details:
 - Customer Name: %s
 - Customer Email: %s
 - Customer Phone: %s
-- Total Amount: $%.2f
+- Total Amount: %s
 
 Order Items:
 %s
@@ -75,3 +77,23 @@ Please process this order as soon as possible.
 
 	return e.SendEmail(e.AdminEmail, subject, body)
 }
+
+// SendLowStockNotificationToAdmin tells the administrator that a product has
+// fallen to its reorder threshold
+func (e *EmailService) SendLowStockNotificationToAdmin(productID, productName string, stock, threshold int) error {
+	subject := fmt.Sprintf("Low Stock - %s", productName)
+
+	body := fmt.Sprintf(`
+A product is running low on stock!
+
+Product Details:
+- Product ID: %s
+- Product Name: %s
+- Stock Left: %d
+- Reorder Threshold: %d
+
+Please reorder this product before it runs out.
+`, productID, productName, stock, threshold)
+
+	return e.SendEmail(e.AdminEmail, subject, body)
+}
@@ -0,0 +1,37 @@
+package notifications
+
+import (
+	"errors"
+	"fmt"
+
+	"commerce-app/internal/models"
+)
+
+// LowStockNotifier tells the administrator about low-stock alerts by email and SMS
+type LowStockNotifier struct {
+	Email *EmailService
+	SMS   *SMSService
+}
+
+// NewLowStockNotifier creates a low-stock notifier sending through new email and SMS services
+func NewLowStockNotifier() *LowStockNotifier {
+	return &LowStockNotifier{
+		Email: NewEmailService(),
+		SMS:   NewSMSService(),
+	}
+}
+
+// NotifyLowStock sends an alert by email and SMS. It fails only when neither
+// was sent, so that the alert is retried only if the administrator never
+// heard about it.
+func (n *LowStockNotifier) NotifyLowStock(alert models.StockAlert) error {
+	emailErr := n.Email.SendLowStockNotificationToAdmin(alert.ProductID.String(), alert.ProductName, alert.Stock, alert.Threshold)
+	smsErr := n.SMS.SendLowStockNotification(alert.ProductName, alert.Stock, alert.Threshold)
+	switch {
+	case emailErr != nil && smsErr != nil:
+		return errors.Join(emailErr, smsErr)
+	case emailErr != nil:
+		fmt.Printf("Failed to send low stock email: %v\n", emailErr)
+	}
+	return nil
+}
@@ -34,6 +34,17 @@ func NewSMSService() *SMSService {
 
 // SendOrderNotification sends an SMS notification for a new order
 func (s *SMSService) SendOrderNotification(message string) error {
+	return s.send(message)
+}
+
+// SendLowStockNotification sends an SMS notification for a product that has
+// fallen to its reorder threshold
+func (s *SMSService) SendLowStockNotification(productName string, stock, threshold int) error {
+	return s.send(fmt.Sprintf("Low stock: %s has %d left (reorder threshold %d)", productName, stock, threshold))
+}
+
+// send sends an SMS to the recipient
+func (s *SMSService) send(message string) error {
 
 	env := "sandbox"
 
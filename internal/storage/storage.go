@@ -0,0 +1,111 @@
+// Package storage keeps uploaded files such as product images
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLocalDir     = "uploads"
+	defaultLocalBaseURL = "/api/images"
+	defaultS3Region     = "us-east-1"
+	defaultS3URLExpiry  = 15 * time.Minute
+)
+
+// ErrNotFound is returned for a key that holds no file
+var ErrNotFound = errors.New("file not found")
+
+// ErrInvalidKey is returned for a key that is not a relative slash-separated path
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// Storage stores files under slash-separated keys such as
+// "products/<product id>/<image id>.jpg"
+type Storage interface {
+	// Put stores data under key, replacing any file already there
+	Put(ctx context.Context, key, contentType string, data []byte) error
+	// Get opens the file stored under key
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the file stored under key. Deleting a missing file is
+	// not an error.
+	Delete(ctx context.Context, key string) error
+	// URL returns the address clients fetch the file from, signed when the
+	// files are private
+	URL(ctx context.Context, key string) (string, error)
+}
+
+// NewFromEnv returns the storage selected by IMAGE_STORAGE: "local", the
+// default, keeps files under IMAGE_STORAGE_DIR and "s3" keeps them in an
+// S3-compatible bucket configured by the S3_* variables
+func NewFromEnv() (Storage, error) {
+	switch backend := getEnv("IMAGE_STORAGE", "local"); backend {
+	case "local":
+		return NewLocalStorage(getEnv("IMAGE_STORAGE_DIR", defaultLocalDir), defaultLocalBaseURL), nil
+	case "s3":
+		return s3StorageFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown IMAGE_STORAGE %q: use local or s3", backend)
+	}
+}
+
+func s3StorageFromEnv() (*S3Storage, error) {
+	s := &S3Storage{
+		Endpoint:  strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+		Region:    getEnv("S3_REGION", defaultS3Region),
+		Bucket:    os.Getenv("S3_BUCKET"),
+		AccessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		URLExpiry: defaultS3URLExpiry,
+	}
+
+	var missing []string
+	for _, setting := range []struct{ name, value string }{
+		{"S3_ENDPOINT", s.Endpoint},
+		{"S3_BUCKET", s.Bucket},
+		{"S3_ACCESS_KEY_ID", s.AccessKey},
+		{"S3_SECRET_ACCESS_KEY", s.SecretKey},
+	} {
+		if setting.value == "" {
+			missing = append(missing, setting.name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("s3 image storage needs %s", strings.Join(missing, ", "))
+	}
+
+	if value := os.Getenv("S3_URL_EXPIRY"); value != "" {
+		expiry, err := time.ParseDuration(value)
+		if err != nil || expiry <= 0 || expiry > 7*24*time.Hour {
+			return nil, fmt.Errorf("invalid S3_URL_EXPIRY %q: must be a duration of at most 168h", value)
+		}
+		s.URLExpiry = expiry
+	}
+	return s, nil
+}
+
+// validKey reports whether key is a relative slash-separated path without
+// empty, "." or ".." segments
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.Contains(segment, `\`) {
+			return false
+		}
+	}
+	return true
+}
+
+// getEnv gets environment variable with fallback
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
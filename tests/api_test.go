@@ -1,9 +1,13 @@
 package tests
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
+	"sync"
 	"testing"
 
 	"commerce-app/internal/database"
@@ -21,8 +25,7 @@ func TestCustomerRoutes(t *testing.T) {
 
 	t.Run("CreateCustomer", func(t *testing.T) {
 
-		var customerRepo *database.CustomerRepository
-		customerRepo = &database.CustomerRepository{}
+		customerRepo := ts.Repos.Customers
 
 		customerData := GetTestUserDetails()
 
@@ -36,7 +39,7 @@ func TestCustomerRoutes(t *testing.T) {
 		assert.Equal(t, customerData.Phone, customer.Phone)
 
 		// Clean Up
-		err := customerRepo.Delete(customer.ID)
+		err := customerRepo.Delete(context.Background(), customer.ID)
 		assert.NoError(t, err)
 
 	})
@@ -61,8 +64,7 @@ func TestCustomerRoutes(t *testing.T) {
 	})
 
 	t.Run("GetCustomer", func(t *testing.T) {
-		var customerRepo *database.CustomerRepository
-		customerRepo = &database.CustomerRepository{}
+		customerRepo := ts.Repos.Customers
 
 		customer, token := ts.GetTestCustomer(t)
 
@@ -85,7 +87,7 @@ func TestCustomerRoutes(t *testing.T) {
 		assert.Equal(t, customer.Phone, retrievedCustomer.Phone)
 
 		// Clean up
-		err = customerRepo.Delete(customer.ID)
+		err = customerRepo.Delete(context.Background(), customer.ID)
 		assert.NoError(t, err)
 	})
 
@@ -111,8 +113,7 @@ func TestCategoryRoutes(t *testing.T) {
 
 	t.Run("CreateCategory", func(t *testing.T) {
 
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
+		categoryRepo := ts.Repos.Categories
 
 		categoryData := map[string]string{
 			"name":        "Test Category",
@@ -134,14 +135,23 @@ func TestCategoryRoutes(t *testing.T) {
 		assert.Equal(t, "/Test Category", category.Path)
 
 		//Clean up the created category
-		err = categoryRepo.Delete(category.ID, 0)
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
 		assert.NoError(t, err)
 	})
 
+	t.Run("CreateCategoryInvalidName", func(t *testing.T) {
+		// Category paths are separated by "/", so names cannot contain it
+		for _, name := range []string{"", "   ", "Phones/Tablets", strings.Repeat("x", 256)} {
+			resp := MakeRequest(t, ts, "POST", "/api/categories", map[string]string{"name": name}, nil)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+		}
+	})
+
 	t.Run("CreateSubCategory", func(t *testing.T) {
 
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
+		categoryRepo := ts.Repos.Categories
 
 		parentCategory := CreateTestCategory(t, ts, nil)
 
@@ -165,18 +175,17 @@ func TestCategoryRoutes(t *testing.T) {
 		assert.Equal(t, parentCategory.Path+"/Test Subcategory", category.Path)
 
 		//Clean up the created parent category
-		err = categoryRepo.Delete(parentCategory.ID, 0)
+		err = categoryRepo.Delete(context.Background(), parentCategory.ID, 0)
 		assert.NoError(t, err)
 
 		//Clean up the created subcategory
-		err = categoryRepo.Delete(category.ID, 1)
+		err = categoryRepo.Delete(context.Background(), category.ID, 1)
 		assert.NoError(t, err)
 	})
 
 	t.Run("GetAllCategories", func(t *testing.T) {
 
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
+		categoryRepo := ts.Repos.Categories
 
 		createdCategory := CreateTestCategory(t, ts, nil)
 
@@ -192,7 +201,7 @@ func TestCategoryRoutes(t *testing.T) {
 		assert.Greater(t, len(categories), 0)
 
 		//Clean up the created category
-		err = categoryRepo.Delete(createdCategory.ID, 0)
+		err = categoryRepo.Delete(context.Background(), createdCategory.ID, 0)
 		assert.NoError(t, err)
 	})
 
@@ -214,8 +223,7 @@ func TestCategoryRoutes(t *testing.T) {
 
 	t.Run("GetCategoryChildren", func(t *testing.T) {
 
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
+		categoryRepo := ts.Repos.Categories
 
 		parentCategory := CreateTestCategory(t, ts, nil)
 		childCategory := CreateTestCategory(t, ts, &parentCategory.ID)
@@ -232,11 +240,239 @@ func TestCategoryRoutes(t *testing.T) {
 		assert.Greater(t, len(children), 0)
 
 		// Clean Up Parent Category
-		err = categoryRepo.Delete(parentCategory.ID, 0)
+		err = categoryRepo.Delete(context.Background(), parentCategory.ID, 0)
 		assert.NoError(t, err)
 
 		// Clean Up Child Category
-		err = categoryRepo.Delete(childCategory.ID, 1)
+		err = categoryRepo.Delete(context.Background(), childCategory.ID, 1)
+		assert.NoError(t, err)
+	})
+
+	t.Run("GetCategoryTree", func(t *testing.T) {
+
+		categoryRepo := ts.Repos.Categories
+
+		root := CreateTestCategory(t, ts, nil)
+		child := CreateTestCategory(t, ts, &root.ID)
+		grandchild := CreateTestCategory(t, ts, &child.ID)
+		CreateTestProduct(t, ts, root.ID)
+		CreateTestProduct(t, ts, grandchild.ID)
+		CreateTestProduct(t, ts, grandchild.ID)
+
+		resp := MakeRequest(t, ts, "GET", "/api/categories/tree?root="+root.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var tree []models.Category
+		err := json.NewDecoder(resp.Body).Decode(&tree)
+		assert.NoError(t, err)
+		if assert.Len(t, tree, 1) && assert.Len(t, tree[0].Children, 1) && assert.Len(t, tree[0].Children[0].Children, 1) {
+			assert.Equal(t, root.ID, tree[0].ID)
+			assert.Equal(t, 3, *tree[0].ProductCount)
+			assert.Equal(t, child.ID, tree[0].Children[0].ID)
+			assert.Equal(t, 2, *tree[0].Children[0].ProductCount)
+			assert.Equal(t, grandchild.ID, tree[0].Children[0].Children[0].ID)
+			assert.Empty(t, tree[0].Children[0].Children[0].Children)
+		}
+
+		// The depth counts the levels below the root
+		resp = MakeRequest(t, ts, "GET", "/api/categories/tree?depth=1&root="+root.ID.String(), nil, nil)
+		defer resp.Body.Close()
+
+		tree = nil
+		err = json.NewDecoder(resp.Body).Decode(&tree)
+		assert.NoError(t, err)
+		if assert.Len(t, tree, 1) && assert.Len(t, tree[0].Children, 1) {
+			assert.Empty(t, tree[0].Children[0].Children)
+			assert.Equal(t, 2, *tree[0].Children[0].ProductCount)
+		}
+
+		resp = MakeRequest(t, ts, "GET", "/api/categories/tree?depth=0", nil, nil)
+		defer resp.Body.Close()
+
+		tree = nil
+		err = json.NewDecoder(resp.Body).Decode(&tree)
+		assert.NoError(t, err)
+		for _, category := range tree {
+			assert.Equal(t, 0, category.Level)
+			assert.Empty(t, category.Children)
+		}
+
+		resp = MakeRequest(t, ts, "GET", "/api/categories/tree?depth=-1", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", "/api/categories/tree?root="+uuid.New().String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), root.ID, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("GetCategoryStats", func(t *testing.T) {
+
+		categoryRepo := ts.Repos.Categories
+
+		parent := CreateTestCategory(t, ts, nil)
+		child := CreateTestCategory(t, ts, &parent.ID)
+		resp := MakeRequest(t, ts, "POST", "/api/categories", map[string]string{"name": "Empty Category"}, nil)
+		defer resp.Body.Close()
+
+		var empty models.Category
+		err := json.NewDecoder(resp.Body).Decode(&empty)
+		assert.NoError(t, err)
+
+		for _, product := range []map[string]interface{}{
+			{"category_id": parent.ID, "price": 10, "stock": 2},
+			{"category_id": child.ID, "price": 20, "stock": 1},
+			{"category_id": child.ID, "price": 40, "stock": 0},
+			{"category_id": child.ID, "price": map[string]interface{}{"amount": 500, "currency": "USD"}, "stock": 3},
+		} {
+			product["name"] = "Stats Product"
+			resp := MakeRequest(t, ts, "POST", "/api/products", product, nil)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		}
+
+		getStats := func(path string) models.CategoryStats {
+			resp := MakeRequest(t, ts, "GET", path, nil, nil)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			var stats models.CategoryStats
+			err := json.NewDecoder(resp.Body).Decode(&stats)
+			assert.NoError(t, err)
+			return stats
+		}
+
+		statsPath := "/api/categories/" + parent.ID.String() + "/stats"
+		stats := getStats(statsPath)
+		assert.True(t, stats.Recursive)
+		assert.Equal(t, models.DefaultCurrency, stats.Currency)
+		assert.Equal(t, 3, stats.ProductCount)
+		if assert.NotNil(t, stats.AveragePrice) && assert.NotNil(t, stats.MedianPrice) {
+			assert.Equal(t, int64(2333), stats.AveragePrice.Amount)
+			assert.Equal(t, int64(1000), stats.MinPrice.Amount)
+			assert.Equal(t, int64(4000), stats.MaxPrice.Amount)
+			assert.Equal(t, int64(2000), stats.MedianPrice.Amount)
+		}
+		assert.Equal(t, int64(4000), stats.TotalStockValue.Amount)
+
+		stats = getStats(statsPath + "?recursive=false")
+		assert.False(t, stats.Recursive)
+		assert.Equal(t, 1, stats.ProductCount)
+		if assert.NotNil(t, stats.MedianPrice) {
+			assert.Equal(t, int64(1000), stats.MedianPrice.Amount)
+		}
+
+		stats = getStats("/api/categories/" + child.ID.String() + "/stats?currency=usd")
+		assert.Equal(t, "USD", stats.Currency)
+		assert.Equal(t, 1, stats.ProductCount)
+		assert.Equal(t, int64(1500), stats.TotalStockValue.Amount)
+
+		stats = getStats("/api/categories/" + empty.ID.String() + "/stats")
+		assert.Equal(t, 0, stats.ProductCount)
+		assert.Nil(t, stats.AveragePrice)
+		assert.Nil(t, stats.MedianPrice)
+
+		resp = MakeRequest(t, ts, "GET", statsPath+"?recursive=maybe", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", "/api/categories/"+uuid.New().String()+"/stats", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		//cleanup
+		for _, id := range []uuid.UUID{parent.ID, empty.ID} {
+			err = categoryRepo.Delete(context.Background(), id, 0)
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("MoveCategory", func(t *testing.T) {
+
+		categoryRepo := ts.Repos.Categories
+
+		oldParent := CreateTestCategory(t, ts, nil)
+		newParent := CreateTestCategory(t, ts, nil)
+		category := CreateTestCategory(t, ts, &oldParent.ID)
+		child := CreateTestCategory(t, ts, &category.ID)
+		categoryPath := "/api/categories/" + category.ID.String()
+
+		resp := MakeRequest(t, ts, "PUT", categoryPath, map[string]interface{}{
+			"name": "Moved Category", "description": "Moved", "parent_id": newParent.ID,
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var moved models.Category
+		err := json.NewDecoder(resp.Body).Decode(&moved)
+		assert.NoError(t, err)
+		assert.Equal(t, "Moved Category", moved.Name)
+		assert.Equal(t, newParent.Path+"/Moved Category", moved.Path)
+		assert.Equal(t, 1, moved.Level)
+
+		// The subtree follows the category
+		resp = MakeRequest(t, ts, "GET", "/api/categories/"+child.ID.String(), nil, nil)
+		defer resp.Body.Close()
+
+		var movedChild models.Category
+		err = json.NewDecoder(resp.Body).Decode(&movedChild)
+		assert.NoError(t, err)
+		assert.Equal(t, moved.Path+"/"+child.Name, movedChild.Path)
+		assert.Equal(t, 2, movedChild.Level)
+
+		// A category cannot move under itself or its subcategories
+		for _, parentID := range []uuid.UUID{category.ID, child.ID} {
+			resp = MakeRequest(t, ts, "PUT", categoryPath, map[string]interface{}{
+				"name": "Moved Category", "parent_id": parentID,
+			}, nil)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusConflict, resp.StatusCode)
+		}
+
+		resp = MakeRequest(t, ts, "PUT", "/api/categories/"+newParent.ID.String(), map[string]interface{}{
+			"name": newParent.Name, "parent_id": child.ID,
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "PUT", categoryPath, map[string]interface{}{"name": "a/b"}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "PUT", categoryPath, map[string]interface{}{
+			"name": "Moved Category", "parent_id": uuid.New(),
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "PUT", "/api/categories/"+uuid.New().String(), map[string]interface{}{"name": "Missing"}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		// Without a parent the category moves to the top of the tree
+		resp = MakeRequest(t, ts, "PUT", categoryPath, map[string]interface{}{"name": "Top Category"}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", "/api/categories/"+child.ID.String(), nil, nil)
+		defer resp.Body.Close()
+
+		err = json.NewDecoder(resp.Body).Decode(&movedChild)
+		assert.NoError(t, err)
+		assert.Equal(t, "/Top Category/"+child.Name, movedChild.Path)
+		assert.Equal(t, 1, movedChild.Level)
+
+		//cleanup
+		for _, id := range []uuid.UUID{oldParent.ID, newParent.ID, category.ID} {
+			err = categoryRepo.Delete(context.Background(), id, 0)
+			assert.NoError(t, err)
+		}
+		err = categoryRepo.Delete(context.Background(), child.ID, 1)
 		assert.NoError(t, err)
 	})
 }
@@ -247,11 +483,9 @@ func TestProductRoutes(t *testing.T) {
 	defer ts.CleanupTestServer(t)
 
 	t.Run("CreateProduct", func(t *testing.T) {
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
+		categoryRepo := ts.Repos.Categories
 
-		var productRepo *database.ProductRepository
-		productRepo = &database.ProductRepository{}
+		productRepo := ts.Repos.Products
 
 		category := CreateTestCategory(t, ts, nil)
 
@@ -275,25 +509,23 @@ func TestProductRoutes(t *testing.T) {
 
 		assert.Equal(t, "Test Product", product.Name)
 		assert.Equal(t, "Test Product Description", product.Description)
-		assert.Equal(t, 999.99, product.Price)
+		assert.Equal(t, models.NewMoney(99999, "KES"), product.Price)
 		assert.Equal(t, category.ID, product.CategoryID)
 		assert.Equal(t, 10, product.Stock)
 
 		// Clean Up Product
-		err = productRepo.Delete(product.ID)
+		err = productRepo.Delete(context.Background(), product.ID)
 		assert.NoError(t, err)
 
 		// Clean Up Category
-		err = categoryRepo.Delete(category.ID, 0)
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
 		assert.NoError(t, err)
 	})
 
 	t.Run("GetAllProducts", func(t *testing.T) {
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
+		categoryRepo := ts.Repos.Categories
 
-		var productRepo *database.ProductRepository
-		productRepo = &database.ProductRepository{}
+		productRepo := ts.Repos.Products
 
 		category := CreateTestCategory(t, ts, nil)
 		createdProduct := CreateTestProduct(t, ts, category.ID)
@@ -303,261 +535,677 @@ func TestProductRoutes(t *testing.T) {
 
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 
-		var products []models.Product
-		err := json.NewDecoder(resp.Body).Decode(&products)
+		var page models.ProductPage
+		err := json.NewDecoder(resp.Body).Decode(&page)
 		assert.NoError(t, err)
 
-		assert.Greater(t, len(products), 0)
+		assert.Greater(t, len(page.Products), 0)
 
 		// Clean Up Created Product
-		err = productRepo.Delete(createdProduct.ID)
+		err = productRepo.Delete(context.Background(), createdProduct.ID)
 		assert.NoError(t, err)
 
 		// Clean Up Created Category
-		err = categoryRepo.Delete(category.ID, 0)
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
 		assert.NoError(t, err)
 	})
 
-	t.Run("GetProduct", func(t *testing.T) {
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
+	t.Run("GetAllProductsPaginated", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
 
-		var productRepo *database.ProductRepository
-		productRepo = &database.ProductRepository{}
+		productRepo := ts.Repos.Products
 
-		category := CreateTestCategory(t, ts, nil)
-		product := CreateTestProduct(t, ts, category.ID)
+		ctx := context.Background()
+		category := &models.Category{Name: "Paging " + uuid.NewString()}
+		assert.NoError(t, categoryRepo.Create(ctx, category))
 
-		resp := MakeRequest(t, ts, "GET", "/api/products/"+product.ID.String(), nil, nil)
-		defer resp.Body.Close()
+		for i := 1; i <= 5; i++ {
+			product := &models.Product{
+				Name:       fmt.Sprintf("Paged %d", i),
+				Price:      models.NewMoney(int64(i*100), models.DefaultCurrency),
+				CategoryID: category.ID,
+				Stock:      i - 1,
+			}
+			assert.NoError(t, productRepo.Create(ctx, product))
+		}
+
+		// Walk every page sorted by descending price
+		var prices []int64
+		path := "/api/products?category=" + category.ID.String() + "&sort=price_desc&limit=2"
+		next := path
+		for pages := 0; next != ""; pages++ {
+			if !assert.Less(t, pages, 5) {
+				break
+			}
+
+			resp := MakeRequest(t, ts, "GET", next, nil, nil)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			var page models.ProductPage
+			err := json.NewDecoder(resp.Body).Decode(&page)
+			assert.NoError(t, err)
+
+			assert.LessOrEqual(t, len(page.Products), 2)
+			for _, product := range page.Products {
+				prices = append(prices, product.Price.Amount)
+			}
+
+			next = ""
+			if page.NextCursor != "" {
+				next = path + "&cursor=" + page.NextCursor
+			}
+		}
+		assert.Equal(t, []int64{500, 400, 300, 200, 100}, prices)
 
+		// Filters combine with the sort
+		resp := MakeRequest(t, ts, "GET", "/api/products?category="+category.ID.String()+
+			"&min_price=2.00&max_price=4.00&in_stock=true&sort=price_asc", nil, nil)
+		defer resp.Body.Close()
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 
-		var retrievedProduct models.Product
-		err := json.NewDecoder(resp.Body).Decode(&retrievedProduct)
+		var page models.ProductPage
+		err := json.NewDecoder(resp.Body).Decode(&page)
 		assert.NoError(t, err)
 
-		assert.Equal(t, product.ID, retrievedProduct.ID)
-		assert.Equal(t, product.Name, retrievedProduct.Name)
-		assert.Equal(t, product.Price, retrievedProduct.Price)
+		var names []string
+		for _, product := range page.Products {
+			names = append(names, product.Name)
+		}
+		assert.Equal(t, []string{"Paged 2", "Paged 3", "Paged 4"}, names)
+		assert.Empty(t, page.NextCursor)
 
-		// clean up created product
-		err = productRepo.Delete(product.ID)
+		// A cursor is only valid for the sort that issued it
+		resp = MakeRequest(t, ts, "GET", "/api/products?limit=1&sort=newest", nil, nil)
+		defer resp.Body.Close()
+		err = json.NewDecoder(resp.Body).Decode(&page)
 		assert.NoError(t, err)
 
-		// clean up created category
-		err = categoryRepo.Delete(category.ID, 0)
+		resp = MakeRequest(t, ts, "GET", "/api/products?sort=name&cursor="+page.NextCursor, nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		for _, query := range []string{"sort=cheapest", "limit=0", "min_price=abc", "category=nope", "cursor=not-a-cursor"} {
+			resp = MakeRequest(t, ts, "GET", "/api/products?"+query, nil, nil)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+		}
+
+		// Clean Up Created Category and its products
+		err = categoryRepo.Delete(ctx, category.ID, 0)
 		assert.NoError(t, err)
 	})
 
-	t.Run("GetProductsByCategory", func(t *testing.T) {
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
+	t.Run("GetAllProductsIncludesSubcategories", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
 
-		var productRepo *database.ProductRepository
-		productRepo = &database.ProductRepository{}
+		productRepo := ts.Repos.Products
 
-		category := CreateTestCategory(t, ts, nil)
-		createdProduct := CreateTestProduct(t, ts, category.ID)
+		ctx := context.Background()
+		parent := &models.Category{Name: "Parent_" + uuid.NewString()}
+		assert.NoError(t, categoryRepo.Create(ctx, parent))
+		child := &models.Category{Name: "Child", ParentID: &parent.ID}
+		assert.NoError(t, categoryRepo.Create(ctx, child))
 
-		resp := MakeRequest(t, ts, "GET", "/api/products/category/"+category.ID.String(), nil, nil)
-		defer resp.Body.Close()
+		// A sibling whose name matches the parent's with a LIKE wildcard must not match
+		sibling := &models.Category{Name: strings.Replace(parent.Name, "_", "X", 1)}
+		assert.NoError(t, categoryRepo.Create(ctx, sibling))
+		siblingChild := &models.Category{Name: "Child", ParentID: &sibling.ID}
+		assert.NoError(t, categoryRepo.Create(ctx, siblingChild))
+
+		for _, categoryID := range []uuid.UUID{parent.ID, child.ID, siblingChild.ID} {
+			product := &models.Product{Name: "Nested", Price: models.NewMoney(100, models.DefaultCurrency), CategoryID: categoryID, Stock: 1}
+			assert.NoError(t, productRepo.Create(ctx, product))
+		}
 
+		resp := MakeRequest(t, ts, "GET", "/api/products?category="+parent.ID.String(), nil, nil)
+		defer resp.Body.Close()
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 
-		var products []models.Product
-		err := json.NewDecoder(resp.Body).Decode(&products)
+		var page models.ProductPage
+		err := json.NewDecoder(resp.Body).Decode(&page)
 		assert.NoError(t, err)
 
-		assert.Greater(t, len(products), 0)
-		for _, product := range products {
-			assert.Equal(t, category.ID, product.CategoryID)
+		categories := map[uuid.UUID]bool{}
+		for _, product := range page.Products {
+			categories[product.CategoryID] = true
 		}
+		assert.Equal(t, map[uuid.UUID]bool{parent.ID: true, child.ID: true}, categories)
 
-		//Clean up created product
-		err = productRepo.Delete(createdProduct.ID)
+		// Clean Up Created Categories and their products
+		err = categoryRepo.Delete(ctx, parent.ID, 0)
 		assert.NoError(t, err)
 
-		//Clean up created category
-		err = categoryRepo.Delete(category.ID, 0)
+		err = categoryRepo.Delete(ctx, sibling.ID, 0)
 		assert.NoError(t, err)
 	})
 
-	t.Run("GetAveragePriceByCategory", func(t *testing.T) {
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
-
-		var productRepo *database.ProductRepository
-		productRepo = &database.ProductRepository{}
-
-		category := CreateTestCategory(t, ts, nil)
-		createdProduct := CreateTestProduct(t, ts, category.ID)
+	t.Run("SearchProducts", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		productRepo := ts.Repos.Products
+
+		ctx := context.Background()
+		category := &models.Category{Name: "Search " + uuid.NewString()}
+		assert.NoError(t, categoryRepo.Create(ctx, category))
+
+		marker := "zq" + strings.ReplaceAll(uuid.NewString()[:8], "-", "")
+		named := &models.Product{Name: "Wireless " + marker + "phone", Description: "Bluetooth headset",
+			Price: models.NewMoney(100, models.DefaultCurrency), CategoryID: category.ID}
+		described := &models.Product{Name: "Charger", Description: "Works with any " + marker + "phone",
+			Price: models.NewMoney(100, models.DefaultCurrency), CategoryID: category.ID}
+		unrelated := &models.Product{Name: "Desk lamp", Description: "LED",
+			Price: models.NewMoney(100, models.DefaultCurrency), CategoryID: category.ID}
+		markup := &models.Product{Name: "Tom & Jerry <img src=x onerror=alert(1)> mug" + marker,
+			Price: models.NewMoney(100, models.DefaultCurrency), CategoryID: category.ID}
+		for _, product := range []*models.Product{named, described, unrelated, markup} {
+			assert.NoError(t, productRepo.Create(ctx, product))
+		}
 
-		resp := MakeRequest(t, ts, "GET", "/api/products/category/"+category.ID.String()+"/average-price", nil, nil)
+		// A partially typed word matches as a prefix, and name matches rank first
+		resp := MakeRequest(t, ts, "GET", "/api/products/search?q="+marker[:6], nil, nil)
 		defer resp.Body.Close()
-
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 
-		var categoryPrice models.CategoryPrice
-		err := json.NewDecoder(resp.Body).Decode(&categoryPrice)
+		var results []models.ProductSearchResult
+		err := json.NewDecoder(resp.Body).Decode(&results)
 		assert.NoError(t, err)
 
-		assert.Equal(t, category.ID, categoryPrice.CategoryID)
-		assert.Equal(t, category.Name, categoryPrice.CategoryName)
-		assert.Greater(t, categoryPrice.AveragePrice, 0.0)
-		assert.Greater(t, categoryPrice.ProductCount, 0)
+		if assert.Len(t, results, 2) {
+			assert.Equal(t, named.ID, results[0].ID)
+			assert.Equal(t, described.ID, results[1].ID)
+			assert.Greater(t, results[0].Rank, results[1].Rank)
+			assert.Contains(t, results[0].Highlights.Name, "<mark>"+marker+"phone</mark>")
+			assert.Contains(t, results[1].Highlights.Description, "<mark>"+marker+"phone</mark>")
+		}
 
-		// Clean up created product
-		err = productRepo.Delete(createdProduct.ID)
+		// Every term must match
+		resp = MakeRequest(t, ts, "GET", "/api/products/search?q="+marker+"+bluetooth", nil, nil)
+		defer resp.Body.Close()
+		err = json.NewDecoder(resp.Body).Decode(&results)
 		assert.NoError(t, err)
+		if assert.Len(t, results, 1) {
+			assert.Equal(t, named.ID, results[0].ID)
+		}
 
-		// Clean up created category
-		err = categoryRepo.Delete(category.ID, 0)
+		// Highlights escape the product text around their marks
+		resp = MakeRequest(t, ts, "GET", "/api/products/search?q=mug"+marker, nil, nil)
+		defer resp.Body.Close()
+		err = json.NewDecoder(resp.Body).Decode(&results)
 		assert.NoError(t, err)
-	})
-}
-
-// TestOrderRoutes tests all order-related endpoints
-func TestOrderRoutes(t *testing.T) {
-	ts := SetupTestServer(t)
-	defer ts.CleanupTestServer(t)
+		if assert.Len(t, results, 1) {
+			assert.Equal(t, "Tom &amp; Jerry &lt;img src=x onerror=alert(1)&gt; <mark>mug"+marker+"</mark>",
+				results[0].Highlights.Name)
+		}
 
-	t.Run("CreateOrder", func(t *testing.T) {
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
+		resp = MakeRequest(t, ts, "GET", "/api/products/search?q=+%21", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 
-		var productRepo *database.ProductRepository
-		productRepo = &database.ProductRepository{}
+		// Clean Up Created Category and its products
+		err = categoryRepo.Delete(ctx, category.ID, 0)
+		assert.NoError(t, err)
+	})
 
-		var orderRepo *database.OrderRepository
-		orderRepo = &database.OrderRepository{}
+	t.Run("GetProductFacets", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
 
-		var customerRepo *database.CustomerRepository
-		customerRepo = &database.CustomerRepository{}
+		productRepo := ts.Repos.Products
 
-		customer, _ := ts.GetTestCustomer(t)
-		category := CreateTestCategory(t, ts, nil)
-		product := CreateTestProduct(t, ts, category.ID)
+		ctx := context.Background()
+		parent := &models.Category{Name: "Facets " + uuid.NewString()}
+		assert.NoError(t, categoryRepo.Create(ctx, parent))
+		child := &models.Category{Name: "Child", ParentID: &parent.ID}
+		assert.NoError(t, categoryRepo.Create(ctx, child))
 
-		orderData := map[string]interface{}{
-			"customer_id": customer.ID.String(),
-			"items": []map[string]interface{}{
-				{
-					"product_id": product.ID.String(),
-					"quantity":   2,
-				},
-			},
+		for _, product := range []*models.Product{
+			{Name: "Cheap", Price: models.NewMoney(10000, models.DefaultCurrency), CategoryID: parent.ID, Stock: 1},
+			{Name: "Sold out", Price: models.NewMoney(70000, models.DefaultCurrency), CategoryID: child.ID, Stock: 0},
+			{Name: "Premium", Price: models.NewMoney(2000000, models.DefaultCurrency), CategoryID: child.ID, Stock: 2},
+		} {
+			assert.NoError(t, productRepo.Create(ctx, product))
 		}
 
-		resp := MakeRequest(t, ts, "POST", "/api/orders", orderData, nil)
+		resp := MakeRequest(t, ts, "GET", "/api/products/facets?category="+parent.ID.String()+"&buckets=0,500,10000", nil, nil)
 		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
 
-		assert.Equal(t, http.StatusCreated, resp.StatusCode)
-
-		var order models.Order
-		err := json.NewDecoder(resp.Body).Decode(&order)
+		var facets models.ProductFacets
+		err := json.NewDecoder(resp.Body).Decode(&facets)
 		assert.NoError(t, err)
 
-		assert.Equal(t, customer.ID, order.CustomerID)
-		assert.Equal(t, "pending", order.Status)
-		assert.Greater(t, order.Total, 0.0)
-		assert.Equal(t, 1, len(order.Items))
+		assert.Equal(t, 3, facets.Total)
+		assert.Equal(t, models.AvailabilityFacet{InStock: 2, OutOfStock: 1}, facets.Availability)
 
-		//clean up Order
-		err = orderRepo.Delete(order.ID)
-		assert.NoError(t, err)
+		// Parent counts include the child's products
+		counts := map[uuid.UUID]int{}
+		for _, facet := range facets.Categories {
+			counts[facet.CategoryID] = facet.ProductCount
+		}
+		assert.Equal(t, map[uuid.UUID]int{parent.ID: 3, child.ID: 2}, counts)
+
+		if assert.Len(t, facets.PriceBuckets, 3) {
+			assert.Equal(t, models.NewMoney(50000, models.DefaultCurrency), *facets.PriceBuckets[0].Max)
+			assert.Nil(t, facets.PriceBuckets[2].Max)
+			for _, bucket := range facets.PriceBuckets {
+				assert.Equal(t, 1, bucket.ProductCount)
+			}
+		}
 
-		//clean up customer
-		err = customerRepo.Delete(customer.ID)
+		// Facets follow the listing filters
+		resp = MakeRequest(t, ts, "GET", "/api/products/facets?in_stock=true&category="+parent.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		err = json.NewDecoder(resp.Body).Decode(&facets)
 		assert.NoError(t, err)
+		assert.Equal(t, 2, facets.Total)
+		assert.Len(t, facets.PriceBuckets, len(models.DefaultPriceBucketEdges))
 
-		//clean up product
-		err = productRepo.Delete(product.ID)
-		assert.NoError(t, err)
+		resp = MakeRequest(t, ts, "GET", "/api/products/facets?buckets=500,100", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 
-		//clean up category
-		err = categoryRepo.Delete(category.ID, 0)
+		// Clean Up Created Categories and their products
+		err = categoryRepo.Delete(ctx, parent.ID, 0)
 		assert.NoError(t, err)
 	})
 
-	t.Run("CreateOrderInvalidCustomerID", func(t *testing.T) {
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
+	t.Run("GetProduct", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
 
-		var productRepo *database.ProductRepository
-		productRepo = &database.ProductRepository{}
+		productRepo := ts.Repos.Products
 
 		category := CreateTestCategory(t, ts, nil)
 		product := CreateTestProduct(t, ts, category.ID)
 
-		orderData := map[string]interface{}{
-			"customer_id": uuid.New().String(),
-			"items": []map[string]interface{}{
-				{
-					"product_id": product.ID.String(),
-					"quantity":   2,
-				},
-			},
-		}
-
-		resp := MakeRequest(t, ts, "POST", "/api/orders", orderData, nil)
+		resp := MakeRequest(t, ts, "GET", "/api/products/"+product.ID.String(), nil, nil)
 		defer resp.Body.Close()
 
-		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
 
-		//clean up category
-		err := categoryRepo.Delete(category.ID, 0)
+		var retrievedProduct models.Product
+		err := json.NewDecoder(resp.Body).Decode(&retrievedProduct)
 		assert.NoError(t, err)
 
-		//clean up product
-		err = productRepo.Delete(product.ID)
+		assert.Equal(t, product.ID, retrievedProduct.ID)
+		assert.Equal(t, product.Name, retrievedProduct.Name)
+		assert.Equal(t, product.Price, retrievedProduct.Price)
+
+		// clean up created product
+		err = productRepo.Delete(context.Background(), product.ID)
 		assert.NoError(t, err)
 
+		// clean up created category
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
 	})
 
-	t.Run("CreateOrderMissingCustomerID", func(t *testing.T) {
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
-
-		var productRepo *database.ProductRepository
-		productRepo = &database.ProductRepository{}
+	t.Run("UpdateProduct", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
 
 		category := CreateTestCategory(t, ts, nil)
+		other := CreateTestCategory(t, ts, nil)
 		product := CreateTestProduct(t, ts, category.ID)
 
-		orderData := map[string]interface{}{
-			"items": []map[string]interface{}{
-				{
-					"product_id": product.ID.String(),
-					"quantity":   2,
-				},
-			},
-		}
-
-		resp := MakeRequest(t, ts, "POST", "/api/orders", orderData, nil)
+		resp := MakeRequest(t, ts, "PUT", "/api/products/"+product.ID.String(), map[string]interface{}{
+			"name":        "  Updated Product  ",
+			"price":       "149.50",
+			"category_id": other.ID,
+			"stock":       3,
+		}, nil)
 		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
 
+		var updated models.Product
+		err := json.NewDecoder(resp.Body).Decode(&updated)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "Updated Product", updated.Name)
+		assert.Equal(t, models.NewMoney(14950, models.DefaultCurrency), updated.Price)
+		assert.Equal(t, other.ID, updated.CategoryID)
+		assert.Equal(t, other.Name, updated.Category.Name)
+		assert.Equal(t, 3, updated.Stock)
+		// PUT replaces the product, so omitted optional fields are cleared
+		assert.Empty(t, updated.Description)
+		assert.Empty(t, updated.ImageURL)
+
+		resp = MakeRequest(t, ts, "PUT", "/api/products/"+product.ID.String(), map[string]interface{}{"name": "Incomplete"}, nil)
+		defer resp.Body.Close()
 		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 
-		//clean up category
-		err := categoryRepo.Delete(category.ID, 0)
-		assert.NoError(t, err)
+		resp = MakeRequest(t, ts, "PUT", "/api/products/"+uuid.New().String(), map[string]interface{}{
+			"name": "Missing", "price": 1, "category_id": category.ID, "stock": 1,
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
 
-		//clean up product
-		err = productRepo.Delete(product.ID)
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
 		assert.NoError(t, err)
 
+		err = categoryRepo.Delete(context.Background(), other.ID, 0)
+		assert.NoError(t, err)
 	})
 
-	t.Run("CreateOrderInvalidProductID", func(t *testing.T) {
-		var customerRepo *database.CustomerRepository
-		customerRepo = &database.CustomerRepository{}
+	t.Run("PatchProduct", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
 
-		customer, _ := ts.GetTestCustomer(t)
+		productRepo := ts.Repos.Products
 
-		orderData := map[string]interface{}{
-			"customer_id": customer.ID.String(),
-			"items": []map[string]interface{}{
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+
+		resp := MakeRequest(t, ts, "PATCH", "/api/products/"+product.ID.String(), map[string]interface{}{
+			"description": "New description",
+			"image_url":   "https://example.com/new.jpg",
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var patched models.Product
+		err := json.NewDecoder(resp.Body).Decode(&patched)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "New description", patched.Description)
+		assert.Equal(t, "https://example.com/new.jpg", patched.ImageURL)
+		assert.Equal(t, product.Name, patched.Name)
+		assert.Equal(t, product.Price, patched.Price)
+		assert.Equal(t, product.Stock, patched.Stock)
+
+		// Every invalid field is rejected and nothing is changed
+		resp = MakeRequest(t, ts, "PATCH", "/api/products/"+product.ID.String(), map[string]interface{}{
+			"name":      " ",
+			"price":     -1,
+			"stock":     -5,
+			"image_url": "not a url",
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		for _, field := range []string{"name", "price", "stock", "image_url"} {
+			assert.Contains(t, string(body), field)
+		}
+
+		resp = MakeRequest(t, ts, "PATCH", "/api/products/"+product.ID.String(), map[string]interface{}{"category_id": uuid.New()}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		stored, err := productRepo.GetByID(context.Background(), product.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, product.Name, stored.Name)
+		assert.Equal(t, category.ID, stored.CategoryID)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("DeleteProduct", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		productRepo := ts.Repos.Products
+
+		orderRepo := ts.Repos.Orders
+
+		customerRepo := ts.Repos.Customers
+
+		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		ordered := CreateTestProduct(t, ts, category.ID)
+		admin := AuthHeaders(t, uuid.New(), "admin@example.com")
+
+		resp := MakeRequest(t, ts, "DELETE", "/api/products/"+product.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "DELETE", "/api/products/"+product.ID.String(), nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		_, err := productRepo.GetByID(context.Background(), product.ID)
+		assert.Error(t, err)
+
+		resp = MakeRequest(t, ts, "DELETE", "/api/products/"+product.ID.String(), nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "POST", "/api/orders", map[string]interface{}{
+			"customer_id": customer.ID,
+			"items":       []map[string]interface{}{{"product_id": ordered.ID, "quantity": 1}},
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var order models.Order
+		err = json.NewDecoder(resp.Body).Decode(&order)
+		assert.NoError(t, err)
+
+		// Ordered products are soft-deleted, so the order history keeps them
+		resp = MakeRequest(t, ts, "DELETE", "/api/products/"+ordered.ID.String(), nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		_, err = productRepo.GetByID(context.Background(), ordered.ID)
+		assert.Error(t, err)
+
+		stored, err := orderRepo.GetByID(context.Background(), order.ID)
+		assert.NoError(t, err)
+		assert.Len(t, stored.Items, 1)
+		assert.Equal(t, ordered.Name, stored.Items[0].Product.Name)
+
+		err = productRepo.Delete(context.Background(), ordered.ID)
+		assert.ErrorIs(t, err, database.ErrProductInUse)
+
+		//cleanup
+		err = orderRepo.Delete(context.Background(), order.ID)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("GetProductsByCategory", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		productRepo := ts.Repos.Products
+
+		category := CreateTestCategory(t, ts, nil)
+		createdProduct := CreateTestProduct(t, ts, category.ID)
+
+		resp := MakeRequest(t, ts, "GET", "/api/products/category/"+category.ID.String(), nil, nil)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var products []models.Product
+		err := json.NewDecoder(resp.Body).Decode(&products)
+		assert.NoError(t, err)
+
+		assert.Greater(t, len(products), 0)
+		for _, product := range products {
+			assert.Equal(t, category.ID, product.CategoryID)
+		}
+
+		//Clean up created product
+		err = productRepo.Delete(context.Background(), createdProduct.ID)
+		assert.NoError(t, err)
+
+		//Clean up created category
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("GetAveragePriceByCategory", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		productRepo := ts.Repos.Products
+
+		category := CreateTestCategory(t, ts, nil)
+		createdProduct := CreateTestProduct(t, ts, category.ID)
+
+		resp := MakeRequest(t, ts, "GET", "/api/products/category/"+category.ID.String()+"/average-price", nil, nil)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var categoryPrice models.CategoryPrice
+		err := json.NewDecoder(resp.Body).Decode(&categoryPrice)
+		assert.NoError(t, err)
+
+		assert.Equal(t, category.ID, categoryPrice.CategoryID)
+		assert.Equal(t, category.Name, categoryPrice.CategoryName)
+		assert.Greater(t, categoryPrice.AveragePrice.Amount, int64(0))
+		assert.Greater(t, categoryPrice.ProductCount, 0)
+
+		// Clean up created product
+		err = productRepo.Delete(context.Background(), createdProduct.ID)
+		assert.NoError(t, err)
+
+		// Clean up created category
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+}
+
+// TestOrderRoutes tests all order-related endpoints
+func TestOrderRoutes(t *testing.T) {
+	ts := SetupTestServer(t)
+	defer ts.CleanupTestServer(t)
+
+	staff := AuthHeaders(t, uuid.New(), "staff@example.com")
+
+	t.Run("CreateOrder", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		productRepo := ts.Repos.Products
+
+		orderRepo := ts.Repos.Orders
+
+		customerRepo := ts.Repos.Customers
+
+		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+
+		orderData := map[string]interface{}{
+			"customer_id": customer.ID.String(),
+			"items": []map[string]interface{}{
+				{
+					"product_id": product.ID.String(),
+					"quantity":   2,
+				},
+			},
+		}
+
+		resp := MakeRequest(t, ts, "POST", "/api/orders", orderData, nil)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var order models.Order
+		err := json.NewDecoder(resp.Body).Decode(&order)
+		assert.NoError(t, err)
+
+		assert.Equal(t, customer.ID, order.CustomerID)
+		assert.Equal(t, "pending", order.Status)
+		assert.Greater(t, order.Total.Amount, int64(0))
+		assert.Equal(t, 1, len(order.Items))
+
+		//clean up Order
+		err = orderRepo.Delete(context.Background(), order.ID)
+		assert.NoError(t, err)
+
+		//clean up customer
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+
+		//clean up product
+		err = productRepo.Delete(context.Background(), product.ID)
+		assert.NoError(t, err)
+
+		//clean up category
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("CreateOrderInvalidCustomerID", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		productRepo := ts.Repos.Products
+
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+
+		orderData := map[string]interface{}{
+			"customer_id": uuid.New().String(),
+			"items": []map[string]interface{}{
+				{
+					"product_id": product.ID.String(),
+					"quantity":   2,
+				},
+			},
+		}
+
+		resp := MakeRequest(t, ts, "POST", "/api/orders", orderData, nil)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		//clean up category
+		err := categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		//clean up product
+		err = productRepo.Delete(context.Background(), product.ID)
+		assert.NoError(t, err)
+
+	})
+
+	t.Run("CreateOrderMissingCustomerID", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		productRepo := ts.Repos.Products
+
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+
+		orderData := map[string]interface{}{
+			"items": []map[string]interface{}{
+				{
+					"product_id": product.ID.String(),
+					"quantity":   2,
+				},
+			},
+		}
+
+		resp := MakeRequest(t, ts, "POST", "/api/orders", orderData, nil)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		//clean up category
+		err := categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		//clean up product
+		err = productRepo.Delete(context.Background(), product.ID)
+		assert.NoError(t, err)
+
+	})
+
+	t.Run("CreateOrderInvalidProductID", func(t *testing.T) {
+		customerRepo := ts.Repos.Customers
+
+		customer, _ := ts.GetTestCustomer(t)
+
+		orderData := map[string]interface{}{
+			"customer_id": customer.ID.String(),
+			"items": []map[string]interface{}{
 				{
 					"product_id": uuid.New().String(),
 					"quantity":   2,
@@ -565,53 +1213,227 @@ func TestOrderRoutes(t *testing.T) {
 			},
 		}
 
-		resp := MakeRequest(t, ts, "POST", "/api/orders", orderData, nil)
+		resp := MakeRequest(t, ts, "POST", "/api/orders", orderData, nil)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		//clean up customer
+		err := customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("CreateOrderMissingProductID", func(t *testing.T) {
+		customerRepo := ts.Repos.Customers
+
+		customer, _ := ts.GetTestCustomer(t)
+
+		orderData := map[string]interface{}{
+			"customer_id": customer.ID.String(),
+			"items": []map[string]interface{}{
+				{
+					"quantity": 2,
+				},
+			},
+		}
+
+		resp := MakeRequest(t, ts, "POST", "/api/orders", orderData, nil)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		//clean up customer
+		err := customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("CreateOrderInsufficientStock", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		productRepo := ts.Repos.Products
+
+		customerRepo := ts.Repos.Customers
+
+		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+
+		orderData := map[string]interface{}{
+			"customer_id": customer.ID.String(),
+			"items": []map[string]interface{}{
+				{
+					"product_id": product.ID.String(),
+					"quantity":   product.Stock + 1,
+				},
+			},
+		}
+
+		resp := MakeRequest(t, ts, "POST", "/api/orders", orderData, nil)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Contains(t, string(body), product.Name)
+
+		// Stock is untouched by the rejected order
+		retrievedProduct, err := productRepo.GetByID(context.Background(), product.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, product.Stock, retrievedProduct.Stock)
+
+		//clean up
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+
+		err = productRepo.Delete(context.Background(), product.ID)
+		assert.NoError(t, err)
+
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("CreateOrderIdempotencyKey", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		productRepo := ts.Repos.Products
+
+		customerRepo := ts.Repos.Customers
+
+		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+
+		orderData := map[string]interface{}{
+			"customer_id": customer.ID.String(),
+			"items": []map[string]interface{}{
+				{"product_id": product.ID.String(), "quantity": 2},
+			},
+		}
+		headers := map[string]string{"Idempotency-Key": uuid.New().String()}
+
+		resp := MakeRequest(t, ts, "POST", "/api/orders", orderData, headers)
 		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
 
-		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		var order models.Order
+		err := json.NewDecoder(resp.Body).Decode(&order)
+		assert.NoError(t, err)
 
-		//clean up customer
-		err := customerRepo.Delete(customer.ID)
+		// A retry gets the original response and does not place a second order
+		resp = MakeRequest(t, ts, "POST", "/api/orders", orderData, headers)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+
+		var replayed models.Order
+		err = json.NewDecoder(resp.Body).Decode(&replayed)
+		assert.NoError(t, err)
+		assert.Equal(t, order.ID, replayed.ID)
+
+		stored, err := productRepo.GetByID(context.Background(), product.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, product.Stock-2, stored.Stock)
+
+		// The same key cannot be reused for a different order
+		orderData["items"] = []map[string]interface{}{
+			{"product_id": product.ID.String(), "quantity": 1},
+		}
+		resp = MakeRequest(t, ts, "POST", "/api/orders", orderData, headers)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+		// Keys belong to the caller, so another client may use the same one
+		for _, email := range []string{"first@example.com", "second@example.com"} {
+			scoped := AuthHeaders(t, uuid.New(), email)
+			scoped["Idempotency-Key"] = headers["Idempotency-Key"]
+
+			resp = MakeRequest(t, ts, "POST", "/api/orders", orderData, scoped)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusCreated, resp.StatusCode)
+			assert.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+		}
+
+		stored, err = productRepo.GetByID(context.Background(), product.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, product.Stock-4, stored.Stock)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
 		assert.NoError(t, err)
 	})
 
-	t.Run("CreateOrderMissingProductID", func(t *testing.T) {
-		var customerRepo *database.CustomerRepository
-		customerRepo = &database.CustomerRepository{}
+	t.Run("CreateOrderConcurrentDoesNotOversell", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		productRepo := ts.Repos.Products
+
+		customerRepo := ts.Repos.Customers
 
 		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
 
 		orderData := map[string]interface{}{
 			"customer_id": customer.ID.String(),
 			"items": []map[string]interface{}{
 				{
-					"quantity": 2,
+					"product_id": product.ID.String(),
+					"quantity":   1,
 				},
 			},
 		}
 
-		resp := MakeRequest(t, ts, "POST", "/api/orders", orderData, nil)
-		defer resp.Body.Close()
+		var wg sync.WaitGroup
+		statuses := make(chan int, product.Stock*2)
+		for i := 0; i < product.Stock*2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp := MakeRequest(t, ts, "POST", "/api/orders", orderData, nil)
+				resp.Body.Close()
+				statuses <- resp.StatusCode
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+
+		created := 0
+		for status := range statuses {
+			if status == http.StatusCreated {
+				created++
+			} else {
+				assert.Equal(t, http.StatusConflict, status)
+			}
+		}
+		assert.Equal(t, product.Stock, created)
 
-		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		retrievedProduct, err := productRepo.GetByID(context.Background(), product.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, retrievedProduct.Stock)
 
-		//clean up customer
-		err := customerRepo.Delete(customer.ID)
+		//clean up
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+
+		err = productRepo.Delete(context.Background(), product.ID)
+		assert.NoError(t, err)
+
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
 		assert.NoError(t, err)
 	})
 
 	t.Run("GetOrder", func(t *testing.T) {
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
+		categoryRepo := ts.Repos.Categories
 
-		var productRepo *database.ProductRepository
-		productRepo = &database.ProductRepository{}
+		productRepo := ts.Repos.Products
 
-		var orderRepo *database.OrderRepository
-		orderRepo = &database.OrderRepository{}
+		orderRepo := ts.Repos.Orders
 
-		var customerRepo *database.CustomerRepository
-		customerRepo = &database.CustomerRepository{}
+		customerRepo := ts.Repos.Customers
 
 		customer, _ := ts.GetTestCustomer(t)
 		category := CreateTestCategory(t, ts, nil)
@@ -633,35 +1455,31 @@ func TestOrderRoutes(t *testing.T) {
 		assert.Equal(t, order.Total, retrievedOrder.Total)
 
 		//clean up order
-		err = orderRepo.Delete(order.ID)
+		err = orderRepo.Delete(context.Background(), order.ID)
 		assert.NoError(t, err)
 
 		//clean up customer
-		err = customerRepo.Delete(customer.ID)
+		err = customerRepo.Delete(context.Background(), customer.ID)
 		assert.NoError(t, err)
 
 		//clean up category
-		err = categoryRepo.Delete(category.ID, 0)
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
 		assert.NoError(t, err)
 
 		//clean up product
-		err = productRepo.Delete(product.ID)
+		err = productRepo.Delete(context.Background(), product.ID)
 		assert.NoError(t, err)
 
 	})
 
 	t.Run("GetOrdersByCustomer", func(t *testing.T) {
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
+		categoryRepo := ts.Repos.Categories
 
-		var productRepo *database.ProductRepository
-		productRepo = &database.ProductRepository{}
+		productRepo := ts.Repos.Products
 
-		var customerRepo *database.CustomerRepository
-		customerRepo = &database.CustomerRepository{}
+		customerRepo := ts.Repos.Customers
 
-		var orderRepo *database.OrderRepository
-		orderRepo = &database.OrderRepository{}
+		orderRepo := ts.Repos.Orders
 
 		customer, token := ts.GetTestCustomer(t)
 
@@ -688,34 +1506,100 @@ func TestOrderRoutes(t *testing.T) {
 		}
 
 		//clean up order
-		err = orderRepo.Delete(createdOrder.ID)
+		err = orderRepo.Delete(context.Background(), createdOrder.ID)
 		assert.NoError(t, err)
 
 		//clean up customer
-		err = customerRepo.Delete(customer.ID)
+		err = customerRepo.Delete(context.Background(), customer.ID)
 		assert.NoError(t, err)
 
 		//clean up category
-		err = categoryRepo.Delete(category.ID, 0)
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
 		assert.NoError(t, err)
 
 		//clean up product
-		err = productRepo.Delete(product.ID)
+		err = productRepo.Delete(context.Background(), product.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("GetOrderByVariant", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		customerRepo := ts.Repos.Customers
+
+		customer, token := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		variant := createTestVariant(t, ts, product.ID.String(), map[string]interface{}{
+			"sku":     "TEE-M",
+			"options": map[string]string{"size": "M"},
+			"stock":   4,
+		})
+
+		resp := MakeRequest(t, ts, "POST", "/api/orders", map[string]interface{}{
+			"customer_id": customer.ID.String(),
+			"items": []map[string]interface{}{
+				{"product_id": product.ID.String(), "variant_id": variant.ID.String(), "quantity": 1},
+			},
+			"ship_to": map[string]interface{}{"latitude": -1.2921, "longitude": 36.8219},
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var order models.Order
+		err := json.NewDecoder(resp.Body).Decode(&order)
+		assert.NoError(t, err)
+
+		resp = MakeRequest(t, ts, "GET", "/api/orders/"+order.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var retrievedOrder models.Order
+		err = json.NewDecoder(resp.Body).Decode(&retrievedOrder)
+		assert.NoError(t, err)
+
+		if assert.Len(t, retrievedOrder.Items, 1) {
+			item := retrievedOrder.Items[0]
+			assert.Equal(t, &variant.ID, item.VariantID)
+			if assert.NotNil(t, item.Variant) {
+				assert.Equal(t, "TEE-M", item.Variant.SKU)
+			}
+			assert.NotEmpty(t, item.Allocations)
+		}
+
+		// Customer order listings keep the variant, allocations and ship_to too
+		headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", token)}
+		resp = MakeRequest(t, ts, "GET", "/api/customers/"+customer.ID.String()+"/orders", nil, headers)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var orders []models.Order
+		err = json.NewDecoder(resp.Body).Decode(&orders)
+		assert.NoError(t, err)
+
+		if assert.Len(t, orders, 1) && assert.Len(t, orders[0].Items, 1) {
+			assert.Equal(t, &variant.ID, orders[0].Items[0].VariantID)
+			assert.NotNil(t, orders[0].Items[0].Variant)
+			assert.NotEmpty(t, orders[0].Items[0].Allocations)
+			assert.NotNil(t, orders[0].ShipTo)
+		}
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
 		assert.NoError(t, err)
 	})
 
 	t.Run("UpdateOrderStatus", func(t *testing.T) {
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
+		categoryRepo := ts.Repos.Categories
 
-		var productRepo *database.ProductRepository
-		productRepo = &database.ProductRepository{}
+		productRepo := ts.Repos.Products
 
-		var customerRepo *database.CustomerRepository
-		customerRepo = &database.CustomerRepository{}
+		customerRepo := ts.Repos.Customers
 
-		var orderRepo *database.OrderRepository
-		orderRepo = &database.OrderRepository{}
+		orderRepo := ts.Repos.Orders
 
 		customer, _ := ts.GetTestCustomer(t)
 		category := CreateTestCategory(t, ts, nil)
@@ -726,7 +1610,7 @@ func TestOrderRoutes(t *testing.T) {
 			"status": "processing",
 		}
 
-		resp := MakeRequest(t, ts, "PUT", "/api/orders/"+order.ID.String()+"/status", statusData, nil)
+		resp := MakeRequest(t, ts, "PUT", "/api/orders/"+order.ID.String()+"/status", statusData, staff)
 		defer resp.Body.Close()
 
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
@@ -738,32 +1622,28 @@ func TestOrderRoutes(t *testing.T) {
 		assert.Equal(t, "processing", updatedOrder.Status)
 
 		//clean up
-		err = categoryRepo.Delete(category.ID, 0)
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
 		assert.NoError(t, err)
 
-		err = productRepo.Delete(product.ID)
+		err = productRepo.Delete(context.Background(), product.ID)
 		assert.NoError(t, err)
 
-		err = customerRepo.Delete(customer.ID)
+		err = customerRepo.Delete(context.Background(), customer.ID)
 		assert.NoError(t, err)
 
-		err = orderRepo.Delete(order.ID)
+		err = orderRepo.Delete(context.Background(), order.ID)
 		assert.NoError(t, err)
 	})
 
 	t.Run("UpdateOrderStatusInvalid", func(t *testing.T) {
 
-		var categoryRepo *database.CategoryRepository
-		categoryRepo = &database.CategoryRepository{}
+		categoryRepo := ts.Repos.Categories
 
-		var productRepo *database.ProductRepository
-		productRepo = &database.ProductRepository{}
+		productRepo := ts.Repos.Products
 
-		var customerRepo *database.CustomerRepository
-		customerRepo = &database.CustomerRepository{}
+		customerRepo := ts.Repos.Customers
 
-		var orderRepo *database.OrderRepository
-		orderRepo = &database.OrderRepository{}
+		orderRepo := ts.Repos.Orders
 
 		customer, _ := ts.GetTestCustomer(t)
 		category := CreateTestCategory(t, ts, nil)
@@ -774,24 +1654,292 @@ func TestOrderRoutes(t *testing.T) {
 			"status": "invalid_status",
 		}
 
-		resp := MakeRequest(t, ts, "PUT", "/api/orders/"+order.ID.String()+"/status", statusData, nil)
+		resp := MakeRequest(t, ts, "PUT", "/api/orders/"+order.ID.String()+"/status", statusData, staff)
 		defer resp.Body.Close()
 
 		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 
 		//cleanup
-		err := orderRepo.Delete(order.ID)
+		err := orderRepo.Delete(context.Background(), order.ID)
+		assert.NoError(t, err)
+
+		err = productRepo.Delete(context.Background(), product.ID)
+		assert.NoError(t, err)
+
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("UpdateOrderStatusInvalidTransition", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		customerRepo := ts.Repos.Customers
+
+		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		order := CreateTestOrder(t, ts, customer.ID, product.ID)
+
+		// A pending order cannot skip straight to delivered
+		statusData := map[string]interface{}{
+			"status": "delivered",
+		}
+
+		resp := MakeRequest(t, ts, "PUT", "/api/orders/"+order.ID.String()+"/status", statusData, staff)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		stored, err := ts.Repos.Orders.GetByID(context.Background(), order.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, models.OrderStatusPending, stored.Status)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("CancelOrderRestocksInventory", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		productRepo := ts.Repos.Products
+
+		customerRepo := ts.Repos.Customers
+
+		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		order := CreateTestOrder(t, ts, customer.ID, product.ID)
+
+		reserved, err := productRepo.GetByID(context.Background(), product.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, product.Stock-2, reserved.Stock)
+
+		statusData := map[string]interface{}{
+			"status": "cancelled",
+			"reason": "customer request",
+		}
+
+		resp := MakeRequest(t, ts, "PUT", "/api/orders/"+order.ID.String()+"/status", statusData, staff)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		restocked, err := productRepo.GetByID(context.Background(), product.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, product.Stock, restocked.Stock)
+
+		// Cancelled is terminal
+		statusData["status"] = "processing"
+		resp = MakeRequest(t, ts, "PUT", "/api/orders/"+order.ID.String()+"/status", statusData, staff)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("DeleteOrderRestocksInventory", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		productRepo := ts.Repos.Products
+
+		customerRepo := ts.Repos.Customers
+
+		orderRepo := ts.Repos.Orders
+
+		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		pending := CreateTestOrder(t, ts, customer.ID, product.ID)
+		cancelled := CreateTestOrder(t, ts, customer.ID, product.ID)
+
+		resp := MakeRequest(t, ts, "PUT", "/api/orders/"+cancelled.ID.String()+"/status", map[string]interface{}{"status": "cancelled"}, staff)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		err := orderRepo.Delete(context.Background(), pending.ID)
+		assert.NoError(t, err)
+
+		// The cancelled order already returned its stock and must not do so twice
+		err = orderRepo.Delete(context.Background(), cancelled.ID)
+		assert.NoError(t, err)
+
+		restocked, err := productRepo.GetByID(context.Background(), product.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, product.Stock, restocked.Stock)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("CancelOrderItemPartially", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		productRepo := ts.Repos.Products
+
+		customerRepo := ts.Repos.Customers
+
+		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		order := CreateTestOrder(t, ts, customer.ID, product.ID)
+		itemPath := "/api/orders/" + order.ID.String() + "/items/" + order.Items[0].ID.String() + "/cancel"
+
+		resp := MakeRequest(t, ts, "POST", itemPath, map[string]interface{}{"quantity": 1}, staff)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var updatedOrder models.Order
+		err := json.NewDecoder(resp.Body).Decode(&updatedOrder)
+		assert.NoError(t, err)
+
+		assert.Equal(t, product.Price, updatedOrder.Total)
+		if assert.Len(t, updatedOrder.Items, 1) {
+			assert.Equal(t, 2, updatedOrder.Items[0].Quantity)
+			assert.Equal(t, 1, updatedOrder.Items[0].CancelledQuantity)
+			assert.Equal(t, product.Price, updatedOrder.Items[0].Price)
+		}
+
+		stored, err := productRepo.GetByID(context.Background(), product.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, product.Stock-1, stored.Stock)
+
+		// Only one unit is left on the line
+		resp = MakeRequest(t, ts, "POST", itemPath, map[string]interface{}{"quantity": 2}, staff)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		// Cancelling the order returns only what is still outstanding
+		resp = MakeRequest(t, ts, "PUT", "/api/orders/"+order.ID.String()+"/status", map[string]interface{}{"status": "cancelled"}, staff)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		stored, err = productRepo.GetByID(context.Background(), product.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, product.Stock, stored.Stock)
+
+		resp = MakeRequest(t, ts, "POST", itemPath, nil, staff)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("CancelOrderItemCannotShipEmptyOrder", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		customerRepo := ts.Repos.Customers
+
+		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		order := CreateTestOrder(t, ts, customer.ID, product.ID)
+
+		resp := MakeRequest(t, ts, "POST", "/api/orders/"+order.ID.String()+"/items/"+order.Items[0].ID.String()+"/cancel", nil, staff)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "PUT", "/api/orders/"+order.ID.String()+"/status", map[string]interface{}{"status": "processing"}, staff)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "PUT", "/api/orders/"+order.ID.String()+"/status", map[string]interface{}{"status": "shipped"}, staff)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "POST", "/api/orders/"+order.ID.String()+"/items/"+uuid.New().String()+"/cancel", nil, staff)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		//cleanup
+		err := categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
 		assert.NoError(t, err)
+	})
+
+	t.Run("GetOrderHistory", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		customerRepo := ts.Repos.Customers
+
+		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		order := CreateTestOrder(t, ts, customer.ID, product.ID)
+
+		// Status changes need an authenticated user to record in the history
+		resp := MakeRequest(t, ts, "PUT", "/api/orders/"+order.ID.String()+"/status", map[string]interface{}{"status": "processing"}, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		for _, status := range []string{"processing", "shipped"} {
+			resp := MakeRequest(t, ts, "PUT", "/api/orders/"+order.ID.String()+"/status", map[string]interface{}{"status": status}, staff)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+
+		resp = MakeRequest(t, ts, "GET", "/api/orders/"+order.ID.String()+"/history", nil, nil)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
 
-		err = productRepo.Delete(product.ID)
+		var history []models.OrderStatusChange
+		err := json.NewDecoder(resp.Body).Decode(&history)
 		assert.NoError(t, err)
 
-		err = categoryRepo.Delete(category.ID, 0)
+		if assert.Len(t, history, 2) {
+			assert.Equal(t, "pending", history[0].FromStatus)
+			assert.Equal(t, "processing", history[0].ToStatus)
+			assert.Equal(t, "processing", history[1].FromStatus)
+			assert.Equal(t, "shipped", history[1].ToStatus)
+			assert.Equal(t, "staff@example.com", history[1].ChangedBy)
+		}
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
 		assert.NoError(t, err)
 
-		err = customerRepo.Delete(customer.ID)
+		err = customerRepo.Delete(context.Background(), customer.ID)
 		assert.NoError(t, err)
 	})
+
+	t.Run("GetOrderHistoryNotFound", func(t *testing.T) {
+		resp := MakeRequest(t, ts, "GET", "/api/orders/"+uuid.New().String()+"/history", nil, nil)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
 }
 
 // TestHealthCheck tests the health check endpoint
@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"commerce-app/internal/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCategoryAttributes tests attribute schemas on categories and filtering products by attribute
+func TestCategoryAttributes(t *testing.T) {
+	ts := SetupTestServer(t)
+	defer ts.CleanupTestServer(t)
+
+	t.Run("SchemaInheritanceAndValidation", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		parent := CreateTestCategory(t, ts, nil)
+		child := CreateTestCategory(t, ts, &parent.ID)
+		parentPath := "/api/categories/" + parent.ID.String() + "/attributes"
+		childPath := "/api/categories/" + child.ID.String() + "/attributes"
+
+		resp := MakeRequest(t, ts, "POST", parentPath, map[string]interface{}{
+			"name": "screen_size", "type": "number", "unit": "inches", "required": true,
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "POST", childPath, map[string]interface{}{
+			"name": "material", "type": "enum", "values": []string{"aluminium", "plastic"},
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		// A name is defined once along any path of the tree
+		resp = MakeRequest(t, ts, "POST", childPath, map[string]interface{}{"name": "screen_size", "type": "text"}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "POST", parentPath, map[string]interface{}{"name": "material", "type": "text"}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "POST", childPath, map[string]interface{}{"name": "colour", "type": "enum"}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", childPath, nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var schema models.AttributeSchema
+		err := json.NewDecoder(resp.Body).Decode(&schema)
+		assert.NoError(t, err)
+		if assert.Len(t, schema, 2) {
+			assert.Equal(t, "material", schema[0].Name)
+			assert.Equal(t, child.ID, schema[0].CategoryID)
+			assert.Equal(t, "screen_size", schema[1].Name)
+			assert.Equal(t, parent.ID, schema[1].CategoryID)
+			assert.Equal(t, "inches", schema[1].Unit)
+		}
+
+		product := map[string]interface{}{
+			"name": "Tablet", "price": 250, "category_id": child.ID, "stock": 3,
+			"attributes": map[string]interface{}{"material": "wood"},
+		}
+		resp = MakeRequest(t, ts, "POST", "/api/products", product, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		product["attributes"] = map[string]interface{}{"material": "aluminium", "screen_size": 10.9}
+		resp = MakeRequest(t, ts, "POST", "/api/products", product, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var created models.Product
+		err = json.NewDecoder(resp.Body).Decode(&created)
+		assert.NoError(t, err)
+		productPath := "/api/products/" + created.ID.String()
+
+		resp = MakeRequest(t, ts, "PATCH", productPath, map[string]interface{}{
+			"attributes": map[string]interface{}{"screen_size": "large"},
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		// Moving to the parent leaves material undefined
+		resp = MakeRequest(t, ts, "PATCH", productPath, map[string]interface{}{"category_id": parent.ID}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "DELETE", childPath+"/material", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "DELETE", childPath+"/material", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", productPath, nil, nil)
+		defer resp.Body.Close()
+
+		var stored models.Product
+		err = json.NewDecoder(resp.Body).Decode(&stored)
+		assert.NoError(t, err)
+		assert.Equal(t, models.ProductAttributes{"screen_size": 10.9}, stored.Attributes)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), parent.ID, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("FilterByAttribute", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		category := CreateTestCategory(t, ts, nil)
+		attributesPath := "/api/categories/" + category.ID.String() + "/attributes"
+
+		for _, attribute := range []map[string]interface{}{
+			{"name": "weight", "type": "number", "unit": "kg"},
+			{"name": "colour", "type": "text"},
+			{"name": "waterproof", "type": "boolean"},
+		} {
+			resp := MakeRequest(t, ts, "POST", attributesPath, attribute, nil)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		}
+
+		for _, attributes := range []map[string]interface{}{
+			{"weight": 1.5, "colour": "red", "waterproof": true},
+			{"weight": 3, "colour": "red"},
+			{"weight": 0.8, "colour": "blue", "waterproof": false},
+		} {
+			resp := MakeRequest(t, ts, "POST", "/api/products", map[string]interface{}{
+				"name": "Jacket", "price": 100, "category_id": category.ID, "stock": 1, "attributes": attributes,
+			}, nil)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		}
+
+		for query, expected := range map[string]int{
+			"attr.colour=red":                          2,
+			"attr.colour=red&attr.weight.max=2":        1,
+			"attr.weight.min=1&attr.weight.max=3":      2,
+			"attr.waterproof=false":                    1,
+			"attr.waterproof":                          2,
+			"attr.colour=green":                        0,
+			"attr.weight=3&attr.colour=red&limit=10":   1,
+			"attr.colour.min=1&attr.colour.max=999999": 0,
+		} {
+			resp := MakeRequest(t, ts, "GET", "/api/products?category="+category.ID.String()+"&"+query, nil, nil)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode, query)
+
+			var page models.ProductPage
+			err := json.NewDecoder(resp.Body).Decode(&page)
+			assert.NoError(t, err)
+			assert.Len(t, page.Products, expected, query)
+		}
+
+		resp := MakeRequest(t, ts, "GET", "/api/products?attr.weight.min=heavy", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		//cleanup
+		err := categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,315 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// decodeCart reads a cart from a response body
+func decodeCart(t *testing.T, resp *http.Response) models.Cart {
+	var cart models.Cart
+	err := json.NewDecoder(resp.Body).Decode(&cart)
+	assert.NoError(t, err)
+	return cart
+}
+
+// TestCartRoutes tests the cart endpoints
+func TestCartRoutes(t *testing.T) {
+	ts := SetupTestServer(t)
+	defer ts.CleanupTestServer(t)
+
+	t.Run("CustomerCartAddUpdateRemove", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		customerRepo := ts.Repos.Customers
+
+		customer, token := ts.GetTestCustomer(t)
+		headers := map[string]string{"Authorization": "Bearer " + token}
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+
+		resp := MakeRequest(t, ts, "POST", "/api/carts", nil, headers)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		cart := decodeCart(t, resp)
+		assert.Empty(t, cart.Token)
+		assert.Equal(t, &customer.ID, cart.CustomerID)
+
+		// The customer has one persistent cart
+		resp = MakeRequest(t, ts, "POST", "/api/carts", nil, headers)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, cart.ID, decodeCart(t, resp).ID)
+
+		cartPath := "/api/carts/" + cart.ID.String()
+		line := map[string]interface{}{"product_id": product.ID, "quantity": 2}
+
+		resp = MakeRequest(t, ts, "POST", cartPath+"/items", line, headers)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "POST", cartPath+"/items", line, headers)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		cart = decodeCart(t, resp)
+		if assert.Len(t, cart.Items, 1) {
+			assert.Equal(t, 4, cart.Items[0].Quantity)
+			assert.Equal(t, product.Price, cart.Items[0].UnitPrice)
+			assert.Equal(t, product.Price.Mul(4), cart.Items[0].LineTotal)
+			assert.True(t, cart.Items[0].InStock)
+		}
+		assert.Equal(t, product.Price.Mul(4), cart.Total)
+
+		// More than the product has in stock is rejected
+		itemPath := cartPath + "/items/" + cart.Items[0].ID.String()
+		resp = MakeRequest(t, ts, "PUT", itemPath, map[string]interface{}{"quantity": product.Stock + 1}, headers)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "PUT", itemPath, map[string]interface{}{"quantity": 1}, headers)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, product.Price, decodeCart(t, resp).Total)
+
+		resp = MakeRequest(t, ts, "DELETE", itemPath, nil, headers)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, decodeCart(t, resp).Items)
+
+		resp = MakeRequest(t, ts, "DELETE", itemPath, nil, headers)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		//cleanup
+		err := categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("AnonymousCartRequiresToken", func(t *testing.T) {
+		resp := MakeRequest(t, ts, "POST", "/api/carts", nil, nil)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		cart := decodeCart(t, resp)
+		assert.NotEmpty(t, cart.Token)
+
+		resp = MakeRequest(t, ts, "GET", "/api/carts/"+cart.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", "/api/carts/"+cart.ID.String(), nil, map[string]string{"X-Cart-Token": "wrong"})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", "/api/carts/"+cart.ID.String(), nil, map[string]string{"X-Cart-Token": cart.Token})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", "/api/carts/"+uuid.New().String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		err := ts.Repos.Carts.Delete(context.Background(), cart.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("MergeAnonymousCartAndCheckout", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		productRepo := ts.Repos.Products
+
+		customerRepo := ts.Repos.Customers
+
+		customer, token := ts.GetTestCustomer(t)
+		authHeaders := map[string]string{"Authorization": "Bearer " + token}
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		other := CreateTestProduct(t, ts, category.ID)
+
+		resp := MakeRequest(t, ts, "POST", "/api/carts", nil, authHeaders)
+		defer resp.Body.Close()
+		customerCart := decodeCart(t, resp)
+
+		resp = MakeRequest(t, ts, "POST", "/api/carts/"+customerCart.ID.String()+"/items",
+			map[string]interface{}{"product_id": product.ID, "quantity": 1}, authHeaders)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "POST", "/api/carts", nil, nil)
+		defer resp.Body.Close()
+		anonymous := decodeCart(t, resp)
+		headers := map[string]string{"X-Cart-Token": anonymous.Token}
+
+		for _, line := range []map[string]interface{}{
+			{"product_id": product.ID, "quantity": 2},
+			{"product_id": other.ID, "quantity": 3},
+		} {
+			resp = MakeRequest(t, ts, "POST", "/api/carts/"+anonymous.ID.String()+"/items", line, headers)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+
+		// Merging and checking out need a logged-in customer
+		resp = MakeRequest(t, ts, "POST", "/api/carts/"+anonymous.ID.String()+"/merge", nil, headers)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		headers["Authorization"] = authHeaders["Authorization"]
+
+		// Anonymous carts cannot be checked out
+		resp = MakeRequest(t, ts, "POST", "/api/carts/"+anonymous.ID.String()+"/checkout", nil, headers)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "POST", "/api/carts/"+anonymous.ID.String()+"/merge", nil, headers)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		merged := decodeCart(t, resp)
+		assert.Equal(t, customerCart.ID, merged.ID)
+		if assert.Len(t, merged.Items, 2) {
+			quantities := map[uuid.UUID]int{}
+			for _, item := range merged.Items {
+				quantities[item.ProductID] = item.Quantity
+			}
+			assert.Equal(t, 3, quantities[product.ID])
+			assert.Equal(t, 3, quantities[other.ID])
+		}
+
+		_, err := ts.Repos.Carts.GetByID(context.Background(), anonymous.ID)
+		assert.Error(t, err)
+
+		resp = MakeRequest(t, ts, "POST", "/api/carts/"+customerCart.ID.String()+"/checkout", nil, authHeaders)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var order models.Order
+		err = json.NewDecoder(resp.Body).Decode(&order)
+		assert.NoError(t, err)
+
+		assert.Equal(t, customer.ID, order.CustomerID)
+		assert.Equal(t, models.OrderStatusPending, order.Status)
+		assert.Len(t, order.Items, 2)
+		assert.Equal(t, merged.Total, order.Total)
+
+		stored, err := productRepo.GetByID(context.Background(), product.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, product.Stock-3, stored.Stock)
+
+		// Checkout empties the cart
+		_, err = ts.Repos.Carts.GetByID(context.Background(), customerCart.ID)
+		assert.Error(t, err)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("CustomerCartIsPrivate", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		customerRepo := ts.Repos.Customers
+
+		customer, token := ts.GetTestCustomer(t)
+		headers := map[string]string{"Authorization": "Bearer " + token}
+		intruder, intruderToken := ts.GetTestCustomer(t)
+		intruderHeaders := map[string]string{"Authorization": "Bearer " + intruderToken}
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+
+		resp := MakeRequest(t, ts, "POST", "/api/carts", nil, headers)
+		defer resp.Body.Close()
+		cart := decodeCart(t, resp)
+		cartPath := "/api/carts/" + cart.ID.String()
+
+		resp = MakeRequest(t, ts, "POST", cartPath+"/items", map[string]interface{}{"product_id": product.ID, "quantity": 1}, headers)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// A customer ID in the body does not hand out that customer's cart
+		resp = MakeRequest(t, ts, "POST", "/api/carts", map[string]interface{}{"customer_id": customer.ID}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		anonymous := decodeCart(t, resp)
+		assert.NotEqual(t, cart.ID, anonymous.ID)
+		assert.Nil(t, anonymous.CustomerID)
+
+		for _, h := range []map[string]string{nil, intruderHeaders} {
+			resp = MakeRequest(t, ts, "GET", cartPath, nil, h)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+			resp = MakeRequest(t, ts, "POST", cartPath+"/items", map[string]interface{}{"product_id": product.ID, "quantity": 1}, h)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		}
+
+		resp = MakeRequest(t, ts, "POST", cartPath+"/checkout", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "POST", cartPath+"/checkout", nil, intruderHeaders)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", cartPath, nil, map[string]string{"Authorization": "Bearer invalid"})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", cartPath, nil, headers)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Len(t, decodeCart(t, resp).Items, 1)
+
+		//cleanup
+		err := ts.Repos.Carts.Delete(context.Background(), anonymous.ID)
+		assert.NoError(t, err)
+
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), intruder.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("CheckoutEmptyCart", func(t *testing.T) {
+		customerRepo := ts.Repos.Customers
+
+		customer, token := ts.GetTestCustomer(t)
+		headers := map[string]string{"Authorization": "Bearer " + token}
+
+		resp := MakeRequest(t, ts, "POST", "/api/carts", nil, headers)
+		defer resp.Body.Close()
+		cart := decodeCart(t, resp)
+
+		resp = MakeRequest(t, ts, "POST", "/api/carts/"+cart.ID.String()+"/checkout", nil, headers)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		// Deleting the customer removes their cart
+		err := customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+
+		_, err = ts.Repos.Carts.GetByID(context.Background(), cart.ID)
+		assert.Error(t, err)
+	})
+}
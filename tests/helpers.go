@@ -26,15 +26,25 @@ import (
 type TestServer struct {
 	Server *httptest.Server
 	DB     *sql.DB
+	Repos  *database.Repositories
 }
 
-// SetupTestServer creates a test server with a clean database
+// SetupTestServer creates a test server with a clean database. The in-memory
+// backend is used unless STORAGE_BACKEND is set to postgres.
 func SetupTestServer(t *testing.T) *TestServer {
 	// Set test environment variables
 	if err := godotenv.Load(".env.test"); err != nil {
 		log.Println("No .env file found")
 	}
 
+	if os.Getenv("STORAGE_BACKEND") != "postgres" {
+		repos := database.NewMemoryRepositories()
+		return &TestServer{
+			Server: httptest.NewServer(rest.Router(repos)),
+			Repos:  repos,
+		}
+	}
+
 	os.Setenv("DB_HOST", os.Getenv("DB_HOST"))
 	os.Setenv("DB_PORT", os.Getenv("DB_PORT"))
 	os.Setenv("DB_USER", os.Getenv("DB_USER"))
@@ -50,7 +60,8 @@ func SetupTestServer(t *testing.T) *TestServer {
 	assert.NoError(t, err)
 
 	// Create router
-	router := rest.Router()
+	repos := database.NewPostgresRepositories()
+	router := rest.Router(repos)
 
 	// Create test server
 	server := httptest.NewServer(router)
@@ -58,6 +69,7 @@ func SetupTestServer(t *testing.T) *TestServer {
 	return &TestServer{
 		Server: server,
 		DB:     database.DB,
+		Repos:  repos,
 	}
 }
 
@@ -84,7 +96,7 @@ func getRandomEmail() string {
 }
 
 func getRandomPhoneNumber() string {
-	return fmt.Sprintf("%d", rand.Intn(9999999999))
+	return fmt.Sprintf("%010d", rand.Intn(9999999999))
 }
 
 func GetTestUserDetails() models.Customer {
@@ -225,6 +237,16 @@ func CreateTestOrder(t *testing.T, ts *TestServer, customerID uuid.UUID, product
 	return &order
 }
 
+// AuthHeaders returns request headers carrying a JWT for the given user
+func AuthHeaders(t *testing.T, userID uuid.UUID, email string) map[string]string {
+	token, err := auth.GenerateToken(userID, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]string{"Authorization": fmt.Sprintf("Bearer %s", token)}
+}
+
 // MakeRequest is a helper function to make HTTP requests
 func MakeRequest(t *testing.T, ts *TestServer, method, path string, body interface{}, headers map[string]string) *http.Response {
 	var jsonData []byte
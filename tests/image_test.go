@@ -0,0 +1,214 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"testing"
+
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// testImageFile is a file sent in an image upload
+type testImageFile struct {
+	name string
+	data []byte
+}
+
+// encodeTestImage returns a width x height image encoded as PNG or JPEG
+func encodeTestImage(t *testing.T, width, height int, format string) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	var err error
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, nil)
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	assert.NoError(t, err)
+	return buf.Bytes()
+}
+
+// uploadTestImages posts files in the images field of a multipart form
+func uploadTestImages(t *testing.T, ts *TestServer, productID string, files ...testImageFile) *http.Response {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, file := range files {
+		part, err := form.CreateFormFile("images", file.name)
+		assert.NoError(t, err)
+		part.Write(file.data)
+	}
+	assert.NoError(t, form.Close())
+
+	req, err := http.NewRequest("POST", ts.Server.URL+"/api/products/"+productID+"/images", &body)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	return resp
+}
+
+// TestProductImages tests uploading, ordering, serving and deleting product images
+func TestProductImages(t *testing.T) {
+	t.Setenv("IMAGE_STORAGE_DIR", t.TempDir())
+	t.Setenv("IMAGE_MAX_BYTES", "200000")
+
+	ts := SetupTestServer(t)
+	defer ts.CleanupTestServer(t)
+
+	t.Run("UploadReorderAndDelete", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		imagesPath := "/api/products/" + product.ID.String() + "/images"
+
+		resp := uploadTestImages(t, ts, product.ID.String(),
+			testImageFile{"wide.png", encodeTestImage(t, 800, 400, "png")},
+			testImageFile{"square.jpg", encodeTestImage(t, 100, 100, "jpeg")})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var uploaded []models.ProductImage
+		err := json.NewDecoder(resp.Body).Decode(&uploaded)
+		assert.NoError(t, err)
+		if !assert.Len(t, uploaded, 2) {
+			return
+		}
+		wide, square := uploaded[0], uploaded[1]
+		assert.Equal(t, 1, wide.Position)
+		assert.Equal(t, "image/png", wide.ContentType)
+		assert.Equal(t, 800, wide.Width)
+		assert.Equal(t, 2, square.Position)
+		assert.Equal(t, "image/jpeg", square.ContentType)
+
+		// The files are served from local storage
+		resp, err = http.Get(ts.Server.URL + wide.URL)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+
+		resp, err = http.Get(ts.Server.URL + wide.ThumbnailURL)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		thumbnail, _, err := image.DecodeConfig(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, 320, thumbnail.Width)
+		assert.Equal(t, 160, thumbnail.Height)
+
+		resp = MakeRequest(t, ts, "PUT", imagesPath+"/order", map[string]interface{}{
+			"image_ids": []uuid.UUID{square.ID, wide.ID},
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var reordered []models.ProductImage
+		err = json.NewDecoder(resp.Body).Decode(&reordered)
+		assert.NoError(t, err)
+		if assert.Len(t, reordered, 2) {
+			assert.Equal(t, square.ID, reordered[0].ID)
+			assert.Equal(t, 1, reordered[0].Position)
+			assert.Equal(t, wide.ID, reordered[1].ID)
+		}
+
+		// An order must list every image once
+		for _, ids := range [][]uuid.UUID{{square.ID}, {square.ID, square.ID}, {square.ID, uuid.New()}} {
+			resp = MakeRequest(t, ts, "PUT", imagesPath+"/order", map[string]interface{}{"image_ids": ids}, nil)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		}
+
+		resp = MakeRequest(t, ts, "DELETE", imagesPath+"/"+square.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "DELETE", imagesPath+"/"+square.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", imagesPath, nil, nil)
+		defer resp.Body.Close()
+
+		var remaining []models.ProductImage
+		err = json.NewDecoder(resp.Body).Decode(&remaining)
+		assert.NoError(t, err)
+		if assert.Len(t, remaining, 1) {
+			assert.Equal(t, wide.ID, remaining[0].ID)
+			assert.Equal(t, 1, remaining[0].Position)
+		}
+
+		resp, err = http.Get(ts.Server.URL + square.URL)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("RejectsInvalidUploads", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+
+		resp := uploadTestImages(t, ts, product.ID.String(), testImageFile{"notes.png", []byte("not an image")})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+		resp = uploadTestImages(t, ts, product.ID.String(), testImageFile{"huge.png", make([]byte, 300000)})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+		// A valid file is not stored when another file in the upload is rejected
+		resp = uploadTestImages(t, ts, product.ID.String(),
+			testImageFile{"ok.png", encodeTestImage(t, 10, 10, "png")},
+			testImageFile{"notes.txt", []byte("not an image")})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+		resp = uploadTestImages(t, ts, product.ID.String())
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", "/api/products/"+product.ID.String()+"/images", nil, nil)
+		defer resp.Body.Close()
+
+		var stored []models.ProductImage
+		err := json.NewDecoder(resp.Body).Decode(&stored)
+		assert.NoError(t, err)
+		assert.Empty(t, stored)
+
+		resp = uploadTestImages(t, ts, uuid.New().String(), testImageFile{"ok.png", encodeTestImage(t, 10, 10, "png")})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", "/api/images/products/missing.png", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,236 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// postImport sends an import file with the given content type
+func postImport(t *testing.T, ts *TestServer, contentType, body string) *http.Response {
+	req, err := http.NewRequest("POST", ts.Server.URL+"/api/products/import", strings.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	return resp
+}
+
+// TestProductImportExport tests importing products from CSV and NDJSON and exporting them again
+func TestProductImportExport(t *testing.T) {
+	ts := SetupTestServer(t)
+	defer ts.CleanupTestServer(t)
+
+	t.Run("ImportAndExport", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		file := strings.Join([]string{
+			"name,price,currency,category_path,stock,attributes",
+			`Import Phone,199.99,usd,/Import Test/Phones,5,`,
+			`Import Case,9.50,USD,/Import Test/Phones/Cases,20,`,
+			`Import Charger,12.345,USD,/Import Test/Phones,1,`,
+			`Import Cable,3.00,USD,Import Test,1,`,
+			`Import Stand,4.00,USD,/Import Test,many,`,
+			`Import Sticker,1.00,USD,/Import Test,1,"{""color"": ""red""}"`,
+		}, "\n")
+
+		resp := postImport(t, ts, "text/csv", file)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var report models.ImportReport
+		err := json.NewDecoder(resp.Body).Decode(&report)
+		assert.NoError(t, err)
+		assert.True(t, report.Complete)
+		assert.Equal(t, 6, report.Rows)
+		assert.Equal(t, 2, report.Created)
+		assert.Equal(t, 0, report.Updated)
+		assert.Equal(t, 4, report.Failed)
+		assert.Equal(t, 3, report.CategoriesCreated)
+		if assert.Len(t, report.Errors, 4) {
+			assert.Equal(t, 3, report.Errors[0].Row)
+			assert.Contains(t, report.Errors[0].Error, "decimal places")
+			assert.Equal(t, 4, report.Errors[1].Row)
+			assert.Contains(t, report.Errors[1].Error, "category_path")
+			assert.Equal(t, 5, report.Errors[2].Row)
+			assert.Contains(t, report.Errors[2].Error, "stock")
+			assert.Equal(t, 6, report.Errors[3].Row)
+			assert.Contains(t, report.Errors[3].Error, "attribute color")
+		}
+
+		categories, err := categoryRepo.GetAll(context.Background())
+		assert.NoError(t, err)
+		var root, phones models.Category
+		for _, category := range categories {
+			switch category.Path {
+			case "/Import Test":
+				root = category
+			case "/Import Test/Phones":
+				phones = category
+			}
+		}
+		if !assert.NotEqual(t, uuid.Nil, root.ID) || !assert.NotEqual(t, uuid.Nil, phones.ID) {
+			return
+		}
+		assert.Equal(t, root.ID, *phones.ParentID)
+
+		resp = MakeRequest(t, ts, "GET", "/api/products/export?format=ndjson&category="+root.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+		var exported []models.ProductRecord
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var record models.ProductRecord
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+			exported = append(exported, record)
+		}
+		if !assert.Len(t, exported, 2) {
+			return
+		}
+		assert.Equal(t, "Import Case", exported[0].Name)
+		assert.Equal(t, "/Import Test/Phones/Cases", exported[0].CategoryPath)
+		assert.Equal(t, "Import Phone", exported[1].Name)
+		assert.Equal(t, json.Number("199.99"), exported[1].Price)
+		assert.Equal(t, "USD", exported[1].Currency)
+		assert.Equal(t, 5, exported[1].Stock)
+
+		// Importing the export again with changes updates the same products
+		exported[1].Price = "149.99"
+		exported[1].Stock = 7
+		var lines []string
+		for _, record := range exported {
+			line, err := json.Marshal(record)
+			assert.NoError(t, err)
+			lines = append(lines, string(line))
+		}
+		lines = append(lines, "", `{"name": "Import Tablet", "price": 300, "currency": "USD", "category_path": "/Import Test"}`,
+			`{"name": "Import Watch", "colour": "blue"}`)
+
+		resp = postImport(t, ts, "application/x-ndjson", strings.Join(lines, "\n"))
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		report = models.ImportReport{}
+		err = json.NewDecoder(resp.Body).Decode(&report)
+		assert.NoError(t, err)
+		assert.True(t, report.Complete)
+		assert.Equal(t, 4, report.Rows)
+		assert.Equal(t, 1, report.Created)
+		assert.Equal(t, 2, report.Updated)
+		assert.Equal(t, 1, report.Failed)
+		assert.Equal(t, 0, report.CategoriesCreated)
+		if assert.Len(t, report.Errors, 1) {
+			assert.Equal(t, 4, report.Errors[0].Row)
+			assert.Contains(t, report.Errors[0].Error, "colour")
+		}
+
+		resp = MakeRequest(t, ts, "GET", "/api/products/"+exported[1].ID, nil, nil)
+		defer resp.Body.Close()
+
+		var product models.Product
+		err = json.NewDecoder(resp.Body).Decode(&product)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(14999), product.Price.Amount)
+		assert.Equal(t, 7, product.Stock)
+		assert.Equal(t, phones.ID, product.CategoryID)
+
+		resp = MakeRequest(t, ts, "GET", "/api/products/export?category="+root.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		rows, err := csv.NewReader(resp.Body).ReadAll()
+		assert.NoError(t, err)
+		if assert.Len(t, rows, 4) {
+			assert.Equal(t, models.ProductRecordFields, rows[0])
+			assert.Equal(t, []string{exported[1].ID, "Import Phone", "", "149.99", "USD", "/Import Test/Phones", "7", "", ""}, rows[2])
+			assert.Equal(t, "Import Tablet", rows[3][1])
+			assert.Equal(t, "300.00", rows[3][3])
+		}
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), root.ID, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("ValidatesCategoryNames", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		file := strings.Join([]string{
+			"name,price,currency,category_path",
+			`Named Lamp,10.00,USD,/Named Import/ Lamps `,
+			`Blank Lamp,10.00,USD,/Named Import/Blank//Lamps`,
+			`Trailing Lamp,10.00,USD,/Named Import/Trailing/`,
+			`Long Lamp,10.00,USD,/Named Import/Long/` + strings.Repeat("x", 256),
+		}, "\n")
+
+		resp := postImport(t, ts, "text/csv", file)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var report models.ImportReport
+		err := json.NewDecoder(resp.Body).Decode(&report)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, report.Created)
+		assert.Equal(t, 3, report.Failed)
+		assert.Equal(t, 2, report.CategoriesCreated)
+		if assert.Len(t, report.Errors, 3) {
+			assert.Contains(t, report.Errors[0].Error, "name must not be empty")
+			assert.Contains(t, report.Errors[1].Error, "name must not be empty")
+			assert.Contains(t, report.Errors[2].Error, "at most 255 characters")
+		}
+
+		// Names are trimmed like those of categories created directly, and
+		// rejected rows leave no categories behind
+		categories, err := categoryRepo.GetAll(context.Background())
+		assert.NoError(t, err)
+		var paths []string
+		var root uuid.UUID
+		for _, category := range categories {
+			if strings.HasPrefix(category.Path, "/Named Import") {
+				paths = append(paths, category.Path)
+			}
+			if category.Path == "/Named Import" {
+				root = category.ID
+			}
+		}
+		assert.ElementsMatch(t, []string{"/Named Import", "/Named Import/Lamps"}, paths)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), root, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("RejectsUnreadableFiles", func(t *testing.T) {
+		resp := postImport(t, ts, "application/json", `{"name": "Widget"}`)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+		resp = postImport(t, ts, "text/csv", "name,price,category_path,colour\nWidget,1.00,/Widgets,blue\n")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = postImport(t, ts, "text/csv", "name,price\nWidget,1.00\n")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = postImport(t, ts, "text/csv", "")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", "/api/products/export?format=xml", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
@@ -0,0 +1,454 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// createTestWarehouse creates a warehouse with a unique code through the API
+func createTestWarehouse(t *testing.T, ts *TestServer, warehouse map[string]interface{}) models.Warehouse {
+	warehouse["code"] = fmt.Sprintf("TEST-%06d", rand.Intn(1000000))
+	resp := MakeRequest(t, ts, "POST", "/api/warehouses", warehouse, nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var created models.Warehouse
+	err := json.NewDecoder(resp.Body).Decode(&created)
+	assert.NoError(t, err)
+	return created
+}
+
+// getInventoryLevels gets the inventory levels listed at a path
+func getInventoryLevels(t *testing.T, ts *TestServer, path string) map[uuid.UUID]models.InventoryLevel {
+	resp := MakeRequest(t, ts, "GET", path, nil, nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var levels []models.InventoryLevel
+	err := json.NewDecoder(resp.Body).Decode(&levels)
+	assert.NoError(t, err)
+
+	byWarehouse := make(map[uuid.UUID]models.InventoryLevel, len(levels))
+	for _, level := range levels {
+		byWarehouse[level.WarehouseID] = level
+	}
+	return byWarehouse
+}
+
+// defaultWarehouse finds the default warehouse through the API
+func defaultWarehouse(t *testing.T, ts *TestServer) models.Warehouse {
+	resp := MakeRequest(t, ts, "GET", "/api/warehouses", nil, nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var warehouses []models.Warehouse
+	err := json.NewDecoder(resp.Body).Decode(&warehouses)
+	assert.NoError(t, err)
+	for _, warehouse := range warehouses {
+		if warehouse.IsDefault {
+			return warehouse
+		}
+	}
+	t.Fatal("no default warehouse")
+	return models.Warehouse{}
+}
+
+// getReconciliation gets the reconciliation report of a product through the API
+func getReconciliation(t *testing.T, ts *TestServer, query string) models.ReconciliationReport {
+	resp := MakeRequest(t, ts, "GET", "/api/inventory/reconciliation?"+query, nil, nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var report models.ReconciliationReport
+	err := json.NewDecoder(resp.Body).Decode(&report)
+	assert.NoError(t, err)
+	return report
+}
+
+// TestInventory tests warehouses, stock transfers and the allocation of orders
+// to warehouses
+func TestInventory(t *testing.T) {
+	ts := SetupTestServer(t)
+	defer ts.CleanupTestServer(t)
+
+	staff := AuthHeaders(t, uuid.New(), "staff@example.com")
+
+	t.Run("Warehouses", func(t *testing.T) {
+		main := defaultWarehouse(t, ts)
+		assert.True(t, main.Active)
+
+		warehouse := createTestWarehouse(t, ts, map[string]interface{}{
+			"name":     "Mombasa Depot",
+			"location": map[string]interface{}{"latitude": -4.0435, "longitude": 39.6682},
+			"priority": 5,
+		})
+		assert.True(t, warehouse.Active)
+		assert.False(t, warehouse.IsDefault)
+		assert.Equal(t, 5, warehouse.Priority)
+
+		resp := MakeRequest(t, ts, "POST", "/api/warehouses", map[string]interface{}{
+			"code": warehouse.Code,
+			"name": "Duplicate",
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		for _, invalid := range []map[string]interface{}{
+			{"code": "", "name": "No code"},
+			{"code": "BAD-LOCATION", "name": "Bad location", "location": map[string]interface{}{"latitude": 91, "longitude": 0}},
+			{"code": "BAD-PRIORITY", "name": "Bad priority", "priority": -1},
+		} {
+			resp = MakeRequest(t, ts, "POST", "/api/warehouses", invalid, nil)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		}
+
+		resp = MakeRequest(t, ts, "PUT", "/api/warehouses/"+main.ID.String(), map[string]interface{}{
+			"code":   main.Code,
+			"name":   main.Name,
+			"active": false,
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "PUT", "/api/warehouses/"+warehouse.ID.String(), map[string]interface{}{
+			"code":   warehouse.Code,
+			"name":   "Mombasa Port Depot",
+			"active": false,
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var updated models.Warehouse
+		err := json.NewDecoder(resp.Body).Decode(&updated)
+		assert.NoError(t, err)
+		assert.Equal(t, "Mombasa Port Depot", updated.Name)
+		assert.False(t, updated.Active)
+		assert.Nil(t, updated.Location)
+
+		resp = MakeRequest(t, ts, "GET", "/api/warehouses/"+uuid.New().String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("TransferAndAllocate", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+		customerRepo := ts.Repos.Customers
+		orderRepo := ts.Repos.Orders
+
+		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		productPath := "/api/products/" + product.ID.String()
+
+		main := defaultWarehouse(t, ts)
+		levels := getInventoryLevels(t, ts, productPath+"/inventory")
+		assert.Len(t, levels, 1)
+		assert.Equal(t, product.Stock, levels[main.ID].OnHand)
+		assert.Equal(t, product.Stock, levels[main.ID].Available)
+
+		nairobi := createTestWarehouse(t, ts, map[string]interface{}{
+			"name":     "Nairobi Hub",
+			"location": map[string]interface{}{"latitude": -1.2921, "longitude": 36.8219},
+		})
+
+		transfer := map[string]interface{}{
+			"product_id":        product.ID,
+			"from_warehouse_id": main.ID,
+			"to_warehouse_id":   nairobi.ID,
+			"quantity":          6,
+			"note":              "restock Nairobi",
+		}
+		resp := MakeRequest(t, ts, "POST", "/api/inventory/transfers", transfer, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "POST", "/api/inventory/transfers", transfer, staff)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var created models.StockTransfer
+		err := json.NewDecoder(resp.Body).Decode(&created)
+		assert.NoError(t, err)
+		assert.NotEqual(t, uuid.Nil, created.ID)
+		assert.Equal(t, "staff@example.com", created.CreatedBy)
+
+		transfer["quantity"] = 100
+		resp = MakeRequest(t, ts, "POST", "/api/inventory/transfers", transfer, staff)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		transfer["to_warehouse_id"] = main.ID
+		resp = MakeRequest(t, ts, "POST", "/api/inventory/transfers", transfer, staff)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		transfer["to_warehouse_id"] = uuid.New()
+		transfer["quantity"] = 1
+		resp = MakeRequest(t, ts, "POST", "/api/inventory/transfers", transfer, staff)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		levels = getInventoryLevels(t, ts, productPath+"/inventory")
+		assert.Equal(t, 4, levels[main.ID].OnHand)
+		assert.Equal(t, 6, levels[nairobi.ID].OnHand)
+
+		// The Nairobi hub is nearest and can supply the whole line
+		resp = MakeRequest(t, ts, "POST", "/api/orders", map[string]interface{}{
+			"customer_id": customer.ID,
+			"items":       []map[string]interface{}{{"product_id": product.ID, "quantity": 5}},
+			"ship_to":     map[string]interface{}{"latitude": -1.2864, "longitude": 36.8172},
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var order models.Order
+		err = json.NewDecoder(resp.Body).Decode(&order)
+		assert.NoError(t, err)
+		assert.NotNil(t, order.ShipTo)
+		if assert.Len(t, order.Items, 1) && assert.Len(t, order.Items[0].Allocations, 1) {
+			assert.Equal(t, nairobi.ID, order.Items[0].Allocations[0].WarehouseID)
+			assert.Equal(t, 5, order.Items[0].Allocations[0].Quantity)
+		}
+
+		levels = getInventoryLevels(t, ts, "/api/warehouses/"+nairobi.ID.String()+"/inventory")
+		assert.Equal(t, 6, levels[nairobi.ID].OnHand)
+		assert.Equal(t, 5, levels[nairobi.ID].Reserved)
+		assert.Equal(t, 1, levels[nairobi.ID].Available)
+
+		// A warehouse holding stock cannot be deactivated
+		resp = MakeRequest(t, ts, "PUT", "/api/warehouses/"+nairobi.ID.String(), map[string]interface{}{
+			"code":   nairobi.Code,
+			"name":   nairobi.Name,
+			"active": false,
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		for _, status := range []string{models.OrderStatusProcessing, models.OrderStatusShipped} {
+			resp = MakeRequest(t, ts, "PUT", "/api/orders/"+order.ID.String()+"/status", map[string]interface{}{"status": status}, staff)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+
+		levels = getInventoryLevels(t, ts, productPath+"/inventory")
+		assert.Equal(t, 1, levels[nairobi.ID].OnHand)
+		assert.Equal(t, 0, levels[nairobi.ID].Reserved)
+
+		resp = MakeRequest(t, ts, "GET", "/api/inventory/movements?product_id="+product.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var movements []models.InventoryMovement
+		err = json.NewDecoder(resp.Body).Decode(&movements)
+		assert.NoError(t, err)
+		types := make([]string, len(movements))
+		for i, movement := range movements {
+			types[i] = movement.Type
+		}
+		assert.ElementsMatch(t, []string{models.MovementInitial, models.MovementTransferOut, models.MovementTransferIn,
+			models.MovementSale, models.MovementShipment}, types)
+		if assert.NotEmpty(t, movements) {
+			assert.Equal(t, models.MovementShipment, movements[0].Type)
+			assert.Equal(t, -5, movements[0].OnHandChange)
+			assert.Equal(t, -5, movements[0].ReservedChange)
+			assert.Equal(t, order.ID, *movements[0].OrderID)
+		}
+
+		resp = MakeRequest(t, ts, "GET", "/api/inventory/movements?limit=0", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		//cleanup
+		err = orderRepo.Delete(context.Background(), order.ID)
+		assert.NoError(t, err)
+
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("CancelReleasesReservation", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+		customerRepo := ts.Repos.Customers
+		productRepo := ts.Repos.Products
+
+		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		order := CreateTestOrder(t, ts, customer.ID, product.ID)
+
+		main := defaultWarehouse(t, ts)
+		levels := getInventoryLevels(t, ts, "/api/products/"+product.ID.String()+"/inventory")
+		assert.Equal(t, 2, levels[main.ID].Reserved)
+		assert.Equal(t, product.Stock-2, levels[main.ID].Available)
+
+		resp := MakeRequest(t, ts, "PUT", "/api/orders/"+order.ID.String()+"/status", map[string]interface{}{"status": "cancelled"}, staff)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		levels = getInventoryLevels(t, ts, "/api/products/"+product.ID.String()+"/inventory")
+		assert.Equal(t, product.Stock, levels[main.ID].OnHand)
+		assert.Equal(t, 0, levels[main.ID].Reserved)
+
+		stored, err := productRepo.GetByID(context.Background(), product.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, product.Stock, stored.Stock)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("AdjustAndReconcile", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+		productRepo := ts.Repos.Products
+
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		main := defaultWarehouse(t, ts)
+
+		adjust := func(adjustment map[string]interface{}) *http.Response {
+			adjustment["product_id"] = product.ID
+			adjustment["warehouse_id"] = main.ID
+			return MakeRequest(t, ts, "POST", "/api/inventory/adjustments", adjustment, staff)
+		}
+
+		resp := MakeRequest(t, ts, "POST", "/api/inventory/adjustments", map[string]interface{}{
+			"product_id": product.ID, "warehouse_id": main.ID, "change": 5, "reason": "stock_take",
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = adjust(map[string]interface{}{"change": 5, "reason": "stock_take", "note": "annual count"})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var counted models.StockAdjustment
+		err := json.NewDecoder(resp.Body).Decode(&counted)
+		assert.NoError(t, err)
+		assert.NotEqual(t, uuid.Nil, counted.ID)
+		assert.Equal(t, product.Stock+5, counted.OnHand)
+		assert.Equal(t, product.Stock+5, counted.Available)
+		assert.Equal(t, "staff@example.com", counted.CreatedBy)
+
+		resp = adjust(map[string]interface{}{"change": -3, "reason": "damage"})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		for _, invalid := range []map[string]interface{}{
+			{"change": 1, "reason": "damage"},
+			{"change": 1, "reason": "sale"},
+			{"change": 0, "reason": "adjustment"},
+		} {
+			resp = adjust(invalid)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		}
+
+		resp = adjust(map[string]interface{}{"change": -100, "reason": "adjustment"})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		stored, err := productRepo.GetByID(context.Background(), product.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, product.Stock+2, stored.Stock)
+
+		resp = MakeRequest(t, ts, "GET", "/api/inventory/movements?product_id="+product.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var movements []models.InventoryMovement
+		err = json.NewDecoder(resp.Body).Decode(&movements)
+		assert.NoError(t, err)
+		if assert.Len(t, movements, 3) {
+			assert.Equal(t, models.MovementDamage, movements[0].Type)
+			assert.Equal(t, -3, movements[0].OnHandChange)
+			assert.Equal(t, models.MovementStockTake, movements[1].Type)
+			assert.Equal(t, counted.ID, movements[1].ID)
+			assert.Equal(t, "annual count", movements[1].Note)
+			assert.Equal(t, "staff@example.com", movements[1].CreatedBy)
+		}
+
+		// Adding a variant writes the product's own stock off
+		variant := createTestVariant(t, ts, product.ID.String(), map[string]interface{}{
+			"sku":   fmt.Sprintf("ADJ-%06d", rand.Intn(1000000)),
+			"stock": 4,
+		})
+
+		resp = adjust(map[string]interface{}{"change": 1, "reason": "adjustment"})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = adjust(map[string]interface{}{"change": -1, "reason": "damage", "variant_id": variant.ID})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		report := getReconciliation(t, ts, "product_id="+product.ID.String())
+		assert.Equal(t, 0, report.Drifted)
+		assert.Len(t, report.Levels, 2)
+		for _, level := range report.Levels {
+			assert.False(t, level.Drift)
+			assert.Equal(t, level.OnHand, level.LedgerOnHand)
+		}
+		if assert.Len(t, report.Stock, 2) {
+			assert.Nil(t, report.Stock[0].VariantID)
+			assert.Equal(t, 3, report.Stock[0].Stock)
+			assert.Equal(t, 3, report.Stock[0].LedgerStock)
+			assert.Equal(t, variant.ID, *report.Stock[1].VariantID)
+			assert.Equal(t, 3, report.Stock[1].LedgerStock)
+		}
+
+		report = getReconciliation(t, ts, "drift=true&product_id="+product.ID.String())
+		assert.Empty(t, report.Levels)
+		assert.Empty(t, report.Stock)
+
+		resp = MakeRequest(t, ts, "GET", "/api/inventory/reconciliation?product_id=not-a-uuid", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+}
+
+func TestReconciliationReportFlagsDrift(t *testing.T) {
+	levels := []models.LevelReconciliation{
+		{WarehouseCode: "MAIN", OnHand: 10, Reserved: 2, LedgerOnHand: 10, LedgerReserved: 2},
+		{WarehouseCode: "NBO", OnHand: 4, LedgerOnHand: 6},
+	}
+	stock := []models.StockReconciliation{
+		{Name: "Kept", Stock: 8, LedgerStock: 8},
+		{Name: "Drifted", Stock: 5, LedgerStock: 3},
+	}
+
+	report := models.NewReconciliationReport(levels, stock, time.Now())
+	assert.Equal(t, 2, report.Drifted)
+	assert.False(t, report.Levels[0].Drift)
+	assert.True(t, report.Levels[1].Drift)
+	assert.True(t, report.Stock[1].Drift)
+
+	drifted := report.DriftOnly()
+	assert.Equal(t, 2, drifted.Drifted)
+	if assert.Len(t, drifted.Levels, 1) && assert.Len(t, drifted.Stock, 1) {
+		assert.Equal(t, "NBO", drifted.Levels[0].WarehouseCode)
+		assert.Equal(t, "Drifted", drifted.Stock[0].Name)
+	}
+	assert.Len(t, report.Levels, 2)
+}
@@ -0,0 +1,148 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"commerce-app/internal/database"
+	"commerce-app/internal/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRepositoriesConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	repos := database.NewMemoryRepositories()
+
+	category := &models.Category{Name: "Concurrent"}
+	assert.NoError(t, repos.Categories.Create(ctx, category))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			product := &models.Product{Name: "Product", Price: models.NewMoney(1000, models.DefaultCurrency), CategoryID: category.ID, Stock: 1}
+			assert.NoError(t, repos.Products.Create(ctx, product))
+			_, err := repos.Products.List(ctx, models.ProductFilter{})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	products, err := repos.Products.GetByCategory(ctx, category.ID)
+	assert.NoError(t, err)
+	assert.Len(t, products, 50)
+}
+
+func TestMemoryRepositoriesCascadeDelete(t *testing.T) {
+	ctx := context.Background()
+	repos := database.NewMemoryRepositories()
+
+	customer := &models.Customer{Email: "cascade@example.com", Name: "Cascade", Phone: "0700000000"}
+	assert.NoError(t, repos.Customers.Create(ctx, customer))
+
+	parent := &models.Category{Name: "Parent"}
+	assert.NoError(t, repos.Categories.Create(ctx, parent))
+	child := &models.Category{Name: "Child", ParentID: &parent.ID}
+	assert.NoError(t, repos.Categories.Create(ctx, child))
+	assert.Equal(t, "/Parent/Child", child.Path)
+
+	product := &models.Product{Name: "Product", Price: models.NewMoney(500, models.DefaultCurrency), CategoryID: child.ID, Stock: 3}
+	assert.NoError(t, repos.Products.Create(ctx, product))
+
+	order := &models.Order{
+		CustomerID: customer.ID,
+		Status:     "pending",
+		Items:      []models.OrderItem{{ProductID: product.ID, Quantity: 1, Price: models.NewMoney(500, models.DefaultCurrency)}},
+	}
+	assert.NoError(t, repos.Orders.Create(ctx, order))
+
+	// Duplicate emails are rejected like the unique constraint
+	assert.Error(t, repos.Customers.Create(ctx, &models.Customer{Email: customer.Email}))
+
+	assert.NoError(t, repos.Categories.Delete(ctx, parent.ID, 0))
+
+	_, err := repos.Categories.GetByID(ctx, child.ID)
+	assert.Error(t, err)
+	_, err = repos.Products.GetByID(ctx, product.ID)
+	assert.Error(t, err)
+
+	retrieved, err := repos.Orders.GetByID(ctx, order.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, retrieved.Items)
+
+	assert.NoError(t, repos.Customers.Delete(ctx, customer.ID))
+	_, err = repos.Orders.GetByID(ctx, order.ID)
+	assert.Error(t, err)
+}
+
+func TestRepositoriesReportCanceledQueries(t *testing.T) {
+	repos := database.NewMemoryRepositories()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := repos.Products.List(ctx, models.ProductFilter{})
+	assert.True(t, errors.Is(err, database.ErrQueryCanceled))
+	assert.False(t, errors.Is(err, database.ErrQueryTimeout))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	_, err = repos.Categories.GetAll(ctx)
+	assert.True(t, errors.Is(err, database.ErrQueryTimeout))
+}
+
+func TestMemoryIdempotencyKeysExpire(t *testing.T) {
+	ctx := context.Background()
+	repos := database.NewMemoryRepositories()
+
+	record := &models.IdempotencyRecord{Key: "retry-me", RequestHash: "a", ExpiresAt: time.Now().Add(-time.Second)}
+	existing, err := repos.Idempotency.Reserve(ctx, record)
+	assert.NoError(t, err)
+	assert.Nil(t, existing)
+
+	// The first reservation has already expired, so the key can be claimed again
+	record = &models.IdempotencyRecord{Key: "retry-me", RequestHash: "b", ExpiresAt: time.Now().Add(time.Hour)}
+	existing, err = repos.Idempotency.Reserve(ctx, record)
+	assert.NoError(t, err)
+	assert.Nil(t, existing)
+
+	existing, err = repos.Idempotency.Reserve(ctx, &models.IdempotencyRecord{Key: "retry-me", RequestHash: "b", ExpiresAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	if assert.NotNil(t, existing) {
+		assert.Equal(t, "b", existing.RequestHash)
+		assert.False(t, existing.Completed())
+	}
+}
+
+func TestMemoryIdempotencyDeleteExpired(t *testing.T) {
+	ctx := context.Background()
+	repos := database.NewMemoryRepositories()
+
+	for _, record := range []*models.IdempotencyRecord{
+		{Key: "expired", RequestHash: "a", ExpiresAt: time.Now().Add(-time.Second)},
+		{Key: "live", RequestHash: "b", ExpiresAt: time.Now().Add(time.Hour)},
+	} {
+		existing, err := repos.Idempotency.Reserve(ctx, record)
+		assert.NoError(t, err)
+		assert.Nil(t, existing)
+	}
+
+	deleted, err := repos.Idempotency.DeleteExpired(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+
+	// The live key still holds its reservation
+	existing, err := repos.Idempotency.Reserve(ctx, &models.IdempotencyRecord{Key: "live", RequestHash: "b", ExpiresAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.NotNil(t, existing)
+
+	deleted, err = repos.Idempotency.DeleteExpired(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+}
@@ -0,0 +1,23 @@
+package tests
+
+import (
+	"testing"
+
+	"commerce-app/internal/database"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationsAreOrderedAndReversible(t *testing.T) {
+	migrations := database.Migrations()
+	assert.NotEmpty(t, migrations)
+
+	for i, m := range migrations {
+		assert.NotEmpty(t, m.Up, "migration %d has no up statement", m.Version)
+		assert.NotEmpty(t, m.Down, "migration %d has no down statement", m.Version)
+		assert.NotEmpty(t, m.Description, "migration %d has no description", m.Version)
+		if i > 0 {
+			assert.Greater(t, m.Version, migrations[i-1].Version, "migration versions must be unique")
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package tests
+
+import (
+	"encoding/json"
+	"testing"
+
+	"commerce-app/internal/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMoney(t *testing.T) {
+	price, err := models.ParseMoney("999.99", "KES")
+	assert.NoError(t, err)
+	assert.Equal(t, models.NewMoney(99999, "KES"), price)
+
+	price, err = models.ParseMoney("5", "")
+	assert.NoError(t, err)
+	assert.Equal(t, models.NewMoney(500, models.DefaultCurrency), price)
+
+	price, err = models.ParseMoney("1500", "UGX")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1500), price.Amount)
+
+	_, err = models.ParseMoney("1.005", "KES")
+	assert.Error(t, err)
+
+	_, err = models.ParseMoney("abc", "KES")
+	assert.Error(t, err)
+}
+
+func TestMoneyArithmeticDoesNotDrift(t *testing.T) {
+	tenCents := models.NewMoney(10, "KES")
+
+	total := models.Money{}
+	for i := 0; i < 3; i++ {
+		var err error
+		total, err = total.Add(tenCents)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, "0.30", total.Decimal())
+	assert.Equal(t, "KES 2999.97", models.NewMoney(99999, "KES").Mul(3).String())
+
+	_, err := total.Add(models.NewMoney(10, "USD"))
+	assert.Error(t, err)
+}
+
+func TestMoneyJSON(t *testing.T) {
+	encoded, err := json.Marshal(models.NewMoney(99999, "KES"))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"amount": 99999, "currency": "KES"}`, string(encoded))
+
+	var price models.Money
+	assert.NoError(t, json.Unmarshal([]byte(`{"amount": 250, "currency": "usd"}`), &price))
+	assert.Equal(t, models.NewMoney(250, "USD"), price)
+
+	// Plain decimals are read exactly in the default currency
+	assert.NoError(t, json.Unmarshal([]byte(`0.29`), &price))
+	assert.Equal(t, models.NewMoney(29, models.DefaultCurrency), price)
+
+	assert.NoError(t, json.Unmarshal([]byte(`"19.90"`), &price))
+	assert.Equal(t, models.NewMoney(1990, models.DefaultCurrency), price)
+}
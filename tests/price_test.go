@@ -0,0 +1,207 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// getPriceTimeline gets a product's price timeline through the API
+func getPriceTimeline(t *testing.T, ts *TestServer, productID string) models.PriceTimeline {
+	resp := MakeRequest(t, ts, "GET", "/api/products/"+productID+"/prices", nil, nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var timeline models.PriceTimeline
+	err := json.NewDecoder(resp.Body).Decode(&timeline)
+	assert.NoError(t, err)
+	return timeline
+}
+
+// createTestSchedule schedules a price change through the API
+func createTestSchedule(t *testing.T, ts *TestServer, productID string, schedule map[string]interface{}) models.PriceSchedule {
+	resp := MakeRequest(t, ts, "POST", "/api/products/"+productID+"/prices/schedules", schedule,
+		AuthHeaders(t, uuid.New(), "pricing@example.com"))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var created models.PriceSchedule
+	err := json.NewDecoder(resp.Body).Decode(&created)
+	assert.NoError(t, err)
+	return created
+}
+
+// TestPriceSchedules tests the price history and scheduled price changes of a product
+func TestPriceSchedules(t *testing.T) {
+	ts := SetupTestServer(t)
+	defer ts.CleanupTestServer(t)
+
+	staff := AuthHeaders(t, uuid.New(), "pricing@example.com")
+
+	t.Run("SaleStartsAndEnds", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+		priceRepo := ts.Repos.Prices
+
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		productPath := "/api/products/" + product.ID.String()
+
+		resp := MakeRequest(t, ts, "PATCH", productPath, map[string]interface{}{"price": "89.99"}, staff)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		regular := models.NewMoney(8999, models.DefaultCurrency)
+		sale := models.NewMoney(4999, models.DefaultCurrency)
+		now := time.Now()
+		scheduled := createTestSchedule(t, ts, product.ID.String(), map[string]interface{}{
+			"price":     "49.99",
+			"starts_at": now.Add(time.Hour),
+			"ends_at":   now.Add(2 * time.Hour),
+		})
+		assert.Equal(t, models.PriceSchedulePending, scheduled.Status)
+		assert.Equal(t, sale, scheduled.Price)
+		assert.Equal(t, "pricing@example.com", scheduled.CreatedBy)
+
+		// Scheduling a price change needs an authenticated user
+		resp = MakeRequest(t, ts, "POST", productPath+"/prices/schedules", map[string]interface{}{
+			"price":     "39.99",
+			"starts_at": now.Add(3 * time.Hour),
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		for _, invalid := range []map[string]interface{}{
+			{"price": "-1.00", "starts_at": now.Add(3 * time.Hour)},
+			{"price": map[string]interface{}{"amount": 1000, "currency": "USD"}, "starts_at": now.Add(3 * time.Hour)},
+			{"price": "39.99", "starts_at": now.Add(4 * time.Hour), "ends_at": now.Add(3 * time.Hour)},
+			{"price": "39.99", "starts_at": now.Add(-2 * time.Hour), "ends_at": now.Add(-time.Hour)},
+		} {
+			resp = MakeRequest(t, ts, "POST", productPath+"/prices/schedules", invalid, staff)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		}
+
+		// Another sale cannot hold the price while the first one runs
+		resp = MakeRequest(t, ts, "POST", productPath+"/prices/schedules", map[string]interface{}{
+			"price":     "39.99",
+			"starts_at": now.Add(90 * time.Minute),
+			"ends_at":   now.Add(3 * time.Hour),
+		}, staff)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		started, ended, err := priceRepo.ApplySchedules(context.Background(), now.Add(61*time.Minute))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, started)
+		assert.Equal(t, 0, ended)
+
+		resp = MakeRequest(t, ts, "GET", "/api/products?category="+category.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var page models.ProductPage
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		assert.NoError(t, err)
+		if assert.Len(t, page.Products, 1) {
+			assert.Equal(t, sale, page.Products[0].Price)
+			if assert.NotNil(t, page.Products[0].RegularPrice) {
+				assert.Equal(t, regular, *page.Products[0].RegularPrice)
+			}
+		}
+
+		started, ended, err = priceRepo.ApplySchedules(context.Background(), now.Add(121*time.Minute))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, started)
+		assert.Equal(t, 1, ended)
+
+		timeline := getPriceTimeline(t, ts, product.ID.String())
+		assert.Equal(t, regular, timeline.Price)
+		assert.Nil(t, timeline.RegularPrice)
+		if assert.Len(t, timeline.Schedules, 1) {
+			assert.Equal(t, models.PriceScheduleCompleted, timeline.Schedules[0].Status)
+			if assert.NotNil(t, timeline.Schedules[0].PreviousPrice) {
+				assert.Equal(t, regular, *timeline.Schedules[0].PreviousPrice)
+			}
+		}
+		if assert.Len(t, timeline.History, 4) {
+			sources := []string{models.PriceSourceCreated, models.PriceSourceUpdated,
+				models.PriceSourceScheduled, models.PriceSourceScheduleEnd}
+			actors := []string{"anonymous", "pricing@example.com", "pricing@example.com", "pricing@example.com"}
+			for i, change := range timeline.History {
+				assert.Equal(t, sources[i], change.Source)
+				assert.Equal(t, actors[i], change.ChangedBy)
+			}
+			assert.Nil(t, timeline.History[0].OldPrice)
+			assert.Equal(t, product.Price, timeline.History[0].NewPrice)
+			assert.Equal(t, scheduled.ID, *timeline.History[2].ScheduleID)
+			assert.Equal(t, sale, *timeline.History[3].OldPrice)
+			assert.Equal(t, regular, timeline.History[3].NewPrice)
+		}
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("ChangeNowAndCancel", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		productPath := "/api/products/" + product.ID.String()
+
+		// A change without a start is applied straight away
+		changed := createTestSchedule(t, ts, product.ID.String(), map[string]interface{}{"price": "79.99"})
+		assert.Equal(t, models.PriceScheduleCompleted, changed.Status)
+
+		resp := MakeRequest(t, ts, "GET", productPath, nil, nil)
+		defer resp.Body.Close()
+
+		var detail models.Product
+		err := json.NewDecoder(resp.Body).Decode(&detail)
+		assert.NoError(t, err)
+		assert.Equal(t, models.NewMoney(7999, models.DefaultCurrency), detail.Price)
+		assert.Nil(t, detail.RegularPrice)
+
+		pending := createTestSchedule(t, ts, product.ID.String(), map[string]interface{}{
+			"price":     "59.99",
+			"starts_at": time.Now().Add(24 * time.Hour),
+			"ends_at":   time.Now().Add(48 * time.Hour),
+		})
+
+		resp = MakeRequest(t, ts, "DELETE", productPath+"/prices/schedules/"+pending.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "DELETE", productPath+"/prices/schedules/"+pending.ID.String(), nil, staff)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "DELETE", productPath+"/prices/schedules/"+pending.ID.String(), nil, staff)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "DELETE", productPath+"/prices/schedules/not-a-uuid", nil, staff)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		timeline := getPriceTimeline(t, ts, product.ID.String())
+		assert.Equal(t, models.NewMoney(7999, models.DefaultCurrency), timeline.Price)
+		assert.Len(t, timeline.History, 2)
+		if assert.Len(t, timeline.Schedules, 2) {
+			assert.Equal(t, models.PriceScheduleCompleted, timeline.Schedules[0].Status)
+			assert.Equal(t, models.PriceScheduleCancelled, timeline.Schedules[1].Status)
+		}
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,265 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"commerce-app/internal/database"
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSoftDeleteRoutes tests deleting and restoring products, categories and customers
+func TestSoftDeleteRoutes(t *testing.T) {
+	ts := SetupTestServer(t)
+	defer ts.CleanupTestServer(t)
+
+	admin := AuthHeaders(t, uuid.New(), "admin@example.com")
+
+	t.Run("DeleteCategoryHidesSubtree", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+		productRepo := ts.Repos.Products
+
+		parent := CreateTestCategory(t, ts, nil)
+		child := CreateTestCategory(t, ts, &parent.ID)
+		product := CreateTestProduct(t, ts, child.ID)
+		deletedEarlier := CreateTestProduct(t, ts, child.ID)
+
+		resp := MakeRequest(t, ts, "DELETE", "/api/products/"+deletedEarlier.ID.String(), nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "DELETE", "/api/categories/"+parent.ID.String(), nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		for _, path := range []string{
+			"/api/categories/" + parent.ID.String(),
+			"/api/categories/" + child.ID.String(),
+			"/api/products/" + product.ID.String(),
+		} {
+			resp = MakeRequest(t, ts, "GET", path, nil, nil)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+		}
+
+		resp = MakeRequest(t, ts, "GET", "/api/admin/deleted/categories", nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var categories []models.Category
+		err := json.NewDecoder(resp.Body).Decode(&categories)
+		assert.NoError(t, err)
+		assert.Len(t, categories, 2)
+		for _, category := range categories {
+			assert.NotNil(t, category.DeletedAt)
+		}
+
+		// A subcategory cannot be restored into a deleted parent
+		resp = MakeRequest(t, ts, "POST", "/api/admin/categories/"+child.ID.String()+"/restore", nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "POST", "/api/admin/categories/"+parent.ID.String()+"/restore", nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var restored models.Category
+		err = json.NewDecoder(resp.Body).Decode(&restored)
+		assert.NoError(t, err)
+		assert.Equal(t, parent.ID, restored.ID)
+		assert.Nil(t, restored.DeletedAt)
+
+		_, err = categoryRepo.GetByID(context.Background(), child.ID)
+		assert.NoError(t, err)
+
+		_, err = productRepo.GetByID(context.Background(), product.ID)
+		assert.NoError(t, err)
+
+		// Products deleted on their own stay deleted
+		_, err = productRepo.GetByID(context.Background(), deletedEarlier.ID)
+		assert.Error(t, err)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), parent.ID, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("RestoreProduct", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+
+		resp := MakeRequest(t, ts, "POST", "/api/admin/products/"+product.ID.String()+"/restore", nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "DELETE", "/api/products/"+product.ID.String(), nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", "/api/products", nil, nil)
+		defer resp.Body.Close()
+
+		var page models.ProductPage
+		err := json.NewDecoder(resp.Body).Decode(&page)
+		assert.NoError(t, err)
+		for _, listed := range page.Products {
+			assert.NotEqual(t, product.ID, listed.ID)
+		}
+
+		resp = MakeRequest(t, ts, "GET", "/api/admin/deleted/products", nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var deleted []models.Product
+		err = json.NewDecoder(resp.Body).Decode(&deleted)
+		assert.NoError(t, err)
+		assert.Len(t, deleted, 1)
+		assert.Equal(t, product.ID, deleted[0].ID)
+
+		resp = MakeRequest(t, ts, "POST", "/api/admin/products/"+product.ID.String()+"/restore", nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", "/api/products/"+product.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("OrdersOfDeletedCategory", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+		customerRepo := ts.Repos.Customers
+
+		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		order := CreateTestOrder(t, ts, customer.ID, product.ID)
+
+		resp := MakeRequest(t, ts, "DELETE", "/api/categories/"+category.ID.String(), nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		// Orders stay readable with the deleted category of their products
+		resp = MakeRequest(t, ts, "GET", "/api/orders/"+order.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var read models.Order
+		err := json.NewDecoder(resp.Body).Decode(&read)
+		assert.NoError(t, err)
+		if assert.Len(t, read.Items, 1) {
+			assert.Equal(t, category.ID, read.Items[0].Product.Category.ID)
+			assert.NotNil(t, read.Items[0].Product.Category.DeletedAt)
+		}
+
+		resp = MakeRequest(t, ts, "GET", "/api/customers/"+customer.ID.String()+"/orders", nil,
+			AuthHeaders(t, customer.ID, customer.Email))
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("DeleteAndRestoreCustomer", func(t *testing.T) {
+		customerRepo := ts.Repos.Customers
+
+		customer, _ := ts.GetTestCustomer(t)
+
+		resp := MakeRequest(t, ts, "DELETE", "/api/customers/"+customer.ID.String(), nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", "/api/customers/"+customer.ID.String(), nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", "/api/admin/deleted/customers", nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var deleted []models.Customer
+		err := json.NewDecoder(resp.Body).Decode(&deleted)
+		assert.NoError(t, err)
+		assert.Len(t, deleted, 1)
+
+		resp = MakeRequest(t, ts, "POST", "/api/admin/customers/"+customer.ID.String()+"/restore", nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", "/api/customers/"+customer.ID.String(), nil, admin)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		//cleanup
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+	})
+}
+
+func TestMemoryPurgeDeleted(t *testing.T) {
+	ctx := context.Background()
+	repos := database.NewMemoryRepositories()
+
+	customer := &models.Customer{Name: "Purged", Email: "purged@example.com"}
+	assert.NoError(t, repos.Customers.Create(ctx, customer))
+
+	category := &models.Category{Name: "Purged"}
+	assert.NoError(t, repos.Categories.Create(ctx, category))
+
+	unordered := &models.Product{Name: "Unordered", Price: models.NewMoney(1000, models.DefaultCurrency), CategoryID: category.ID, Stock: 5}
+	assert.NoError(t, repos.Products.Create(ctx, unordered))
+
+	ordered := &models.Product{Name: "Ordered", Price: models.NewMoney(1000, models.DefaultCurrency), CategoryID: category.ID, Stock: 5}
+	assert.NoError(t, repos.Products.Create(ctx, ordered))
+
+	order := &models.Order{CustomerID: customer.ID, Items: []models.OrderItem{{ProductID: ordered.ID, Quantity: 1}}}
+	assert.NoError(t, repos.Orders.Create(ctx, order))
+
+	assert.NoError(t, repos.Customers.SoftDelete(ctx, customer.ID))
+	assert.NoError(t, repos.Categories.SoftDelete(ctx, category.ID))
+
+	// Nothing was deleted before the cutoff yet
+	result, err := repos.PurgeDeleted(ctx, time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, database.PurgeResult{}, result)
+
+	result, err = repos.PurgeDeleted(ctx, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, database.PurgeResult{Products: 1}, result)
+
+	// The order keeps its product, which keeps its category, and the customer
+	deleted, err := repos.Products.GetDeleted(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, deleted, 1)
+	assert.Equal(t, ordered.ID, deleted[0].ID)
+
+	categories, err := repos.Categories.GetDeleted(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, categories, 1)
+
+	customers, err := repos.Customers.GetDeleted(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, customers, 1)
+
+	assert.NoError(t, repos.Orders.Delete(ctx, order.ID))
+
+	result, err = repos.PurgeDeleted(ctx, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, database.PurgeResult{Products: 1, Categories: 1, Customers: 1}, result)
+}
@@ -0,0 +1,272 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"commerce-app/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingNotifier records the low-stock alerts it is asked to send, failing
+// every one while err is set
+type recordingNotifier struct {
+	sent []models.StockAlert
+	err  error
+}
+
+func (n *recordingNotifier) NotifyLowStock(alert models.StockAlert) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.sent = append(n.sent, alert)
+	return nil
+}
+
+// sentFor returns the alerts sent for a product
+func (n *recordingNotifier) sentFor(productID uuid.UUID) []models.StockAlert {
+	var alerts []models.StockAlert
+	for _, alert := range n.sent {
+		if alert.ProductID == productID {
+			alerts = append(alerts, alert)
+		}
+	}
+	return alerts
+}
+
+// getStockAlerts gets the low-stock alerts of a product through the API
+func getStockAlerts(t *testing.T, ts *TestServer, status string, productID uuid.UUID) []models.StockAlert {
+	resp := MakeRequest(t, ts, "GET", "/api/inventory/alerts?status="+status, nil, nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var alerts []models.StockAlert
+	err := json.NewDecoder(resp.Body).Decode(&alerts)
+	assert.NoError(t, err)
+
+	var matching []models.StockAlert
+	for _, alert := range alerts {
+		if alert.ProductID == productID {
+			matching = append(matching, alert)
+		}
+	}
+	return matching
+}
+
+// setThreshold sets a reorder threshold through the API
+func setThreshold(t *testing.T, ts *TestServer, path string, threshold interface{}) *http.Response {
+	return MakeRequest(t, ts, "PUT", path+"/reorder-threshold", map[string]interface{}{"threshold": threshold}, nil)
+}
+
+// TestStockAlerts tests reorder thresholds and the low-stock alerts raised
+// and sent when stock falls to them
+func TestStockAlerts(t *testing.T) {
+	ts := SetupTestServer(t)
+	defer ts.CleanupTestServer(t)
+
+	staff := AuthHeaders(t, uuid.New(), "staff@example.com")
+
+	t.Run("OrdersCrossThreshold", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+		customerRepo := ts.Repos.Customers
+		orderRepo := ts.Repos.Orders
+
+		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		productPath := "/api/products/" + product.ID.String()
+
+		resp := setThreshold(t, ts, productPath, 7)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var threshold models.ReorderThreshold
+		err := json.NewDecoder(resp.Body).Decode(&threshold)
+		assert.NoError(t, err)
+		if assert.NotNil(t, threshold.Effective) {
+			assert.Equal(t, 7, *threshold.Effective)
+		}
+		assert.Nil(t, threshold.CategoryThreshold)
+
+		resp = setThreshold(t, ts, productPath, -1)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = setThreshold(t, ts, "/api/products/"+uuid.New().String(), 1)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		// 10 -> 8 stays above the threshold, 8 -> 6 crosses it
+		first := CreateTestOrder(t, ts, customer.ID, product.ID)
+		assert.Empty(t, getStockAlerts(t, ts, "open", product.ID))
+
+		second := CreateTestOrder(t, ts, customer.ID, product.ID)
+		alerts := getStockAlerts(t, ts, "open", product.ID)
+		if assert.Len(t, alerts, 1) {
+			assert.Equal(t, 7, alerts[0].Threshold)
+			assert.Equal(t, 6, alerts[0].Stock)
+			assert.Equal(t, product.Name, alerts[0].ProductName)
+			assert.Nil(t, alerts[0].NotifiedAt)
+		}
+
+		// Further orders below the threshold do not raise another alert
+		third := CreateTestOrder(t, ts, customer.ID, product.ID)
+		assert.Len(t, getStockAlerts(t, ts, "open", product.ID), 1)
+
+		notifier := &recordingNotifier{}
+		_, err = ts.Repos.NotifyStockAlerts(context.Background(), notifier)
+		assert.NoError(t, err)
+		if assert.Len(t, notifier.sentFor(product.ID), 1) {
+			assert.Equal(t, product.Name, notifier.sentFor(product.ID)[0].ProductName)
+		}
+
+		_, err = ts.Repos.NotifyStockAlerts(context.Background(), notifier)
+		assert.NoError(t, err)
+		assert.Len(t, notifier.sentFor(product.ID), 1)
+
+		// Cancelling two orders brings the stock back to 8, above the threshold
+		for _, order := range []*models.Order{first, second} {
+			resp = MakeRequest(t, ts, "PUT", "/api/orders/"+order.ID.String()+"/status", map[string]interface{}{"status": "cancelled"}, staff)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+		assert.Empty(t, getStockAlerts(t, ts, "open", product.ID))
+
+		alerts = getStockAlerts(t, ts, "all", product.ID)
+		if assert.Len(t, alerts, 1) {
+			assert.NotNil(t, alerts[0].NotifiedAt)
+			assert.NotNil(t, alerts[0].ResolvedAt)
+		}
+
+		resp = MakeRequest(t, ts, "GET", "/api/inventory/alerts?status=closed", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		//cleanup
+		for _, order := range []*models.Order{first, second, third} {
+			err = orderRepo.Delete(context.Background(), order.ID)
+			assert.NoError(t, err)
+		}
+
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("CategoryThreshold", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		productPath := "/api/products/" + product.ID.String()
+
+		// The product's 10 units are already at the category's threshold
+		resp := setThreshold(t, ts, "/api/categories/"+category.ID.String(), 10)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Len(t, getStockAlerts(t, ts, "open", product.ID), 1)
+
+		resp = MakeRequest(t, ts, "GET", productPath+"/reorder-threshold", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var threshold models.ReorderThreshold
+		err := json.NewDecoder(resp.Body).Decode(&threshold)
+		assert.NoError(t, err)
+		assert.Nil(t, threshold.Threshold)
+		if assert.NotNil(t, threshold.Effective) {
+			assert.Equal(t, 10, *threshold.Effective)
+		}
+
+		// The product's own threshold takes precedence
+		resp = setThreshold(t, ts, productPath, 3)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, getStockAlerts(t, ts, "open", product.ID))
+
+		resp = setThreshold(t, ts, productPath, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Len(t, getStockAlerts(t, ts, "open", product.ID), 1)
+		assert.Len(t, getStockAlerts(t, ts, "all", product.ID), 2)
+
+		// An alert that fails to send is sent again on the next run
+		notifier := &recordingNotifier{err: errors.New("SMTP server unavailable")}
+		_, err = ts.Repos.NotifyStockAlerts(context.Background(), notifier)
+		assert.NoError(t, err)
+		assert.Empty(t, notifier.sentFor(product.ID))
+
+		notifier.err = nil
+		_, err = ts.Repos.NotifyStockAlerts(context.Background(), notifier)
+		assert.NoError(t, err)
+		assert.Len(t, notifier.sentFor(product.ID), 1)
+
+		resp = setThreshold(t, ts, "/api/categories/"+uuid.New().String(), 1)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("InheritedCategoryThreshold", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		parent := CreateTestCategory(t, ts, nil)
+		child := CreateTestCategory(t, ts, &parent.ID)
+		product := CreateTestProduct(t, ts, child.ID)
+		productPath := "/api/products/" + product.ID.String()
+
+		// The child category has no threshold, so its parent's applies
+		resp := setThreshold(t, ts, "/api/categories/"+parent.ID.String(), 10)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Len(t, getStockAlerts(t, ts, "open", product.ID), 1)
+
+		resp = MakeRequest(t, ts, "GET", productPath+"/reorder-threshold", nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var threshold models.ReorderThreshold
+		err := json.NewDecoder(resp.Body).Decode(&threshold)
+		assert.NoError(t, err)
+		if assert.NotNil(t, threshold.CategoryThreshold) && assert.NotNil(t, threshold.Effective) {
+			assert.Equal(t, 10, *threshold.CategoryThreshold)
+			assert.Equal(t, 10, *threshold.Effective)
+		}
+
+		// The nearest category with a threshold takes precedence
+		resp = setThreshold(t, ts, "/api/categories/"+child.ID.String(), 3)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, getStockAlerts(t, ts, "open", product.ID))
+
+		resp = setThreshold(t, ts, "/api/categories/"+child.ID.String(), nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Len(t, getStockAlerts(t, ts, "open", product.ID), 1)
+
+		// Moving the child out from under its parent leaves it without one
+		resp = MakeRequest(t, ts, "PUT", "/api/categories/"+child.ID.String(), map[string]interface{}{
+			"name": child.Name,
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, getStockAlerts(t, ts, "open", product.ID))
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), child.ID, 0)
+		assert.NoError(t, err)
+
+		err = categoryRepo.Delete(context.Background(), parent.ID, 0)
+		assert.NoError(t, err)
+	})
+}
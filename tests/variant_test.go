@@ -0,0 +1,223 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"commerce-app/internal/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// createTestVariant adds a variant to a product through the API
+func createTestVariant(t *testing.T, ts *TestServer, productID string, variant map[string]interface{}) models.ProductVariant {
+	resp := MakeRequest(t, ts, "POST", "/api/products/"+productID+"/variants", variant, nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var created models.ProductVariant
+	err := json.NewDecoder(resp.Body).Decode(&created)
+	assert.NoError(t, err)
+	return created
+}
+
+// TestVariantRoutes tests the product variant endpoints and ordering by variant
+func TestVariantRoutes(t *testing.T) {
+	ts := SetupTestServer(t)
+	defer ts.CleanupTestServer(t)
+
+	t.Run("VariantsSetStockAndPriceRange", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		productPath := "/api/products/" + product.ID.String()
+
+		small := createTestVariant(t, ts, product.ID.String(), map[string]interface{}{
+			"sku":     "TEE-S",
+			"options": map[string]string{"size": "S"},
+			"stock":   3,
+		})
+		assert.Equal(t, product.ID, small.ProductID)
+		assert.Nil(t, small.Price)
+
+		createTestVariant(t, ts, product.ID.String(), map[string]interface{}{
+			"sku":     "TEE-XL",
+			"options": map[string]string{"size": "XL"},
+			"price":   "129.99",
+			"stock":   4,
+		})
+
+		// SKUs are unique across products
+		resp := MakeRequest(t, ts, "POST", productPath+"/variants", map[string]interface{}{"sku": "TEE-S"}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "POST", productPath+"/variants", map[string]interface{}{
+			"sku":   "TEE-M",
+			"price": map[string]interface{}{"amount": 1000, "currency": "USD"},
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", productPath, nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var detail models.Product
+		err := json.NewDecoder(resp.Body).Decode(&detail)
+		assert.NoError(t, err)
+		assert.Equal(t, 7, detail.Stock)
+		assert.Len(t, detail.Variants, 2)
+		if assert.NotNil(t, detail.MinPrice) && assert.NotNil(t, detail.MaxPrice) {
+			assert.Equal(t, product.Price, *detail.MinPrice)
+			assert.Equal(t, models.NewMoney(12999, models.DefaultCurrency), *detail.MaxPrice)
+		}
+
+		resp = MakeRequest(t, ts, "GET", "/api/products/category/"+category.ID.String(), nil, nil)
+		defer resp.Body.Close()
+
+		var listed []models.Product
+		err = json.NewDecoder(resp.Body).Decode(&listed)
+		assert.NoError(t, err)
+		if assert.Len(t, listed, 1) && assert.NotNil(t, listed[0].MaxPrice) {
+			assert.Equal(t, int64(12999), listed[0].MaxPrice.Amount)
+		}
+
+		// Stock of a product with variants is set through its variants
+		resp = MakeRequest(t, ts, "PATCH", productPath, map[string]interface{}{"stock": 50}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "PUT", productPath+"/variants/"+small.ID.String(), map[string]interface{}{
+			"sku":     "TEE-S",
+			"options": map[string]string{"size": "S"},
+			"stock":   10,
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "DELETE", productPath+"/variants/"+small.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "GET", productPath+"/variants", nil, nil)
+		defer resp.Body.Close()
+
+		var variants []models.ProductVariant
+		err = json.NewDecoder(resp.Body).Decode(&variants)
+		assert.NoError(t, err)
+		if assert.Len(t, variants, 1) {
+			assert.Equal(t, "TEE-XL", variants[0].SKU)
+		}
+
+		//cleanup
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("OrderAndCartByVariant", func(t *testing.T) {
+		categoryRepo := ts.Repos.Categories
+		orderRepo := ts.Repos.Orders
+		customerRepo := ts.Repos.Customers
+
+		customer, _ := ts.GetTestCustomer(t)
+		category := CreateTestCategory(t, ts, nil)
+		product := CreateTestProduct(t, ts, category.ID)
+		productPath := "/api/products/" + product.ID.String()
+
+		variant := createTestVariant(t, ts, product.ID.String(), map[string]interface{}{
+			"sku":     "MUG-RED",
+			"options": map[string]string{"colour": "red"},
+			"price":   "49.50",
+			"stock":   2,
+		})
+		createTestVariant(t, ts, product.ID.String(), map[string]interface{}{
+			"sku":     "MUG-BLUE",
+			"options": map[string]string{"colour": "blue"},
+			"stock":   5,
+		})
+
+		// A product with variants is ordered by variant
+		resp := MakeRequest(t, ts, "POST", "/api/orders", map[string]interface{}{
+			"customer_id": customer.ID.String(),
+			"items":       []map[string]interface{}{{"product_id": product.ID.String(), "quantity": 1}},
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		// The product has enough stock in total, but the variant does not
+		resp = MakeRequest(t, ts, "POST", "/api/orders", map[string]interface{}{
+			"customer_id": customer.ID.String(),
+			"items": []map[string]interface{}{
+				{"product_id": product.ID.String(), "variant_id": variant.ID.String(), "quantity": 3},
+			},
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "POST", "/api/orders", map[string]interface{}{
+			"customer_id": customer.ID.String(),
+			"items": []map[string]interface{}{
+				{"product_id": product.ID.String(), "variant_id": variant.ID.String(), "quantity": 2},
+			},
+		}, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var order models.Order
+		err := json.NewDecoder(resp.Body).Decode(&order)
+		assert.NoError(t, err)
+		assert.Equal(t, models.NewMoney(9900, models.DefaultCurrency), order.Total)
+		if assert.Len(t, order.Items, 1) {
+			assert.Equal(t, &variant.ID, order.Items[0].VariantID)
+		}
+
+		resp = MakeRequest(t, ts, "GET", productPath+"/variants/"+variant.ID.String(), nil, nil)
+		defer resp.Body.Close()
+
+		var stocked models.ProductVariant
+		err = json.NewDecoder(resp.Body).Decode(&stocked)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, stocked.Stock)
+
+		stored, err := ts.Repos.Products.GetByID(context.Background(), product.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, stored.Stock)
+
+		// An ordered variant is kept for the order history
+		resp = MakeRequest(t, ts, "DELETE", productPath+"/variants/"+variant.ID.String(), nil, nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp = MakeRequest(t, ts, "POST", "/api/carts", nil, nil)
+		defer resp.Body.Close()
+		cart := decodeCart(t, resp)
+
+		blue := stored.Variants[0]
+		resp = MakeRequest(t, ts, "POST", "/api/carts/"+cart.ID.String()+"/items", map[string]interface{}{
+			"product_id": product.ID.String(), "variant_id": blue.ID.String(), "quantity": 2,
+		}, map[string]string{"X-Cart-Token": cart.Token})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		cart = decodeCart(t, resp)
+		if assert.Len(t, cart.Items, 1) {
+			assert.Equal(t, &blue.ID, cart.Items[0].VariantID)
+			assert.Equal(t, product.Price, cart.Items[0].UnitPrice)
+		}
+		assert.Equal(t, product.Price.Mul(2), cart.Total)
+
+		//cleanup
+		err = orderRepo.Delete(context.Background(), order.ID)
+		assert.NoError(t, err)
+
+		err = customerRepo.Delete(context.Background(), customer.ID)
+		assert.NoError(t, err)
+
+		err = categoryRepo.Delete(context.Background(), category.ID, 0)
+		assert.NoError(t, err)
+	})
+}